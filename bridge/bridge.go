@@ -1,9 +1,15 @@
 package bridge
 
 import (
+	"errors"
+	"sort"
+	"strings"
 	"time"
 )
 
+// ErrNoSuchChannel is returned by Join when the channel doesn't exist, so it can be created instead.
+var ErrNoSuchChannel = errors.New("no such channel")
+
 type Bridger interface {
 	Invite(channelID, username string) error
 	Join(channelName string) (string, string, error)
@@ -23,21 +29,45 @@ type Bridger interface {
 	StatusUser(userID string) (string, error)
 	StatusUsers() (map[string]string, error)
 	SetStatus(status string) error
+	// SetDND sets the status of the logged in user to do not disturb until a time, forever when it's zero.
+	SetDND(until time.Time) error
+	// SetCustomStatus sets the custom status of the logged in user, nil clears it.
+	SetCustomStatus(status *CustomStatus) error
 
 	Protocol() string
+	GetLimits() *Limits
 
 	GetChannels() []*ChannelInfo
 	GetChannelName(channelID string) string
 	GetLastViewedAt(channelID string) int64
+	// GetUnread returns the channels with unread messages.
+	GetUnread() ([]*Unread, error)
 	UpdateLastViewed(channelID string)
 	UpdateLastViewedUser(userID string) error
 	GetChannelID(name, teamID string) string
+	GetChannel(channelID string) *ChannelInfo
+	GetChannelMembers(channelID string) ([]*ChannelMember, error)
+	SetChannelAdmin(channelID, userID string, admin bool) error
+	CreateChannel(channelName string, private bool) (string, error)
+	RenameChannel(channelID, newName string) error
+	SetPurpose(channelID, text string) error
+	ArchiveChannel(channelID string) error
+	// UnarchiveChannel takes a name as archived channels aren't known to the bridge, it returns the channel ID.
+	UnarchiveChannel(channelName string) (string, error)
+	// CreateGroup opens the group message channel with the users, it's created when it doesn't exist.
+	CreateGroup(userIDs []string) (string, error)
+	// MuteChannel mutes or unmutes a channel for the logged in user.
+	MuteChannel(channelID string, mute bool) error
+	// FavoriteChannel adds a channel to or removes it from the favorites of the logged in user.
+	FavoriteChannel(channelID string, favorite bool) error
 
 	GetChannelUsers(channelID string) ([]*UserInfo, error)
 	GetUsers() []*UserInfo
 	GetUser(userID string) *UserInfo
 	GetMe() *UserInfo
 	GetUserByUsername(username string) *UserInfo
+	// MentionUser returns the text which mentions a user in a message, eg @alice.
+	MentionUser(userID string) string
 	SearchUsers(query string) ([]*UserInfo, error)
 
 	GetTeamName(teamID string) string
@@ -52,6 +82,44 @@ type ChannelInfo struct {
 	Name   string
 	ID     string
 	TeamID string
+
+	Private  bool
+	Direct   bool // direct or group message
+	ReadOnly bool // read-only or archived
+	Muted    bool // muted by the logged in user
+	Favorite bool // a favorite of the logged in user
+}
+
+// Unread has the number of unread messages and mentions of a channel.
+type Unread struct {
+	ChannelID string
+	Messages  int64
+	Mentions  int64
+}
+
+// GroupChannelName returns the IRC name of a group message channel, built from the nicks
+// of the other members so it stays the same, eg &group:alice+bob
+func GroupChannelName(nicks []string) string {
+	sorted := append([]string{}, nicks...)
+	sort.Strings(sorted)
+
+	return "&group:" + strings.Join(sorted, "+")
+}
+
+// Limits are the maximum lengths the bridge accepts, 0 when there's no (known) limit.
+type Limits struct {
+	NickLen    int
+	ChannelLen int // including the # and team prefix
+	TopicLen   int
+	PostLen    int // in characters, 0 if unlimited
+}
+
+// ChannelMember is the role a user has in a channel.
+type ChannelMember struct {
+	UserID string
+	Admin  bool
+	Guest  bool
+	Bot    bool
 }
 
 type UserInfo struct {
@@ -68,14 +136,38 @@ type UserInfo struct {
 	TeamID      string
 	FirstName   string
 	LastName    string
+	// CustomStatus is nil when the user has none (or it expired)
+	CustomStatus *CustomStatus
+}
+
+// CustomStatus is a status message of a user, eg ":palm_tree: on vacation".
+type CustomStatus struct {
+	Emoji string // without the colons
+	Text  string
+	// ExpiresAt is zero when the status doesn't expire
+	ExpiresAt time.Time
+}
+
+func (s *CustomStatus) String() string {
+	text := s.Text
+	if s.Emoji != "" {
+		text = strings.TrimSpace(":" + s.Emoji + ": " + text)
+	}
+
+	if !s.ExpiresAt.IsZero() {
+		text += " (until " + s.ExpiresAt.Local().Format("2006-01-02 15:04") + ")"
+	}
+
+	return text
 }
 
 type Credentials struct {
-	Login  string
-	Team   string
-	Pass   string
-	Server string
-	Token  string
+	Login    string
+	Team     string
+	Pass     string
+	Server   string
+	Token    string
+	MFAToken string
 }
 
 type Event struct {
@@ -110,6 +202,8 @@ type ChannelMessageEvent struct {
 	MessageType string
 	ChannelType string
 	Files       []*File
+	// Mention is true when the message mentions the logged in user, eg @alice or @here
+	Mention bool
 }
 
 type ChannelTopicEvent struct {
@@ -137,11 +231,44 @@ type UserUpdateEvent struct {
 	User *UserInfo
 }
 
+// ChannelUpdateEvent is sent when the name, purpose or type of a channel changed.
+type ChannelUpdateEvent struct {
+	ChannelID string
+}
+
+// ChannelMemberUpdateEvent is sent when the roles of a member of a channel changed.
+type ChannelMemberUpdateEvent struct {
+	ChannelID string
+	UserID    string
+}
+
+// ChannelPrefsEvent is sent when the logged in user muted, unmuted or (un)favorited a channel.
+type ChannelPrefsEvent struct {
+	ChannelID string
+	Muted     bool
+	Favorite  bool
+}
+
+// ChannelViewedEvent is sent when the logged in user read a channel, eg on another device.
+type ChannelViewedEvent struct {
+	ChannelID string
+	// ViewedAt is the new last viewed time in milliseconds
+	ViewedAt int64
+}
+
 type StatusChangeEvent struct {
 	UserID string
 	Status string
 }
 
+// SessionExpiredEvent is sent when the session on the bridge expired or was revoked.
+type SessionExpiredEvent struct {
+	// Restored is true when the bridge logged in again with the stored credentials
+	Restored bool
+	// Err is the error of logging in again, if any
+	Err error
+}
+
 type File struct {
 	Name string
 }
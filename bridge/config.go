@@ -0,0 +1,113 @@
+package bridge
+
+import (
+	"sync"
+	"sync/atomic"
+
+	logger "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Config is the configuration of a session, read by the bridge from its own goroutines. Viper
+// isn't safe for concurrent use, so a stored configuration is never changed: Update changes a
+// copy and swaps it in.
+type Config struct {
+	v atomic.Value
+
+	// serializes the changes
+	mu sync.Mutex
+}
+
+// NewConfig returns a configuration holding v, which mustn't be changed anymore.
+func NewConfig(v *viper.Viper) *Config {
+	c := &Config{}
+	c.v.Store(v)
+
+	return c
+}
+
+// Viper returns the current configuration, don't change it.
+func (c *Config) Viper() *viper.Viper {
+	return c.v.Load().(*viper.Viper)
+}
+
+// Store replaces the configuration with v, which mustn't be changed anymore.
+func (c *Config) Store(v *viper.Viper) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.v.Store(v)
+}
+
+// Update changes a copy of the configuration and replaces it with that.
+func (c *Config) Update(change func(v *viper.Viper)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v := CopyConfig(c.Viper())
+	change(v)
+	c.v.Store(v)
+}
+
+func (c *Config) Get(key string) interface{} {
+	return c.Viper().Get(key)
+}
+
+func (c *Config) GetBool(key string) bool {
+	return c.Viper().GetBool(key)
+}
+
+func (c *Config) GetInt(key string) int {
+	return c.Viper().GetInt(key)
+}
+
+func (c *Config) GetString(key string) string {
+	return c.Viper().GetString(key)
+}
+
+func (c *Config) GetStringSlice(key string) []string {
+	return c.Viper().GetStringSlice(key)
+}
+
+func (c *Config) IsSet(key string) bool {
+	return c.Viper().IsSet(key)
+}
+
+// CopyConfig returns a copy of the configuration which can be changed without changing v.
+func CopyConfig(v *viper.Viper) *viper.Viper {
+	settings := v.AllSettings()
+
+	// AllSettings splits keys on dots, tables keyed by channel or user names can have dots in their
+	// keys (eg #rust:mozilla.org), those are copied as they are.
+	for protocol, value := range settings {
+		if table, ok := value.(map[string]interface{}); ok && v.IsSet(protocol+".channel") {
+			table["channel"] = copyMap(v.GetStringMap(protocol + ".channel"))
+		}
+	}
+
+	if v.IsSet("users") {
+		settings["users"] = copyMap(v.GetStringMap("users"))
+	}
+
+	c := viper.New()
+	if err := c.MergeConfigMap(settings); err != nil {
+		logger.Errorf("copying the configuration failed: %s", err)
+	}
+
+	return c
+}
+
+// copyMap returns a deep copy of a table of the configuration.
+func copyMap(m map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(m))
+
+	for key, value := range m {
+		if table, ok := value.(map[string]interface{}); ok {
+			value = copyMap(table)
+		}
+
+		c[key] = value
+	}
+
+	return c
+}
@@ -0,0 +1,71 @@
+package bridge
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopyConfig(t *testing.T) {
+	v := viper.New()
+	v.SetConfigType("toml")
+	assert.NoError(t, v.ReadConfig(strings.NewReader(`
+[matrix]
+HideReplies = true
+
+[matrix.channel."#rust:mozilla.org"]
+HideReplies = false
+
+[users."john.doe".matrix]
+Mute = true
+`)))
+	v.Set("matrix.JoinExclude", []string{"#random"})
+
+	c := CopyConfig(v)
+	assert.True(t, c.GetBool("matrix.HideReplies"))
+	assert.Equal(t, []string{"#random"}, c.GetStringSlice("matrix.JoinExclude"))
+	assert.Equal(t, map[string]interface{}{"hidereplies": false}, ChannelConfig(c, "matrix", "#rust:mozilla.org"))
+	assert.Contains(t, c.GetStringMap("users"), "john.doe")
+
+	// changing the copy doesn't change the original
+	c.Set("matrix.JoinExclude", []string{})
+	c.GetStringMap("matrix.channel")["#rust:mozilla.org"].(map[string]interface{})["hidereplies"] = true
+	assert.Equal(t, []string{"#random"}, v.GetStringSlice("matrix.JoinExclude"))
+	assert.Equal(t, map[string]interface{}{"hidereplies": false}, ChannelConfig(v, "matrix", "#rust:mozilla.org"))
+}
+
+func TestConfigUpdate(t *testing.T) {
+	v := viper.New()
+	v.Set("slack.JoinInclude", []string{"#general"})
+
+	c := NewConfig(v)
+	old := c.Viper()
+
+	c.Update(func(v *viper.Viper) {
+		v.Set("slack.JoinInclude", append(v.GetStringSlice("slack.JoinInclude"), "#random"))
+	})
+
+	assert.Equal(t, []string{"#general", "#random"}, c.GetStringSlice("slack.JoinInclude"))
+
+	// who still has the old configuration can keep reading it
+	assert.Equal(t, []string{"#general"}, old.GetStringSlice("slack.JoinInclude"))
+
+	// the bridge reads while irckit changes it
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for i := 0; i < 100; i++ {
+			c.Update(func(v *viper.Viper) { v.Set("slack.HideReplies", i%2 == 0) })
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		c.GetBool("slack.HideReplies")
+	}
+
+	<-done
+}
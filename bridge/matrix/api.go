@@ -0,0 +1,179 @@
+package matrix
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// api is a minimal client for the Matrix client-server API.
+type api struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// apiError is the standard error response of the client-server API.
+type apiError struct {
+	Code    string `json:"errcode"`
+	Message string `json:"error"`
+	Status  int    `json:"-"`
+}
+
+func (e *apiError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("matrix: http status %d", e.Status)
+	}
+
+	return e.Code + ": " + e.Message
+}
+
+func newAPI(server string, insecure, skipTLSVerify bool) *api {
+	scheme := "https://"
+	if insecure {
+		scheme = "http://"
+	}
+
+	if strings.HasPrefix(server, "http://") || strings.HasPrefix(server, "https://") {
+		scheme = ""
+	}
+
+	return &api{
+		url: strings.TrimSuffix(scheme+server, "/"),
+		client: &http.Client{
+			// the sync long polling uses 30 seconds
+			Timeout: time.Second * 60,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: skipTLSVerify}, //nolint:gosec
+				Proxy:           http.ProxyFromEnvironment,
+			},
+		},
+	}
+}
+
+func (a *api) do(method, path string, query url.Values, in, out interface{}) error {
+	var body []byte
+
+	if in != nil {
+		var err error
+
+		body, err = json.Marshal(in)
+		if err != nil {
+			return err
+		}
+	}
+
+	u := a.url + "/_matrix/client/r0" + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &apiError{Status: resp.StatusCode}
+		json.Unmarshal(data, apiErr)
+
+		return apiErr
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.Unmarshal(data, out)
+}
+
+func (a *api) get(path string, query url.Values, out interface{}) error {
+	return a.do(http.MethodGet, path, query, nil, out)
+}
+
+func (a *api) post(path string, in, out interface{}) error {
+	return a.do(http.MethodPost, path, nil, in, out)
+}
+
+func (a *api) put(path string, in, out interface{}) error {
+	return a.do(http.MethodPut, path, nil, in, out)
+}
+
+// downloadURL converts a mxc:// uri to a link that can be opened in a browser.
+func (a *api) downloadURL(mxc string) string {
+	if !strings.HasPrefix(mxc, "mxc://") {
+		return mxc
+	}
+
+	return a.url + "/_matrix/media/r0/download/" + strings.TrimPrefix(mxc, "mxc://")
+}
+
+type event struct {
+	Type      string                 `json:"type"`
+	EventID   string                 `json:"event_id"`
+	RoomID    string                 `json:"room_id"`
+	Sender    string                 `json:"sender"`
+	StateKey  *string                `json:"state_key"`
+	Timestamp int64                  `json:"origin_server_ts"`
+	Content   map[string]interface{} `json:"content"`
+	Unsigned  struct {
+		TransactionID string                 `json:"transaction_id"`
+		PrevContent   map[string]interface{} `json:"prev_content"`
+	} `json:"unsigned"`
+}
+
+// str returns the string value of a content key, or "" when it isn't there.
+func (e *event) str(key string) string {
+	s, _ := e.Content[key].(string)
+	return s
+}
+
+type eventList struct {
+	Events []*event `json:"events"`
+}
+
+type joinedRoom struct {
+	State       eventList `json:"state"`
+	Timeline    eventList `json:"timeline"`
+	Ephemeral   eventList `json:"ephemeral"`
+	AccountData eventList `json:"account_data"`
+
+	UnreadNotifications *struct {
+		NotificationCount int64 `json:"notification_count"`
+		HighlightCount    int64 `json:"highlight_count"`
+	} `json:"unread_notifications"`
+}
+
+type syncResponse struct {
+	NextBatch   string    `json:"next_batch"`
+	AccountData eventList `json:"account_data"`
+	Presence    eventList `json:"presence"`
+	Rooms       struct {
+		Join  map[string]*joinedRoom     `json:"join"`
+		Leave map[string]json.RawMessage `json:"leave"`
+	} `json:"rooms"`
+}
@@ -0,0 +1,1611 @@
+package matrix
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/42wim/matterircd/bridge"
+	"github.com/davecgh/go-spew/spew"
+	"github.com/jpillora/backoff"
+	"github.com/mattermost/mattermost-server/v5/model"
+	logger "github.com/sirupsen/logrus"
+)
+
+type Matrix struct {
+	api         *api
+	credentials bridge.Credentials
+	eventChan   chan *bridge.Event
+	onConnect   func()
+	userID      string
+	domain      string
+	nextBatch   string
+	quit        chan struct{}
+	logoutOnce  sync.Once
+	v           *bridge.Config
+	settings    *bridge.Settings
+	templates   *bridge.Templates
+
+	sync.RWMutex
+	rooms    map[string]*room
+	users    map[string]string // user id -> display name
+	statuses map[string]string
+	sent     map[string]bool
+	txnID    int64
+}
+
+// room is the state we keep of every joined room.
+type room struct {
+	id        string
+	name      string
+	alias     string
+	topic     string
+	direct    bool
+	members   map[string]bool
+	lastEvent string
+	lastRead  int64
+
+	// notification counts of the homeserver
+	notifications int64
+	highlights    int64
+
+	joinRule    string
+	powerLevels map[string]interface{}
+	archived    bool
+}
+
+// adminLevel is the power level from which users are shown as channel admins (moderators).
+const adminLevel = 50
+
+func New(v *bridge.Config, cred bridge.Credentials, eventChan chan *bridge.Event, onConnect func()) (bridge.Bridger, error) {
+	m := &Matrix{
+		credentials: cred,
+		eventChan:   eventChan,
+		onConnect:   onConnect,
+		quit:        make(chan struct{}),
+		v:           v,
+		rooms:       make(map[string]*room),
+		users:       make(map[string]string),
+		statuses:    make(map[string]string),
+		sent:        make(map[string]bool),
+		txnID:       time.Now().UnixNano(),
+	}
+
+	m.settings = bridge.NewSettings(v, "matrix", m.GetChannelName)
+	m.templates = bridge.NewTemplates(m.settings, nil)
+
+	if v.GetBool("debug") {
+		logger.SetLevel(logger.DebugLevel)
+	}
+
+	if v.GetBool("trace") {
+		logger.SetLevel(logger.TraceLevel)
+	}
+
+	err := m.loginToMatrix()
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *Matrix) loginToMatrix() error {
+	m.api = newAPI(m.credentials.Server, m.v.GetBool("matrix.Insecure"), m.v.GetBool("matrix.SkipTLSVerify"))
+
+	logger.Infof("login as %s on %s", m.credentials.Login, m.credentials.Server)
+
+	if strings.HasPrefix(m.credentials.Pass, "token=") {
+		m.api.token = strings.TrimPrefix(m.credentials.Pass, "token=")
+
+		var res struct {
+			UserID string `json:"user_id"`
+		}
+
+		err := m.api.get("/account/whoami", nil, &res)
+		if err != nil {
+			logger.Error("login failed", err)
+			return err
+		}
+
+		m.userID = res.UserID
+	} else {
+		var res struct {
+			UserID      string `json:"user_id"`
+			AccessToken string `json:"access_token"`
+		}
+
+		err := m.api.post("/login", map[string]interface{}{
+			"type": "m.login.password",
+			"identifier": map[string]string{
+				"type": "m.id.user",
+				"user": m.credentials.Login,
+			},
+			"password":                    m.credentials.Pass,
+			"initial_device_display_name": "matterircd",
+		}, &res)
+		if err != nil {
+			logger.Error("login failed", err)
+			return err
+		}
+
+		m.userID = res.UserID
+		m.api.token = res.AccessToken
+	}
+
+	m.domain = serverName(m.userID)
+
+	logger.Info("login succeeded")
+
+	// the initial sync only fills our state, we don't relay anything from it.
+	var res syncResponse
+
+	err := m.api.get("/sync", url.Values{"timeout": {"0"}}, &res)
+	if err != nil {
+		return err
+	}
+
+	m.handleSync(&res, true)
+
+	go m.syncLoop()
+	go m.onConnect()
+
+	return nil
+}
+
+func (m *Matrix) syncLoop() {
+	b := &backoff.Backoff{
+		Min:    time.Second,
+		Max:    5 * time.Minute,
+		Jitter: true,
+	}
+
+	for {
+		select {
+		case <-m.quit:
+			logger.Debug("exiting syncLoop")
+			return
+		default:
+		}
+
+		var res syncResponse
+
+		err := m.api.get("/sync", url.Values{"since": {m.nextBatch}, "timeout": {"30000"}}, &res)
+		if err != nil {
+			d := b.Duration()
+			logger.Errorf("sync failed: %s, retrying in %s", err, d)
+			time.Sleep(d)
+
+			continue
+		}
+
+		b.Reset()
+
+		m.handleSync(&res, false)
+	}
+}
+
+// serverName returns the homeserver part of a user id or alias.
+func serverName(id string) string {
+	if i := strings.Index(id, ":"); i >= 0 {
+		return id[i+1:]
+	}
+
+	return ""
+}
+
+// localpart returns the user part of a user id (without @ and the homeserver).
+func localpart(id string) string {
+	id = strings.TrimPrefix(id, "@")
+	if i := strings.Index(id, ":"); i >= 0 {
+		return id[:i]
+	}
+
+	return id
+}
+
+// channelName returns the IRC name (without #) of a room. The canonical alias is used when there is one,
+// the homeserver part is stripped for rooms on our own homeserver.
+func (m *Matrix) channelName(r *room) string {
+	if r.direct {
+		var peers []string
+
+		for member := range r.members {
+			if member != m.userID {
+				peers = append(peers, member)
+			}
+		}
+
+		sort.Strings(peers)
+
+		// one on one conversations use the same format as mattermost
+		if len(peers) == 1 {
+			return peers[0] + "__" + m.userID
+		}
+
+		for i, peer := range peers {
+			peers[i] = localpart(peer)
+		}
+
+		return strings.Join(peers, "-")
+	}
+
+	if r.alias != "" {
+		alias := strings.TrimPrefix(r.alias, "#")
+		return strings.TrimSuffix(alias, ":"+m.domain)
+	}
+
+	if r.name != "" {
+		return strings.Join(strings.Fields(r.name), "-")
+	}
+
+	return strings.TrimPrefix(r.id, "!")
+}
+
+func (m *Matrix) getRoom(roomID string) *room {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.rooms[m.roomIDLocked(roomID)]
+}
+
+// roomID returns the room id with its original case, irckit lowercases channel ids.
+func (m *Matrix) roomID(channelID string) string {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.roomIDLocked(channelID)
+}
+
+func (m *Matrix) roomIDLocked(channelID string) string {
+	if _, ok := m.rooms[channelID]; ok {
+		return channelID
+	}
+
+	for id := range m.rooms {
+		if strings.EqualFold(id, channelID) {
+			return id
+		}
+	}
+
+	return channelID
+}
+
+// roomIDFromName resolves an IRC channel name (without #) to a room id.
+func (m *Matrix) roomIDFromName(name string) string {
+	m.RLock()
+	defer m.RUnlock()
+
+	for _, r := range m.rooms {
+		if m.channelName(r) == name {
+			return r.id
+		}
+	}
+
+	return ""
+}
+
+func (m *Matrix) nextTxnID() string {
+	m.Lock()
+	defer m.Unlock()
+
+	m.txnID++
+
+	id := "matterircd" + strconv.FormatInt(m.txnID, 10)
+	m.sent[id] = true
+
+	return id
+}
+
+func (m *Matrix) sendMessage(roomID, msgtype, text string) error {
+	txnID := m.nextTxnID()
+
+	err := m.api.put("/rooms/"+url.PathEscape(roomID)+"/send/m.room.message/"+txnID, map[string]string{
+		"msgtype": msgtype,
+		"body":    text,
+	}, nil)
+	if err != nil {
+		m.Lock()
+		delete(m.sent, txnID)
+		m.Unlock()
+	}
+
+	return err
+}
+
+func (m *Matrix) Invite(channelID, username string) error {
+	channelID = m.roomID(channelID)
+
+	return m.api.post("/rooms/"+url.PathEscape(channelID)+"/invite", map[string]string{"user_id": username}, nil)
+}
+
+func (m *Matrix) Join(channelName string) (string, string, error) {
+	alias := channelName
+
+	if !strings.HasPrefix(alias, "!") {
+		alias = "#" + alias
+		if !strings.Contains(alias, ":") {
+			alias += ":" + m.domain
+		}
+	}
+
+	var res struct {
+		RoomID string `json:"room_id"`
+	}
+
+	err := m.api.post("/join/"+url.PathEscape(alias), map[string]string{}, &res)
+	logger.Debugf("join channel %s, id %s, err: %v", channelName, res.RoomID, err)
+
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.Code == "M_NOT_FOUND" {
+		return "", "", bridge.ErrNoSuchChannel
+	}
+
+	if err != nil {
+		return "", "", fmt.Errorf("cannot join channel (+i)")
+	}
+
+	r, err := m.fetchRoom(res.RoomID)
+	if err != nil {
+		return "", "", err
+	}
+
+	return r.id, r.topic, nil
+}
+
+// CreateChannel creates a room with an alias on our homeserver.
+func (m *Matrix) CreateChannel(channelName string, private bool) (string, error) {
+	if strings.Contains(channelName, ":") {
+		return "", errors.New("rooms can only be created on your own homeserver")
+	}
+
+	preset, visibility := "public_chat", "public"
+	if private {
+		preset, visibility = "private_chat", "private"
+	}
+
+	var res struct {
+		RoomID string `json:"room_id"`
+	}
+
+	err := m.api.post("/createRoom", map[string]interface{}{
+		"room_alias_name": channelName,
+		"name":            channelName,
+		"preset":          preset,
+		"visibility":      visibility,
+	}, &res)
+	if err != nil {
+		return "", err
+	}
+
+	r, err := m.fetchRoom(res.RoomID)
+	if err != nil {
+		return "", err
+	}
+
+	return r.id, nil
+}
+
+// RenameChannel adds a new alias for the room and makes it the canonical one, the old alias keeps working.
+func (m *Matrix) RenameChannel(channelID, newName string) error {
+	channelID = m.roomID(channelID)
+	alias := "#" + newName + ":" + m.domain
+
+	err := m.api.put("/directory/room/"+url.PathEscape(alias), map[string]string{"room_id": channelID}, nil)
+	if err != nil {
+		return err
+	}
+
+	err = m.api.put("/rooms/"+url.PathEscape(channelID)+"/state/m.room.canonical_alias", map[string]string{"alias": alias}, nil)
+	if err != nil {
+		return err
+	}
+
+	return m.api.put("/rooms/"+url.PathEscape(channelID)+"/state/m.room.name", map[string]string{"name": newName}, nil)
+}
+
+func (m *Matrix) SetPurpose(channelID, text string) error {
+	return errors.New("matrix rooms have no purpose, use the topic")
+}
+
+func (m *Matrix) ArchiveChannel(channelID string) error {
+	return errors.New("matrix rooms can't be archived")
+}
+
+func (m *Matrix) UnarchiveChannel(channelName string) (string, error) {
+	return "", errors.New("matrix rooms can't be archived")
+}
+
+// fetchRoom gets the full state of a room we just joined.
+func (m *Matrix) fetchRoom(roomID string) (*room, error) {
+	var events []*event
+
+	err := m.api.get("/rooms/"+url.PathEscape(roomID)+"/state", nil, &events)
+	if err != nil {
+		return nil, err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	r, ok := m.rooms[roomID]
+	if !ok {
+		r = &room{id: roomID, members: make(map[string]bool)}
+		m.rooms[roomID] = r
+	}
+
+	for _, ev := range events {
+		m.applyState(r, ev)
+	}
+
+	return r, nil
+}
+
+func (m *Matrix) List() (map[string]string, error) {
+	var res struct {
+		Chunk []struct {
+			RoomID string `json:"room_id"`
+			Alias  string `json:"canonical_alias"`
+			Name   string `json:"name"`
+			Topic  string `json:"topic"`
+		} `json:"chunk"`
+	}
+
+	err := m.api.get("/publicRooms", url.Values{"limit": {"500"}}, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	channelinfo := make(map[string]string)
+
+	for _, pub := range res.Chunk {
+		r := &room{id: pub.RoomID, alias: pub.Alias, name: pub.Name}
+		channelinfo["#"+m.channelName(r)] = strings.ReplaceAll(pub.Topic, "\n", " | ")
+	}
+
+	return channelinfo, nil
+}
+
+func (m *Matrix) Part(channelID string) error {
+	channelID = m.roomID(channelID)
+
+	return m.api.post("/rooms/"+url.PathEscape(channelID)+"/leave", map[string]string{}, nil)
+}
+
+func (m *Matrix) UpdateChannels() error {
+	return nil
+}
+
+// Logout stops the sync loop and logs out, it's called again when the user quits so only the first
+// call does anything.
+func (m *Matrix) Logout() error {
+	var err error
+
+	m.logoutOnce.Do(func() {
+		err = m.logout()
+	})
+
+	return err
+}
+
+func (m *Matrix) logout() error {
+	logger.Debug("calling logout from matrix")
+
+	close(m.quit)
+
+	// don't invalidate tokens the user gave us, they may be in use elsewhere.
+	if strings.HasPrefix(m.credentials.Pass, "token=") {
+		return nil
+	}
+
+	err := m.api.post("/logout", map[string]string{}, nil)
+	if err != nil {
+		logger.Error("logout failed")
+		return err
+	}
+
+	logger.Info("logout succeeded")
+
+	return nil
+}
+
+// directRoom returns the direct room with the specified user, creating it if needed.
+func (m *Matrix) directRoom(userID string) (string, error) {
+	return m.directRoomWith([]string{userID})
+}
+
+// directRoomWith returns the direct room with exactly the specified users, creating it if needed.
+func (m *Matrix) directRoomWith(userIDs []string) (string, error) {
+	m.RLock()
+	for _, r := range m.rooms {
+		if r.direct && sameMembers(r, m.userID, userIDs) {
+			m.RUnlock()
+			return r.id, nil
+		}
+	}
+	m.RUnlock()
+
+	var res struct {
+		RoomID string `json:"room_id"`
+	}
+
+	err := m.api.post("/createRoom", map[string]interface{}{
+		"is_direct": true,
+		"invite":    userIDs,
+		"preset":    "trusted_private_chat",
+	}, &res)
+	if err != nil {
+		return "", err
+	}
+
+	members := map[string]bool{m.userID: true}
+	for _, userID := range userIDs {
+		members[userID] = true
+	}
+
+	m.Lock()
+	m.rooms[res.RoomID] = &room{
+		id:      res.RoomID,
+		direct:  true,
+		members: members,
+	}
+
+	direct := make(map[string][]string)
+
+	for _, r := range m.rooms {
+		if !r.direct {
+			continue
+		}
+
+		for member := range r.members {
+			if member != m.userID {
+				direct[member] = append(direct[member], r.id)
+			}
+		}
+	}
+	m.Unlock()
+
+	// other clients need m.direct to show this as a direct conversation
+	err = m.api.put("/user/"+url.PathEscape(m.userID)+"/account_data/m.direct", direct, nil)
+	if err != nil {
+		logger.Errorf("updating m.direct failed: %s", err)
+	}
+
+	return res.RoomID, nil
+}
+
+// sameMembers returns whether the members of the room, leaving out me, are the specified users.
+func sameMembers(r *room, me string, userIDs []string) bool {
+	count := 0
+
+	for member := range r.members {
+		if member != me {
+			count++
+		}
+	}
+
+	if count != len(userIDs) {
+		return false
+	}
+
+	for _, userID := range userIDs {
+		if !r.members[userID] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (m *Matrix) CreateGroup(userIDs []string) (string, error) {
+	return m.directRoomWith(userIDs)
+}
+
+func (m *Matrix) MuteChannel(channelID string, mute bool) error {
+	return errors.New("matrix rooms can't be muted from IRC")
+}
+
+func (m *Matrix) FavoriteChannel(channelID string, favorite bool) error {
+	return errors.New("matrix rooms can't be favorited from IRC")
+}
+
+func (m *Matrix) MsgUser(username, text string) error {
+	roomID, err := m.directRoom(username)
+	if err != nil {
+		return err
+	}
+
+	return m.sendMessage(roomID, "m.text", text)
+}
+
+func (m *Matrix) MsgChannel(channelID, text string) error {
+	channelID = m.roomID(channelID)
+
+	return m.sendMessage(channelID, "m.text", text)
+}
+
+func (m *Matrix) Topic(channelID string) string {
+	r := m.getRoom(channelID)
+	if r == nil {
+		return ""
+	}
+
+	return r.topic
+}
+
+func (m *Matrix) SetTopic(channelID, text string) error {
+	channelID = m.roomID(channelID)
+
+	return m.api.put("/rooms/"+url.PathEscape(channelID)+"/state/m.room.topic", map[string]string{"topic": text}, nil)
+}
+
+func (m *Matrix) StatusUser(userID string) (string, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.statuses[userID], nil
+}
+
+func (m *Matrix) StatusUsers() (map[string]string, error) {
+	statuses := make(map[string]string)
+
+	m.RLock()
+	for id, status := range m.statuses {
+		statuses[id] = status
+	}
+	m.RUnlock()
+
+	return statuses, nil
+}
+
+func (m *Matrix) SetStatus(status string) error {
+	presence := "online"
+
+	switch status {
+	case "away":
+		presence = "unavailable"
+	case "offline":
+		presence = "offline"
+	}
+
+	return m.api.put("/presence/"+url.PathEscape(m.userID)+"/status", map[string]string{"presence": presence}, nil)
+}
+
+func (m *Matrix) SetDND(until time.Time) error {
+	return errors.New("do not disturb can't be set from IRC on matrix")
+}
+
+func (m *Matrix) SetCustomStatus(status *bridge.CustomStatus) error {
+	return errors.New("custom statuses can't be set from IRC on matrix")
+}
+
+func (m *Matrix) Protocol() string {
+	return "matrix"
+}
+
+// GetLimits returns the limits of the spec, user IDs and room aliases are at most 255 characters.
+func (m *Matrix) GetLimits() *bridge.Limits {
+	return &bridge.Limits{
+		NickLen:    255,
+		ChannelLen: 255,
+	}
+}
+
+func (m *Matrix) Kick(channelID, username string) error {
+	channelID = m.roomID(channelID)
+
+	return m.api.post("/rooms/"+url.PathEscape(channelID)+"/kick", map[string]string{"user_id": username}, nil)
+}
+
+func (m *Matrix) Nick(name string) error {
+	return m.api.put("/profile/"+url.PathEscape(m.userID)+"/displayname", map[string]string{"displayname": name}, nil)
+}
+
+func (m *Matrix) GetChannels() []*bridge.ChannelInfo {
+	var channels []*bridge.ChannelInfo
+
+	m.RLock()
+	defer m.RUnlock()
+
+	for _, r := range m.rooms {
+		channels = append(channels, &bridge.ChannelInfo{
+			Name: m.channelName(r),
+			ID:   r.id,
+		})
+	}
+
+	return channels
+}
+
+func (m *Matrix) GetChannelName(channelID string) string {
+	m.RLock()
+	defer m.RUnlock()
+
+	r, ok := m.rooms[m.roomIDLocked(channelID)]
+	if !ok {
+		return channelID
+	}
+
+	if r.direct && len(r.members) > 2 && m.v.GetBool("matrix.GroupChannelNames") {
+		var nicks []string
+
+		for member := range r.members {
+			if member != m.userID {
+				nicks = append(nicks, m.createUser(member).Nick)
+			}
+		}
+
+		return bridge.GroupChannelName(nicks)
+	}
+
+	return "#" + m.channelName(r)
+}
+
+func (m *Matrix) GetChannelUsers(channelID string) ([]*bridge.UserInfo, error) {
+	r := m.getRoom(channelID)
+	if r == nil {
+		return nil, errors.New("Unknown channel seen (" + channelID + ")")
+	}
+
+	var users []*bridge.UserInfo
+
+	m.RLock()
+	for member := range r.members {
+		users = append(users, m.createUser(member))
+	}
+	m.RUnlock()
+
+	return users, nil
+}
+
+func (m *Matrix) GetChannel(channelID string) *bridge.ChannelInfo {
+	m.RLock()
+	defer m.RUnlock()
+
+	r, ok := m.rooms[m.roomIDLocked(channelID)]
+	if !ok {
+		return nil
+	}
+
+	return &bridge.ChannelInfo{
+		Name:     m.channelName(r),
+		ID:       r.id,
+		Private:  r.joinRule != "public",
+		Direct:   r.direct,
+		ReadOnly: r.archived || powerLevel(r, m.userID) < levelSetting(r, "events_default", 0),
+	}
+}
+
+// GetChannelMembers returns the members of a room, moderators and admins (power level 50 and up) are admins.
+func (m *Matrix) GetChannelMembers(channelID string) ([]*bridge.ChannelMember, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	r, ok := m.rooms[m.roomIDLocked(channelID)]
+	if !ok {
+		return nil, errors.New("Unknown channel seen (" + channelID + ")")
+	}
+
+	members := make([]*bridge.ChannelMember, 0, len(r.members))
+
+	for member := range r.members {
+		members = append(members, &bridge.ChannelMember{
+			UserID: member,
+			Admin:  powerLevel(r, member) >= adminLevel,
+		})
+	}
+
+	return members, nil
+}
+
+func (m *Matrix) SetChannelAdmin(channelID, userID string, admin bool) error {
+	m.RLock()
+
+	r, ok := m.rooms[m.roomIDLocked(channelID)]
+	if !ok {
+		m.RUnlock()
+		return errors.New("Unknown channel seen (" + channelID + ")")
+	}
+
+	// copy the power levels, we only change the users
+	content := make(map[string]interface{})
+	for key, value := range r.powerLevels {
+		content[key] = value
+	}
+
+	users := make(map[string]interface{})
+	if current, ok := content["users"].(map[string]interface{}); ok {
+		for key, value := range current {
+			users[key] = value
+		}
+	}
+
+	roomID := r.id
+	m.RUnlock()
+
+	if admin {
+		users[userID] = adminLevel
+	} else {
+		delete(users, userID)
+	}
+
+	content["users"] = users
+
+	return m.api.put("/rooms/"+url.PathEscape(roomID)+"/state/m.room.power_levels", content, nil)
+}
+
+// powerLevel returns the power level of a user in the room.
+func powerLevel(r *room, userID string) int {
+	if users, ok := r.powerLevels["users"].(map[string]interface{}); ok {
+		if level, ok := users[userID].(float64); ok {
+			return int(level)
+		}
+	}
+
+	return levelSetting(r, "users_default", 0)
+}
+
+// levelSetting returns a setting of the power levels of the room, eg events_default.
+func levelSetting(r *room, key string, def int) int {
+	if level, ok := r.powerLevels[key].(float64); ok {
+		return int(level)
+	}
+
+	return def
+}
+
+func (m *Matrix) GetUsers() []*bridge.UserInfo {
+	var users []*bridge.UserInfo
+
+	m.RLock()
+	for userID := range m.users {
+		users = append(users, m.createUser(userID))
+	}
+	m.RUnlock()
+
+	return users
+}
+
+func (m *Matrix) GetUser(userID string) *bridge.UserInfo {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.createUser(userID)
+}
+
+func (m *Matrix) GetMe() *bridge.UserInfo {
+	return m.GetUser(m.userID)
+}
+
+func (m *Matrix) GetUserByUsername(username string) *bridge.UserInfo {
+	m.RLock()
+	defer m.RUnlock()
+
+	for userID := range m.users {
+		if localpart(userID) == username {
+			return m.createUser(userID)
+		}
+	}
+
+	return &bridge.UserInfo{}
+}
+
+// MentionUser returns the display name, clients highlight messages containing it.
+func (m *Matrix) MentionUser(userID string) string {
+	info := m.GetUser(userID)
+	if info.DisplayName != "" {
+		return info.DisplayName
+	}
+
+	return info.Username
+}
+
+func (m *Matrix) SearchUsers(query string) ([]*bridge.UserInfo, error) {
+	var res struct {
+		Results []struct {
+			UserID      string `json:"user_id"`
+			DisplayName string `json:"display_name"`
+		} `json:"results"`
+	}
+
+	err := m.api.post("/user_directory/search", map[string]interface{}{"search_term": query, "limit": 50}, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []*bridge.UserInfo
+
+	m.Lock()
+	defer m.Unlock()
+
+	for _, result := range res.Results {
+		if _, ok := m.users[result.UserID]; !ok {
+			m.users[result.UserID] = result.DisplayName
+		}
+
+		users = append(users, m.createUser(result.UserID))
+	}
+
+	return users, nil
+}
+
+func (m *Matrix) GetTeamName(teamID string) string {
+	return ""
+}
+
+func (m *Matrix) GetLastViewedAt(channelID string) int64 {
+	r := m.getRoom(channelID)
+	if r == nil {
+		return 0
+	}
+
+	m.RLock()
+	defer m.RUnlock()
+
+	return r.lastRead
+}
+
+// GetUnread returns the notification counts of the homeserver, messages which don't notify
+// (depending on the push rules) aren't counted.
+func (m *Matrix) GetUnread() ([]*bridge.Unread, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	var unread []*bridge.Unread
+
+	for _, r := range m.rooms {
+		if r.notifications > 0 || r.highlights > 0 {
+			unread = append(unread, &bridge.Unread{
+				ChannelID: r.id,
+				Messages:  r.notifications,
+				Mentions:  r.highlights,
+			})
+		}
+	}
+
+	return unread, nil
+}
+
+func (m *Matrix) UpdateLastViewed(channelID string) {
+	channelID = m.roomID(channelID)
+
+	r := m.getRoom(channelID)
+	if r == nil {
+		return
+	}
+
+	m.RLock()
+	eventID := r.lastEvent
+	m.RUnlock()
+
+	if eventID == "" {
+		return
+	}
+
+	err := m.api.post("/rooms/"+url.PathEscape(channelID)+"/receipt/m.read/"+url.PathEscape(eventID), map[string]string{}, nil)
+	if err != nil {
+		logger.Errorf("updatelastviewed for %s failed: %s", channelID, err)
+	}
+}
+
+func (m *Matrix) UpdateLastViewedUser(userID string) error {
+	roomID, err := m.directRoom(userID)
+	if err != nil {
+		return err
+	}
+
+	m.UpdateLastViewed(roomID)
+
+	return nil
+}
+
+func (m *Matrix) GetChannelID(name, teamID string) string {
+	return m.roomIDFromName(name)
+}
+
+// postList converts room events to a mattermost postlist, which is what irckit uses for replaying.
+// The events need to be ordered newest first.
+func (m *Matrix) postList(events []*event) *model.PostList {
+	postlist := model.NewPostList()
+
+	for _, ev := range events {
+		if ev.Type != "m.room.message" {
+			continue
+		}
+
+		post := &model.Post{
+			Id:        ev.EventID,
+			ChannelId: ev.RoomID,
+			UserId:    ev.Sender,
+			Message:   m.messageText(ev),
+			CreateAt:  ev.Timestamp,
+		}
+
+		if url := ev.str("url"); url != "" {
+			post.FileIds = append(post.FileIds, url)
+		}
+
+		postlist.AddPost(post)
+		postlist.AddOrder(post.Id)
+	}
+
+	return postlist
+}
+
+// messages gets the history of a room, newest first, until limit events or the since timestamp is reached.
+func (m *Matrix) messages(channelID string, limit int, since int64) *model.PostList {
+	channelID = m.roomID(channelID)
+
+	var events []*event
+
+	from := ""
+
+	for len(events) < limit {
+		var res struct {
+			Chunk []*event `json:"chunk"`
+			End   string   `json:"end"`
+		}
+
+		query := url.Values{"dir": {"b"}, "limit": {"100"}}
+		if from != "" {
+			query.Set("from", from)
+		}
+
+		err := m.api.get("/rooms/"+url.PathEscape(channelID)+"/messages", query, &res)
+		if err != nil {
+			logger.Errorf("messages of %s failed: %s", channelID, err)
+			return nil
+		}
+
+		for _, ev := range res.Chunk {
+			if ev.Timestamp <= since || len(events) == limit {
+				return m.postList(events)
+			}
+
+			ev.RoomID = channelID
+			events = append(events, ev)
+		}
+
+		if len(res.Chunk) == 0 || res.End == "" || res.End == from {
+			break
+		}
+
+		from = res.End
+	}
+
+	return m.postList(events)
+}
+
+func (m *Matrix) GetPostsSince(channelID string, since int64) interface{} {
+	postlist := m.messages(channelID, 1000, since)
+	if postlist == nil {
+		return nil
+	}
+
+	return postlist
+}
+
+func (m *Matrix) GetPosts(channelID string, limit int) interface{} {
+	postlist := m.messages(channelID, limit, 0)
+	if postlist == nil {
+		return nil
+	}
+
+	return postlist
+}
+
+func (m *Matrix) SearchPosts(search string) interface{} {
+	var res struct {
+		SearchCategories struct {
+			RoomEvents struct {
+				Results []struct {
+					Result *event `json:"result"`
+				} `json:"results"`
+			} `json:"room_events"`
+		} `json:"search_categories"`
+	}
+
+	err := m.api.post("/search", map[string]interface{}{
+		"search_categories": map[string]interface{}{
+			"room_events": map[string]interface{}{
+				"search_term": search,
+				"order_by":    "recent",
+			},
+		},
+	}, &res)
+	if err != nil {
+		logger.Errorf("search failed: %s", err)
+		return nil
+	}
+
+	var events []*event
+
+	for _, result := range res.SearchCategories.RoomEvents.Results {
+		events = append(events, result.Result)
+	}
+
+	return m.postList(events)
+}
+
+func (m *Matrix) GetFileLinks(fileIDs []string) []string {
+	var links []string
+
+	for _, id := range fileIDs {
+		links = append(links, m.api.downloadURL(id))
+	}
+
+	return links
+}
+
+// createUser needs to be called with the lock held.
+func (m *Matrix) createUser(userID string) *bridge.UserInfo {
+	if userID == "" {
+		return &bridge.UserInfo{}
+	}
+
+	displayName := m.users[userID]
+
+	nick := localpart(userID)
+	if m.v.GetBool("matrix.PreferNickname") && isValidNick(displayName) {
+		nick = displayName
+	}
+
+	return &bridge.UserInfo{
+		Nick:        nick,
+		User:        userID,
+		Real:        displayName,
+		Host:        serverName(userID),
+		DisplayName: displayName,
+		Ghost:       true,
+		Me:          userID == m.userID,
+		Username:    localpart(userID),
+	}
+}
+
+func isValidNick(s string) bool {
+	if len(s) < 1 || len(s) > 27 {
+		return false
+	}
+
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_[]\\^{}|`", c)) {
+			return false
+		}
+	}
+
+	return !strings.ContainsAny(s[:1], "-0123456789")
+}
+
+// applyState updates the room with a state event, it needs to be called with the lock held.
+func (m *Matrix) applyState(r *room, ev *event) {
+	switch ev.Type {
+	case "m.room.name":
+		r.name = ev.str("name")
+	case "m.room.canonical_alias":
+		r.alias = ev.str("alias")
+	case "m.room.topic":
+		r.topic = ev.str("topic")
+	case "m.room.join_rules":
+		r.joinRule = ev.str("join_rule")
+	case "m.room.power_levels":
+		r.powerLevels = ev.Content
+	case "m.room.tombstone":
+		r.archived = true
+	case "m.room.member":
+		if ev.StateKey == nil {
+			return
+		}
+
+		switch ev.str("membership") {
+		case "join":
+			r.members[*ev.StateKey] = true
+
+			// member events without a displayname shouldn't clear the one we know from other rooms
+			if displayName := ev.str("displayname"); displayName != "" || m.users[*ev.StateKey] == "" {
+				m.users[*ev.StateKey] = displayName
+			}
+		case "leave", "ban":
+			delete(r.members, *ev.StateKey)
+		}
+	}
+}
+
+// handleSync processes a sync response. On the initial sync we only update our state.
+// nolint:funlen,gocognit,gocyclo
+func (m *Matrix) handleSync(res *syncResponse, initial bool) {
+	logger.Tracef("handleSync %s", spew.Sdump(res))
+
+	m.Lock()
+
+	m.nextBatch = res.NextBatch
+
+	var created []string
+
+	// our read receipts, also the ones of other devices
+	var viewedEvents []*bridge.Event
+
+	for roomID, joined := range res.Rooms.Join {
+		r, ok := m.rooms[roomID]
+		if !ok {
+			r = &room{id: roomID, members: make(map[string]bool)}
+			m.rooms[roomID] = r
+
+			created = append(created, roomID)
+		}
+
+		for _, ev := range joined.State.Events {
+			m.applyState(r, ev)
+		}
+
+		if counts := joined.UnreadNotifications; counts != nil {
+			r.notifications, r.highlights = counts.NotificationCount, counts.HighlightCount
+		}
+
+		for _, ev := range joined.Ephemeral.Events {
+			if ev.Type != "m.receipt" {
+				continue
+			}
+
+			for _, receipt := range ev.Content {
+				read, _ := receipt.(map[string]interface{})["m.read"].(map[string]interface{})
+				if mine, ok := read[m.userID].(map[string]interface{}); ok {
+					if ts, ok := mine["ts"].(float64); ok && int64(ts) > r.lastRead {
+						r.lastRead = int64(ts)
+
+						viewedEvents = append(viewedEvents, &bridge.Event{
+							Type: "channel_viewed",
+							Data: &bridge.ChannelViewedEvent{
+								ChannelID: roomID,
+								ViewedAt:  r.lastRead,
+							},
+						})
+					}
+				}
+			}
+		}
+
+		if initial {
+			for _, ev := range joined.Timeline.Events {
+				if ev.StateKey != nil {
+					m.applyState(r, ev)
+				}
+
+				r.lastEvent = ev.EventID
+			}
+		}
+	}
+
+	for _, ev := range res.AccountData.Events {
+		if ev.Type != "m.direct" {
+			continue
+		}
+
+		for _, roomIDs := range ev.Content {
+			list, _ := roomIDs.([]interface{})
+			for _, roomID := range list {
+				if r, ok := m.rooms[roomID.(string)]; ok {
+					r.direct = true
+				}
+			}
+		}
+	}
+
+	var statusEvents []*bridge.Event
+
+	for _, ev := range res.Presence.Events {
+		status := "offline"
+
+		switch ev.str("presence") {
+		case "online":
+			status = "online"
+		case "unavailable":
+			status = "away"
+		}
+
+		m.statuses[ev.Sender] = status
+
+		statusEvents = append(statusEvents, &bridge.Event{
+			Type: "status_change",
+			Data: &bridge.StatusChangeEvent{
+				UserID: ev.Sender,
+				Status: status,
+			},
+		})
+	}
+
+	m.Unlock()
+
+	if initial {
+		return
+	}
+
+	for _, event := range statusEvents {
+		m.sendEvent(event)
+	}
+
+	for _, event := range viewedEvents {
+		m.sendEvent(event)
+	}
+
+	for _, roomID := range created {
+		m.sendEvent(&bridge.Event{
+			Type: "channel_create",
+			Data: &bridge.ChannelCreateEvent{
+				ChannelID: roomID,
+			},
+		})
+	}
+
+	for roomID, joined := range res.Rooms.Join {
+		for _, ev := range joined.Timeline.Events {
+			ev.RoomID = roomID
+			m.handleTimelineEvent(ev)
+		}
+	}
+
+	for roomID := range res.Rooms.Leave {
+		m.Lock()
+		_, ok := m.rooms[roomID]
+		delete(m.rooms, roomID)
+		m.Unlock()
+
+		if ok {
+			m.sendEvent(&bridge.Event{
+				Type: "channel_delete",
+				Data: &bridge.ChannelDeleteEvent{
+					ChannelID: roomID,
+				},
+			})
+		}
+	}
+}
+
+func (m *Matrix) sendEvent(event *bridge.Event) {
+	m.eventChan <- event
+}
+
+// messageText returns the text of a message event as we show it on IRC.
+func (m *Matrix) messageText(ev *event) string {
+	body := ev.str("body")
+
+	// edits have the new content in m.new_content
+	if relates, ok := ev.Content["m.relates_to"].(map[string]interface{}); ok && relates["rel_type"] == "m.replace" {
+		if newContent, ok := ev.Content["m.new_content"].(map[string]interface{}); ok {
+			body, _ = newContent["body"].(string)
+		}
+
+		return m.templates.Render(bridge.TemplateEdit, ev.RoomID, &bridge.TemplateData{Message: body})
+	}
+
+	// replies include a quote of the parent message, format it like mattermost replies
+	if strings.HasPrefix(body, "> <") {
+		lines := strings.Split(body, "\n")
+
+		var quote []string
+
+		for len(lines) > 0 && strings.HasPrefix(lines[0], "> ") {
+			quote = append(quote, strings.TrimPrefix(lines[0], "> "))
+			lines = lines[1:]
+		}
+
+		body = strings.TrimSpace(strings.Join(lines, "\n"))
+
+		parent := strings.Join(quote, " ")
+		if i := strings.Index(parent, "> "); strings.HasPrefix(parent, "<") && i > 0 {
+			reply := &bridge.TemplateData{
+				Message:    body,
+				ParentNick: localpart(parent[1:i]),
+			}
+
+			if !m.settings.Bool(ev.RoomID, "HideReplies") {
+				reply.ParentMessage = parent[i+2:]
+			}
+
+			body = m.templates.Render(bridge.TemplateReply, ev.RoomID, reply)
+		}
+	}
+
+	if ev.str("msgtype") == "m.emote" {
+		body = "*" + body + "*"
+	}
+
+	return body
+}
+
+// nolint:funlen,gocognit
+func (m *Matrix) handleTimelineEvent(ev *event) {
+	m.Lock()
+
+	r, ok := m.rooms[ev.RoomID]
+	if !ok {
+		m.Unlock()
+		return
+	}
+
+	r.lastEvent = ev.EventID
+
+	if ev.StateKey != nil {
+		m.applyState(r, ev)
+	}
+
+	ours := m.sent[ev.Unsigned.TransactionID]
+	delete(m.sent, ev.Unsigned.TransactionID)
+
+	direct := r.direct
+	channelType := "O"
+
+	if direct {
+		channelType = "D"
+		if len(r.members) > 2 {
+			channelType = "G"
+		}
+	}
+
+	ghost := m.createUser(ev.Sender)
+
+	m.Unlock()
+
+	switch ev.Type {
+	case "m.room.member":
+		m.handleMemberEvent(ev, ghost)
+		return
+	case "m.room.topic":
+		m.sendEvent(&bridge.Event{
+			Type: "channel_topic",
+			Data: &bridge.ChannelTopicEvent{
+				Text:      ev.str("topic"),
+				ChannelID: ev.RoomID,
+				Sender:    ghost.Nick,
+			},
+		})
+
+		return
+	case "m.room.canonical_alias":
+		m.settings.Forget(ev.RoomID)
+		m.sendEvent(&bridge.Event{
+			Type: "channel_update",
+			Data: &bridge.ChannelUpdateEvent{
+				ChannelID: ev.RoomID,
+			},
+		})
+
+		return
+	case "m.room.power_levels":
+		m.sendEvent(&bridge.Event{
+			Type: "channel_member_update",
+			Data: &bridge.ChannelMemberUpdateEvent{
+				ChannelID: ev.RoomID,
+			},
+		})
+
+		return
+	case "m.room.message":
+	default:
+		return
+	}
+
+	if ours {
+		logger.Debugf("message is sent from matterircd, not relaying %#v", ev.str("body"))
+		return
+	}
+
+	switch ev.str("msgtype") {
+	case "m.image", "m.file", "m.video", "m.audio":
+		fileEvent := &bridge.FileEvent{
+			Sender:      ghost,
+			Receiver:    ghost,
+			ChannelID:   ev.RoomID,
+			ChannelType: channelType,
+			Files: []*bridge.File{{
+				Name: m.api.downloadURL(ev.str("url")),
+			}},
+		}
+
+		if channelType == "D" {
+			fileEvent.Receiver = m.GetMe()
+		}
+
+		m.sendEvent(&bridge.Event{
+			Type: "file_event",
+			Data: fileEvent,
+		})
+
+		return
+	}
+
+	messageType := ""
+	if ev.str("msgtype") == "m.notice" {
+		messageType = "notice"
+	}
+
+	for _, msg := range strings.Split(m.messageText(ev), "\n") {
+		if msg == "" {
+			continue
+		}
+
+		if channelType == "D" {
+			m.sendEvent(&bridge.Event{
+				Type: "direct_message",
+				Data: &bridge.DirectMessageEvent{
+					Text:     msg,
+					Sender:   ghost,
+					Receiver: m.GetMe(),
+				},
+			})
+
+			continue
+		}
+
+		m.sendEvent(&bridge.Event{
+			Type: "channel_message",
+			Data: &bridge.ChannelMessageEvent{
+				Text:        msg,
+				ChannelID:   ev.RoomID,
+				Sender:      ghost,
+				MessageType: messageType,
+				ChannelType: channelType,
+			},
+		})
+	}
+
+	if !m.settings.Bool(ev.RoomID, "DisableAutoView") {
+		m.UpdateLastViewed(ev.RoomID)
+	}
+}
+
+func (m *Matrix) handleMemberEvent(ev *event, sender *bridge.UserInfo) {
+	if ev.StateKey == nil {
+		return
+	}
+
+	prev, _ := ev.Unsigned.PrevContent["membership"].(string)
+	target := m.GetUser(*ev.StateKey)
+
+	switch ev.str("membership") {
+	case "join":
+		if prev == "join" {
+			// displayname or avatar change
+			m.sendEvent(&bridge.Event{
+				Type: "user_updated",
+				Data: &bridge.UserUpdateEvent{
+					User: target,
+				},
+			})
+
+			return
+		}
+
+		event := &bridge.ChannelAddEvent{
+			Added:     []*bridge.UserInfo{target},
+			ChannelID: ev.RoomID,
+		}
+
+		if ev.Sender != *ev.StateKey {
+			event.Adder = sender
+		}
+
+		m.sendEvent(&bridge.Event{
+			Type: "channel_add",
+			Data: event,
+		})
+	case "leave", "ban":
+		event := &bridge.ChannelRemoveEvent{
+			Removed:   []*bridge.UserInfo{target},
+			ChannelID: ev.RoomID,
+		}
+
+		if ev.Sender != *ev.StateKey {
+			event.Remover = sender
+		}
+
+		m.sendEvent(&bridge.Event{
+			Type: "channel_remove",
+			Data: event,
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package matrix
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/42wim/matterircd/bridge"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+const initialSync = `{
+	"next_batch": "s1",
+	"account_data": {"events": [
+		{"type": "m.direct", "content": {"@bob:example.org": ["!dm:example.org"]}}
+	]},
+	"rooms": {"join": {
+		"!general:example.org": {
+			"state": {"events": [
+				{"type": "m.room.canonical_alias", "state_key": "", "content": {"alias": "#general:example.org"}},
+				{"type": "m.room.topic", "state_key": "", "content": {"topic": "welcome"}},
+				{"type": "m.room.member", "state_key": "@alice:example.org", "content": {"membership": "join", "displayname": "Alice"}},
+				{"type": "m.room.member", "state_key": "@bob:example.org", "content": {"membership": "join", "displayname": "Bob"}}
+			]}
+		},
+		"!remote:example.org": {
+			"state": {"events": [
+				{"type": "m.room.canonical_alias", "state_key": "", "content": {"alias": "#rust:mozilla.org"}}
+			]}
+		},
+		"!dm:example.org": {
+			"state": {"events": [
+				{"type": "m.room.member", "state_key": "@alice:example.org", "content": {"membership": "join"}},
+				{"type": "m.room.member", "state_key": "@bob:example.org", "content": {"membership": "join"}}
+			]}
+		}
+	}}
+}`
+
+// fakeHomeserver serves the initial sync and afterwards every response pushed on syncs.
+type fakeHomeserver struct {
+	*httptest.Server
+	syncs chan string
+	sent  chan map[string]string
+}
+
+func newFakeHomeserver(t *testing.T) *fakeHomeserver {
+	hs := &fakeHomeserver{
+		syncs: make(chan string, 10),
+		sent:  make(chan map[string]string, 10),
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/_matrix/client/r0/login", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Password string `json:"password"`
+		}
+
+		json.NewDecoder(r.Body).Decode(&req)
+
+		if req.Password != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errcode": "M_FORBIDDEN", "error": "Invalid password"}`))
+
+			return
+		}
+
+		w.Write([]byte(`{"user_id": "@alice:example.org", "access_token": "abc"}`))
+	})
+
+	mux.HandleFunc("/_matrix/client/r0/account/whoami", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"user_id": "@alice:example.org"}`))
+	})
+
+	mux.HandleFunc("/_matrix/client/r0/sync", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer abc", r.Header.Get("Authorization"))
+
+		if r.URL.Query().Get("since") == "" {
+			w.Write([]byte(initialSync))
+			return
+		}
+
+		select {
+		case res := <-hs.syncs:
+			w.Write([]byte(res))
+		case <-time.After(50 * time.Millisecond):
+			w.Write([]byte(`{"next_batch": "` + r.URL.Query().Get("since") + `"}`))
+		}
+	})
+
+	mux.HandleFunc("/_matrix/client/r0/rooms/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/send/m.room.message/") {
+			var content map[string]string
+
+			json.NewDecoder(r.Body).Decode(&content)
+
+			content["path"] = r.URL.Path
+			hs.sent <- content
+		}
+
+		w.Write([]byte(`{"event_id": "$sent"}`))
+	})
+
+	mux.HandleFunc("/_matrix/client/r0/join/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errcode": "M_NOT_FOUND", "error": "Room alias not found"}`))
+	})
+
+	mux.HandleFunc("/_matrix/client/r0/logout", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	})
+
+	hs.Server = httptest.NewServer(mux)
+
+	return hs
+}
+
+func newTestMatrix(t *testing.T, hs *fakeHomeserver, pass string) (*Matrix, chan *bridge.Event, error) {
+	eventChan := make(chan *bridge.Event, 10)
+
+	br, err := New(bridge.NewConfig(viper.New()), bridge.Credentials{
+		Server: hs.URL,
+		Login:  "alice",
+		Pass:   pass,
+	}, eventChan, func() {})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return br.(*Matrix), eventChan, nil
+}
+
+func TestLogin(t *testing.T) {
+	hs := newFakeHomeserver(t)
+	defer hs.Close()
+
+	_, _, err := newTestMatrix(t, hs, "wrong")
+	assert.EqualError(t, err, "M_FORBIDDEN: Invalid password")
+
+	m, _, err := newTestMatrix(t, hs, "token=abc")
+	assert.NoError(t, err)
+	assert.Equal(t, "@alice:example.org", m.GetMe().User)
+	assert.NoError(t, m.Logout())
+}
+
+func TestLogoutTwice(t *testing.T) {
+	hs := newFakeHomeserver(t)
+	defer hs.Close()
+
+	m, _, err := newTestMatrix(t, hs, "secret")
+	assert.NoError(t, err)
+
+	// QUIT logs out the sessions and so does the server when the connection closes
+	assert.NoError(t, m.Logout())
+	assert.NotPanics(t, func() { assert.NoError(t, m.Logout()) })
+}
+
+func TestRoomMapping(t *testing.T) {
+	hs := newFakeHomeserver(t)
+	defer hs.Close()
+
+	m, _, err := newTestMatrix(t, hs, "secret")
+	assert.NoError(t, err)
+
+	defer m.Logout()
+
+	channels := make(map[string]string)
+	for _, channel := range m.GetChannels() {
+		channels[channel.Name] = channel.ID
+	}
+
+	assert.Equal(t, map[string]string{
+		"general":                              "!general:example.org",
+		"rust:mozilla.org":                     "!remote:example.org",
+		"@bob:example.org__@alice:example.org": "!dm:example.org",
+	}, channels)
+
+	assert.Equal(t, "#general", m.GetChannelName("!general:example.org"))
+	assert.Equal(t, "welcome", m.Topic("!general:example.org"))
+	assert.Equal(t, "!general:example.org", m.GetChannelID("general", ""))
+
+	users, err := m.GetChannelUsers("!general:example.org")
+	assert.NoError(t, err)
+	assert.Len(t, users, 2)
+
+	bob := m.GetUser("@bob:example.org")
+	assert.Equal(t, "bob", bob.Nick)
+	assert.Equal(t, "Bob", bob.Real)
+	assert.Equal(t, "example.org", bob.Host)
+}
+
+func TestJoinMissingRoom(t *testing.T) {
+	hs := newFakeHomeserver(t)
+	defer hs.Close()
+
+	m, _, err := newTestMatrix(t, hs, "secret")
+	assert.NoError(t, err)
+
+	defer m.Logout()
+
+	_, _, err = m.Join("doesnotexist")
+	assert.Equal(t, bridge.ErrNoSuchChannel, err)
+}
+
+func TestMessages(t *testing.T) {
+	hs := newFakeHomeserver(t)
+	defer hs.Close()
+
+	m, events, err := newTestMatrix(t, hs, "secret")
+	assert.NoError(t, err)
+
+	defer m.Logout()
+
+	assert.NoError(t, m.MsgChannel("!general:example.org", "hello"))
+
+	sent := <-hs.sent
+	assert.Equal(t, "hello", sent["body"])
+	assert.Equal(t, "m.text", sent["msgtype"])
+
+	txnID := sent["path"][strings.LastIndex(sent["path"], "/")+1:]
+
+	// our own message comes back with its transaction id and must not be relayed.
+	hs.syncs <- `{"next_batch": "s2", "rooms": {"join": {
+		"!general:example.org": {"timeline": {"events": [
+			{"type": "m.room.message", "event_id": "$1", "sender": "@alice:example.org",
+			 "content": {"msgtype": "m.text", "body": "hello"}, "unsigned": {"transaction_id": "` + txnID + `"}},
+			{"type": "m.room.message", "event_id": "$2", "sender": "@bob:example.org",
+			 "content": {"msgtype": "m.text", "body": "> <@alice:example.org> hello\n\nhi alice"}}
+		]}},
+		"!dm:example.org": {"timeline": {"events": [
+			{"type": "m.room.message", "event_id": "$3", "sender": "@bob:example.org",
+			 "content": {"msgtype": "m.text", "body": "psst"}}
+		]}}
+	}}}`
+
+	got := make(map[string]string)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case event := <-events:
+			switch data := event.Data.(type) {
+			case *bridge.ChannelMessageEvent:
+				assert.Equal(t, "bob", data.Sender.Nick)
+				got[data.ChannelID] = data.Text
+			case *bridge.DirectMessageEvent:
+				assert.Equal(t, "bob", data.Sender.Nick)
+				got["direct"] = data.Text
+			default:
+				t.Fatalf("unexpected event %#v", event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for events")
+		}
+	}
+
+	assert.Equal(t, map[string]string{
+		"!general:example.org": "hi alice (re @alice: hello)",
+		"direct":               "psst",
+	}, got)
+}
+
+func TestGroupChannelName(t *testing.T) {
+	m := &Matrix{
+		v:      bridge.NewConfig(viper.New()),
+		userID: "@alice:example.org",
+		users:  map[string]string{"@bob:example.org": "Bobby", "@carol:example.org": "Carol"},
+		rooms: map[string]*room{"!group:example.org": {
+			id:      "!group:example.org",
+			direct:  true,
+			members: map[string]bool{"@alice:example.org": true, "@bob:example.org": true, "@carol:example.org": true},
+		}},
+	}
+
+	assert.Equal(t, "#bob-carol", m.GetChannelName("!group:example.org"))
+
+	m.v.Update(func(v *viper.Viper) { v.Set("matrix.GroupChannelNames", true) })
+	assert.Equal(t, "&group:bob+carol", m.GetChannelName("!group:example.org"))
+
+	// the same nicks as the ghosts
+	m.v.Update(func(v *viper.Viper) { v.Set("matrix.PreferNickname", true) })
+	assert.Equal(t, "&group:Bobby+Carol", m.GetChannelName("!group:example.org"))
+}
@@ -1,9 +1,15 @@
 package mattermost
 
 import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/42wim/matterbridge/matterclient"
@@ -12,24 +18,54 @@ import (
 	"github.com/mattermost/mattermost-server/v5/model"
 	"github.com/mitchellh/mapstructure"
 	logger "github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
 )
 
 type Mattermost struct {
+	// mc is replaced when we login again after the session expired, use client()
+	mcMutex     sync.RWMutex
 	mc          *matterclient.MMClient
+	loggedIn    bool
 	credentials bridge.Credentials
-	idleStop    chan struct{}
+	// quit is closed by Logout, it stops the goroutines of the current client
+	quit        chan struct{}
+	onWsConnect func()
 	eventChan   chan *bridge.Event
-	v           *viper.Viper
+	v           *bridge.Config
+	settings    *bridge.Settings
+	templates   *bridge.Templates
+
+	// relogin is 1 while we're logging in again after the session expired
+	relogin int32
+
+	// muted and favorite channels of the logged in user, by channel ID
+	prefsMutex sync.RWMutex
+	muted      map[string]bool
+	favorites  map[string]bool
+
+	// mentionRe matches the mention keys of our notification settings, see mentionRegexp
+	mentionMutex sync.Mutex
+	mentionKeys  string
+	mentionRe    *regexp.Regexp
+
+	// whether users are team admins, by team ID and user ID
+	teamRolesMutex sync.Mutex
+	teamRoles      map[string]map[string]bool
 }
 
-func New(v *viper.Viper, cred bridge.Credentials, eventChan chan *bridge.Event, onWsConnect func()) (bridge.Bridger, *matterclient.MMClient, error) {
+// errSessionExpired is returned when a request fails because the session expired.
+var errSessionExpired = errors.New("session expired")
+
+func New(v *bridge.Config, cred bridge.Credentials, eventChan chan *bridge.Event, onWsConnect func()) (bridge.Bridger, *matterclient.MMClient, error) {
 	m := &Mattermost{
 		credentials: cred,
 		eventChan:   eventChan,
 		v:           v,
+		onWsConnect: onWsConnect,
 	}
 
+	m.settings = bridge.NewSettings(v, "mattermost", m.GetChannelName)
+	m.templates = bridge.NewTemplates(m.settings, nil)
+
 	if v.GetBool("debug") {
 		logger.SetLevel(logger.DebugLevel)
 	}
@@ -45,18 +81,44 @@ func New(v *viper.Viper, cred bridge.Credentials, eventChan chan *bridge.Event,
 		return nil, nil, err
 	}
 
-	mc.EnableAllEvents()
+	go m.onWsConnect()
 
-	m.mc.OnWsConnect = onWsConnect
-	go mc.StatusLoop()
+	m.loadChannelPrefs()
 
-	m.mc = mc
+	go m.sessionLoop(m.quit)
 
 	return m, mc, nil
 }
 
+// client returns the client of the current session.
+func (m *Mattermost) client() *matterclient.MMClient {
+	m.mcMutex.RLock()
+	defer m.mcMutex.RUnlock()
+
+	return m.mc
+}
+
+// errMFARequired is returned when the account uses MFA and no code was given.
+var errMFARequired = errors.New("login failed: MFA is required for this account, add mfa=<code> to your login")
+
 func (m *Mattermost) loginToMattermost() (*matterclient.MMClient, error) {
-	mc := matterclient.New(m.credentials.Login, m.credentials.Pass, m.credentials.Team, m.credentials.Server)
+	pass := m.credentials.Pass
+
+	switch {
+	case pass == "" && m.credentials.Token != "":
+		pass = "token=" + m.credentials.Token
+	case m.credentials.MFAToken != "" && !strings.Contains(pass, "token=") && !strings.Contains(pass, model.SESSION_COOKIE_TOKEN):
+		// matterclient doesn't support MFA, so login ourselves and use the session token
+		token, err := m.loginWithMFA()
+		if err != nil {
+			logger.Error("login failed ", err)
+			return nil, err
+		}
+
+		pass = "token=" + token
+	}
+
+	mc := matterclient.New(m.credentials.Login, pass, m.credentials.Team, m.credentials.Server)
 	if m.v.GetBool("mattermost.Insecure") {
 		mc.Credentials.NoTLS = true
 	}
@@ -74,23 +136,31 @@ func (m *Mattermost) loginToMattermost() (*matterclient.MMClient, error) {
 	err := mc.Login()
 	if err != nil {
 		logger.Error("login failed", err)
+
+		if m.credentials.MFAToken == "" && strings.Contains(strings.ToLower(err.Error()), "mfa") {
+			return nil, errMFARequired
+		}
+
 		return nil, err
 	}
 
 	logger.Info("login succeeded")
 
+	m.mcMutex.Lock()
 	m.mc = mc
+	m.loggedIn = true
+	m.quit = make(chan struct{})
+	quit := m.quit
+	m.mcMutex.Unlock()
 
-	m.mc.WsQuit = false
-
-	go mc.WsReceiver()
-	go m.handleWsMessage()
+	go m.wsReceiver(mc, quit)
+	go m.handleWsMessage(mc, quit)
 
 	// do anti idle on town-square, every installation should have this channel
-	channels := m.mc.GetChannels()
+	channels := mc.GetChannels()
 	for _, channel := range channels {
 		if channel.Name == "town-square" && !m.v.GetBool("mattermost.DisableAutoView") {
-			go m.antiIdle(channel.Id)
+			go m.antiIdle(channel.Id, quit)
 			continue
 		}
 	}
@@ -98,19 +168,50 @@ func (m *Mattermost) loginToMattermost() (*matterclient.MMClient, error) {
 	return mc, nil
 }
 
-func (m *Mattermost) handleWsMessage() {
+// loginWithMFA logs in with the password and MFA code and returns the token of the session.
+func (m *Mattermost) loginWithMFA() (string, error) {
+	uriScheme := "https://"
+	if m.v.GetBool("mattermost.Insecure") {
+		uriScheme = "http://"
+	}
+
+	client := model.NewAPIv4Client(uriScheme + m.credentials.Server)
+	client.HttpClient.Transport = &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: m.v.GetBool("mattermost.SkipTLSVerify")}, //nolint:gosec
+		Proxy:           http.ProxyFromEnvironment,
+	}
+	client.HttpClient.Timeout = time.Second * 10
+
+	_, resp := client.LoginWithMFA(m.credentials.Login, m.credentials.Pass, m.credentials.MFAToken)
+	if resp.Error != nil {
+		switch resp.Error.Id {
+		case "api.user.check_user_mfa.bad_code.app_error", "mfa.validate_token.authenticate.app_error":
+			return "", errors.New("login failed: invalid MFA code")
+		}
+
+		return "", errors.New(resp.Error.Message)
+	}
+
+	return client.AuthToken, nil
+}
+
+// handleWsMessage handles the websocket events of a client until quit is closed.
+func (m *Mattermost) handleWsMessage(mc *matterclient.MMClient, quit chan struct{}) {
 	updateChannelsThrottle := time.NewTicker(time.Second * 60)
+	defer updateChannelsThrottle.Stop()
 
 	for {
-		if m.mc.WsQuit {
+		logger.Debug("in handleWsMessage", len(mc.MessageChan))
+
+		var message *matterclient.Message
+
+		select {
+		case <-quit:
 			logger.Debug("exiting handleWsMessage")
 			return
+		case message = <-mc.MessageChan:
 		}
 
-		logger.Debug("in handleWsMessage", len(m.mc.MessageChan))
-
-		message := <-m.mc.MessageChan
-
 		logger.Debugf("MMUser WsReceiver: %#v", message.Raw)
 		logger.Tracef("handleWsMessage %s", spew.Sdump(message))
 		// check if we have the users/channels in our cache. If not update
@@ -133,6 +234,20 @@ func (m *Mattermost) handleWsMessage() {
 			m.handleWsActionUserUpdated(message.Raw)
 		case model.WEBSOCKET_EVENT_STATUS_CHANGE:
 			m.handleStatusChangeEvent(message.Raw)
+		case model.WEBSOCKET_EVENT_CHANNEL_UPDATED, model.WEBSOCKET_EVENT_CHANNEL_CONVERTED:
+			m.handleWsActionChannelUpdated(message.Raw)
+		case model.WEBSOCKET_EVENT_CHANNEL_RESTORED:
+			m.handleWsActionChannelCreated(message.Raw)
+		case model.WEBSOCKET_EVENT_CHANNEL_MEMBER_UPDATED:
+			m.handleWsActionChannelMemberUpdated(message.Raw)
+		case model.WEBSOCKET_EVENT_MEMBERROLE_UPDATED:
+			m.handleWsActionMemberRoleUpdated(message.Raw)
+		case model.WEBSOCKET_EVENT_PREFERENCE_CHANGED, model.WEBSOCKET_EVENT_PREFERENCES_CHANGED:
+			m.handleWsActionPreferencesChanged(message.Raw, false)
+		case model.WEBSOCKET_EVENT_PREFERENCES_DELETED:
+			m.handleWsActionPreferencesChanged(message.Raw, true)
+		case model.WEBSOCKET_EVENT_CHANNEL_VIEWED:
+			m.handleWsActionChannelViewed(message.Raw)
 		}
 	}
 }
@@ -151,27 +266,28 @@ func (m *Mattermost) checkWsActionMessage(rmsg *model.WebSocketEvent, throttle *
 }
 
 // antiIdle does a lastviewed every 60 seconds so that the user is shown as online instead of away
-func (m *Mattermost) antiIdle(channelID string) {
+func (m *Mattermost) antiIdle(channelID string, stop chan struct{}) {
 	ticker := time.NewTicker(time.Second * 60)
 
 	for {
 		select {
-		case <-m.idleStop:
+		case <-stop:
 			logger.Debug("stopping antiIdle loop")
 			return
 		case <-ticker.C:
-			if m.mc == nil {
+			mc := m.client()
+			if mc == nil {
 				logger.Error("antiidle: don't have a connection, exiting loop.")
 				return
 			}
 
-			m.mc.UpdateLastViewed(channelID)
+			mc.UpdateLastViewed(channelID)
 		}
 	}
 }
 
 func (m *Mattermost) Invite(channelID, username string) error {
-	_, resp := m.mc.Client.AddChannelMember(channelID, username)
+	_, resp := m.client().Client.AddChannelMember(channelID, username)
 	if resp.Error != nil {
 		return resp.Error
 	}
@@ -179,33 +295,50 @@ func (m *Mattermost) Invite(channelID, username string) error {
 	return nil
 }
 
-func (m *Mattermost) Join(channelName string) (string, string, error) {
-	teamID := ""
-
+// teamChannel splits a channel name like team/channel in the team ID and channel name,
+// channels without a team are in the main team.
+func (m *Mattermost) teamChannel(channelName string) (string, string, error) {
 	sp := strings.Split(channelName, "/")
-	if len(sp) > 1 {
-		team, _ := m.mc.Client.GetTeamByName(sp[0], "")
-		if team == nil {
-			return "", "", fmt.Errorf("cannot join channel (+i)")
-		}
+	if len(sp) == 1 {
+		return m.client().Team.Id, channelName, nil
+	}
 
-		teamID = team.Id
-		channelName = sp[1]
+	team, _ := m.client().Client.GetTeamByName(sp[0], "")
+	if team == nil {
+		return "", "", fmt.Errorf("team %s not found", sp[0])
 	}
 
-	if teamID == "" {
-		teamID = m.mc.Team.Id
+	return team.Id, sp[1], nil
+}
+
+func (m *Mattermost) Join(channelName string) (string, string, error) {
+	teamID, channelName, err := m.teamChannel(channelName)
+	if err != nil {
+		return "", "", fmt.Errorf("cannot join channel (+i)")
 	}
 
-	channelID := m.mc.GetChannelId(channelName, teamID)
+	channelID := m.client().GetChannelId(channelName, teamID)
+	if channelID == "" {
+		// not in our cache, only the server knows whether it doesn't exist or we may not see it
+		mmchannel, resp := m.client().Client.GetChannelByName(channelName, teamID, "")
+		if resp.StatusCode == http.StatusNotFound {
+			return "", "", bridge.ErrNoSuchChannel
+		}
+
+		if resp.Error != nil {
+			return "", "", resp.Error
+		}
+
+		channelID = mmchannel.Id
+	}
 
-	err := m.mc.JoinChannel(channelID)
+	err = m.client().JoinChannel(channelID)
 	logger.Debugf("join channel %s, id %s, err: %v", channelName, channelID, err)
 	if err != nil {
 		return "", "", fmt.Errorf("cannot join channel (+i)")
 	}
 
-	topic := m.mc.GetChannelHeader(channelID)
+	topic := m.client().GetChannelHeader(channelID)
 
 	return channelID, topic, nil
 }
@@ -213,7 +346,7 @@ func (m *Mattermost) Join(channelName string) (string, string, error) {
 func (m *Mattermost) List() (map[string]string, error) {
 	channelinfo := make(map[string]string)
 
-	for _, channel := range append(m.mc.GetChannels(), m.mc.GetMoreChannels()...) {
+	for _, channel := range append(m.client().GetChannels(), m.client().GetMoreChannels()...) {
 		// FIXME: This needs to be broken up into multiple messages to fit <510 chars
 		if strings.Contains(channel.Name, "__") {
 			continue
@@ -221,8 +354,8 @@ func (m *Mattermost) List() (map[string]string, error) {
 
 		channelName := "#" + channel.Name
 		// prefix channels outside of our team with team name
-		if channel.TeamId != m.mc.Team.Id {
-			channelName = m.mc.GetTeamName(channel.TeamId) + "/" + channel.Name
+		if channel.TeamId != m.client().Team.Id {
+			channelName = m.client().GetTeamName(channel.TeamId) + "/" + channel.Name
 		}
 
 		channelinfo[channelName] = strings.ReplaceAll(channel.Header, "\n", " | ")
@@ -232,44 +365,141 @@ func (m *Mattermost) List() (map[string]string, error) {
 }
 
 func (m *Mattermost) Part(channelID string) error {
-	m.mc.Client.RemoveUserFromChannel(channelID, m.mc.User.Id)
+	m.client().Client.RemoveUserFromChannel(channelID, m.client().User.Id)
 
 	return nil
 }
 
 func (m *Mattermost) UpdateChannels() error {
-	return m.mc.UpdateChannels()
+	return m.client().UpdateChannels()
 }
 
 func (m *Mattermost) Logout() error {
-	if m.mc.WsClient != nil {
-		err := m.mc.Logout()
-		if err != nil {
+	m.mcMutex.Lock()
+	mc, loggedIn := m.mc, m.loggedIn
+	m.loggedIn = false
+
+	if m.quit != nil {
+		close(m.quit)
+		m.quit = nil
+	}
+	m.mcMutex.Unlock()
+
+	// the session was already logged out when logging in again failed. Closing quit stopped
+	// the websocket, matterclient's Logout would only tell its own goroutines.
+	if loggedIn && !strings.Contains(mc.Credentials.Pass, model.SESSION_COOKIE_TOKEN) {
+		if _, resp := mc.Client.Logout(); resp.Error != nil {
 			logger.Error("logout failed")
 		}
-		logger.Info("logout succeeded")
+	}
 
-		m.idleStop <- struct{}{}
+	if loggedIn {
+		logger.Info("logout succeeded")
 	}
 
 	return nil
 }
 
+// sessionCheckInterval is how often sessionLoop checks the session.
+var sessionCheckInterval = time.Minute
+
+// sessionLoop checks if our session is still valid, until stop is closed. The websocket
+// reconnects with the same token by itself without telling us it's refused, so an expired
+// session shows up here as well.
+func (m *Mattermost) sessionLoop(stop chan struct{}) {
+	ticker := time.NewTicker(sessionCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			_, resp := m.client().Client.GetMe("")
+			if resp.StatusCode == http.StatusUnauthorized {
+				m.handleSessionExpired()
+				return
+			}
+		}
+	}
+}
+
+// canRelogin returns true when we can login again without asking the user, which
+// isn't possible for tokens and MFA logins.
+func (m *Mattermost) canRelogin() bool {
+	pass := m.credentials.Pass
+
+	return pass != "" && m.credentials.MFAToken == "" &&
+		!strings.Contains(pass, "token=") && !strings.Contains(pass, model.SESSION_COOKIE_TOKEN)
+}
+
+// handleSessionExpired logs in again when the session expired or was revoked. When that's
+// not possible the user gets logged out of the bridge by irckit.
+func (m *Mattermost) handleSessionExpired() {
+	if !atomic.CompareAndSwapInt32(&m.relogin, 0, 1) {
+		return
+	}
+
+	defer atomic.StoreInt32(&m.relogin, 0)
+
+	logger.Info("mattermost session expired")
+
+	if !m.canRelogin() {
+		m.eventChan <- &bridge.Event{
+			Type: "session_expired",
+			Data: &bridge.SessionExpiredEvent{},
+		}
+
+		return
+	}
+
+	m.Logout()
+
+	_, err := m.loginToMattermost()
+	if err != nil {
+		logger.Error("login after session expiry failed: ", err)
+
+		m.eventChan <- &bridge.Event{
+			Type: "session_expired",
+			Data: &bridge.SessionExpiredEvent{Err: err},
+		}
+
+		return
+	}
+
+	m.mcMutex.RLock()
+	stop := m.quit
+	m.mcMutex.RUnlock()
+
+	go m.onWsConnect()
+	go m.sessionLoop(stop)
+
+	m.eventChan <- &bridge.Event{
+		Type: "session_expired",
+		Data: &bridge.SessionExpiredEvent{Restored: true},
+	}
+}
+
 func (m *Mattermost) MsgUser(username, text string) error {
 	props := make(map[string]interface{})
 
-	props["matterircd_"+m.mc.User.Id] = true
-	m.mc.SendDirectMessageProps(username, text, "", props)
+	props["matterircd_"+m.client().User.Id] = true
+	m.client().SendDirectMessageProps(username, text, "", props)
 
 	return nil
 }
 
 func (m *Mattermost) MsgChannel(channelID, text string) error {
 	props := make(map[string]interface{})
-	props["matterircd_"+m.mc.User.Id] = true
+	props["matterircd_"+m.client().User.Id] = true
 
 	post := &model.Post{ChannelId: channelID, Message: text, Props: props}
-	_, resp := m.mc.Client.CreatePost(post)
+	_, resp := m.client().Client.CreatePost(post)
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		go m.handleSessionExpired()
+		return errSessionExpired
+	}
 
 	if resp.Error != nil {
 		return resp.Error
@@ -279,7 +509,7 @@ func (m *Mattermost) MsgChannel(channelID, text string) error {
 }
 
 func (m *Mattermost) Topic(channelID string) string {
-	return m.mc.GetChannelHeader(channelID)
+	return m.client().GetChannelHeader(channelID)
 }
 
 func (m *Mattermost) SetTopic(channelID, text string) error {
@@ -288,7 +518,7 @@ func (m *Mattermost) SetTopic(channelID, text string) error {
 		Header: &text,
 	}
 
-	_, resp := m.mc.Client.PatchChannel(channelID, patch)
+	_, resp := m.client().Client.PatchChannel(channelID, patch)
 	if resp.Error != nil {
 		return resp.Error
 	}
@@ -297,19 +527,28 @@ func (m *Mattermost) SetTopic(channelID, text string) error {
 }
 
 func (m *Mattermost) StatusUser(userID string) (string, error) {
-	return m.mc.GetStatus(userID), nil
+	return m.client().GetStatus(userID), nil
 }
 
 func (m *Mattermost) StatusUsers() (map[string]string, error) {
-	return m.mc.GetStatuses(), nil
+	return m.client().GetStatuses(), nil
 }
 
 func (m *Mattermost) Protocol() string {
 	return "mattermost"
 }
 
+func (m *Mattermost) GetLimits() *bridge.Limits {
+	return &bridge.Limits{
+		NickLen:    model.USER_NAME_MAX_LENGTH,
+		ChannelLen: len("#/") + model.TEAM_NAME_MAX_LENGTH + model.CHANNEL_NAME_MAX_LENGTH,
+		TopicLen:   model.CHANNEL_HEADER_MAX_RUNES,
+		PostLen:    model.POST_MESSAGE_MAX_RUNES_V2,
+	}
+}
+
 func (m *Mattermost) Kick(channelID, username string) error {
-	_, resp := m.mc.Client.RemoveUserFromChannel(channelID, username)
+	_, resp := m.client().Client.RemoveUserFromChannel(channelID, username)
 	if resp.Error != nil {
 		return resp.Error
 	}
@@ -318,9 +557,9 @@ func (m *Mattermost) Kick(channelID, username string) error {
 }
 
 func (m *Mattermost) SetStatus(status string) error {
-	_, resp := m.mc.Client.UpdateUserStatus(m.mc.User.Id, &model.Status{
+	_, resp := m.client().Client.UpdateUserStatus(m.client().User.Id, &model.Status{
 		Status: status,
-		UserId: m.mc.User.Id,
+		UserId: m.client().User.Id,
 	})
 	if resp.Error != nil {
 		return resp.Error
@@ -329,26 +568,86 @@ func (m *Mattermost) SetStatus(status string) error {
 	return nil
 }
 
+// SetDND sets do not disturb with dnd_end_time, mattermost 5.37 and later turn it off at that time.
+func (m *Mattermost) SetDND(until time.Time) error {
+	status := map[string]interface{}{
+		"user_id": m.client().User.Id,
+		"status":  model.STATUS_DND,
+	}
+
+	if !until.IsZero() {
+		status["dnd_end_time"] = until.Unix()
+	}
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	resp, appErr := m.client().Client.DoApiPut(m.client().Client.GetUserStatusRoute(m.client().User.Id), string(data))
+	if appErr != nil {
+		return appErr
+	}
+
+	return resp.Body.Close()
+}
+
+// SetCustomStatus sets the custom status of mattermost 5.36 and later.
+func (m *Mattermost) SetCustomStatus(status *bridge.CustomStatus) error {
+	route := m.client().Client.GetUserRoute(m.client().User.Id) + "/status/custom"
+
+	if status == nil {
+		resp, appErr := m.client().Client.DoApiDelete(route)
+		if appErr != nil {
+			return appErr
+		}
+
+		return resp.Body.Close()
+	}
+
+	custom := &customStatus{
+		Emoji: status.Emoji,
+		Text:  status.Text,
+	}
+
+	if !status.ExpiresAt.IsZero() {
+		custom.Duration = "date_and_time"
+		custom.ExpiresAt = status.ExpiresAt.UTC()
+	}
+
+	data, err := json.Marshal(custom)
+	if err != nil {
+		return err
+	}
+
+	resp, appErr := m.client().Client.DoApiPut(route, string(data))
+	if appErr != nil {
+		return appErr
+	}
+
+	return resp.Body.Close()
+}
+
 func (m *Mattermost) Nick(name string) error {
-	return m.mc.UpdateUserNick(name)
+	return m.client().UpdateUserNick(name)
 }
 
 func (m *Mattermost) GetChannelName(channelID string) string {
 	var name string
 
-	channelName := m.mc.GetChannelName(channelID)
-	teamID := m.mc.GetTeamFromChannel(channelID)
-	teamName := m.mc.GetTeamName(teamID)
+	channelName := m.client().GetChannelName(channelID)
+	teamID := m.client().GetTeamFromChannel(channelID)
+	teamName := m.client().GetTeamName(teamID)
 
 	if channelName != "" {
-		if (teamName != "" && teamID != m.mc.Team.Id) || m.v.GetBool("mattermost.PrefixMainTeam") {
+		if (teamName != "" && teamID != m.client().Team.Id) || m.v.GetBool("mattermost.PrefixMainTeam") {
 			name = "#" + teamName + "/" + channelName
 		}
-		if teamID == m.mc.Team.Id && !m.v.GetBool("mattermost.PrefixMainTeam") {
+		if teamID == m.client().Team.Id && !m.v.GetBool("mattermost.PrefixMainTeam") {
 			name = "#" + channelName
 		}
-		if teamID == "G" {
-			name = "#" + channelName
+		if teamID == "G" && m.v.GetBool("mattermost.GroupChannelNames") {
+			name = m.groupChannelName(channelID)
 		}
 	} else {
 		name = channelID
@@ -366,13 +665,13 @@ func (m *Mattermost) GetChannelUsers(channelID string) ([]*bridge.UserInfo, erro
 	idx := 0
 	max := 200
 
-	mmusersPaged, resp := m.mc.Client.GetUsersInChannel(channelID, idx, max, "")
+	mmusersPaged, resp := m.client().Client.GetUsersInChannel(channelID, idx, max, "")
 	if resp.Error != nil {
 		return nil, resp.Error
 	}
 
 	for len(mmusersPaged) > 0 {
-		mmusersPaged, resp = m.mc.Client.GetUsersInChannel(channelID, idx, max, "")
+		mmusersPaged, resp = m.client().Client.GetUsersInChannel(channelID, idx, max, "")
 		if resp.Error != nil {
 			return nil, resp.Error
 		}
@@ -394,7 +693,7 @@ func (m *Mattermost) GetChannelUsers(channelID string) ([]*bridge.UserInfo, erro
 func (m *Mattermost) GetUsers() []*bridge.UserInfo {
 	var users []*bridge.UserInfo
 
-	for _, mmuser := range m.mc.GetUsers() {
+	for _, mmuser := range m.client().GetUsers() {
 		users = append(users, m.createUser(mmuser))
 	}
 
@@ -404,27 +703,376 @@ func (m *Mattermost) GetUsers() []*bridge.UserInfo {
 func (m *Mattermost) GetChannels() []*bridge.ChannelInfo {
 	var channels []*bridge.ChannelInfo
 
-	for _, mmchannel := range m.mc.GetChannels() {
+	for _, mmchannel := range m.client().GetChannels() {
 		channels = append(channels, &bridge.ChannelInfo{
-			Name:   mmchannel.Name,
-			ID:     mmchannel.Id,
-			TeamID: mmchannel.TeamId,
+			Name:     mmchannel.Name,
+			ID:       mmchannel.Id,
+			TeamID:   mmchannel.TeamId,
+			Muted:    m.isMuted(mmchannel.Id),
+			Favorite: m.isFavorite(mmchannel.Id),
 		})
 	}
 
 	return channels
 }
 
+func (m *Mattermost) GetChannel(channelID string) *bridge.ChannelInfo {
+	for _, mmchannel := range m.client().GetChannels() {
+		if mmchannel.Id != channelID {
+			continue
+		}
+
+		return &bridge.ChannelInfo{
+			Name:     mmchannel.Name,
+			ID:       mmchannel.Id,
+			TeamID:   mmchannel.TeamId,
+			Private:  mmchannel.Type == model.CHANNEL_PRIVATE,
+			Direct:   mmchannel.Type == model.CHANNEL_DIRECT || mmchannel.Type == model.CHANNEL_GROUP,
+			ReadOnly: mmchannel.DeleteAt > 0,
+			Muted:    m.isMuted(mmchannel.Id),
+			Favorite: m.isFavorite(mmchannel.Id),
+		}
+	}
+
+	return nil
+}
+
+// GetChannelMembers returns the members of a channel. Users and team roles are taken from caches so
+// syncing the modes of all channels at login doesn't do a request for every member.
+func (m *Mattermost) GetChannelMembers(channelID string) ([]*bridge.ChannelMember, error) {
+	var (
+		members []*bridge.ChannelMember
+		userIDs []string
+	)
+
+	max := 200
+
+	for page := 0; ; page++ {
+		mmmembers, resp := m.client().Client.GetChannelMembers(channelID, page, max, "")
+		if resp.Error != nil {
+			return nil, resp.Error
+		}
+
+		for _, mmmember := range *mmmembers {
+			member := &bridge.ChannelMember{
+				UserID: mmmember.UserId,
+				Admin:  mmmember.SchemeAdmin || strings.Contains(mmmember.Roles, model.CHANNEL_ADMIN_ROLE_ID),
+				Guest:  mmmember.SchemeGuest || strings.Contains(mmmember.Roles, model.CHANNEL_GUEST_ROLE_ID),
+			}
+
+			if mmuser := m.cachedUser(mmmember.UserId); mmuser != nil {
+				member.Bot = mmuser.IsBot
+				member.Admin = member.Admin || strings.Contains(mmuser.Roles, model.SYSTEM_ADMIN_ROLE_ID)
+			}
+
+			members = append(members, member)
+			userIDs = append(userIDs, mmmember.UserId)
+		}
+
+		if len(*mmmembers) < max {
+			break
+		}
+	}
+
+	// team admins are admins of all the channels of the team
+	info := m.GetChannel(channelID)
+	if info == nil || info.TeamID == "" || len(userIDs) == 0 {
+		return members, nil
+	}
+
+	teamAdmins := m.teamAdmins(info.TeamID, userIDs)
+
+	for _, member := range members {
+		member.Admin = member.Admin || teamAdmins[member.UserID]
+	}
+
+	return members, nil
+}
+
+// cachedUser returns a user from the cache of the client, unlike GetUser it never asks the server.
+func (m *Mattermost) cachedUser(userID string) *model.User {
+	mc := m.client()
+
+	mc.RLock()
+	defer mc.RUnlock()
+
+	return mc.Users[userID]
+}
+
+// teamAdmins returns which of the users are admins of the team, only the users we haven't seen
+// in the team before are requested.
+func (m *Mattermost) teamAdmins(teamID string, userIDs []string) map[string]bool {
+	m.teamRolesMutex.Lock()
+	defer m.teamRolesMutex.Unlock()
+
+	if m.teamRoles == nil {
+		m.teamRoles = make(map[string]map[string]bool)
+	}
+
+	roles, ok := m.teamRoles[teamID]
+	if !ok {
+		roles = make(map[string]bool)
+		m.teamRoles[teamID] = roles
+	}
+
+	var missing []string
+
+	for _, userID := range userIDs {
+		if _, ok := roles[userID]; !ok {
+			missing = append(missing, userID)
+		}
+	}
+
+	if len(missing) > 0 {
+		teamMembers, resp := m.client().Client.GetTeamMembersByIds(teamID, missing)
+		if resp.Error != nil {
+			logger.Debugf("getting team members of %s failed: %s", teamID, resp.Error)
+			return roles
+		}
+
+		// users who left the team aren't returned, they're no admin
+		for _, userID := range missing {
+			roles[userID] = false
+		}
+
+		for _, teamMember := range teamMembers {
+			roles[teamMember.UserId] = teamMember.SchemeAdmin || strings.Contains(teamMember.Roles, model.TEAM_ADMIN_ROLE_ID)
+		}
+	}
+
+	admins := make(map[string]bool)
+
+	for userID, admin := range roles {
+		if admin {
+			admins[userID] = true
+		}
+	}
+
+	return admins
+}
+
+// handleWsActionMemberRoleUpdated updates the cached team role of a user.
+func (m *Mattermost) handleWsActionMemberRoleUpdated(rmsg *model.WebSocketEvent) {
+	data, ok := rmsg.Data["member"].(string)
+	if !ok {
+		return
+	}
+
+	member := model.TeamMemberFromJson(strings.NewReader(data))
+	if member == nil {
+		return
+	}
+
+	m.teamRolesMutex.Lock()
+	if roles, ok := m.teamRoles[member.TeamId]; ok {
+		roles[member.UserId] = member.SchemeAdmin || strings.Contains(member.Roles, model.TEAM_ADMIN_ROLE_ID)
+	}
+	m.teamRolesMutex.Unlock()
+}
+
+// SetChannelAdmin only changes the admin role, a guest stays a guest.
+func (m *Mattermost) SetChannelAdmin(channelID, userID string, admin bool) error {
+	member, resp := m.client().Client.GetChannelMember(channelID, userID, "")
+	if resp.Error != nil {
+		return resp.Error
+	}
+
+	_, resp = m.client().Client.UpdateChannelMemberSchemeRoles(channelID, userID, &model.SchemeRoles{
+		SchemeAdmin: admin,
+		SchemeUser:  member.SchemeUser,
+		SchemeGuest: member.SchemeGuest,
+	})
+	if resp.Error != nil {
+		return resp.Error
+	}
+
+	return nil
+}
+
+// groupChannelName returns the IRC name of a group message channel built from the nicks of the members,
+// its display name has their usernames.
+func (m *Mattermost) groupChannelName(channelID string) string {
+	var nicks []string
+
+	for _, mmchannel := range m.client().GetChannels() {
+		if mmchannel.Id != channelID {
+			continue
+		}
+
+		for _, username := range strings.Split(mmchannel.DisplayName, ",") {
+			username = strings.TrimSpace(username)
+			if username != "" && username != m.client().User.Username {
+				nicks = append(nicks, m.nickOf(username))
+			}
+		}
+	}
+
+	return bridge.GroupChannelName(nicks)
+}
+
+// nickOf returns the nick of a user the way createUser makes it, the username when the user isn't cached.
+func (m *Mattermost) nickOf(username string) string {
+	var found *model.User
+
+	mc := m.client()
+
+	mc.RLock()
+	for _, mmuser := range mc.Users {
+		if mmuser.Username == username {
+			found = mmuser
+			break
+		}
+	}
+	mc.RUnlock()
+
+	if found == nil {
+		return username
+	}
+
+	return m.createUser(found).Nick
+}
+
+func (m *Mattermost) CreateGroup(userIDs []string) (string, error) {
+	mmchannel, resp := m.client().Client.CreateGroupChannel(append(userIDs, m.client().User.Id))
+	if resp.Error != nil {
+		return "", resp.Error
+	}
+
+	m.client().UpdateChannels()
+
+	return mmchannel.Id, nil
+}
+
+// MuteChannel mutes a channel the way the webapp does, only mentions mark it unread.
+func (m *Mattermost) MuteChannel(channelID string, mute bool) error {
+	markUnread := model.CHANNEL_MARK_UNREAD_ALL
+	if mute {
+		markUnread = model.CHANNEL_MARK_UNREAD_MENTION
+	}
+
+	_, resp := m.client().Client.UpdateChannelNotifyProps(channelID, m.client().User.Id, map[string]string{
+		model.MARK_UNREAD_NOTIFY_PROP: markUnread,
+	})
+	if resp.Error != nil {
+		return resp.Error
+	}
+
+	m.setMuted(channelID, mute)
+
+	return nil
+}
+
+func (m *Mattermost) FavoriteChannel(channelID string, favorite bool) error {
+	prefs := model.Preferences{{
+		UserId:   m.client().User.Id,
+		Category: model.PREFERENCE_CATEGORY_FAVORITE_CHANNEL,
+		Name:     channelID,
+		Value:    "true",
+	}}
+
+	var resp *model.Response
+
+	if favorite {
+		_, resp = m.client().Client.UpdatePreferences(m.client().User.Id, &prefs)
+	} else {
+		_, resp = m.client().Client.DeletePreferences(m.client().User.Id, &prefs)
+	}
+
+	if resp.Error != nil {
+		return resp.Error
+	}
+
+	m.setFavorite(channelID, favorite)
+
+	return nil
+}
+
+func (m *Mattermost) CreateChannel(channelName string, private bool) (string, error) {
+	teamID, channelName, err := m.teamChannel(channelName)
+	if err != nil {
+		return "", err
+	}
+
+	channelType := model.CHANNEL_OPEN
+	if private {
+		channelType = model.CHANNEL_PRIVATE
+	}
+
+	mmchannel, resp := m.client().Client.CreateChannel(&model.Channel{
+		TeamId:      teamID,
+		Name:        channelName,
+		DisplayName: channelName,
+		Type:        channelType,
+	})
+	if resp.Error != nil {
+		return "", resp.Error
+	}
+
+	m.client().UpdateChannels()
+
+	return mmchannel.Id, nil
+}
+
+func (m *Mattermost) RenameChannel(channelID, newName string) error {
+	_, resp := m.client().Client.PatchChannel(channelID, &model.ChannelPatch{
+		Name:        &newName,
+		DisplayName: &newName,
+	})
+	if resp.Error != nil {
+		return resp.Error
+	}
+
+	return m.client().UpdateChannels()
+}
+
+func (m *Mattermost) SetPurpose(channelID, text string) error {
+	_, resp := m.client().Client.PatchChannel(channelID, &model.ChannelPatch{
+		Purpose: &text,
+	})
+	if resp.Error != nil {
+		return resp.Error
+	}
+
+	return nil
+}
+
+func (m *Mattermost) ArchiveChannel(channelID string) error {
+	_, resp := m.client().Client.DeleteChannel(channelID)
+	if resp.Error != nil {
+		return resp.Error
+	}
+
+	return nil
+}
+
+func (m *Mattermost) UnarchiveChannel(channelName string) (string, error) {
+	teamID, channelName, err := m.teamChannel(channelName)
+	if err != nil {
+		return "", err
+	}
+
+	mmchannel, resp := m.client().Client.GetChannelByNameIncludeDeleted(channelName, teamID, "")
+	if resp.Error != nil {
+		return "", resp.Error
+	}
+
+	if _, resp = m.client().Client.RestoreChannel(mmchannel.Id); resp.Error != nil {
+		return "", resp.Error
+	}
+
+	return mmchannel.Id, m.client().UpdateChannels()
+}
+
 func (m *Mattermost) GetUser(userID string) *bridge.UserInfo {
-	return m.createUser(m.mc.GetUser(userID))
+	return m.createUser(m.client().GetUser(userID))
 }
 
 func (m *Mattermost) GetMe() *bridge.UserInfo {
-	return m.createUser(m.mc.User)
+	return m.createUser(m.client().User)
 }
 
 func (m *Mattermost) GetUserByUsername(username string) *bridge.UserInfo {
-	mmuser, resp := m.mc.Client.GetUserByUsername(username, "")
+	mmuser, resp := m.client().Client.GetUserByUsername(username, "")
 	if resp.Error != nil {
 		return &bridge.UserInfo{}
 	}
@@ -432,6 +1080,15 @@ func (m *Mattermost) GetUserByUsername(username string) *bridge.UserInfo {
 	return m.createUser(mmuser)
 }
 
+func (m *Mattermost) MentionUser(userID string) string {
+	mmuser := m.client().GetUser(userID)
+	if mmuser == nil {
+		return ""
+	}
+
+	return "@" + mmuser.Username
+}
+
 func (m *Mattermost) createUser(mmuser *model.User) *bridge.UserInfo {
 	teamID := ""
 
@@ -446,16 +1103,16 @@ func (m *Mattermost) createUser(mmuser *model.User) *bridge.UserInfo {
 
 	me := false
 
-	if mmuser.Id == m.mc.User.Id {
+	if mmuser.Id == m.client().User.Id {
 		me = true
-		teamID = m.mc.Team.Id
+		teamID = m.client().Team.Id
 	}
 
 	info := &bridge.UserInfo{
 		Nick:      nick,
 		User:      mmuser.Id,
 		Real:      mmuser.FirstName + " " + mmuser.LastName,
-		Host:      m.mc.Client.Url,
+		Host:      m.client().Client.Url,
 		Roles:     mmuser.Roles,
 		Ghost:     true,
 		Me:        me,
@@ -463,11 +1120,56 @@ func (m *Mattermost) createUser(mmuser *model.User) *bridge.UserInfo {
 		Username:  mmuser.Username,
 		FirstName: mmuser.FirstName,
 		LastName:  mmuser.LastName,
+
+		CustomStatus: userCustomStatus(mmuser),
 	}
 
 	return info
 }
 
+// customStatus is the custom status of mattermost 5.36, the model we vendor doesn't have it yet.
+type customStatus struct {
+	Emoji     string    `json:"emoji"`
+	Text      string    `json:"text"`
+	Duration  string    `json:"duration,omitempty"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+// userCustomStatus returns the custom status of a user, it's kept as JSON in the props.
+func userCustomStatus(mmuser *model.User) *bridge.CustomStatus {
+	data := mmuser.Props["customStatus"]
+	if data == "" {
+		return nil
+	}
+
+	var custom customStatus
+
+	if err := json.Unmarshal([]byte(data), &custom); err != nil {
+		logger.Debugf("invalid custom status of %s: %s", mmuser.Username, err)
+		return nil
+	}
+
+	if custom.Emoji == "" && custom.Text == "" {
+		return nil
+	}
+
+	// mattermost keeps expired statuses, the clients hide them
+	if !custom.ExpiresAt.IsZero() && custom.ExpiresAt.Before(time.Now()) {
+		return nil
+	}
+
+	status := &bridge.CustomStatus{
+		Emoji: custom.Emoji,
+		Text:  custom.Text,
+	}
+
+	if custom.Duration != "" && custom.Duration != "dont_clear" {
+		status.ExpiresAt = custom.ExpiresAt
+	}
+
+	return status
+}
+
 func isValidNick(s string) bool {
 	/* IRC RFC ([0] - see below) mentions a limit of 9 chars for
 	 * IRC nicks, but modern clients allow more than that. Let's
@@ -539,18 +1241,25 @@ func (m *Mattermost) handleWsActionPost(rmsg *model.WebSocketEvent) {
 		return
 	}
 
+	// before the parent message gets added to it
+	mention := rmsg.Event == model.WEBSOCKET_EVENT_POSTED && data.UserId != m.client().User.Id && m.isMention(data.Message, props)
+
 	// nolint:nestif
 	if data.ParentId != "" {
-		parentPost, resp := m.mc.Client.GetPost(data.ParentId, "")
+		parentPost, resp := m.client().Client.GetPost(data.ParentId, "")
 		if resp.Error != nil {
 			logger.Errorf("Unable to get parent post for %#v", data)
 		} else {
-			parentGhost := m.GetUser(parentPost.UserId)
-			if m.v.GetBool("mattermost.HideReplies") {
-				data.Message = fmt.Sprintf("%s (re @%s)", data.Message, parentGhost.Nick)
-			} else {
-				data.Message = fmt.Sprintf("%s (re @%s: %s)", data.Message, parentGhost.Nick, parentPost.Message)
+			reply := &bridge.TemplateData{
+				Message:    data.Message,
+				ParentNick: m.GetUser(parentPost.UserId).Nick,
+			}
+
+			if !m.settings.Bool(data.ChannelId, "HideReplies") {
+				reply.ParentMessage = parentPost.Message
 			}
+
+			data.Message = m.templates.Render(bridge.TemplateReply, data.ChannelId, reply)
 		}
 	}
 
@@ -621,7 +1330,7 @@ func (m *Mattermost) handleWsActionPost(rmsg *model.WebSocketEvent) {
 
 	// add an edited string when messages are edited
 	if len(msgs) > 0 && rmsg.Event == model.WEBSOCKET_EVENT_POST_EDITED {
-		msgs[len(msgs)-1] = msgs[len(msgs)-1] + " (edited)"
+		msgs[len(msgs)-1] = m.templates.Render(bridge.TemplateEdit, data.ChannelId, &bridge.TemplateData{Message: msgs[len(msgs)-1]})
 
 		// check if we have an edited direct message (channels have __)
 		name := m.GetChannelName(data.ChannelId)
@@ -664,6 +1373,7 @@ func (m *Mattermost) handleWsActionPost(rmsg *model.WebSocketEvent) {
 					MessageType: "notice",
 					ChannelType: channelType,
 					Files:       m.getFilesFromData(data),
+					Mention:     mention,
 				},
 			}
 
@@ -677,6 +1387,7 @@ func (m *Mattermost) handleWsActionPost(rmsg *model.WebSocketEvent) {
 					Sender:      ghost,
 					ChannelType: channelType,
 					Files:       m.getFilesFromData(data),
+					Mention:     mention,
 				},
 			}
 
@@ -686,19 +1397,67 @@ func (m *Mattermost) handleWsActionPost(rmsg *model.WebSocketEvent) {
 
 	m.handleFileEvent(channelType, ghost, data, props)
 
-	logger.Debugf("handleWsActionPost() user %s sent %s", m.mc.GetUser(data.UserId).Username, data.Message)
+	logger.Debugf("handleWsActionPost() user %s sent %s", m.client().GetUser(data.UserId).Username, data.Message)
 	logger.Debugf("%#v", data)
 
 	// updatelastviewed
-	if !m.v.GetBool("mattermost.DisableAutoView") {
-		m.mc.UpdateLastViewed(data.ChannelId)
+	if !m.settings.Bool(data.ChannelId, "DisableAutoView") {
+		m.client().UpdateLastViewed(data.ChannelId)
+	}
+}
+
+// isMention returns whether a post mentions us: mattermost sends the mentioned users along with a
+// post, we also look for the mention keys of the notification settings like the webapp does.
+func (m *Mattermost) isMention(text string, props map[string]interface{}) bool {
+	me := m.client().User
+
+	if mentions, ok := props["mentions"].(string); ok && strings.Contains(mentions, `"`+me.Id+`"`) {
+		return true
+	}
+
+	keys := []string{"@" + me.Username}
+
+	for _, key := range strings.Split(me.NotifyProps[model.MENTION_KEYS_NOTIFY_PROP], ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+
+	if me.NotifyProps[model.FIRST_NAME_NOTIFY_PROP] == "true" && me.FirstName != "" {
+		keys = append(keys, me.FirstName)
 	}
+
+	if me.NotifyProps[model.CHANNEL_MENTIONS_NOTIFY_PROP] != "false" {
+		keys = append(keys, "@channel", "@all", "@here")
+	}
+
+	return m.mentionRegexp(keys).MatchString(text)
+}
+
+// mentionRegexp returns the regexp matching the mention keys, it's only compiled again when they changed.
+func (m *Mattermost) mentionRegexp(keys []string) *regexp.Regexp {
+	quoted := make([]string, 0, len(keys))
+	for _, key := range keys {
+		quoted = append(quoted, regexp.QuoteMeta(key))
+	}
+
+	alternatives := strings.Join(quoted, "|")
+
+	m.mentionMutex.Lock()
+	defer m.mentionMutex.Unlock()
+
+	if m.mentionRe == nil || m.mentionKeys != alternatives {
+		m.mentionKeys = alternatives
+		m.mentionRe = regexp.MustCompile(`(?i)(^|[^\w@])(` + alternatives + `)($|\W)`)
+	}
+
+	return m.mentionRe
 }
 
 func (m *Mattermost) getFilesFromData(data *model.Post) []*bridge.File {
 	files := []*bridge.File{}
 
-	for _, fname := range m.mc.GetFileLinks(data.FileIds) {
+	for _, fname := range m.client().GetFileLinks(data.FileIds) {
 		files = append(files, &bridge.File{
 			Name: fname,
 		})
@@ -837,6 +1596,14 @@ func (m *Mattermost) handleWsActionUserUpdated(rmsg *model.WebSocketEvent) {
 		return
 	}
 
+	// keep the cache up to date, eg for the custom status
+	mc := m.client()
+	mc.Lock()
+	if _, ok := mc.Users[info.Id]; ok {
+		mc.Users[info.Id] = &info
+	}
+	mc.Unlock()
+
 	event := &bridge.Event{
 		Type: "user_updated",
 		Data: &bridge.UserUpdateEvent{
@@ -879,6 +1646,104 @@ func (m *Mattermost) handleWsActionChannelDeleted(rmsg *model.WebSocketEvent) {
 	m.eventChan <- event
 }
 
+func (m *Mattermost) handleWsActionChannelUpdated(rmsg *model.WebSocketEvent) {
+	channelID, ok := rmsg.Data["channel_id"].(string)
+
+	// channel_updated has the whole channel
+	if data, isChannel := rmsg.Data["channel"].(string); isChannel {
+		if mmchannel := model.ChannelFromJson(strings.NewReader(data)); mmchannel != nil {
+			channelID, ok = mmchannel.Id, true
+		}
+	}
+
+	if !ok {
+		return
+	}
+
+	m.settings.Forget(channelID)
+
+	event := &bridge.Event{
+		Type: "channel_update",
+		Data: &bridge.ChannelUpdateEvent{
+			ChannelID: channelID,
+		},
+	}
+
+	m.eventChan <- event
+}
+
+func (m *Mattermost) handleWsActionChannelMemberUpdated(rmsg *model.WebSocketEvent) {
+	data, ok := rmsg.Data["channelMember"].(string)
+	if !ok {
+		return
+	}
+
+	member := model.ChannelMemberFromJson(strings.NewReader(data))
+	if member == nil {
+		return
+	}
+
+	if member.UserId == m.client().User.Id {
+		m.setMuted(member.ChannelId, isMutedMember(member))
+	}
+
+	event := &bridge.Event{
+		Type: "channel_member_update",
+		Data: &bridge.ChannelMemberUpdateEvent{
+			ChannelID: member.ChannelId,
+			UserID:    member.UserId,
+		},
+	}
+
+	m.eventChan <- event
+}
+
+// handleWsActionChannelViewed passes on the channels we viewed, also on other devices.
+func (m *Mattermost) handleWsActionChannelViewed(rmsg *model.WebSocketEvent) {
+	channelID, ok := rmsg.Data["channel_id"].(string)
+	if !ok {
+		return
+	}
+
+	// the channel was viewed just now, asking the server would block the websocket loop
+	event := &bridge.Event{
+		Type: "channel_viewed",
+		Data: &bridge.ChannelViewedEvent{
+			ChannelID: channelID,
+			ViewedAt:  model.GetMillis(),
+		},
+	}
+
+	m.eventChan <- event
+}
+
+// handleWsActionPreferencesChanged keeps the favorite channels up to date.
+func (m *Mattermost) handleWsActionPreferencesChanged(rmsg *model.WebSocketEvent, deleted bool) {
+	var prefs model.Preferences
+
+	if data, ok := rmsg.Data["preferences"].(string); ok {
+		var err error
+
+		prefs, err = model.PreferencesFromJson(strings.NewReader(data))
+		if err != nil {
+			logger.Errorf("decoding preferences failed: %s", err)
+			return
+		}
+	}
+
+	if data, ok := rmsg.Data["preference"].(string); ok {
+		if pref := model.PreferenceFromJson(strings.NewReader(data)); pref != nil {
+			prefs = append(prefs, *pref)
+		}
+	}
+
+	for _, pref := range prefs {
+		if pref.Category == model.PREFERENCE_CATEGORY_FAVORITE_CHANNEL {
+			m.setFavorite(pref.Name, !deleted && pref.Value == "true")
+		}
+	}
+}
+
 func (m *Mattermost) handleStatusChangeEvent(rmsg *model.WebSocketEvent) {
 	var info model.Status
 
@@ -901,40 +1766,80 @@ func (m *Mattermost) handleStatusChangeEvent(rmsg *model.WebSocketEvent) {
 }
 
 func (m *Mattermost) GetTeamName(teamID string) string {
-	return m.mc.GetTeamName(teamID)
+	return m.client().GetTeamName(teamID)
 }
 
 func (m *Mattermost) GetLastViewedAt(channelID string) int64 {
-	return m.mc.GetLastViewedAt(channelID)
+	return m.client().GetLastViewedAt(channelID)
+}
+
+// GetUnread compares the message count of the channels with the one of our channel memberships.
+func (m *Mattermost) GetUnread() ([]*bridge.Unread, error) {
+	totals := make(map[string]int64)
+
+	for _, mmchannel := range m.client().GetChannels() {
+		totals[mmchannel.Id] = mmchannel.TotalMsgCount
+	}
+
+	var unread []*bridge.Unread
+
+	seen := make(map[string]bool)
+
+	for _, team := range m.client().OtherTeams {
+		members, resp := m.client().Client.GetChannelMembersForUser(m.client().User.Id, team.Id, "")
+		if resp.Error != nil {
+			return nil, resp.Error
+		}
+
+		// direct and group messages are members of every team
+		for _, member := range *members {
+			total, ok := totals[member.ChannelId]
+			if !ok || seen[member.ChannelId] {
+				continue
+			}
+
+			seen[member.ChannelId] = true
+
+			if total > member.MsgCount || member.MentionCount > 0 {
+				unread = append(unread, &bridge.Unread{
+					ChannelID: member.ChannelId,
+					Messages:  total - member.MsgCount,
+					Mentions:  member.MentionCount,
+				})
+			}
+		}
+	}
+
+	return unread, nil
 }
 
 func (m *Mattermost) GetPostsSince(channelID string, since int64) interface{} {
-	return m.mc.GetPostsSince(channelID, since)
+	return m.client().GetPostsSince(channelID, since)
 }
 
 func (m *Mattermost) UpdateLastViewed(channelID string) {
-	m.mc.UpdateLastViewed(channelID)
+	m.client().UpdateLastViewed(channelID)
 }
 
 func (m *Mattermost) UpdateLastViewedUser(userID string) error {
-	dc, resp := m.mc.Client.CreateDirectChannel(m.mc.User.Id, userID)
+	dc, resp := m.client().Client.CreateDirectChannel(m.client().User.Id, userID)
 	if resp.Error != nil {
 		return resp.Error
 	}
 
-	return m.mc.UpdateLastViewed(dc.Id)
+	return m.client().UpdateLastViewed(dc.Id)
 }
 
 func (m *Mattermost) SearchPosts(search string) interface{} {
-	return m.mc.SearchPosts(search)
+	return m.client().SearchPosts(search)
 }
 
 func (m *Mattermost) GetFileLinks(fileIDs []string) []string {
-	return m.mc.GetFileLinks(fileIDs)
+	return m.client().GetFileLinks(fileIDs)
 }
 
 func (m *Mattermost) SearchUsers(query string) ([]*bridge.UserInfo, error) {
-	users, resp := m.mc.Client.SearchUsers(&model.UserSearch{Term: query})
+	users, resp := m.client().Client.SearchUsers(&model.UserSearch{Term: query})
 	if resp.Error != nil {
 		return nil, resp.Error
 	}
@@ -949,11 +1854,11 @@ func (m *Mattermost) SearchUsers(query string) ([]*bridge.UserInfo, error) {
 }
 
 func (m *Mattermost) GetPosts(channelID string, limit int) interface{} {
-	return m.mc.GetPosts(channelID, limit)
+	return m.client().GetPosts(channelID, limit)
 }
 
 func (m *Mattermost) GetChannelID(name, teamID string) string {
-	return m.mc.GetChannelId(name, teamID)
+	return m.client().GetChannelId(name, teamID)
 }
 
 func Decode(input interface{}, output interface{}) error {
@@ -970,3 +1875,99 @@ func Decode(input interface{}, output interface{}) error {
 
 	return decoder.Decode(input)
 }
+
+// loadChannelPrefs gets the muted and favorite channels of the logged in user.
+func (m *Mattermost) loadChannelPrefs() {
+	muted := make(map[string]bool)
+	favorites := make(map[string]bool)
+
+	for _, team := range m.client().OtherTeams {
+		members, resp := m.client().Client.GetChannelMembersForUser(m.client().User.Id, team.Id, "")
+		if resp.Error != nil {
+			logger.Errorf("getting channel members of team %s failed: %s", team.Id, resp.Error)
+			continue
+		}
+
+		for i := range *members {
+			member := (*members)[i]
+			muted[member.ChannelId] = isMutedMember(&member)
+		}
+	}
+
+	prefs, resp := m.client().Client.GetPreferencesByCategory(m.client().User.Id, model.PREFERENCE_CATEGORY_FAVORITE_CHANNEL)
+	if resp.Error != nil {
+		logger.Errorf("getting favorite channels failed: %s", resp.Error)
+	}
+
+	for _, pref := range prefs {
+		favorites[pref.Name] = pref.Value == "true"
+	}
+
+	m.prefsMutex.Lock()
+	m.muted = muted
+	m.favorites = favorites
+	m.prefsMutex.Unlock()
+}
+
+func isMutedMember(member *model.ChannelMember) bool {
+	return member.NotifyProps[model.MARK_UNREAD_NOTIFY_PROP] == model.CHANNEL_MARK_UNREAD_MENTION
+}
+
+func (m *Mattermost) isMuted(channelID string) bool {
+	m.prefsMutex.RLock()
+	defer m.prefsMutex.RUnlock()
+
+	return m.muted[channelID]
+}
+
+func (m *Mattermost) isFavorite(channelID string) bool {
+	m.prefsMutex.RLock()
+	defer m.prefsMutex.RUnlock()
+
+	return m.favorites[channelID]
+}
+
+// setMuted updates whether a channel is muted and sends a channel_prefs event when it changed.
+func (m *Mattermost) setMuted(channelID string, muted bool) {
+	m.setChannelPrefs(channelID, func() bool {
+		changed := m.muted[channelID] != muted
+		m.muted[channelID] = muted
+
+		return changed
+	})
+}
+
+// setFavorite updates whether a channel is a favorite and sends a channel_prefs event when it changed.
+func (m *Mattermost) setFavorite(channelID string, favorite bool) {
+	m.setChannelPrefs(channelID, func() bool {
+		changed := m.favorites[channelID] != favorite
+		m.favorites[channelID] = favorite
+
+		return changed
+	})
+}
+
+func (m *Mattermost) setChannelPrefs(channelID string, update func() bool) {
+	m.prefsMutex.Lock()
+
+	if m.muted == nil {
+		m.muted = make(map[string]bool)
+		m.favorites = make(map[string]bool)
+	}
+
+	changed := update()
+	event := &bridge.Event{
+		Type: "channel_prefs",
+		Data: &bridge.ChannelPrefsEvent{
+			ChannelID: channelID,
+			Muted:     m.muted[channelID],
+			Favorite:  m.favorites[channelID],
+		},
+	}
+
+	m.prefsMutex.Unlock()
+
+	if changed {
+		m.eventChan <- event
+	}
+}
@@ -0,0 +1,400 @@
+package mattermost
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/42wim/matterbridge/matterclient"
+	"github.com/42wim/matterircd/bridge"
+	"github.com/gorilla/websocket"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+const sessionExpiredError = `{"id": "api.context.session_expired.app_error", "message": "Invalid or expired session", "status_code": 401}`
+
+// fakeServer is a mattermost server with a single user and team, revoke invalidates the sessions.
+type fakeServer struct {
+	*httptest.Server
+
+	sync.Mutex
+	password string
+	token    string
+	logins   int
+	lookups  [][]string
+	joined   []string
+	// writes are the requests which change the channel preferences or roles, with their body
+	writes []string
+}
+
+func newFakeServer() *fakeServer {
+	fs := &fakeServer{password: "secret"}
+	fs.Server = httptest.NewServer(http.HandlerFunc(fs.handle))
+
+	return fs
+}
+
+// revoke invalidates the session, the password is used for the next login.
+func (fs *fakeServer) revoke(password string) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	fs.password = password
+	fs.token = ""
+}
+
+func (fs *fakeServer) handle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Version-Id", "5.30.0")
+
+	fs.Lock()
+	defer fs.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/v4")
+
+	switch path {
+	case "/users/logout":
+		w.Write([]byte(`{"status": "OK"}`))
+		return
+	case "/users/login":
+		var req map[string]string
+
+		json.NewDecoder(r.Body).Decode(&req)
+
+		if req["password"] != fs.password {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"id": "api.user.login.invalid_credentials", "message": "Enter a valid email or username and/or password.", "status_code": 401}`))
+
+			return
+		}
+
+		fs.logins++
+		fs.token = fmt.Sprintf("token%d", fs.logins)
+
+		w.Header().Set("Token", fs.token)
+		w.Write([]byte(`{"id": "u1", "username": "alice"}`))
+
+		return
+	}
+
+	if fs.token == "" || r.Header.Get("Authorization") != "BEARER "+fs.token {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(sessionExpiredError))
+
+		return
+	}
+
+	switch {
+	case path == "/websocket":
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		go func() {
+			for {
+				if _, _, err := ws.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+	case path == "/teams/t1/members/ids":
+		var ids []string
+
+		json.NewDecoder(r.Body).Decode(&ids)
+
+		fs.lookups = append(fs.lookups, ids)
+
+		w.Write([]byte(`[{"team_id": "t1", "user_id": "u1", "roles": "team_user team_admin"},
+			{"team_id": "t1", "user_id": "u2", "roles": "team_user"}]`))
+	case strings.HasPrefix(path, "/teams/t1/channels/name/"):
+		switch strings.TrimPrefix(path, "/teams/t1/channels/name/") {
+		case "general":
+			w.Write([]byte(`{"id": "c1", "team_id": "t1", "name": "general", "type": "O"}`))
+		case "secret":
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"id": "api.context.permissions.app_error", "status_code": 403}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"id": "store.sql_channel.get_by_name.missing.app_error", "status_code": 404}`))
+		}
+	case path == "/channels/c1/members":
+		fs.joined = append(fs.joined, "c1")
+
+		w.Write([]byte(`{"channel_id": "c1", "user_id": "u1"}`))
+	case path == "/users/u1/teams/t1/channels/members":
+		w.Write([]byte(`[{"channel_id": "c1", "user_id": "u1", "notify_props": {"mark_unread": "mention"}},
+			{"channel_id": "c2", "user_id": "u1", "notify_props": {"mark_unread": "all"}}]`))
+	case path == "/users/u1/preferences/favorite_channel":
+		w.Write([]byte(`[{"user_id": "u1", "category": "favorite_channel", "name": "c2", "value": "true"}]`))
+	case path == "/channels/c1/members/u2":
+		w.Write([]byte(`{"channel_id": "c1", "user_id": "u2", "scheme_guest": true}`))
+	case path == "/channels/c1/members/u1/notify_props", path == "/channels/c1/members/u2/schemeRoles",
+		strings.HasPrefix(path, "/users/u1/preferences"):
+		body, _ := ioutil.ReadAll(r.Body)
+
+		fs.writes = append(fs.writes, r.Method+" "+path+" "+string(body))
+
+		w.Write([]byte(`{"status": "OK"}`))
+	case path == "/users/me":
+		w.Write([]byte(`{"id": "u1", "username": "alice"}`))
+	case path == "/users/u1/teams":
+		w.Write([]byte(`[{"id": "t1", "name": "team"}]`))
+	case path == "/users" && r.URL.Query().Get("page") == "0":
+		w.Write([]byte(`[{"id": "u1", "username": "alice"}]`))
+	default:
+		w.Write([]byte(`[]`))
+	}
+}
+
+func newTestMattermost(t *testing.T, fs *fakeServer, eventChan chan *bridge.Event) *Mattermost {
+	v := viper.New()
+	v.Set("mattermost.Insecure", true)
+
+	br, _, err := New(bridge.NewConfig(v), bridge.Credentials{
+		Server: strings.TrimPrefix(fs.URL, "http://"),
+		Team:   "team",
+		Login:  "alice",
+		Pass:   "secret",
+	}, eventChan, func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return br.(*Mattermost)
+}
+
+func TestSessionExpired(t *testing.T) {
+	sessionCheckInterval = 50 * time.Millisecond
+
+	fs := newFakeServer()
+	defer fs.Close()
+
+	eventChan := make(chan *bridge.Event, 10)
+
+	m := newTestMattermost(t, fs, eventChan)
+	old := m.client()
+
+	expired := func() *bridge.SessionExpiredEvent {
+		select {
+		case event := <-eventChan:
+			return event.Data.(*bridge.SessionExpiredEvent)
+		case <-time.After(5 * time.Second):
+			t.Fatal("session expiry not detected")
+		}
+
+		return nil
+	}
+
+	// the session is revoked, we login again with the same password
+	fs.revoke("secret")
+	assert.Equal(t, &bridge.SessionExpiredEvent{Restored: true}, expired())
+	assert.True(t, old != m.client())
+	assert.Equal(t, "token2", m.client().Client.AuthToken)
+
+	// the password was changed, irckit has to log us out
+	fs.revoke("changed")
+	event := expired()
+	assert.False(t, event.Restored)
+	assert.Error(t, event.Err)
+
+	assert.NoError(t, m.Logout())
+}
+
+func TestTeamAdmins(t *testing.T) {
+	fs := newFakeServer()
+	defer fs.Close()
+
+	m := newTestMattermost(t, fs, make(chan *bridge.Event, 10))
+	defer m.Logout()
+
+	assert.Equal(t, map[string]bool{"u1": true}, m.teamAdmins("t1", []string{"u1", "u2", "u3"}))
+	assert.Equal(t, map[string]bool{"u1": true}, m.teamAdmins("t1", []string{"u1", "u2"}))
+
+	// u4 is the only user we haven't seen yet
+	m.teamAdmins("t1", []string{"u1", "u4"})
+
+	fs.Lock()
+	assert.Equal(t, [][]string{{"u1", "u2", "u3"}, {"u4"}}, fs.lookups)
+	fs.Unlock()
+
+	m.handleWsActionMemberRoleUpdated(&model.WebSocketEvent{Data: map[string]interface{}{
+		"member": `{"team_id": "t1", "user_id": "u2", "roles": "team_user team_admin"}`,
+	}})
+	assert.Equal(t, map[string]bool{"u1": true, "u2": true}, m.teamAdmins("t1", []string{"u2"}))
+}
+
+func TestJoin(t *testing.T) {
+	fs := newFakeServer()
+	defer fs.Close()
+
+	m := newTestMattermost(t, fs, make(chan *bridge.Event, 10))
+	defer m.Logout()
+
+	id, _, err := m.Join("general")
+	assert.NoError(t, err)
+	assert.Equal(t, "c1", id)
+
+	fs.Lock()
+	assert.Equal(t, []string{"c1"}, fs.joined)
+	fs.Unlock()
+
+	_, _, err = m.Join("missing")
+	assert.Equal(t, bridge.ErrNoSuchChannel, err)
+
+	// we may not see it, that doesn't mean it can be created
+	_, _, err = m.Join("secret")
+	assert.Error(t, err)
+	assert.NotEqual(t, bridge.ErrNoSuchChannel, err)
+}
+
+func TestSetChannelAdmin(t *testing.T) {
+	fs := newFakeServer()
+	defer fs.Close()
+
+	m := newTestMattermost(t, fs, make(chan *bridge.Event, 10))
+	defer m.Logout()
+
+	// u2 is a guest
+	assert.NoError(t, m.SetChannelAdmin("c1", "u2", true))
+	assert.NoError(t, m.SetChannelAdmin("c1", "u2", false))
+
+	fs.Lock()
+	assert.Equal(t, []string{
+		`PUT /channels/c1/members/u2/schemeRoles {"scheme_admin":true,"scheme_user":false,"scheme_guest":true}`,
+		`PUT /channels/c1/members/u2/schemeRoles {"scheme_admin":false,"scheme_user":false,"scheme_guest":true}`,
+	}, fs.writes)
+	fs.Unlock()
+}
+
+func TestIsMention(t *testing.T) {
+	m := &Mattermost{mc: &matterclient.MMClient{User: &model.User{
+		Id:          "u1",
+		Username:    "alice",
+		FirstName:   "Alice",
+		NotifyProps: model.StringMap{model.MENTION_KEYS_NOTIFY_PROP: "deploy, c++"},
+	}}}
+
+	assert.True(t, m.isMention("@alice: ping", nil))
+	assert.True(t, m.isMention("who broke the Deploy?", nil))
+	assert.True(t, m.isMention("c++ question", nil))
+	assert.True(t, m.isMention("hi @here", nil))
+	assert.True(t, m.isMention("hi", map[string]interface{}{"mentions": `["u1"]`}))
+	assert.False(t, m.isMention("@alicex deployment", nil))
+	assert.False(t, m.isMention("hi Alice", nil))
+
+	// the regexp is only compiled again when the keys change
+	re := m.mentionRe
+	m.isMention("hi", nil)
+	assert.True(t, re == m.mentionRe)
+
+	m.mc.User.NotifyProps[model.FIRST_NAME_NOTIFY_PROP] = "true"
+	assert.True(t, m.isMention("hi Alice", nil))
+	assert.False(t, re == m.mentionRe)
+}
+
+func TestChannelViewed(t *testing.T) {
+	eventChan := make(chan *bridge.Event, 1)
+	m := &Mattermost{eventChan: eventChan}
+
+	before := model.GetMillis()
+
+	m.handleWsActionChannelViewed(&model.WebSocketEvent{Data: map[string]interface{}{"channel_id": "c1"}})
+
+	viewed := (<-eventChan).Data.(*bridge.ChannelViewedEvent)
+	assert.Equal(t, "c1", viewed.ChannelID)
+	assert.GreaterOrEqual(t, viewed.ViewedAt, before)
+}
+
+// channelPrefs returns the next channel_prefs event.
+func channelPrefs(t *testing.T, eventChan chan *bridge.Event) *bridge.ChannelPrefsEvent {
+	for {
+		select {
+		case event := <-eventChan:
+			if prefs, ok := event.Data.(*bridge.ChannelPrefsEvent); ok {
+				return prefs
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no channel_prefs event")
+		}
+	}
+}
+
+func TestChannelPrefs(t *testing.T) {
+	fs := newFakeServer()
+	defer fs.Close()
+
+	eventChan := make(chan *bridge.Event, 10)
+
+	m := newTestMattermost(t, fs, eventChan)
+	defer m.Logout()
+
+	// loaded on login
+	assert.True(t, m.isMuted("c1"))
+	assert.False(t, m.isMuted("c2"))
+	assert.False(t, m.isFavorite("c1"))
+	assert.True(t, m.isFavorite("c2"))
+
+	assert.NoError(t, m.MuteChannel("c1", false))
+	assert.Equal(t, &bridge.ChannelPrefsEvent{ChannelID: "c1"}, channelPrefs(t, eventChan))
+
+	assert.NoError(t, m.MuteChannel("c1", true))
+	assert.Equal(t, &bridge.ChannelPrefsEvent{ChannelID: "c1", Muted: true}, channelPrefs(t, eventChan))
+
+	assert.NoError(t, m.FavoriteChannel("c1", true))
+	assert.Equal(t, &bridge.ChannelPrefsEvent{ChannelID: "c1", Muted: true, Favorite: true}, channelPrefs(t, eventChan))
+
+	assert.NoError(t, m.FavoriteChannel("c1", false))
+	assert.Equal(t, &bridge.ChannelPrefsEvent{ChannelID: "c1", Muted: true}, channelPrefs(t, eventChan))
+
+	fav := `[{"user_id":"u1","category":"favorite_channel","name":"c1","value":"true"}]`
+
+	fs.Lock()
+	assert.Equal(t, []string{
+		`PUT /channels/c1/members/u1/notify_props {"mark_unread":"all"}`,
+		`PUT /channels/c1/members/u1/notify_props {"mark_unread":"mention"}`,
+		"PUT /users/u1/preferences " + fav,
+		"POST /users/u1/preferences/delete " + fav,
+	}, fs.writes)
+	fs.Unlock()
+
+	// changed in the webapp
+	m.handleWsActionChannelMemberUpdated(&model.WebSocketEvent{Data: map[string]interface{}{
+		"channelMember": `{"channel_id": "c2", "user_id": "u1", "notify_props": {"mark_unread": "mention"}}`,
+	}})
+	assert.Equal(t, &bridge.ChannelPrefsEvent{ChannelID: "c2", Muted: true, Favorite: true}, channelPrefs(t, eventChan))
+
+	// other members don't change our prefs
+	m.handleWsActionChannelMemberUpdated(&model.WebSocketEvent{Data: map[string]interface{}{
+		"channelMember": `{"channel_id": "c2", "user_id": "u2", "notify_props": {"mark_unread": "all"}}`,
+	}})
+	assert.True(t, m.isMuted("c2"))
+
+	m.handleWsActionPreferencesChanged(&model.WebSocketEvent{Data: map[string]interface{}{
+		"preferences": `[{"user_id": "u1", "category": "favorite_channel", "name": "c2", "value": "true"}]`,
+	}}, true)
+	assert.Equal(t, &bridge.ChannelPrefsEvent{ChannelID: "c2", Muted: true}, channelPrefs(t, eventChan))
+
+	m.handleWsActionPreferencesChanged(&model.WebSocketEvent{Data: map[string]interface{}{
+		"preference": `{"user_id": "u1", "category": "favorite_channel", "name": "c1", "value": "true"}`,
+	}}, false)
+	assert.Equal(t, &bridge.ChannelPrefsEvent{ChannelID: "c1", Muted: true, Favorite: true}, channelPrefs(t, eventChan))
+
+	// unchanged, no event
+	m.handleWsActionPreferencesChanged(&model.WebSocketEvent{Data: map[string]interface{}{
+		"preference": `{"user_id": "u1", "category": "favorite_channel", "name": "c1", "value": "true"}`,
+	}}, false)
+
+	for len(eventChan) > 0 {
+		if _, ok := (<-eventChan).Data.(*bridge.ChannelPrefsEvent); ok {
+			t.Fatal("unexpected channel_prefs event")
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package mattermost
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net/http"
+	"time"
+
+	"github.com/42wim/matterbridge/matterclient"
+	"github.com/gorilla/websocket"
+	"github.com/jpillora/backoff"
+	"github.com/mattermost/mattermost-server/v5/model"
+	logger "github.com/sirupsen/logrus"
+)
+
+// wsPingInterval is how often we ping the websocket, without anything read for two
+// intervals we connect again.
+var wsPingInterval = 30 * time.Second
+
+// wsReceiver reads the websocket of a client into its MessageChan until quit is closed,
+// reconnecting when it breaks. It replaces WsReceiver and StatusLoop of matterclient, which
+// keep running after Logout and share the fields of the client without locks.
+func (m *Mattermost) wsReceiver(mc *matterclient.MMClient, quit chan struct{}) {
+	b := &backoff.Backoff{
+		Min:    time.Second,
+		Max:    5 * time.Minute,
+		Jitter: true,
+	}
+
+	// Login already connected
+	ws := mc.WsClient
+
+	for {
+		if ws != nil {
+			readWs(mc, ws, quit)
+		}
+
+		select {
+		case <-quit:
+			logger.Debug("exiting wsReceiver")
+			return
+		default:
+		}
+
+		var err error
+
+		ws, err = dialWs(mc)
+		if err == nil {
+			b.Reset()
+			continue
+		}
+
+		dur := b.Duration()
+		logger.Errorf("mattermost websocket connection failed: %s, reconnecting in %s", err, dur)
+
+		select {
+		case <-quit:
+			logger.Debug("exiting wsReceiver")
+			return
+		case <-time.After(dur):
+		}
+	}
+}
+
+func dialWs(mc *matterclient.MMClient) (*websocket.Conn, error) {
+	scheme := "wss://"
+	if mc.Credentials.NoTLS {
+		scheme = "ws://"
+	}
+
+	dialer := &websocket.Dialer{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: mc.Credentials.SkipTLSVerify}, //nolint:gosec
+		Proxy:           http.ProxyFromEnvironment,
+	}
+
+	header := http.Header{}
+	header.Set(model.HEADER_AUTH, "BEARER "+mc.Client.AuthToken)
+
+	ws, _, err := dialer.Dial(scheme+mc.Credentials.Server+model.API_URL_SUFFIX_V4+"/websocket", header)
+
+	return ws, err
+}
+
+// readWs reads the events of ws until it breaks or quit is closed, it closes ws.
+func readWs(mc *matterclient.MMClient, ws *websocket.Conn, quit chan struct{}) {
+	done := make(chan struct{})
+	defer close(done)
+
+	// pinging, and closing ws to stop the read below
+	go func() {
+		ticker := time.NewTicker(wsPingInterval)
+		defer ticker.Stop()
+		defer ws.Close()
+
+		for seq := int64(1); ; seq++ {
+			select {
+			case <-quit:
+				return
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := ws.WriteJSON(&model.WebSocketRequest{Seq: seq, Action: "ping"}); err != nil {
+					logger.Debugf("mattermost websocket ping failed: %s", err)
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		ws.SetReadDeadline(time.Now().Add(2 * wsPingInterval))
+
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			logger.Debugf("mattermost websocket read error: %s", err)
+			return
+		}
+
+		// responses, eg to our pings, aren't events
+		event := model.WebSocketEventFromJson(bytes.NewReader(data))
+		if event == nil || !event.IsValid() {
+			continue
+		}
+
+		select {
+		case mc.MessageChan <- &matterclient.Message{Raw: event, Team: mc.Credentials.Team}:
+		case <-quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package rocketchat
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// api is a minimal client for the Rocket.Chat REST API.
+type api struct {
+	url    string
+	userID string
+	token  string
+	client *http.Client
+}
+
+type apiResponse struct {
+	Success bool   `json:"success"`
+	Status  string `json:"status"`
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+func newAPI(server string, insecure, skipTLSVerify bool) *api {
+	scheme := "https://"
+	if insecure {
+		scheme = "http://"
+	}
+
+	if strings.HasPrefix(server, "http://") || strings.HasPrefix(server, "https://") {
+		scheme = ""
+	}
+
+	return &api{
+		url: strings.TrimSuffix(scheme+server, "/"),
+		client: &http.Client{
+			Timeout: time.Second * 10,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: skipTLSVerify}, //nolint:gosec
+				Proxy:           http.ProxyFromEnvironment,
+			},
+		},
+	}
+}
+
+func (a *api) do(method, path string, query url.Values, in, out interface{}) error {
+	var body []byte
+
+	if in != nil {
+		var err error
+
+		body, err = json.Marshal(in)
+		if err != nil {
+			return err
+		}
+	}
+
+	u := a.url + "/api/v1/" + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if a.token != "" {
+		req.Header.Set("X-User-Id", a.userID)
+		req.Header.Set("X-Auth-Token", a.token)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var status apiResponse
+
+	// not every endpoint returns json on errors (eg a 404 from a proxy)
+	if err := json.Unmarshal(data, &status); err != nil {
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+
+	if resp.StatusCode != http.StatusOK || (!status.Success && status.Status != "success") {
+		switch {
+		case status.Error != "":
+			return errors.New(status.Error)
+		case status.Message != "":
+			return errors.New(status.Message)
+		}
+
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.Unmarshal(data, out)
+}
+
+func (a *api) get(path string, query url.Values, out interface{}) error {
+	return a.do(http.MethodGet, path, query, nil, out)
+}
+
+func (a *api) post(path string, in, out interface{}) error {
+	return a.do(http.MethodPost, path, nil, in, out)
+}
+
+// rcTime handles both the ISO dates of the REST API and the {"$date": ms} dates of the realtime API.
+type rcTime struct {
+	time.Time
+}
+
+func (t *rcTime) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+
+		ts, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return err
+		}
+
+		t.Time = ts
+
+		return nil
+	}
+
+	var d struct {
+		Date int64 `json:"$date"`
+	}
+
+	if err := json.Unmarshal(b, &d); err != nil {
+		return err
+	}
+
+	t.Time = time.Unix(0, d.Date*int64(time.Millisecond))
+
+	return nil
+}
+
+// millis returns the time in milliseconds since epoch, which is what the bridge interface uses.
+func (t rcTime) millis() int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+type rcUser struct {
+	ID       string   `json:"_id"`
+	Username string   `json:"username"`
+	Name     string   `json:"name"`
+	Nickname string   `json:"nickname"`
+	Status   string   `json:"status"`
+	Roles    []string `json:"roles"`
+}
+
+type rcRoom struct {
+	ID        string   `json:"_id"`
+	Type      string   `json:"t"`
+	Name      string   `json:"name"`
+	FName     string   `json:"fname"`
+	Topic     string   `json:"topic"`
+	Usernames []string `json:"usernames"`
+	UIDs      []string `json:"uids"`
+	ReadOnly  bool     `json:"ro"`
+	Archived  bool     `json:"archived"`
+}
+
+type rcSubscription struct {
+	RoomID   string `json:"rid"`
+	Name     string `json:"name"`
+	Type     string `json:"t"`
+	LastSeen rcTime `json:"ls"`
+	Open     bool   `json:"open"`
+	Unread   int    `json:"unread"`
+
+	UserMentions int `json:"userMentions"`
+}
+
+type rcAttachment struct {
+	Title     string `json:"title"`
+	TitleLink string `json:"title_link"`
+	Text      string `json:"text"`
+}
+
+type rcFile struct {
+	ID   string `json:"_id"`
+	Name string `json:"name"`
+}
+
+type rcMessage struct {
+	ID          string          `json:"_id"`
+	RoomID      string          `json:"rid"`
+	Msg         string          `json:"msg"`
+	Type        string          `json:"t"`
+	TS          rcTime          `json:"ts"`
+	User        rcUser          `json:"u"`
+	EditedAt    *rcTime         `json:"editedAt"`
+	ThreadID    string          `json:"tmid"`
+	Alias       string          `json:"alias"`
+	Attachments []*rcAttachment `json:"attachments"`
+	File        *rcFile         `json:"file"`
+}
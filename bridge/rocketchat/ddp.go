@@ -0,0 +1,223 @@
+package rocketchat
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jpillora/backoff"
+	logger "github.com/sirupsen/logrus"
+)
+
+// ddpMessage is a message of the meteor DDP protocol, which is what the Rocket.Chat realtime API speaks.
+type ddpMessage struct {
+	Msg        string          `json:"msg"`
+	ID         string          `json:"id,omitempty"`
+	Version    string          `json:"version,omitempty"`
+	Support    []string        `json:"support,omitempty"`
+	Method     string          `json:"method,omitempty"`
+	Name       string          `json:"name,omitempty"`
+	Params     []interface{}   `json:"params,omitempty"`
+	Collection string          `json:"collection,omitempty"`
+	Fields     json.RawMessage `json:"fields,omitempty"`
+	Error      json.RawMessage `json:"error,omitempty"`
+}
+
+type ddpStreamFields struct {
+	EventName string            `json:"eventName"`
+	Args      []json.RawMessage `json:"args"`
+}
+
+type ddpSubscription struct {
+	name   string
+	params []interface{}
+}
+
+// ddp keeps a realtime connection to Rocket.Chat, reconnecting and resubscribing when it drops.
+type ddp struct {
+	url     string
+	token   string
+	dialer  *websocket.Dialer
+	handler func(*ddpMessage)
+
+	mu   sync.Mutex
+	ws   *websocket.Conn
+	id   int
+	subs []*ddpSubscription
+	quit bool
+}
+
+func newDDP(apiURL, token string, skipTLSVerify bool, handler func(*ddpMessage)) *ddp {
+	wsURL := strings.Replace(apiURL, "http", "ws", 1) + "/websocket"
+
+	return &ddp{
+		url:     wsURL,
+		token:   token,
+		handler: handler,
+		dialer: &websocket.Dialer{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: skipTLSVerify}, //nolint:gosec
+			Proxy:           http.ProxyFromEnvironment,
+		},
+	}
+}
+
+func (d *ddp) nextID() string {
+	d.id++
+	return strconv.Itoa(d.id)
+}
+
+func (d *ddp) send(msg *ddpMessage) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.ws == nil {
+		return errors.New("not connected")
+	}
+
+	if msg.ID == "" && (msg.Msg == "method" || msg.Msg == "sub") {
+		msg.ID = d.nextID()
+	}
+
+	return d.ws.WriteJSON(msg)
+}
+
+// subscribe adds a stream subscription, which will also be restored on reconnects.
+func (d *ddp) subscribe(name string, params ...interface{}) error {
+	d.mu.Lock()
+	d.subs = append(d.subs, &ddpSubscription{name: name, params: params})
+	connected := d.ws != nil
+	d.mu.Unlock()
+
+	// not connected yet, connect sends it
+	if !connected {
+		return nil
+	}
+
+	return d.send(&ddpMessage{Msg: "sub", Name: name, Params: params})
+}
+
+// connect does the DDP handshake and resumes our REST session on the websocket.
+func (d *ddp) connect() error {
+	ws, _, err := d.dialer.Dial(d.url, nil)
+	if err != nil {
+		return err
+	}
+
+	err = ws.WriteJSON(&ddpMessage{Msg: "connect", Version: "1", Support: []string{"1"}})
+	if err != nil {
+		ws.Close()
+		return err
+	}
+
+	for {
+		var msg ddpMessage
+
+		if err := ws.ReadJSON(&msg); err != nil {
+			ws.Close()
+			return err
+		}
+
+		if msg.Msg == "failed" {
+			ws.Close()
+			return errors.New("ddp: server refused protocol version")
+		}
+
+		if msg.Msg == "connected" {
+			break
+		}
+	}
+
+	d.mu.Lock()
+	d.ws = ws
+	subs := d.subs
+	d.mu.Unlock()
+
+	err = d.send(&ddpMessage{
+		Msg:    "method",
+		Method: "login",
+		Params: []interface{}{map[string]string{"resume": d.token}},
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range subs {
+		if err := d.send(&ddpMessage{Msg: "sub", Name: sub.name, Params: sub.params}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// run reads from the websocket until close is called.
+func (d *ddp) run() {
+	b := &backoff.Backoff{
+		Min:    time.Second,
+		Max:    5 * time.Minute,
+		Jitter: true,
+	}
+
+	for {
+		d.mu.Lock()
+		ws, quit := d.ws, d.quit
+		d.mu.Unlock()
+
+		if quit {
+			logger.Debug("exiting ddp loop")
+			return
+		}
+
+		if ws == nil {
+			if err := d.connect(); err != nil {
+				dur := b.Duration()
+				logger.Errorf("rocketchat realtime connection failed: %s, reconnecting in %s", err, dur)
+				time.Sleep(dur)
+			} else {
+				b.Reset()
+			}
+
+			continue
+		}
+
+		var msg ddpMessage
+
+		if err := ws.ReadJSON(&msg); err != nil {
+			logger.Debugf("ddp read error: %s", err)
+
+			d.mu.Lock()
+			d.ws = nil
+			d.mu.Unlock()
+			ws.Close()
+
+			continue
+		}
+
+		switch msg.Msg {
+		case "ping":
+			if err := d.send(&ddpMessage{Msg: "pong", ID: msg.ID}); err != nil {
+				logger.Errorf("ddp pong failed: %s", err)
+			}
+		case "changed", "added", "result", "nosub":
+			d.handler(&msg)
+		}
+	}
+}
+
+func (d *ddp) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.quit = true
+
+	if d.ws != nil {
+		d.ws.Close()
+		d.ws = nil
+	}
+}
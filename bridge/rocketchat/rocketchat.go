@@ -0,0 +1,1437 @@
+package rocketchat
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/42wim/matterircd/bridge"
+	"github.com/davecgh/go-spew/spew"
+	"github.com/mattermost/mattermost-server/v5/model"
+	logger "github.com/sirupsen/logrus"
+)
+
+type RocketChat struct {
+	api         *api
+	ddp         *ddp
+	credentials bridge.Credentials
+	eventChan   chan *bridge.Event
+	onConnect   func()
+	me          *rcUser
+	v           *bridge.Config
+	settings    *bridge.Settings
+	templates   *bridge.Templates
+
+	sync.RWMutex
+	users    map[string]*rcUser
+	rooms    map[string]*rcRoom
+	subs     map[string]*rcSubscription
+	statuses map[string]string
+	sent     map[string]bool
+}
+
+func New(v *bridge.Config, cred bridge.Credentials, eventChan chan *bridge.Event, onConnect func()) (bridge.Bridger, error) {
+	r := &RocketChat{
+		credentials: cred,
+		eventChan:   eventChan,
+		onConnect:   onConnect,
+		v:           v,
+		users:       make(map[string]*rcUser),
+		rooms:       make(map[string]*rcRoom),
+		subs:        make(map[string]*rcSubscription),
+		statuses:    make(map[string]string),
+		sent:        make(map[string]bool),
+	}
+
+	r.settings = bridge.NewSettings(v, "rocketchat", r.GetChannelName)
+	r.templates = bridge.NewTemplates(r.settings, nil)
+
+	if v.GetBool("debug") {
+		logger.SetLevel(logger.DebugLevel)
+	}
+
+	if v.GetBool("trace") {
+		logger.SetLevel(logger.TraceLevel)
+	}
+
+	err := r.loginToRocketChat()
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *RocketChat) loginToRocketChat() error {
+	r.api = newAPI(r.credentials.Server, r.v.GetBool("rocketchat.Insecure"), r.v.GetBool("rocketchat.SkipTLSVerify"))
+
+	logger.Infof("login as %s on %s", r.credentials.Login, r.credentials.Server)
+
+	if strings.HasPrefix(r.credentials.Pass, "token=") {
+		// personal access tokens are always used together with the user id
+		r.api.userID = r.credentials.Login
+		r.api.token = strings.TrimPrefix(r.credentials.Pass, "token=")
+	} else {
+		var res struct {
+			Data struct {
+				UserID    string `json:"userId"`
+				AuthToken string `json:"authToken"`
+			} `json:"data"`
+		}
+
+		err := r.api.post("login", map[string]string{"user": r.credentials.Login, "password": r.credentials.Pass}, &res)
+		if err != nil {
+			logger.Error("login failed", err)
+			return err
+		}
+
+		r.api.userID = res.Data.UserID
+		r.api.token = res.Data.AuthToken
+	}
+
+	me := &rcUser{}
+
+	err := r.api.get("me", nil, me)
+	if err != nil {
+		logger.Error("login failed", err)
+		return err
+	}
+
+	r.me = me
+
+	logger.Info("login succeeded")
+
+	if err := r.updateUsers(); err != nil {
+		return err
+	}
+
+	if err := r.UpdateChannels(); err != nil {
+		return err
+	}
+
+	r.ddp = newDDP(r.api.url, r.api.token, r.v.GetBool("rocketchat.SkipTLSVerify"), r.handleDDPMessage)
+
+	subs := [][]interface{}{
+		{"stream-room-messages", "__my_messages__"},
+		{"stream-notify-user", r.me.ID + "/subscriptions-changed"},
+		{"stream-notify-user", r.me.ID + "/rooms-changed"},
+		{"stream-notify-logged", "user-status"},
+	}
+
+	for _, sub := range subs {
+		if err := r.ddp.subscribe(sub[0].(string), sub[1], false); err != nil {
+			logger.Errorf("subscribing to %s %s failed: %s", sub[0], sub[1], err)
+		}
+	}
+
+	go r.ddp.run()
+	go r.onConnect()
+
+	return nil
+}
+
+func (r *RocketChat) updateUsers() error {
+	offset := 0
+
+	for {
+		var res struct {
+			Users []*rcUser `json:"users"`
+			Total int       `json:"total"`
+		}
+
+		err := r.api.get("users.list", url.Values{
+			"count":  {"100"},
+			"offset": {strconv.Itoa(offset)},
+		}, &res)
+		if err != nil {
+			return err
+		}
+
+		r.Lock()
+		for _, user := range res.Users {
+			r.users[user.ID] = user
+			r.statuses[user.ID] = user.Status
+		}
+		r.Unlock()
+
+		offset += len(res.Users)
+
+		if len(res.Users) == 0 || offset >= res.Total {
+			return nil
+		}
+	}
+}
+
+// roomAPI returns the REST API namespace that handles the specified room.
+func (r *RocketChat) roomAPI(roomID string) string {
+	r.RLock()
+	defer r.RUnlock()
+
+	if room, ok := r.rooms[roomID]; ok {
+		switch room.Type {
+		case "p":
+			return "groups"
+		case "d":
+			return "im"
+		}
+	}
+
+	return "channels"
+}
+
+func (r *RocketChat) getRoom(roomID string) *rcRoom {
+	r.RLock()
+	room, ok := r.rooms[roomID]
+	r.RUnlock()
+
+	if ok {
+		return room
+	}
+
+	var res struct {
+		Room *rcRoom `json:"room"`
+	}
+
+	err := r.api.get("rooms.info", url.Values{"roomId": {roomID}}, &res)
+	if err != nil || res.Room == nil {
+		return nil
+	}
+
+	r.Lock()
+	r.rooms[roomID] = res.Room
+	r.Unlock()
+
+	return res.Room
+}
+
+// dmPeers returns the other users of a direct message room.
+func (r *RocketChat) dmPeers(room *rcRoom) []string {
+	var peers []string
+
+	for _, uid := range room.UIDs {
+		if uid != r.me.ID {
+			peers = append(peers, uid)
+		}
+	}
+
+	// older servers don't send uids, the room id is the concatenation of both user ids
+	if len(peers) == 0 && len(room.UIDs) == 0 {
+		peers = append(peers, strings.Replace(room.ID, r.me.ID, "", 1))
+	}
+
+	return peers
+}
+
+// roomName returns the name of the room without the IRC channel prefix.
+func (r *RocketChat) roomName(room *rcRoom) string {
+	if room.Type != "d" {
+		return room.Name
+	}
+
+	peers := r.dmPeers(room)
+
+	// a one on one conversation, use the same format as mattermost
+	if len(peers) == 1 {
+		return peers[0] + "__" + r.me.ID
+	}
+
+	var names []string
+
+	for _, username := range room.Usernames {
+		if username != r.me.Username {
+			names = append(names, username)
+		}
+	}
+
+	sort.Strings(names)
+
+	return strings.Join(names, "-")
+}
+
+func (r *RocketChat) channelType(room *rcRoom) string {
+	switch {
+	case room.Type == "c":
+		return "O"
+	case room.Type == "p":
+		return "P"
+	case len(r.dmPeers(room)) > 1:
+		return "G"
+	}
+
+	return "D"
+}
+
+func (r *RocketChat) Invite(channelID, username string) error {
+	return r.api.post(r.roomAPI(channelID)+".invite", map[string]string{"roomId": channelID, "userId": username}, nil)
+}
+
+func (r *RocketChat) Join(channelName string) (string, string, error) {
+	var res struct {
+		Channel *rcRoom `json:"channel"`
+	}
+
+	err := r.api.get("channels.info", url.Values{"roomName": {channelName}}, &res)
+	if err != nil && strings.Contains(err.Error(), "room-not-found") {
+		return "", "", bridge.ErrNoSuchChannel
+	}
+
+	if err != nil || res.Channel == nil {
+		return "", "", fmt.Errorf("cannot join channel (+i)")
+	}
+
+	err = r.api.post("channels.join", map[string]string{"roomId": res.Channel.ID}, nil)
+	logger.Debugf("join channel %s, id %s, err: %v", channelName, res.Channel.ID, err)
+	if err != nil {
+		return "", "", fmt.Errorf("cannot join channel (+i)")
+	}
+
+	r.Lock()
+	r.rooms[res.Channel.ID] = res.Channel
+	r.Unlock()
+
+	return res.Channel.ID, res.Channel.Topic, nil
+}
+
+func (r *RocketChat) CreateGroup(userIDs []string) (string, error) {
+	usernames := make([]string, 0, len(userIDs))
+	for _, userID := range userIDs {
+		usernames = append(usernames, r.GetUser(userID).Username)
+	}
+
+	var res struct {
+		Room struct {
+			ID  string `json:"_id"`
+			RID string `json:"rid"`
+		} `json:"room"`
+	}
+
+	err := r.api.post("im.create", map[string]string{"usernames": strings.Join(usernames, ",")}, &res)
+	if err != nil {
+		return "", err
+	}
+
+	if res.Room.RID != "" {
+		return res.Room.RID, nil
+	}
+
+	return res.Room.ID, nil
+}
+
+func (r *RocketChat) MuteChannel(channelID string, mute bool) error {
+	return errors.New("rocketchat channels can't be muted from IRC")
+}
+
+func (r *RocketChat) FavoriteChannel(channelID string, favorite bool) error {
+	return errors.New("rocketchat channels can't be favorited from IRC")
+}
+
+func (r *RocketChat) CreateChannel(channelName string, private bool) (string, error) {
+	roomAPI, key := "channels", "channel"
+	if private {
+		roomAPI, key = "groups", "group"
+	}
+
+	var res map[string]*rcRoom
+
+	if err := r.api.post(roomAPI+".create", map[string]string{"name": channelName}, &res); err != nil {
+		return "", err
+	}
+
+	room := res[key]
+	if room == nil {
+		return "", fmt.Errorf("creating %s failed", channelName)
+	}
+
+	r.Lock()
+	r.rooms[room.ID] = room
+	r.Unlock()
+
+	return room.ID, nil
+}
+
+func (r *RocketChat) RenameChannel(channelID, newName string) error {
+	return r.api.post(r.roomAPI(channelID)+".rename", map[string]string{"roomId": channelID, "name": newName}, nil)
+}
+
+func (r *RocketChat) SetPurpose(channelID, text string) error {
+	return r.api.post(r.roomAPI(channelID)+".setDescription", map[string]string{"roomId": channelID, "description": text}, nil)
+}
+
+func (r *RocketChat) ArchiveChannel(channelID string) error {
+	return r.api.post(r.roomAPI(channelID)+".archive", map[string]string{"roomId": channelID}, nil)
+}
+
+func (r *RocketChat) UnarchiveChannel(channelName string) (string, error) {
+	var res map[string]*rcRoom
+
+	// archived channels can be public or private
+	roomAPI, key := "channels", "channel"
+
+	err := r.api.get("channels.info", url.Values{"roomName": {channelName}}, &res)
+	if err != nil {
+		roomAPI, key = "groups", "group"
+		err = r.api.get("groups.info", url.Values{"roomName": {channelName}}, &res)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	room := res[key]
+	if room == nil {
+		return "", fmt.Errorf("no archived channel %s", channelName)
+	}
+
+	return room.ID, r.api.post(roomAPI+".unarchive", map[string]string{"roomId": room.ID}, nil)
+}
+
+func (r *RocketChat) List() (map[string]string, error) {
+	channelinfo := make(map[string]string)
+	offset := 0
+
+	for {
+		var res struct {
+			Channels []*rcRoom `json:"channels"`
+			Total    int       `json:"total"`
+		}
+
+		err := r.api.get("channels.list", url.Values{
+			"count":  {"100"},
+			"offset": {strconv.Itoa(offset)},
+		}, &res)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, channel := range res.Channels {
+			channelinfo["#"+channel.Name] = strings.ReplaceAll(channel.Topic, "\n", " | ")
+		}
+
+		offset += len(res.Channels)
+
+		if len(res.Channels) == 0 || offset >= res.Total {
+			break
+		}
+	}
+
+	// private groups we're a member of
+	r.RLock()
+	for _, room := range r.rooms {
+		if room.Type == "p" {
+			channelinfo["#"+room.Name] = strings.ReplaceAll(room.Topic, "\n", " | ")
+		}
+	}
+	r.RUnlock()
+
+	return channelinfo, nil
+}
+
+func (r *RocketChat) Part(channelID string) error {
+	return r.api.post(r.roomAPI(channelID)+".leave", map[string]string{"roomId": channelID}, nil)
+}
+
+func (r *RocketChat) UpdateChannels() error {
+	var subs struct {
+		Update []*rcSubscription `json:"update"`
+	}
+
+	if err := r.api.get("subscriptions.get", nil, &subs); err != nil {
+		return err
+	}
+
+	var rooms struct {
+		Update []*rcRoom `json:"update"`
+	}
+
+	if err := r.api.get("rooms.get", nil, &rooms); err != nil {
+		return err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.subs = make(map[string]*rcSubscription)
+
+	for _, sub := range subs.Update {
+		r.subs[sub.RoomID] = sub
+	}
+
+	for _, room := range rooms.Update {
+		r.rooms[room.ID] = room
+	}
+
+	return nil
+}
+
+func (r *RocketChat) Logout() error {
+	logger.Debug("calling logout from rocketchat")
+
+	if r.ddp != nil {
+		r.ddp.close()
+	}
+
+	err := r.api.post("logout", nil, nil)
+	if err != nil {
+		logger.Error("logout failed")
+		return err
+	}
+
+	logger.Info("logout succeeded")
+
+	return nil
+}
+
+// newMessageID generates an id in the same format Rocket.Chat uses, so we can recognize our own messages.
+func newMessageID() (string, error) {
+	const chars = "23456789ABCDEFGHJKLMNPQRSTWXYZabcdefghijkmnopqrstuvwxyz"
+
+	id := make([]byte, 0, 17)
+	max := big.NewInt(int64(len(chars)))
+
+	for len(id) < cap(id) {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+
+		id = append(id, chars[n.Int64()])
+	}
+
+	return string(id), nil
+}
+
+func (r *RocketChat) sendMessage(roomID, text string) error {
+	id, err := newMessageID()
+	if err != nil {
+		return err
+	}
+
+	r.Lock()
+	r.sent[id] = true
+	r.Unlock()
+
+	err = r.api.post("chat.sendMessage", map[string]interface{}{
+		"message": map[string]string{
+			"_id": id,
+			"rid": roomID,
+			"msg": text,
+		},
+	}, nil)
+	if err != nil {
+		r.Lock()
+		delete(r.sent, id)
+		r.Unlock()
+	}
+
+	return err
+}
+
+func (r *RocketChat) MsgUser(username, text string) error {
+	user := r.GetUser(username)
+
+	var res struct {
+		Room struct {
+			ID  string `json:"_id"`
+			RID string `json:"rid"`
+		} `json:"room"`
+	}
+
+	err := r.api.post("im.create", map[string]string{"username": user.Username}, &res)
+	if err != nil {
+		return err
+	}
+
+	roomID := res.Room.RID
+	if roomID == "" {
+		roomID = res.Room.ID
+	}
+
+	return r.sendMessage(roomID, text)
+}
+
+func (r *RocketChat) MsgChannel(channelID, text string) error {
+	return r.sendMessage(channelID, text)
+}
+
+func (r *RocketChat) Topic(channelID string) string {
+	room := r.getRoom(channelID)
+	if room == nil {
+		return ""
+	}
+
+	return room.Topic
+}
+
+func (r *RocketChat) SetTopic(channelID, text string) error {
+	return r.api.post(r.roomAPI(channelID)+".setTopic", map[string]string{"roomId": channelID, "topic": text}, nil)
+}
+
+func (r *RocketChat) StatusUser(userID string) (string, error) {
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.statuses[userID], nil
+}
+
+func (r *RocketChat) StatusUsers() (map[string]string, error) {
+	statuses := make(map[string]string)
+
+	r.RLock()
+	for id, status := range r.statuses {
+		statuses[id] = status
+	}
+	r.RUnlock()
+
+	return statuses, nil
+}
+
+func (r *RocketChat) SetStatus(status string) error {
+	return r.api.post("users.setStatus", map[string]string{"status": status}, nil)
+}
+
+func (r *RocketChat) SetDND(until time.Time) error {
+	return errors.New("do not disturb can't be set from IRC on rocketchat")
+}
+
+func (r *RocketChat) SetCustomStatus(status *bridge.CustomStatus) error {
+	return errors.New("custom statuses can't be set from IRC on rocketchat")
+}
+
+func (r *RocketChat) Protocol() string {
+	return "rocketchat"
+}
+
+// GetLimits returns no limits, they're server settings rocket.chat doesn't expose to users.
+func (r *RocketChat) GetLimits() *bridge.Limits {
+	return &bridge.Limits{}
+}
+
+func (r *RocketChat) Kick(channelID, username string) error {
+	return r.api.post(r.roomAPI(channelID)+".kick", map[string]string{"roomId": channelID, "userId": username}, nil)
+}
+
+func (r *RocketChat) Nick(name string) error {
+	return r.api.post("users.updateOwnBasicInfo", map[string]interface{}{
+		"data": map[string]string{"nickname": name},
+	}, nil)
+}
+
+func (r *RocketChat) GetChannels() []*bridge.ChannelInfo {
+	var channels []*bridge.ChannelInfo
+
+	r.RLock()
+	defer r.RUnlock()
+
+	for _, sub := range r.subs {
+		room, ok := r.rooms[sub.RoomID]
+		if !ok {
+			continue
+		}
+
+		channels = append(channels, &bridge.ChannelInfo{
+			Name: r.roomName(room),
+			ID:   room.ID,
+		})
+	}
+
+	return channels
+}
+
+func (r *RocketChat) GetChannelName(channelID string) string {
+	room := r.getRoom(channelID)
+	if room == nil {
+		return channelID
+	}
+
+	if room.Type == "d" && len(r.dmPeers(room)) > 1 && r.v.GetBool("rocketchat.GroupChannelNames") {
+		var nicks []string
+
+		for _, username := range room.Usernames {
+			if username != r.me.Username {
+				nicks = append(nicks, username)
+			}
+		}
+
+		return bridge.GroupChannelName(nicks)
+	}
+
+	return "#" + r.roomName(room)
+}
+
+func (r *RocketChat) GetChannel(channelID string) *bridge.ChannelInfo {
+	room := r.getRoom(channelID)
+	if room == nil {
+		return nil
+	}
+
+	return &bridge.ChannelInfo{
+		Name:     r.roomName(room),
+		ID:       room.ID,
+		Private:  room.Type == "p",
+		Direct:   room.Type == "d",
+		ReadOnly: room.ReadOnly || room.Archived,
+	}
+}
+
+// GetChannelMembers returns the members of a channel, owners and moderators are admins.
+func (r *RocketChat) GetChannelMembers(channelID string) ([]*bridge.ChannelMember, error) {
+	users, err := r.GetChannelUsers(channelID)
+	if err != nil {
+		return nil, err
+	}
+
+	admins := make(map[string]bool)
+
+	if r.roomAPI(channelID) != "im" {
+		var res struct {
+			Roles []struct {
+				User  rcUser   `json:"u"`
+				Roles []string `json:"roles"`
+			} `json:"roles"`
+		}
+
+		err = r.api.get(r.roomAPI(channelID)+".roles", url.Values{"roomId": {channelID}}, &res)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, role := range res.Roles {
+			for _, name := range role.Roles {
+				if name == "owner" || name == "moderator" {
+					admins[role.User.ID] = true
+				}
+			}
+		}
+	}
+
+	members := make([]*bridge.ChannelMember, 0, len(users))
+
+	for _, user := range users {
+		roles := strings.Fields(user.Roles)
+
+		members = append(members, &bridge.ChannelMember{
+			UserID: user.User,
+			Admin:  admins[user.User],
+			Guest:  stringInSlice("guest", roles),
+			Bot:    stringInSlice("bot", roles),
+		})
+	}
+
+	return members, nil
+}
+
+func (r *RocketChat) SetChannelAdmin(channelID, userID string, admin bool) error {
+	if r.roomAPI(channelID) == "im" {
+		return errors.New("direct messages have no moderators")
+	}
+
+	method := ".addModerator"
+	if !admin {
+		method = ".removeModerator"
+	}
+
+	return r.api.post(r.roomAPI(channelID)+method, map[string]string{"roomId": channelID, "userId": userID}, nil)
+}
+
+func (r *RocketChat) GetChannelUsers(channelID string) ([]*bridge.UserInfo, error) {
+	var users []*bridge.UserInfo
+
+	offset := 0
+
+	for {
+		var res struct {
+			Members []*rcUser `json:"members"`
+			Total   int       `json:"total"`
+		}
+
+		err := r.api.get(r.roomAPI(channelID)+".members", url.Values{
+			"roomId": {channelID},
+			"count":  {"100"},
+			"offset": {strconv.Itoa(offset)},
+		}, &res)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, member := range res.Members {
+			users = append(users, r.GetUser(member.ID))
+		}
+
+		offset += len(res.Members)
+
+		if len(res.Members) == 0 || offset >= res.Total {
+			break
+		}
+	}
+
+	return users, nil
+}
+
+func (r *RocketChat) GetUsers() []*bridge.UserInfo {
+	var users []*bridge.UserInfo
+
+	r.RLock()
+	for _, user := range r.users {
+		users = append(users, r.createUser(user))
+	}
+	r.RUnlock()
+
+	return users
+}
+
+func (r *RocketChat) getRCUser(userID string) *rcUser {
+	r.RLock()
+	user, ok := r.users[userID]
+	r.RUnlock()
+
+	if ok {
+		return user
+	}
+
+	logger.Debugf("user %s not in cache, asking rocketchat", userID)
+
+	var res struct {
+		User *rcUser `json:"user"`
+	}
+
+	err := r.api.get("users.info", url.Values{"userId": {userID}}, &res)
+	if err != nil || res.User == nil {
+		return nil
+	}
+
+	r.Lock()
+	r.users[userID] = res.User
+	r.Unlock()
+
+	return res.User
+}
+
+func (r *RocketChat) GetUser(userID string) *bridge.UserInfo {
+	return r.createUser(r.getRCUser(userID))
+}
+
+func (r *RocketChat) GetMe() *bridge.UserInfo {
+	return r.createUser(r.me)
+}
+
+func (r *RocketChat) GetUserByUsername(username string) *bridge.UserInfo {
+	r.RLock()
+	for _, user := range r.users {
+		if user.Username == username {
+			r.RUnlock()
+			return r.createUser(user)
+		}
+	}
+	r.RUnlock()
+
+	var res struct {
+		User *rcUser `json:"user"`
+	}
+
+	err := r.api.get("users.info", url.Values{"username": {username}}, &res)
+	if err != nil {
+		return &bridge.UserInfo{}
+	}
+
+	return r.createUser(res.User)
+}
+
+func (r *RocketChat) MentionUser(userID string) string {
+	username := r.GetUser(userID).Username
+	if username == "" {
+		return ""
+	}
+
+	return "@" + username
+}
+
+func (r *RocketChat) SearchUsers(query string) ([]*bridge.UserInfo, error) {
+	var users []*bridge.UserInfo
+
+	query = strings.ToLower(query)
+
+	r.RLock()
+	for _, user := range r.users {
+		if strings.Contains(strings.ToLower(user.Username), query) || strings.Contains(strings.ToLower(user.Name), query) {
+			users = append(users, r.createUser(user))
+		}
+	}
+	r.RUnlock()
+
+	return users, nil
+}
+
+func (r *RocketChat) GetTeamName(teamID string) string {
+	return ""
+}
+
+func (r *RocketChat) GetLastViewedAt(channelID string) int64 {
+	r.RLock()
+	defer r.RUnlock()
+
+	sub, ok := r.subs[channelID]
+	if !ok {
+		return 0
+	}
+
+	return sub.LastSeen.millis()
+}
+
+func (r *RocketChat) GetUnread() ([]*bridge.Unread, error) {
+	r.RLock()
+	defer r.RUnlock()
+
+	var unread []*bridge.Unread
+
+	for _, sub := range r.subs {
+		if sub.Unread > 0 || sub.UserMentions > 0 {
+			unread = append(unread, &bridge.Unread{
+				ChannelID: sub.RoomID,
+				Messages:  int64(sub.Unread),
+				Mentions:  int64(sub.UserMentions),
+			})
+		}
+	}
+
+	return unread, nil
+}
+
+func (r *RocketChat) UpdateLastViewed(channelID string) {
+	err := r.api.post("subscriptions.read", map[string]string{"rid": channelID}, nil)
+	if err != nil {
+		logger.Errorf("updatelastviewed for %s failed: %s", channelID, err)
+	}
+}
+
+func (r *RocketChat) UpdateLastViewedUser(userID string) error {
+	var res struct {
+		Room struct {
+			RID string `json:"rid"`
+		} `json:"room"`
+	}
+
+	err := r.api.post("im.create", map[string]string{"username": r.GetUser(userID).Username}, &res)
+	if err != nil {
+		return err
+	}
+
+	return r.api.post("subscriptions.read", map[string]string{"rid": res.Room.RID}, nil)
+}
+
+func (r *RocketChat) GetChannelID(name, teamID string) string {
+	r.RLock()
+	defer r.RUnlock()
+
+	for _, room := range r.rooms {
+		if r.roomName(room) == name {
+			return room.ID
+		}
+	}
+
+	return ""
+}
+
+// history returns the messages of a room as a mattermost postlist, which is what irckit uses for replaying.
+func (r *RocketChat) history(channelID string, query url.Values) *model.PostList {
+	var res struct {
+		Messages []*rcMessage `json:"messages"`
+	}
+
+	query.Set("roomId", channelID)
+
+	err := r.api.get(r.roomAPI(channelID)+".history", query, &res)
+	if err != nil {
+		logger.Errorf("history of %s failed: %s", channelID, err)
+		return nil
+	}
+
+	postlist := model.NewPostList()
+
+	// rocketchat also returns the newest messages first
+	for _, msg := range res.Messages {
+		post := &model.Post{
+			Id:        msg.ID,
+			ChannelId: msg.RoomID,
+			UserId:    msg.User.ID,
+			Message:   msg.Msg,
+			CreateAt:  msg.TS.millis(),
+		}
+
+		// join/leave and other system messages
+		if msg.Type != "" {
+			post.Type = model.POST_JOIN_LEAVE
+		}
+
+		postlist.AddPost(post)
+		postlist.AddOrder(post.Id)
+	}
+
+	return postlist
+}
+
+func (r *RocketChat) GetPostsSince(channelID string, since int64) interface{} {
+	oldest := time.Unix(0, since*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano)
+
+	postlist := r.history(channelID, url.Values{"oldest": {oldest}, "count": {"1000"}})
+	if postlist == nil {
+		return nil
+	}
+
+	return postlist
+}
+
+func (r *RocketChat) GetPosts(channelID string, limit int) interface{} {
+	postlist := r.history(channelID, url.Values{"count": {strconv.Itoa(limit)}})
+	if postlist == nil {
+		return nil
+	}
+
+	return postlist
+}
+
+func (r *RocketChat) SearchPosts(search string) interface{} {
+	return nil
+}
+
+func (r *RocketChat) GetFileLinks(fileIDs []string) []string {
+	return []string{}
+}
+
+func (r *RocketChat) createUser(rcuser *rcUser) *bridge.UserInfo {
+	if rcuser == nil {
+		return &bridge.UserInfo{}
+	}
+
+	host := strings.TrimPrefix(strings.TrimPrefix(r.api.url, "https://"), "http://")
+
+	info := &bridge.UserInfo{
+		Nick:     rcuser.Username,
+		User:     rcuser.ID,
+		Real:     rcuser.Name,
+		Host:     host,
+		Roles:    strings.Join(rcuser.Roles, " "),
+		Ghost:    true,
+		Me:       rcuser.ID == r.me.ID,
+		Username: rcuser.Username,
+	}
+
+	return info
+}
+
+func (r *RocketChat) handleDDPMessage(msg *ddpMessage) {
+	logger.Tracef("handleDDPMessage %s", spew.Sdump(msg))
+
+	if msg.Msg != "changed" {
+		return
+	}
+
+	var fields ddpStreamFields
+
+	if err := json.Unmarshal(msg.Fields, &fields); err != nil || len(fields.Args) == 0 {
+		return
+	}
+
+	switch {
+	case msg.Collection == "stream-room-messages":
+		var rmsg rcMessage
+
+		if err := json.Unmarshal(fields.Args[0], &rmsg); err != nil {
+			logger.Errorf("couldn't decode message: %s", err)
+			return
+		}
+
+		r.handleMessage(&rmsg)
+	case msg.Collection == "stream-notify-user" && strings.HasSuffix(fields.EventName, "/subscriptions-changed"):
+		r.handleSubscriptionChanged(fields.Args)
+	case msg.Collection == "stream-notify-user" && strings.HasSuffix(fields.EventName, "/rooms-changed"):
+		r.handleRoomChanged(fields.Args)
+	case msg.Collection == "stream-notify-logged" && fields.EventName == "user-status":
+		r.handleUserStatus(fields.Args)
+	}
+}
+
+func (r *RocketChat) handleSubscriptionChanged(args []json.RawMessage) {
+	var action string
+
+	if len(args) < 2 || json.Unmarshal(args[0], &action) != nil {
+		return
+	}
+
+	var sub rcSubscription
+
+	if err := json.Unmarshal(args[1], &sub); err != nil {
+		return
+	}
+
+	switch action {
+	case "inserted":
+		r.Lock()
+		r.subs[sub.RoomID] = &sub
+		r.Unlock()
+
+		// make sure we know the room before irckit asks for it
+		r.getRoom(sub.RoomID)
+
+		r.eventChan <- &bridge.Event{
+			Type: "channel_create",
+			Data: &bridge.ChannelCreateEvent{
+				ChannelID: sub.RoomID,
+			},
+		}
+	case "removed":
+		r.Lock()
+		delete(r.subs, sub.RoomID)
+		r.Unlock()
+
+		r.eventChan <- &bridge.Event{
+			Type: "channel_delete",
+			Data: &bridge.ChannelDeleteEvent{
+				ChannelID: sub.RoomID,
+			},
+		}
+	case "updated":
+		r.Lock()
+		old, ok := r.subs[sub.RoomID]
+		r.subs[sub.RoomID] = &sub
+		r.Unlock()
+
+		// the room was read, maybe on another device
+		if ok && sub.LastSeen.After(old.LastSeen.Time) {
+			r.eventChan <- &bridge.Event{
+				Type: "channel_viewed",
+				Data: &bridge.ChannelViewedEvent{
+					ChannelID: sub.RoomID,
+					ViewedAt:  sub.LastSeen.millis(),
+				},
+			}
+		}
+	}
+}
+
+func (r *RocketChat) handleRoomChanged(args []json.RawMessage) {
+	var action string
+
+	if len(args) < 2 || json.Unmarshal(args[0], &action) != nil {
+		return
+	}
+
+	var room rcRoom
+
+	if err := json.Unmarshal(args[1], &room); err != nil || room.ID == "" {
+		return
+	}
+
+	r.Lock()
+
+	if action == "removed" {
+		delete(r.rooms, room.ID)
+		r.Unlock()
+
+		return
+	}
+
+	old := r.rooms[room.ID]
+	r.rooms[room.ID] = &room
+
+	r.Unlock()
+
+	if old == nil || room.Type == "d" {
+		return
+	}
+
+	var data interface{}
+
+	switch {
+	case room.Archived && !old.Archived:
+		data = &bridge.ChannelDeleteEvent{ChannelID: room.ID}
+	case !room.Archived && old.Archived:
+		data = &bridge.ChannelCreateEvent{ChannelID: room.ID}
+	case room.Name != old.Name || room.Type != old.Type:
+		r.settings.Forget(room.ID)
+		data = &bridge.ChannelUpdateEvent{ChannelID: room.ID}
+	default:
+		return
+	}
+
+	r.eventChan <- &bridge.Event{
+		Type: "channel_update",
+		Data: data,
+	}
+}
+
+func (r *RocketChat) handleUserStatus(args []json.RawMessage) {
+	// [[userid, username, status, statustext]]
+	var data []interface{}
+
+	if err := json.Unmarshal(args[0], &data); err != nil || len(data) < 3 {
+		return
+	}
+
+	userID, _ := data[0].(string)
+	code, _ := data[2].(float64)
+
+	status := "offline"
+
+	switch code {
+	case 1:
+		status = "online"
+	case 2:
+		status = "away"
+	case 3:
+		status = "dnd"
+	}
+
+	r.Lock()
+	r.statuses[userID] = status
+	r.Unlock()
+
+	r.eventChan <- &bridge.Event{
+		Type: "status_change",
+		Data: &bridge.StatusChangeEvent{
+			UserID: userID,
+			Status: status,
+		},
+	}
+}
+
+// nolint:funlen,gocognit,gocyclo
+func (r *RocketChat) handleMessage(rmsg *rcMessage) {
+	r.Lock()
+	ours := r.sent[rmsg.ID]
+	delete(r.sent, rmsg.ID)
+	r.Unlock()
+
+	if ours {
+		logger.Debugf("message is sent from matterircd, not relaying %#v", rmsg.Msg)
+		return
+	}
+
+	room := r.getRoom(rmsg.RoomID)
+	if room == nil {
+		logger.Errorf("message for unknown room %s", rmsg.RoomID)
+		return
+	}
+
+	switch rmsg.Type {
+	case "uj", "au":
+		r.handleMemberAdded(rmsg)
+		return
+	case "ul", "ru":
+		r.handleMemberRemoved(rmsg)
+		return
+	case "room_changed_topic":
+		r.Lock()
+		room.Topic = rmsg.Msg
+		r.Unlock()
+
+		r.eventChan <- &bridge.Event{
+			Type: "channel_topic",
+			Data: &bridge.ChannelTopicEvent{
+				Text:      rmsg.Msg,
+				ChannelID: rmsg.RoomID,
+				Sender:    r.GetUser(rmsg.User.ID).Nick,
+			},
+		}
+
+		return
+	case "subscription-role-added", "subscription-role-removed":
+		r.eventChan <- &bridge.Event{
+			Type: "channel_member_update",
+			Data: &bridge.ChannelMemberUpdateEvent{
+				ChannelID: rmsg.RoomID,
+			},
+		}
+
+		return
+	case "":
+	default:
+		logger.Debugf("system message %s, not relaying %#v", rmsg.Type, rmsg.Msg)
+		return
+	}
+
+	ghost := r.GetUser(rmsg.User.ID)
+
+	// messages from integrations can override the username
+	if rmsg.Alias != "" && isValidNick(rmsg.Alias) {
+		ghost.Nick = rmsg.Alias
+	}
+
+	text := rmsg.Msg
+
+	if rmsg.ThreadID != "" {
+		text = r.addParent(text, rmsg.RoomID, rmsg.ThreadID)
+	}
+
+	msgs := strings.Split(text, "\n")
+
+	// add an edited string when messages are edited
+	if rmsg.EditedAt != nil && len(msgs) > 0 {
+		msgs[len(msgs)-1] = r.templates.Render(bridge.TemplateEdit, rmsg.RoomID, &bridge.TemplateData{Message: msgs[len(msgs)-1]})
+	}
+
+	var files []*bridge.File
+
+	for _, attach := range rmsg.Attachments {
+		if attach.TitleLink != "" {
+			files = append(files, &bridge.File{Name: r.api.url + attach.TitleLink})
+			continue
+		}
+
+		if attach.Text != "" {
+			msgs = append(msgs, "> "+attach.Text)
+		}
+	}
+
+	channelType := r.channelType(room)
+
+	for _, msg := range msgs {
+		if msg == "" {
+			continue
+		}
+
+		if channelType == "D" {
+			r.eventChan <- &bridge.Event{
+				Type: "direct_message",
+				Data: &bridge.DirectMessageEvent{
+					Text:     msg,
+					Sender:   ghost,
+					Receiver: r.GetMe(),
+				},
+			}
+
+			continue
+		}
+
+		messageType := ""
+		if strings.Contains(msg, "@all") || strings.Contains(msg, "@here") {
+			messageType = "notice"
+		}
+
+		r.eventChan <- &bridge.Event{
+			Type: "channel_message",
+			Data: &bridge.ChannelMessageEvent{
+				Text:        msg,
+				ChannelID:   rmsg.RoomID,
+				Sender:      ghost,
+				MessageType: messageType,
+				ChannelType: channelType,
+			},
+		}
+	}
+
+	if len(files) > 0 {
+		fileEvent := &bridge.FileEvent{
+			Sender:      ghost,
+			Receiver:    ghost,
+			ChannelID:   rmsg.RoomID,
+			ChannelType: channelType,
+			Files:       files,
+		}
+
+		if channelType == "D" {
+			fileEvent.Receiver = r.GetMe()
+		}
+
+		r.eventChan <- &bridge.Event{
+			Type: "file_event",
+			Data: fileEvent,
+		}
+	}
+
+	if !r.settings.Bool(rmsg.RoomID, "DisableAutoView") {
+		r.UpdateLastViewed(rmsg.RoomID)
+	}
+}
+
+// addParent adds the message we're replying to, in the same way as mattermost threads.
+func (r *RocketChat) addParent(text, roomID, threadID string) string {
+	var res struct {
+		Message *rcMessage `json:"message"`
+	}
+
+	err := r.api.get("chat.getMessage", url.Values{"msgId": {threadID}}, &res)
+	if err != nil || res.Message == nil {
+		logger.Errorf("Unable to get parent message %s", threadID)
+		return text
+	}
+
+	reply := &bridge.TemplateData{
+		Message:    text,
+		ParentNick: r.GetUser(res.Message.User.ID).Nick,
+	}
+
+	if !r.settings.Bool(roomID, "HideReplies") {
+		reply.ParentMessage = res.Message.Msg
+	}
+
+	return r.templates.Render(bridge.TemplateReply, roomID, reply)
+}
+
+func (r *RocketChat) handleMemberAdded(rmsg *rcMessage) {
+	event := &bridge.ChannelAddEvent{
+		ChannelID: rmsg.RoomID,
+	}
+
+	// for "au" the message is the username that has been added by the sender
+	if rmsg.Type == "au" {
+		event.Added = []*bridge.UserInfo{r.GetUserByUsername(rmsg.Msg)}
+		event.Adder = r.GetUser(rmsg.User.ID)
+	} else {
+		event.Added = []*bridge.UserInfo{r.GetUser(rmsg.User.ID)}
+	}
+
+	r.eventChan <- &bridge.Event{
+		Type: "channel_add",
+		Data: event,
+	}
+}
+
+func (r *RocketChat) handleMemberRemoved(rmsg *rcMessage) {
+	event := &bridge.ChannelRemoveEvent{
+		ChannelID: rmsg.RoomID,
+	}
+
+	if rmsg.Type == "ru" {
+		event.Removed = []*bridge.UserInfo{r.GetUserByUsername(rmsg.Msg)}
+		event.Remover = r.GetUser(rmsg.User.ID)
+	} else {
+		event.Removed = []*bridge.UserInfo{r.GetUser(rmsg.User.ID)}
+	}
+
+	r.eventChan <- &bridge.Event{
+		Type: "channel_remove",
+		Data: event,
+	}
+}
+
+func stringInSlice(a string, list []string) bool {
+	for _, b := range list {
+		if b == a {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isValidNick(s string) bool {
+	if len(s) < 1 || len(s) > 27 {
+		return false
+	}
+
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_[]\\^{}|`", c)) {
+			return false
+		}
+	}
+
+	return !strings.ContainsAny(s[:1], "-0123456789")
+}
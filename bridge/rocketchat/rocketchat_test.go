@@ -0,0 +1,291 @@
+package rocketchat
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/42wim/matterircd/bridge"
+	"github.com/gorilla/websocket"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeServer serves the REST API and a realtime websocket, everything pushed on stream is sent
+// to the websocket.
+type fakeServer struct {
+	*httptest.Server
+	subs   chan string
+	sent   chan map[string]string
+	stream chan string
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	fs := &fakeServer{
+		subs:   make(chan string, 10),
+		sent:   make(chan map[string]string, 10),
+		stream: make(chan string, 10),
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/api/v1/login", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Password string `json:"password"`
+		}
+
+		json.NewDecoder(r.Body).Decode(&req)
+
+		if req.Password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"status": "error", "error": "Unauthorized"}`))
+
+			return
+		}
+
+		w.Write([]byte(`{"status": "success", "data": {"userId": "u1", "authToken": "abc"}}`))
+	})
+
+	mux.HandleFunc("/api/v1/me", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "abc", r.Header.Get("X-Auth-Token"))
+		w.Write([]byte(`{"success": true, "_id": "u1", "username": "alice", "name": "Alice"}`))
+	})
+
+	mux.HandleFunc("/api/v1/users.list", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"success": true, "total": 2, "users": [
+			{"_id": "u1", "username": "alice", "name": "Alice", "status": "online"},
+			{"_id": "u2", "username": "bob", "name": "Bob", "status": "away"}
+		]}`))
+	})
+
+	mux.HandleFunc("/api/v1/subscriptions.get", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"success": true, "update": [
+			{"rid": "r1", "name": "general", "t": "c", "ls": "2020-01-01T00:00:00.000Z", "open": true}
+		]}`))
+	})
+
+	mux.HandleFunc("/api/v1/rooms.get", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"success": true, "update": [{"_id": "r1", "t": "c", "name": "general", "topic": "welcome"}]}`))
+	})
+
+	mux.HandleFunc("/api/v1/channels.info", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("roomName") != "random" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"success": false, "error": "The required \"roomId\" or \"roomName\" param provided does not match any channel [error-room-not-found]"}`))
+
+			return
+		}
+
+		w.Write([]byte(`{"success": true, "channel": {"_id": "r2", "t": "c", "name": "random", "topic": "off topic"}}`))
+	})
+
+	mux.HandleFunc("/api/v1/chat.sendMessage", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Message map[string]string `json:"message"`
+		}
+
+		json.NewDecoder(r.Body).Decode(&req)
+
+		fs.sent <- req.Message
+
+		w.Write([]byte(`{"success": true}`))
+	})
+
+	mux.HandleFunc("/api/v1/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"success": true}`))
+	})
+
+	mux.HandleFunc("/websocket", func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		defer ws.Close()
+
+		var msg ddpMessage
+
+		if ws.ReadJSON(&msg) != nil || msg.Msg != "connect" {
+			return
+		}
+
+		ws.WriteJSON(&ddpMessage{Msg: "connected"})
+
+		go func() {
+			for {
+				var msg ddpMessage
+
+				if ws.ReadJSON(&msg) != nil {
+					return
+				}
+
+				if msg.Msg == "sub" {
+					fs.subs <- msg.Name
+				}
+			}
+		}()
+
+		for text := range fs.stream {
+			if ws.WriteMessage(websocket.TextMessage, []byte(text)) != nil {
+				return
+			}
+		}
+	})
+
+	fs.Server = httptest.NewServer(mux)
+
+	return fs
+}
+
+func newTestRocketChat(fs *fakeServer, pass string) (*RocketChat, chan *bridge.Event, error) {
+	eventChan := make(chan *bridge.Event, 10)
+
+	br, err := New(bridge.NewConfig(viper.New()), bridge.Credentials{
+		Server: fs.URL,
+		Login:  "alice",
+		Pass:   pass,
+	}, eventChan, func() {})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return br.(*RocketChat), eventChan, nil
+}
+
+func nextEvent(t *testing.T, eventChan chan *bridge.Event) *bridge.Event {
+	select {
+	case event := <-eventChan:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+	}
+
+	return nil
+}
+
+func TestLogin(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.Close()
+	defer close(fs.stream)
+
+	_, _, err := newTestRocketChat(fs, "wrong")
+	assert.EqualError(t, err, "Unauthorized")
+
+	r, _, err := newTestRocketChat(fs, "secret")
+	assert.NoError(t, err)
+
+	defer r.Logout()
+
+	assert.Equal(t, "alice", r.GetMe().Nick)
+	assert.Equal(t, "#general", r.GetChannelName("r1"))
+	assert.Equal(t, "welcome", r.Topic("r1"))
+
+	var subs []string
+
+	for len(subs) < 4 {
+		select {
+		case sub := <-fs.subs:
+			subs = append(subs, sub)
+		case <-time.After(time.Second):
+			t.Fatalf("only got subscriptions %v", subs)
+		}
+	}
+
+	assert.ElementsMatch(t, []string{
+		"stream-room-messages", "stream-notify-user", "stream-notify-user", "stream-notify-logged",
+	}, subs)
+}
+
+func TestJoin(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.Close()
+	defer close(fs.stream)
+
+	r, _, err := newTestRocketChat(fs, "secret")
+	assert.NoError(t, err)
+
+	defer r.Logout()
+
+	id, topic, err := r.Join("random")
+	assert.NoError(t, err)
+	assert.Equal(t, "r2", id)
+	assert.Equal(t, "off topic", topic)
+	assert.Equal(t, "#random", r.GetChannelName("r2"))
+
+	_, _, err = r.Join("nonexistent")
+	assert.Equal(t, bridge.ErrNoSuchChannel, err)
+}
+
+func TestMessage(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.Close()
+	defer close(fs.stream)
+
+	r, eventChan, err := newTestRocketChat(fs, "secret")
+	assert.NoError(t, err)
+
+	defer r.Logout()
+
+	assert.NoError(t, r.MsgChannel("r1", "hi"))
+
+	sent := <-fs.sent
+	assert.Equal(t, "r1", sent["rid"])
+	assert.Equal(t, "hi", sent["msg"])
+	assert.Len(t, sent["_id"], 17)
+
+	// our own message comes back on the stream and isn't relayed, bob's is
+	for _, msg := range []string{
+		`{"_id": "` + sent["_id"] + `", "rid": "r1", "msg": "hi", "u": {"_id": "u1", "username": "alice"}}`,
+		`{"_id": "m2", "rid": "r1", "msg": "hello", "u": {"_id": "u2", "username": "bob"}}`,
+	} {
+		fs.stream <- `{"msg": "changed", "collection": "stream-room-messages",
+			"fields": {"eventName": "__my_messages__", "args": [` + msg + `]}}`
+	}
+
+	event := nextEvent(t, eventChan)
+	assert.Equal(t, "channel_message", event.Type)
+
+	msg := event.Data.(*bridge.ChannelMessageEvent)
+	assert.Equal(t, "hello", msg.Text)
+	assert.Equal(t, "r1", msg.ChannelID)
+	assert.Equal(t, "bob", msg.Sender.Nick)
+}
+
+func TestSubscriptionChanged(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.Close()
+	defer close(fs.stream)
+
+	r, eventChan, err := newTestRocketChat(fs, "secret")
+	assert.NoError(t, err)
+
+	defer r.Logout()
+
+	sub := func(action, ls string) string {
+		return `{"msg": "changed", "collection": "stream-notify-user", "fields": {"eventName": "u1/subscriptions-changed",
+			"args": ["` + action + `", {"rid": "r1", "name": "general", "t": "c", "ls": {"$date": ` + ls + `}}]}}`
+	}
+
+	fs.stream <- sub("updated", "1577836800000")
+	fs.stream <- sub("updated", "1577840400000")
+
+	event := nextEvent(t, eventChan)
+	assert.Equal(t, "channel_viewed", event.Type)
+	assert.Equal(t, &bridge.ChannelViewedEvent{ChannelID: "r1", ViewedAt: 1577840400000}, event.Data)
+
+	fs.stream <- sub("removed", "0")
+
+	event = nextEvent(t, eventChan)
+	assert.Equal(t, "channel_delete", event.Type)
+	assert.Equal(t, "r1", event.Data.(*bridge.ChannelDeleteEvent).ChannelID)
+}
+
+func TestNewMessageID(t *testing.T) {
+	id, err := newMessageID()
+	assert.NoError(t, err)
+	assert.Len(t, id, 17)
+	assert.Empty(t, strings.Trim(id, "23456789ABCDEFGHJKLMNPQRSTWXYZabcdefghijkmnopqrstuvwxyz"))
+}
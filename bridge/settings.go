@@ -0,0 +1,108 @@
+package bridge
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// channelNameTTL is how long a channel name is remembered, a message looks up several options.
+var channelNameTTL = time.Minute
+
+// Settings looks up options which can be overridden per channel in [<protocol>.channel."#channel"],
+// eg HideReplies. Channels use their name on the bridge, eg #general or #team/general.
+type Settings struct {
+	v           *Config
+	protocol    string
+	channelName func(channelID string) string
+
+	sync.Mutex
+	names map[string]cachedName
+}
+
+type cachedName struct {
+	name    string
+	expires time.Time
+}
+
+// NewSettings returns the settings of a bridge, channelName is its GetChannelName.
+func NewSettings(v *Config, protocol string, channelName func(string) string) *Settings {
+	return &Settings{
+		v:           v,
+		protocol:    protocol,
+		channelName: channelName,
+		names:       make(map[string]cachedName),
+	}
+}
+
+// Channel returns the overrides of a channel, nil when there are none.
+// Getting the channel name can be slow, so it's only done when channels are configured.
+func (s *Settings) Channel(channelID string) map[string]interface{} {
+	v := s.v.Viper()
+	if channelID == "" || !v.IsSet(s.protocol+".channel") {
+		return nil
+	}
+
+	return ChannelConfig(v, s.protocol, s.name(channelID))
+}
+
+// name returns the name of a channel, it's cached as getting it can take a request to the bridge.
+func (s *Settings) name(channelID string) string {
+	now := time.Now()
+
+	s.Lock()
+	cached, ok := s.names[channelID]
+	s.Unlock()
+
+	if ok && now.Before(cached.expires) {
+		return cached.name
+	}
+
+	name := s.channelName(channelID)
+
+	s.Lock()
+	s.names[channelID] = cachedName{name: name, expires: now.Add(channelNameTTL)}
+	s.Unlock()
+
+	return name
+}
+
+// Forget drops the cached name of a channel, eg when it got renamed.
+func (s *Settings) Forget(channelID string) {
+	s.Lock()
+	delete(s.names, channelID)
+	s.Unlock()
+}
+
+// Bool returns the value of a bool option for a channel.
+func (s *Settings) Bool(channelID, key string) bool {
+	if b, ok := s.Channel(channelID)[strings.ToLower(key)].(bool); ok {
+		return b
+	}
+
+	return s.v.GetBool(s.protocol + "." + key)
+}
+
+// String returns the value of a string option for a channel.
+func (s *Settings) String(channelID, key string) string {
+	if str, ok := s.Channel(channelID)[strings.ToLower(key)].(string); ok {
+		return str
+	}
+
+	return s.v.GetString(s.protocol + "." + key)
+}
+
+// ChannelConfig returns the settings of [<protocol>.channel."<channel>"], nil when there are none.
+// Channel names can contain dots, so they're looked up in the table instead of by key.
+func ChannelConfig(v *viper.Viper, protocol, channel string) map[string]interface{} {
+	for name, settings := range v.GetStringMap(protocol + ".channel") {
+		if strings.EqualFold(name, channel) {
+			m, _ := settings.(map[string]interface{})
+			return m
+		}
+	}
+
+	return nil
+}
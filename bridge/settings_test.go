@@ -0,0 +1,49 @@
+package bridge
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSettings(t *testing.T) {
+	v := viper.New()
+	v.Set("slack.hidereplies", true)
+	v.Set("slack.channel", map[string]interface{}{
+		"#rust:mozilla.org": map[string]interface{}{"hidereplies": false, "notice": true},
+	})
+
+	settings := NewSettings(NewConfig(v), "slack", func(id string) string { return id })
+
+	assert.True(t, settings.Bool("#general", "HideReplies"))
+	assert.False(t, settings.Bool("#Rust:mozilla.org", "HideReplies"))
+	assert.True(t, settings.Bool("#rust:mozilla.org", "Notice"))
+	assert.False(t, settings.Bool("#general", "Notice"))
+}
+
+func TestSettingsChannelNameCache(t *testing.T) {
+	v := viper.New()
+	v.Set("slack.channel", map[string]interface{}{
+		"#general": map[string]interface{}{"notice": true},
+	})
+
+	lookups := 0
+	name := "#general"
+
+	settings := NewSettings(NewConfig(v), "slack", func(id string) string {
+		lookups++
+		return name
+	})
+
+	assert.True(t, settings.Bool("C1", "Notice"))
+	assert.True(t, settings.Bool("C1", "Notice"))
+	assert.Equal(t, 1, lookups)
+
+	// renamed
+	name = "#random"
+
+	settings.Forget("C1")
+	assert.False(t, settings.Bool("C1", "Notice"))
+	assert.Equal(t, 2, lookups)
+}
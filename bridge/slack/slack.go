@@ -3,6 +3,7 @@ package slack
 import (
 	"errors"
 	"fmt"
+	"math"
 	"strings"
 	"sync"
 	"time"
@@ -11,7 +12,6 @@ import (
 	"github.com/davecgh/go-spew/spew"
 	logger "github.com/sirupsen/logrus"
 	"github.com/slack-go/slack"
-	"github.com/spf13/viper"
 )
 
 type Slack struct {
@@ -25,10 +25,12 @@ type Slack struct {
 	eventChan    chan *bridge.Event
 	onConnect    func()
 	sync.RWMutex
-	v *viper.Viper
+	v         *bridge.Config
+	settings  *bridge.Settings
+	templates *bridge.Templates
 }
 
-func New(v *viper.Viper, cred bridge.Credentials, eventChan chan *bridge.Event, onConnect func()) (bridge.Bridger, error) {
+func New(v *bridge.Config, cred bridge.Credentials, eventChan chan *bridge.Event, onConnect func()) (bridge.Bridger, error) {
 	s := &Slack{
 		credentials: cred,
 		eventChan:   eventChan,
@@ -36,6 +38,12 @@ func New(v *viper.Viper, cred bridge.Credentials, eventChan chan *bridge.Event,
 		v:           v,
 	}
 
+	s.settings = bridge.NewSettings(v, "slack", s.GetChannelName)
+	s.templates = bridge.NewTemplates(s.settings, map[string]string{
+		bridge.TemplateReply: "[T {{.Timestamp}}] {{.Message}}",
+		bridge.TemplateEdit:  "[C {{.Timestamp}}] {{.Message}}",
+	})
+
 	var err error
 
 	if v.GetBool("debug") {
@@ -72,7 +80,22 @@ func (s *Slack) Invite(channelID, username string) error {
 }
 
 func (s *Slack) Join(channelName string) (string, string, error) {
-	mychan, _, _, err := s.sc.JoinConversation(channelName)
+	// JoinConversation wants the ID
+	channel, err := s.channelByName(channelName)
+	if err != nil {
+		return "", "", fmt.Errorf("cannot join channel (+i): %s", err)
+	}
+
+	if channel == nil {
+		return "", "", bridge.ErrNoSuchChannel
+	}
+
+	// private channels are only listed when we're a member
+	if channel.IsMember || channel.IsPrivate {
+		return channel.ID, channel.Topic.Value, nil
+	}
+
+	mychan, _, _, err := s.sc.JoinConversation(channel.ID)
 	if err != nil {
 		return "", "", fmt.Errorf("cannot join channel (+i): %s", err)
 	}
@@ -80,6 +103,36 @@ func (s *Slack) Join(channelName string) (string, string, error) {
 	return mychan.ID, mychan.Topic.Value, nil
 }
 
+// channelByName looks up a channel we can see by its name, nil when there's none.
+func (s *Slack) channelByName(name string) (*slack.Channel, error) {
+	name = strings.TrimPrefix(name, "#")
+
+	params := slack.GetConversationsParameters{
+		ExcludeArchived: "true",
+		Limit:           1000,
+		Types:           []string{"public_channel", "private_channel"},
+	}
+
+	for {
+		conversations, nextCursor, err := s.sc.GetConversations(&params)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range conversations {
+			if strings.EqualFold(conversations[i].Name, name) {
+				return &conversations[i], nil
+			}
+		}
+
+		if nextCursor == "" {
+			return nil, nil
+		}
+
+		params.Cursor = nextCursor
+	}
+}
+
 func (s *Slack) List() (map[string]string, error) {
 	channelinfo := make(map[string]string)
 
@@ -208,21 +261,61 @@ func (s *Slack) Protocol() string {
 	return "slack"
 }
 
+// GetLimits returns the limits documented by slack, see https://api.slack.com/methods/conversations.create
+func (s *Slack) GetLimits() *bridge.Limits {
+	return &bridge.Limits{
+		NickLen:    80,
+		ChannelLen: 81,
+		TopicLen:   250,
+		PostLen:    40000,
+	}
+}
+
 func (s *Slack) Kick(channelID, username string) error {
 	return s.sc.KickUserFromConversation(strings.ToUpper(channelID), username)
 }
 
+// SetStatus sets the presence with users.setPresence, slack has no offline so that's away too.
 func (s *Slack) SetStatus(status string) error {
 	switch status {
 	case "online":
 		return s.sc.SetUserPresence("auto")
-	case "away":
+	case "away", "offline":
 		return s.sc.SetUserPresence("away")
 	}
 
 	return nil
 }
 
+// SetDND snoozes the notifications, slack doesn't have a do not disturb without an end.
+func (s *Slack) SetDND(until time.Time) error {
+	if until.IsZero() {
+		return errors.New("do not disturb needs a duration on slack")
+	}
+
+	_, err := s.sc.SetSnooze(int(math.Ceil(time.Until(until).Minutes())))
+
+	return err
+}
+
+func (s *Slack) SetCustomStatus(status *bridge.CustomStatus) error {
+	if status == nil {
+		return s.sc.UnsetUserCustomStatus()
+	}
+
+	var emoji string
+	if status.Emoji != "" {
+		emoji = ":" + status.Emoji + ":"
+	}
+
+	var expiration int64
+	if !status.ExpiresAt.IsZero() {
+		expiration = status.ExpiresAt.Unix()
+	}
+
+	return s.sc.SetUserCustomStatus(status.Text, emoji, expiration)
+}
+
 func (s *Slack) Nick(name string) error {
 	return nil
 }
@@ -231,9 +324,13 @@ func (s *Slack) GetChannelName(channelID string) string {
 	var name string
 
 	info, err := s.sc.GetConversationInfo(channelID, false)
-	if err != nil {
+
+	switch {
+	case err != nil:
 		name = channelID
-	} else {
+	case info.IsMpIM && s.v.GetBool("slack.GroupChannelNames"):
+		name = s.groupChannelName(info.Name)
+	default:
 		name = "#" + info.Name
 	}
 
@@ -341,6 +438,178 @@ func (s *Slack) GetChannels() []*bridge.ChannelInfo {
 	return channels
 }
 
+func (s *Slack) GetChannel(channelID string) *bridge.ChannelInfo {
+	info, err := s.sc.GetConversationInfo(strings.ToUpper(channelID), false)
+	if err != nil || info == nil {
+		return nil
+	}
+
+	return &bridge.ChannelInfo{
+		Name:     info.Name,
+		ID:       info.ID,
+		TeamID:   s.sinfo.Team.ID,
+		Private:  info.IsPrivate,
+		Direct:   info.IsIM || info.IsMpIM,
+		ReadOnly: info.IsArchived,
+	}
+}
+
+// GetChannelMembers returns the members of a channel, slack has no channel admins so
+// workspace admins and owners are used instead.
+func (s *Slack) GetChannelMembers(channelID string) ([]*bridge.ChannelMember, error) {
+	var members []*bridge.ChannelMember
+
+	params := slack.GetUsersInConversationParameters{
+		ChannelID: strings.ToUpper(channelID),
+		Limit:     100,
+	}
+
+	for {
+		userIDs, nextCursor, err := s.sc.GetUsersInConversation(&params)
+		if err != nil {
+			return nil, err
+		}
+
+		params.Cursor = nextCursor
+
+		for _, userID := range userIDs {
+			suser := s.getSlackUser(userID)
+			if suser == nil {
+				continue
+			}
+
+			members = append(members, &bridge.ChannelMember{
+				UserID: suser.ID,
+				Admin:  suser.IsAdmin || suser.IsOwner,
+				Guest:  suser.IsRestricted || suser.IsUltraRestricted,
+				Bot:    suser.IsBot,
+			})
+		}
+
+		if nextCursor == "" {
+			break
+		}
+	}
+
+	return members, nil
+}
+
+func (s *Slack) SetChannelAdmin(channelID, userID string, admin bool) error {
+	return errors.New("slack has no channel admins")
+}
+
+// groupChannelName returns the IRC name of a group message, slack names them after the usernames of
+// the members, eg mpdm-alice--bob--carol-1
+func (s *Slack) groupChannelName(mpimName string) string {
+	var nicks []string
+
+	mpimName = strings.TrimPrefix(mpimName, "mpdm-")
+	if i := strings.LastIndex(mpimName, "-"); i > 0 {
+		mpimName = mpimName[:i]
+	}
+
+	for _, username := range strings.Split(mpimName, "--") {
+		if username != s.sinfo.User.Name {
+			nicks = append(nicks, s.nickOf(username))
+		}
+	}
+
+	return bridge.GroupChannelName(nicks)
+}
+
+// nickOf returns the nick of a user the way createUser makes it, the username when the user isn't cached.
+func (s *Slack) nickOf(username string) string {
+	var found *slack.User
+
+	s.RLock()
+	for _, suser := range s.susers {
+		if suser.Name == username {
+			suser := suser
+			found = &suser
+			break
+		}
+	}
+	s.RUnlock()
+
+	if found == nil {
+		return username
+	}
+
+	return s.createUser(found).Nick
+}
+
+func (s *Slack) CreateGroup(userIDs []string) (string, error) {
+	users := make([]string, 0, len(userIDs))
+	for _, userID := range userIDs {
+		users = append(users, strings.ToUpper(userID))
+	}
+
+	mychan, _, _, err := s.sc.OpenConversation(&slack.OpenConversationParameters{Users: users})
+	if err != nil {
+		return "", err
+	}
+
+	return mychan.ID, nil
+}
+
+func (s *Slack) MuteChannel(channelID string, mute bool) error {
+	return errors.New("slack channels can't be muted from IRC")
+}
+
+func (s *Slack) FavoriteChannel(channelID string, favorite bool) error {
+	return errors.New("slack channels can't be favorited from IRC")
+}
+
+func (s *Slack) CreateChannel(channelName string, private bool) (string, error) {
+	mychan, err := s.sc.CreateConversation(channelName, private)
+	if err != nil {
+		return "", err
+	}
+
+	return mychan.ID, nil
+}
+
+func (s *Slack) RenameChannel(channelID, newName string) error {
+	_, err := s.sc.RenameConversation(strings.ToUpper(channelID), newName)
+	return err
+}
+
+func (s *Slack) SetPurpose(channelID, text string) error {
+	_, err := s.sc.SetPurposeOfConversation(strings.ToUpper(channelID), text)
+	return err
+}
+
+func (s *Slack) ArchiveChannel(channelID string) error {
+	return s.sc.ArchiveConversation(strings.ToUpper(channelID))
+}
+
+func (s *Slack) UnarchiveChannel(channelName string) (string, error) {
+	params := slack.GetConversationsParameters{
+		ExcludeArchived: "false",
+		Limit:           100,
+		Types:           []string{"public_channel", "private_channel"},
+	}
+
+	for {
+		conversations, nextCursor, err := s.sc.GetConversations(&params)
+		if err != nil {
+			return "", err
+		}
+
+		for _, channel := range conversations {
+			if channel.Name == channelName && channel.IsArchived {
+				return channel.ID, s.sc.UnArchiveConversation(channel.ID)
+			}
+		}
+
+		if nextCursor == "" {
+			return "", fmt.Errorf("no archived channel %s", channelName)
+		}
+
+		params.Cursor = nextCursor
+	}
+}
+
 func (s *Slack) GetUser(userID string) *bridge.UserInfo {
 	return s.createUser(s.getSlackUser(userID))
 }
@@ -354,6 +623,10 @@ func (s *Slack) GetUserByUsername(username string) *bridge.UserInfo {
 	return nil
 }
 
+func (s *Slack) MentionUser(userID string) string {
+	return "<@" + strings.ToUpper(userID) + ">"
+}
+
 func (s *Slack) GetTeamName(teamID string) string {
 	return s.sinfo.Team.Name
 }
@@ -362,6 +635,10 @@ func (s *Slack) GetLastViewedAt(channelID string) int64 {
 	return 0
 }
 
+func (s *Slack) GetUnread() ([]*bridge.Unread, error) {
+	return nil, errors.New("unread counts are not supported on slack")
+}
+
 func (s *Slack) GetPostsSince(channelID string, since int64) interface{} {
 	return nil
 }
@@ -390,7 +667,12 @@ func (s *Slack) GetPosts(channelID string, limit int) interface{} {
 }
 
 func (s *Slack) GetChannelID(name, teamID string) string {
-	return ""
+	channel, err := s.channelByName(name)
+	if err != nil || channel == nil {
+		return ""
+	}
+
+	return channel.ID
 }
 
 func (s *Slack) allowedLogin() error {
@@ -482,44 +764,65 @@ func (s *Slack) handleSlack() {
 			}
 		case *slack.MemberLeftChannelEvent:
 			s.handleMemberLeftChannel(ev)
+		case *slack.ChannelRenameEvent:
+			s.settings.Forget(ev.Channel.ID)
+			s.sendChannelEvent(&bridge.ChannelUpdateEvent{ChannelID: ev.Channel.ID})
+		case *slack.GroupRenameEvent:
+			s.settings.Forget(ev.Group.ID)
+			s.sendChannelEvent(&bridge.ChannelUpdateEvent{ChannelID: ev.Group.ID})
+		case *slack.ChannelArchiveEvent:
+			s.sendChannelEvent(&bridge.ChannelDeleteEvent{ChannelID: ev.Channel})
+		case *slack.GroupArchiveEvent:
+			s.sendChannelEvent(&bridge.ChannelDeleteEvent{ChannelID: ev.Channel})
+		case *slack.ChannelUnarchiveEvent:
+			s.sendChannelEvent(&bridge.ChannelCreateEvent{ChannelID: ev.Channel})
+		case *slack.GroupUnarchiveEvent:
+			s.sendChannelEvent(&bridge.ChannelCreateEvent{ChannelID: ev.Channel})
 		case *slack.MemberJoinedChannelEvent:
 			s.handleMemberJoinedChannel(ev)
+		case *slack.ChannelMarkedEvent:
+			s.sendChannelEvent(&bridge.ChannelViewedEvent{ChannelID: ev.Channel, ViewedAt: tsMillis(ev.Timestamp)})
+		case *slack.GroupMarkedEvent:
+			s.sendChannelEvent(&bridge.ChannelViewedEvent{ChannelID: ev.Channel, ViewedAt: tsMillis(ev.Timestamp)})
+		case *slack.IMMarkedEvent:
+			s.sendChannelEvent(&bridge.ChannelViewedEvent{ChannelID: ev.Channel, ViewedAt: tsMillis(ev.Timestamp)})
 		case *slack.DisconnectedEvent:
 			logger.Debug("disconnected event received, we should reconnect now..")
 		case *slack.ReactionAddedEvent:
 			logger.Debugf("ReactionAdded msg %#v", ev)
-			ts := formatTS(ev.Item.Timestamp)
-			msg := "[M " + ts + "] Added reaction :" + ev.Reaction + ":"
+			msg := s.templates.Render(bridge.TemplateReactionAdded, ev.Item.Channel,
+				&bridge.TemplateData{Timestamp: formatTS(ev.Item.Timestamp), Reaction: ev.Reaction})
 			s.handleActionMisc(ev.User, ev.Item.Channel, msg)
 		case *slack.ReactionRemovedEvent:
 			logger.Debugf("ReactionRemoved msg %#v", ev)
-			ts := formatTS(ev.Item.Timestamp)
-			msg := "[M " + ts + "] Removed reaction :" + ev.Reaction + ":"
+			msg := s.templates.Render(bridge.TemplateReactionRemoved, ev.Item.Channel,
+				&bridge.TemplateData{Timestamp: formatTS(ev.Item.Timestamp), Reaction: ev.Reaction})
 			s.handleActionMisc(ev.User, ev.Item.Channel, msg)
 		case *slack.StarAddedEvent:
 			logger.Debugf("StarAdded msg %#v", ev)
-			ts := formatTS(ev.Item.Message.Timestamp)
-			msg := "[M " + ts + "] Message starred (" + ev.Item.Message.Text + ")"
-			s.handleActionMisc(ev.User, ev.Item.Channel, msg)
+			s.handleActionSystem(ev.User, slack.Item(ev.Item), "Message starred")
 		case *slack.StarRemovedEvent:
 			logger.Debugf("StarRemoved msg %#v", ev)
-			ts := formatTS(ev.Item.Message.Timestamp)
-			msg := "[M " + ts + "] Message unstarred (" + ev.Item.Message.Text + ")"
-			s.handleActionMisc(ev.User, ev.Item.Channel, msg)
+			s.handleActionSystem(ev.User, slack.Item(ev.Item), "Message unstarred")
 		case *slack.PinAddedEvent:
 			logger.Debugf("PinAdded msg %#v", ev)
-			ts := formatTS(ev.Item.Message.Timestamp)
-			msg := "[M " + ts + "] Message pinned (" + ev.Item.Message.Text + ")"
-			s.handleActionMisc(ev.User, ev.Item.Channel, msg)
+			s.handleActionSystem(ev.User, ev.Item, "Message pinned")
 		case *slack.PinRemovedEvent:
 			logger.Debugf("PinRemoved msg %#v", ev)
-			ts := formatTS(ev.Item.Message.Timestamp)
-			msg := "[M " + ts + "] Message unpinned (" + ev.Item.Message.Text + ")"
-			s.handleActionMisc(ev.User, ev.Item.Channel, msg)
+			s.handleActionSystem(ev.User, ev.Item, "Message unpinned")
 		}
 	}
 }
 
+// handleActionSystem sends a star or pin of a message with the system template.
+func (s *Slack) handleActionSystem(userID string, item slack.Item, text string) {
+	msg := s.templates.Render(bridge.TemplateSystem, item.Channel, &bridge.TemplateData{
+		Timestamp: formatTS(item.Message.Timestamp),
+		Message:   text + " (" + item.Message.Text + ")",
+	})
+	s.handleActionMisc(userID, item.Channel, msg)
+}
+
 func (s *Slack) handleActionMisc(userID, channelID, msg string) {
 	suser, err := s.rtm.GetUserInfo(userID)
 	if err != nil {
@@ -547,6 +850,25 @@ func (s *Slack) handleActionMisc(userID, channelID, msg string) {
 	}
 }
 
+// sendChannelEvent sends the create, update and delete events of channels.
+func (s *Slack) sendChannelEvent(data interface{}) {
+	eventType := "channel_update"
+
+	switch data.(type) {
+	case *bridge.ChannelCreateEvent:
+		eventType = "channel_create"
+	case *bridge.ChannelDeleteEvent:
+		eventType = "channel_delete"
+	case *bridge.ChannelViewedEvent:
+		eventType = "channel_viewed"
+	}
+
+	s.eventChan <- &bridge.Event{
+		Type: eventType,
+		Data: data,
+	}
+}
+
 func (s *Slack) handleMemberLeftChannel(rmsg *slack.MemberLeftChannelEvent) {
 	event := &bridge.Event{
 		Type: "channel_remove",
@@ -634,13 +956,14 @@ func (s *Slack) sendDirectMessage(ghost *bridge.UserInfo, msg string, channelID
 	s.eventChan <- event
 }
 
-func (s *Slack) sendPublicMessage(ghost *bridge.UserInfo, msg, channelID string) {
+func (s *Slack) sendPublicMessage(ghost *bridge.UserInfo, msg, channelID string, mention bool) {
 	event := &bridge.Event{
 		Type: "channel_message",
 		Data: &bridge.ChannelMessageEvent{
 			Text:      msg,
 			ChannelID: channelID,
 			Sender:    ghost,
+			Mention:   mention,
 		},
 	}
 
@@ -667,8 +990,8 @@ func (s *Slack) handleSlackActionPost(rmsg *slack.MessageEvent) {
 	}
 
 	if rmsg.SubType == "message_deleted" {
-		ts := formatTS(rmsg.DeletedTimestamp)
-		rmsg.Text = "[M " + ts + "] Message deleted"
+		rmsg.Text = s.templates.Render(bridge.TemplateDelete, rmsg.Channel,
+			&bridge.TemplateData{Timestamp: formatTS(rmsg.DeletedTimestamp)})
 	}
 
 	// TODO: cache userinfo
@@ -729,20 +1052,25 @@ func (s *Slack) handleSlackActionPost(rmsg *slack.MessageEvent) {
 
 	if msghandled {
 		if rmsg.ThreadTimestamp != "" && len(msgs) > 0 {
-			msgs[0] = "[T " + formatTS(rmsg.ThreadTimestamp) + "] " + msgs[0]
+			msgs[0] = s.templates.Render(bridge.TemplateReply, rmsg.Channel,
+				&bridge.TemplateData{Timestamp: formatTS(rmsg.ThreadTimestamp), Message: msgs[0]})
 		}
 	}
 
 	if rmsg.SubType == "message_changed" {
 		msgs = append(msgs, strings.Split(rmsg.SubMessage.Text, "\n")...)
 		if len(msgs) > 0 {
-			msgs[0] = "[C " + formatTS(rmsg.SubMessage.Timestamp) + "] " + msgs[0]
+			msgs[0] = s.templates.Render(bridge.TemplateEdit, rmsg.Channel,
+				&bridge.TemplateData{Timestamp: formatTS(rmsg.SubMessage.Timestamp), Message: msgs[0]})
 		}
 		msghandled = true
 	}
 
 	channelID := rmsg.Channel
 
+	// edits and deletions aren't new mentions
+	mention := rmsg.SubType == "" && suser.ID != s.sinfo.User.ID && s.isMention(rmsg.Text)
+
 	for _, msg := range msgs {
 		// cleanup the message
 		msg = s.cleanupMessage(msg)
@@ -759,7 +1087,7 @@ func (s *Slack) handleSlackActionPost(rmsg *slack.MessageEvent) {
 		default:
 			// could be a bot
 			ghost.Nick = spoofUsername
-			s.sendPublicMessage(ghost, msg, channelID)
+			s.sendPublicMessage(ghost, msg, channelID, mention)
 		}
 	}
 }
@@ -126,6 +126,15 @@ func formatTS(unixts string) string {
 	return ts.Format("15:04:05")
 }
 
+// tsMillis converts a slack timestamp, eg 1355517523.000005, to milliseconds.
+func tsMillis(unixts string) int64 {
+	var targetts, targetus int64
+
+	fmt.Sscanf(unixts, "%d.%d", &targetts, &targetus)
+
+	return targetts*1000 + targetus/1000
+}
+
 // @see https://api.slack.com/docs/message-formatting#linking_to_channels_and_users
 func (s *Slack) replaceMention(text string) string {
 	results := regexp.MustCompile(`<@([a-zA-z0-9]+)>`).FindAllStringSubmatch(text, -1)
@@ -136,6 +145,21 @@ func (s *Slack) replaceMention(text string) string {
 	return text
 }
 
+// isMention returns whether a message mentions us, <@U123> or <@U123|alice>, or everyone, <!here>.
+func (s *Slack) isMention(text string) bool {
+	if strings.Contains(text, "<@"+s.sinfo.User.ID+">") || strings.Contains(text, "<@"+s.sinfo.User.ID+"|") {
+		return true
+	}
+
+	for _, variable := range []string{"<!here", "<!channel", "<!everyone"} {
+		if strings.Contains(text, variable) {
+			return true
+		}
+	}
+
+	return false
+}
+
 // @see https://api.slack.com/docs/message-formatting#linking_to_channels_and_users
 func replaceChannel(text string) string {
 	results := regexp.MustCompile(`<#[a-zA-Z0-9]+\|(.+?)>`).FindAllStringSubmatch(text, -1)
@@ -0,0 +1,137 @@
+package bridge
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"text/template"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// Kinds of templates, they're configured in [<protocol>.templates] and per channel in
+// [<protocol>.channel."#channel".templates].
+const (
+	TemplateReply           = "Reply"
+	TemplateEdit            = "Edit"
+	TemplateDelete          = "Delete"
+	TemplateFile            = "File"
+	TemplateReactionAdded   = "ReactionAdded"
+	TemplateReactionRemoved = "ReactionRemoved"
+	TemplateReplay          = "Replay"
+	TemplateReplaySince     = "ReplaySince"
+	TemplateSystem          = "System"
+)
+
+// DefaultTemplates are used for the kinds a bridge and the configuration don't set.
+var DefaultTemplates = map[string]string{
+	TemplateReply:           "{{.Message}} (re @{{.ParentNick}}{{if .ParentMessage}}: {{.ParentMessage}}{{end}})",
+	TemplateEdit:            "{{.Message}} (edited)",
+	TemplateDelete:          "[M {{.Timestamp}}] Message deleted",
+	TemplateFile:            "download file -{{.File}}",
+	TemplateReactionAdded:   "[M {{.Timestamp}}] Added reaction :{{.Reaction}}:",
+	TemplateReactionRemoved: "[M {{.Timestamp}}] Removed reaction :{{.Reaction}}:",
+	TemplateReplay:          "[{{.Timestamp}}] {{.Message}}",
+	TemplateReplaySince:     "Replaying since {{.Timestamp}}",
+	TemplateSystem:          "[M {{.Timestamp}}] {{.Message}}",
+}
+
+// TemplateData is what templates can use, not every kind sets every field.
+type TemplateData struct {
+	Message       string
+	ParentNick    string
+	ParentMessage string
+	Timestamp     string
+	Reaction      string
+	File          string
+}
+
+// Templates renders the text added to bridged messages, eg replies and edits.
+type Templates struct {
+	settings *Settings
+	defaults map[string]string
+
+	sync.Mutex
+	parsed map[string]*template.Template
+}
+
+// NewTemplates returns the templates of a bridge, defaults overrides DefaultTemplates for it.
+func NewTemplates(settings *Settings, defaults map[string]string) *Templates {
+	t := &Templates{
+		settings: settings,
+		defaults: make(map[string]string),
+		parsed:   make(map[string]*template.Template),
+	}
+
+	for kind, text := range DefaultTemplates {
+		t.defaults[kind] = text
+	}
+
+	for kind, text := range defaults {
+		t.defaults[kind] = text
+	}
+
+	return t
+}
+
+// Render renders the template of kind for a channel, the default template is used when the
+// configured one is invalid.
+func (t *Templates) Render(kind, channelID string, data *TemplateData) string {
+	text := t.lookup(kind, channelID)
+
+	out, err := t.execute(text, data)
+	if err != nil {
+		logger.Errorf("template %s %q failed: %s", kind, text, err)
+
+		out, _ = t.execute(t.defaults[kind], data)
+	}
+
+	return out
+}
+
+// lookup returns the template text of kind, the channel setting wins over the bridge one.
+func (t *Templates) lookup(kind, channelID string) string {
+	kind = strings.ToLower(kind)
+
+	templates, _ := t.settings.Channel(channelID)["templates"].(map[string]interface{})
+	if text, ok := templates[kind].(string); ok {
+		return text
+	}
+
+	if text := t.settings.String("", "templates."+kind); text != "" {
+		return text
+	}
+
+	for k, text := range t.defaults {
+		if strings.ToLower(k) == kind {
+			return text
+		}
+	}
+
+	return ""
+}
+
+func (t *Templates) execute(text string, data *TemplateData) (string, error) {
+	t.Lock()
+	tmpl, ok := t.parsed[text]
+	t.Unlock()
+
+	if !ok {
+		var err error
+
+		tmpl, err = template.New("").Parse(text)
+		if err != nil {
+			return "", err
+		}
+
+		t.Lock()
+		t.parsed[text] = tmpl
+		t.Unlock()
+	}
+
+	var buf bytes.Buffer
+
+	err := tmpl.Execute(&buf, data)
+
+	return buf.String(), err
+}
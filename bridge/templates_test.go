@@ -0,0 +1,32 @@
+package bridge
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemplates(t *testing.T) {
+	v := viper.New()
+	v.Set("mattermost.templates.edit", "{{.Message}} [edit]")
+	v.Set("mattermost.templates.file", "{{.Broken")
+	v.Set("mattermost.channel", map[string]interface{}{
+		"#alerts": map[string]interface{}{
+			"templates": map[string]interface{}{"edit": "* {{.Message}}"},
+		},
+	})
+
+	names := map[string]string{"id1": "#alerts", "id2": "#general"}
+	tmpl := NewTemplates(NewSettings(NewConfig(v), "mattermost", func(id string) string { return names[id] }), nil)
+
+	assert.Equal(t, "hi (re @bob: hello)", tmpl.Render(TemplateReply, "id2",
+		&TemplateData{Message: "hi", ParentNick: "bob", ParentMessage: "hello"}))
+	assert.Equal(t, "hi (re @bob)", tmpl.Render(TemplateReply, "id2", &TemplateData{Message: "hi", ParentNick: "bob"}))
+	assert.Equal(t, "hi [edit]", tmpl.Render(TemplateEdit, "id2", &TemplateData{Message: "hi"}))
+	assert.Equal(t, "* hi", tmpl.Render(TemplateEdit, "id1", &TemplateData{Message: "hi"}))
+	assert.Equal(t, "download file -x", tmpl.Render(TemplateFile, "id1", &TemplateData{File: "x"}))
+
+	slack := NewTemplates(NewSettings(NewConfig(v), "slack", nil), map[string]string{TemplateEdit: "[C {{.Timestamp}}] {{.Message}}"})
+	assert.Equal(t, "[C 10:00] hi", slack.Render(TemplateEdit, "", &TemplateData{Message: "hi", Timestamp: "10:00"}))
+}
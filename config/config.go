@@ -3,13 +3,50 @@ package config
 import (
 	"fmt"
 	"strings"
+	"sync"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
 var Logger *logrus.Entry
 
+var (
+	subscribersMu sync.Mutex
+	subscribers   = make(map[int]func())
+	subscriberID  int
+)
+
+// Subscribe calls fn after every reload of the config file, until the returned function is called.
+func Subscribe(fn func()) func() {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+
+	subscriberID++
+	id := subscriberID
+	subscribers[id] = fn
+
+	return func() {
+		subscribersMu.Lock()
+		delete(subscribers, id)
+		subscribersMu.Unlock()
+	}
+}
+
+func notifySubscribers() {
+	subscribersMu.Lock()
+	fns := make([]func(), 0, len(subscribers))
+	for _, fn := range subscribers {
+		fns = append(fns, fn)
+	}
+	subscribersMu.Unlock()
+
+	for _, fn := range fns {
+		fn()
+	}
+}
+
 func LoadConfig(cfgfile string) (*viper.Viper, error) {
 	v := viper.New()
 	v.SetConfigFile(cfgfile)
@@ -24,6 +61,10 @@ func LoadConfig(cfgfile string) (*viper.Viper, error) {
 	}
 
 	// reload config on file changes
+	v.OnConfigChange(func(e fsnotify.Event) {
+		Logger.Infof("config file %s changed, applying it", e.Name)
+		notifySubscribers()
+	})
 	v.WatchConfig()
 
 	return v, nil
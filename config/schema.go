@@ -0,0 +1,593 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/42wim/matterircd/bridge"
+	"github.com/spf13/viper"
+)
+
+// Kinds of values of options.
+const (
+	kindBool    = "a bool"
+	kindString  = "a string"
+	kindInt     = "a number"
+	kindStrings = "an array of strings"
+)
+
+// option is a setting of matterircd.toml, protocols limits it to some bridges.
+type option struct {
+	name      string
+	kind      string
+	def       interface{}
+	protocols []string
+
+	// protocolDefaults are used instead of def for these bridges
+	protocolDefaults map[string]interface{}
+}
+
+// protocols are the bridge sections of matterircd.toml.
+var protocols = []string{"mattermost", "slack", "rocketchat", "matrix"}
+
+var globalOptions = []option{
+	{name: "Bind", kind: kindString, def: "127.0.0.1:6667"},
+	{name: "Debug", kind: kindBool, def: false},
+	{name: "Trace", kind: kindBool, def: false},
+	{name: "TLSBind", kind: kindString, def: ""},
+	{name: "TLSDir", kind: kindString, def: "."},
+	{name: "PasteBufferTimeout", kind: kindInt, def: 0},
+	{name: "NamespaceChannels", kind: kindBool, def: false},
+	{name: "CredentialStore", kind: kindString, def: ""},
+	{name: "ProfileDir", kind: kindString, def: ""},
+	{name: "SSOBind", kind: kindString, def: ""},
+	{name: "SSOURL", kind: kindString, def: ""},
+}
+
+// protocolOptions can be set in [<protocol>] and [<protocol>.accounts.<name>].
+var protocolOptions = []option{
+	{name: "Prefix", kind: kindString, protocolDefaults: map[string]interface{}{
+		"mattermost": "mm", "slack": "slack", "rocketchat": "rc", "matrix": "matrix",
+	}},
+	{name: "DefaultServer", kind: kindString, def: "", protocols: []string{"mattermost", "rocketchat", "matrix"}},
+	{name: "DefaultTeam", kind: kindString, def: "", protocols: []string{"mattermost"}},
+	{name: "Insecure", kind: kindBool, def: false, protocols: []string{"mattermost", "rocketchat", "matrix"}},
+	{name: "SkipTLSVerify", kind: kindBool, def: false, protocols: []string{"mattermost", "rocketchat", "matrix"}},
+	{name: "Restrict", kind: kindStrings, def: []string{}},
+	{name: "JoinInclude", kind: kindStrings, def: []string{}},
+	{name: "JoinExclude", kind: kindStrings, def: []string{}},
+	{name: "PartFake", kind: kindBool, def: false},
+	{name: "PrefixMainTeam", kind: kindBool, def: false, protocols: []string{"mattermost"}},
+	{name: "DisableAutoView", kind: kindBool, def: false},
+	{name: "PreferNickname", kind: kindBool, def: false},
+	{name: "GroupChannelNames", kind: kindBool, def: false},
+	{name: "HideReplies", kind: kindBool, def: false},
+	{name: "Voice", kind: kindStrings, def: []string{"guests", "bots"}},
+	{name: "Mute", kind: kindBool, def: false},
+	{name: "Notice", kind: kindBool, def: false},
+	{name: "HideJoinLeave", kind: kindBool, def: false},
+	{name: "MutedChannels", kind: kindString, def: "join", protocols: []string{"mattermost"}},
+	{name: "MarkMentionsViewed", kind: kindBool, def: false},
+	{name: "TranslateMentions", kind: kindBool, def: true},
+	{name: "TranslateInlineNicks", kind: kindBool, def: false},
+	{name: "UnreadSummary", kind: kindString, def: "service", protocols: []string{"mattermost", "rocketchat", "matrix"}},
+	{name: "AwayCustomStatus", kind: kindBool, def: false, protocols: []string{"mattermost", "slack"}},
+	{name: "AutoAwayIdle", kind: kindInt, def: 0},
+	{name: "AutoAwayDetach", kind: kindBool, def: false},
+	{name: "DenyUsers", kind: kindStrings, def: []string{}, protocols: []string{"slack"}},
+	{name: "JoinMpImOnTalk", kind: kindBool, def: false, protocols: []string{"slack"}},
+	{name: "UseDisplayName", kind: kindBool, def: false, protocols: []string{"slack"}},
+	{name: "Login", kind: kindString, def: ""},
+	{name: "Pass", kind: kindString, def: ""},
+	{name: "Token", kind: kindString, def: ""},
+}
+
+// accountOptions can only be set in [<protocol>.accounts.<name>].
+var accountOptions = []option{
+	{name: "Users", kind: kindStrings, def: []string{}},
+}
+
+// channelOptions can be set in [<protocol>.channel."#channel"].
+var channelOptions = []string{"HideReplies", "DisableAutoView", "Mute", "Notice", "HideJoinLeave"}
+
+// profileOptions can be set per user in [users.<name>.<protocol>] and with /msg <bridge> set.
+var profileOptions = []string{
+	"JoinInclude", "JoinExclude", "PartFake", "PrefixMainTeam", "DisableAutoView", "PreferNickname",
+	"HideReplies", "Voice", "Mute", "Notice", "HideJoinLeave", "MutedChannels", "MarkMentionsViewed",
+	"TranslateMentions", "TranslateInlineNicks", "UnreadSummary", "AwayCustomStatus", "AutoAwayIdle",
+	"AutoAwayDetach", "JoinMpImOnTalk", "UseDisplayName",
+}
+
+// secrets aren't shown by Dump.
+var secrets = []string{"pass", "token"}
+
+// Check returns the problems of the config file: unknown keys and values of the wrong kind.
+func Check(v *viper.Viper) []string {
+	var problems []string
+
+	settings := v.AllSettings()
+
+	for _, key := range sortedKeys(settings) {
+		value := settings[key]
+
+		if isProtocol(key) {
+			section, ok := value.(map[string]interface{})
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%s should be a table, eg [%s]", key, key))
+				continue
+			}
+
+			problems = append(problems, checkProtocol(key, key, section, true)...)
+
+			continue
+		}
+
+		if key == "users" {
+			problems = append(problems, checkTables(key, value, checkUser)...)
+			continue
+		}
+
+		problems = append(problems, checkOption(key, key, value, globalOptions, "")...)
+	}
+
+	return problems
+}
+
+// checkProtocol checks a bridge section, path is its name in the config file, eg mattermost.accounts.work
+func checkProtocol(protocol, path string, section map[string]interface{}, accounts bool) []string {
+	var problems []string
+
+	for _, key := range sortedKeys(section) {
+		value := section[key]
+		keyPath := path + "." + key
+
+		switch {
+		case key == "accounts" && accounts:
+			problems = append(problems, checkTables(keyPath, value, func(name string, table map[string]interface{}) []string {
+				return checkProtocol(protocol, keyPath+"."+name, table, false)
+			})...)
+		case !accounts && key == "users":
+			problems = append(problems, checkOption(keyPath, key, value, accountOptions, protocol)...)
+		case key == "channel":
+			problems = append(problems, checkTables(keyPath, value, func(name string, table map[string]interface{}) []string {
+				return checkChannel(fmt.Sprintf("%s.%q", keyPath, name), table)
+			})...)
+		case key == "templates":
+			problems = append(problems, checkTemplates(keyPath, value)...)
+		default:
+			problems = append(problems, checkOption(keyPath, key, value, protocolOptions, protocol)...)
+		}
+	}
+
+	return problems
+}
+
+// checkUser checks the [users.<name>.<protocol>] sections of a user.
+func checkUser(name string, table map[string]interface{}) []string {
+	var problems []string
+
+	for _, protocol := range sortedKeys(table) {
+		path := "users." + name + "." + protocol
+
+		section, ok := table[protocol].(map[string]interface{})
+		if !isProtocol(protocol) || !ok {
+			problems = append(problems, fmt.Sprintf("%s should be a bridge table, eg [users.%s.mattermost]", path, name))
+			continue
+		}
+
+		var options []option
+
+		for _, opt := range protocolOptions {
+			if contains(profileOptions, opt.name) {
+				options = append(options, opt)
+			}
+		}
+
+		for _, key := range sortedKeys(section) {
+			problems = append(problems, checkOption(path+"."+key, key, section[key], options, protocol)...)
+		}
+	}
+
+	return problems
+}
+
+func checkChannel(path string, table map[string]interface{}) []string {
+	var (
+		problems []string
+		options  []option
+	)
+
+	for _, opt := range protocolOptions {
+		if contains(channelOptions, opt.name) {
+			options = append(options, opt)
+		}
+	}
+
+	for _, key := range sortedKeys(table) {
+		if key == "templates" {
+			problems = append(problems, checkTemplates(path+".templates", table[key])...)
+			continue
+		}
+
+		problems = append(problems, checkOption(path+"."+key, key, table[key], options, "")...)
+	}
+
+	return problems
+}
+
+func checkTemplates(path string, value interface{}) []string {
+	table, ok := value.(map[string]interface{})
+	if !ok {
+		return []string{fmt.Sprintf("%s should be a table", path)}
+	}
+
+	var (
+		problems []string
+		options  []option
+	)
+
+	for kind := range bridge.DefaultTemplates {
+		options = append(options, option{name: kind, kind: kindString})
+	}
+
+	for _, key := range sortedKeys(table) {
+		problems = append(problems, checkOption(path+"."+key, key, table[key], options, "")...)
+	}
+
+	return problems
+}
+
+// checkTables checks a table of tables, eg the accounts.
+func checkTables(path string, value interface{}, check func(string, map[string]interface{}) []string) []string {
+	tables, ok := value.(map[string]interface{})
+	if !ok {
+		return []string{fmt.Sprintf("%s should be a table", path)}
+	}
+
+	var problems []string
+
+	for _, name := range sortedKeys(tables) {
+		table, ok := tables[name].(map[string]interface{})
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s.%s should be a table", path, name))
+			continue
+		}
+
+		problems = append(problems, check(name, table)...)
+	}
+
+	return problems
+}
+
+// checkOption checks a key against the known options, protocol limits them to the ones of that bridge.
+func checkOption(path, key string, value interface{}, options []option, protocol string) []string {
+	for _, opt := range options {
+		if !strings.EqualFold(opt.name, key) {
+			continue
+		}
+
+		if protocol != "" && len(opt.protocols) > 0 && !contains(opt.protocols, protocol) {
+			return []string{fmt.Sprintf("%s isn't used by %s", path, protocol)}
+		}
+
+		if !isKind(value, opt.kind) {
+			return []string{fmt.Sprintf("%s should be %s, not %#v", path, opt.kind, value)}
+		}
+
+		return nil
+	}
+
+	if suggestion := closest(key, options); suggestion != "" {
+		return []string{fmt.Sprintf("unknown key %s, did you mean %s?", path, suggestion)}
+	}
+
+	return []string{fmt.Sprintf("unknown key %s", path)}
+}
+
+// ProfileOptions returns the names of the options a user can set for a bridge.
+func ProfileOptions(protocol string) []string {
+	var names []string
+
+	for _, opt := range profileOptionsOf(protocol) {
+		names = append(names, opt.name)
+	}
+
+	return names
+}
+
+// ProfileValue converts the words of /msg <bridge> set <key> <words> to the name and value of a
+// profile option of the bridge.
+func ProfileValue(protocol, key string, words []string) (string, interface{}, error) {
+	for _, opt := range profileOptionsOf(protocol) {
+		if !strings.EqualFold(opt.name, key) {
+			continue
+		}
+
+		switch opt.kind {
+		case kindBool:
+			if len(words) != 1 {
+				return "", nil, fmt.Errorf("%s needs true or false", opt.name)
+			}
+
+			value, err := strconv.ParseBool(words[0])
+			if err != nil {
+				return "", nil, fmt.Errorf("%s needs true or false, not %s", opt.name, words[0])
+			}
+
+			return opt.name, value, nil
+		case kindInt:
+			if len(words) != 1 {
+				return "", nil, fmt.Errorf("%s needs a number", opt.name)
+			}
+
+			value, err := strconv.Atoi(words[0])
+			if err != nil {
+				return "", nil, fmt.Errorf("%s needs a number, not %s", opt.name, words[0])
+			}
+
+			return opt.name, value, nil
+		case kindString:
+			return opt.name, strings.Join(words, " "), nil
+		default:
+			var values []string
+
+			for _, word := range words {
+				for _, value := range strings.Split(word, ",") {
+					if value != "" {
+						values = append(values, value)
+					}
+				}
+			}
+
+			return opt.name, values, nil
+		}
+	}
+
+	return "", nil, fmt.Errorf("%s can't be set, use one of %s", key, strings.Join(ProfileOptions(protocol), ", "))
+}
+
+func profileOptionsOf(protocol string) []option {
+	var options []option
+
+	for _, opt := range protocolOptions {
+		if contains(profileOptions, opt.name) && (len(opt.protocols) == 0 || contains(opt.protocols, protocol)) {
+			options = append(options, opt)
+		}
+	}
+
+	return options
+}
+
+func isKind(value interface{}, kind string) bool {
+	switch kind {
+	case kindBool:
+		_, ok := value.(bool)
+		return ok
+	case kindString:
+		_, ok := value.(string)
+		return ok
+	case kindInt:
+		switch value.(type) {
+		case int, int64:
+			return true
+		}
+
+		return false
+	case kindStrings:
+		switch values := value.(type) {
+		case []string:
+			return true
+		case []interface{}:
+			for _, v := range values {
+				if _, ok := v.(string); !ok {
+					return false
+				}
+			}
+
+			return true
+		}
+
+		return false
+	}
+
+	return false
+}
+
+// closest returns the option which is at most 2 edits away from key.
+func closest(key string, options []option) string {
+	best, bestDistance := "", 3
+
+	for _, opt := range options {
+		if d := distance(strings.ToLower(key), strings.ToLower(opt.name)); d < bestDistance {
+			best, bestDistance = opt.name, d
+		}
+	}
+
+	return best
+}
+
+// distance returns the Levenshtein distance of a and b.
+func distance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+
+		prev = cur
+	}
+
+	return prev[len(b)]
+}
+
+func min(values ...int) int {
+	m := values[0]
+
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+
+	return m
+}
+
+// Dump writes the effective configuration as TOML, with the defaults and environment overrides
+// (eg MATTERIRCD_MATTERMOST_DEFAULTSERVER) applied. Passwords and tokens aren't shown.
+func Dump(w io.Writer, v *viper.Viper) {
+	for _, opt := range globalOptions {
+		fmt.Fprintf(w, "%s = %s\n", opt.name, value(v, opt.name, opt))
+	}
+
+	for _, protocol := range protocols {
+		fmt.Fprintf(w, "\n[%s]\n", protocol)
+
+		for _, opt := range protocolOptions {
+			if len(opt.protocols) > 0 && !contains(opt.protocols, protocol) {
+				continue
+			}
+
+			if def, ok := opt.protocolDefaults[protocol]; ok {
+				opt.def = def
+			}
+
+			fmt.Fprintf(w, "%s = %s\n", opt.name, redacted(opt.name, value(v, protocol+"."+opt.name, opt)))
+		}
+
+		if templates := v.GetStringMap(protocol + ".templates"); len(templates) > 0 {
+			dumpTable(w, protocol+".templates", templates)
+		}
+
+		channels := v.GetStringMap(protocol + ".channel")
+		for _, name := range sortedKeys(channels) {
+			table, _ := channels[name].(map[string]interface{})
+			dumpTable(w, fmt.Sprintf("%s.channel.%q", protocol, name), table)
+		}
+
+		accounts := v.GetStringMap(protocol + ".accounts")
+		for _, name := range sortedKeys(accounts) {
+			table, _ := accounts[name].(map[string]interface{})
+			dumpTable(w, protocol+".accounts."+name, table)
+		}
+	}
+
+	users := v.GetStringMap("users")
+	for _, name := range sortedKeys(users) {
+		table, _ := users[name].(map[string]interface{})
+		dumpTable(w, "users."+name, table)
+	}
+}
+
+// dumpTable writes a table as it is in the config file, its sub tables follow it.
+func dumpTable(w io.Writer, path string, table map[string]interface{}) {
+	fmt.Fprintf(w, "\n[%s]\n", path)
+
+	var subtables []string
+
+	for _, key := range sortedKeys(table) {
+		if _, ok := table[key].(map[string]interface{}); ok {
+			subtables = append(subtables, key)
+			continue
+		}
+
+		fmt.Fprintf(w, "%s = %s\n", key, redacted(key, format(table[key])))
+	}
+
+	for _, key := range subtables {
+		dumpTable(w, path+"."+key, table[key].(map[string]interface{}))
+	}
+}
+
+// value returns the TOML value of an option, or its default when it isn't set.
+func value(v *viper.Viper, key string, opt option) string {
+	if !v.IsSet(key) {
+		return format(opt.def)
+	}
+
+	// environment variables are strings, convert them to the kind of the option
+	switch opt.kind {
+	case kindBool:
+		return format(v.GetBool(key))
+	case kindInt:
+		return format(v.GetInt(key))
+	case kindStrings:
+		return format(v.GetStringSlice(key))
+	default:
+		return format(v.GetString(key))
+	}
+}
+
+func redacted(name, value string) string {
+	if contains(secrets, strings.ToLower(name)) && value != `""` {
+		return `"<redacted>"`
+	}
+
+	return value
+}
+
+func format(value interface{}) string {
+	switch value := value.(type) {
+	case string:
+		return fmt.Sprintf("%q", value)
+	case []string:
+		quoted := make([]string, 0, len(value))
+		for _, s := range value {
+			quoted = append(quoted, fmt.Sprintf("%q", s))
+		}
+
+		return "[" + strings.Join(quoted, ", ") + "]"
+	case []interface{}:
+		quoted := make([]string, 0, len(value))
+		for _, s := range value {
+			quoted = append(quoted, format(s))
+		}
+
+		return "[" + strings.Join(quoted, ", ") + "]"
+	default:
+		return fmt.Sprintf("%v", value)
+	}
+}
+
+func isProtocol(key string) bool {
+	return contains(protocols, key)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+
+	switch m := m.(type) {
+	case map[string]interface{}:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
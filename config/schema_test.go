@@ -0,0 +1,79 @@
+package config
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck(t *testing.T) {
+	v := viper.New()
+	v.SetConfigType("toml")
+
+	err := v.ReadConfig(strings.NewReader(`
+PasteBuferTimeout = 100
+Debug = true
+
+[mattermost]
+JoinInclude = "#devops"
+HideReplies = true
+Users = ["alice"]
+
+[mattermost.accounts.work]
+Users = "alice"
+
+[mattermost.channel."#alerts"]
+Notice = true
+Mute = "yes"
+
+[slack]
+DefaultTeam = "x"
+
+[users.alice.mattermost]
+HideReplies = "yes"
+DefaultServer = "chat.evil.com"
+`))
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{
+		`mattermost.accounts.work.users should be an array of strings, not "alice"`,
+		`mattermost.channel."#alerts".mute should be a bool, not "yes"`,
+		`mattermost.joininclude should be an array of strings, not "#devops"`,
+		"unknown key mattermost.users",
+		"unknown key pastebufertimeout, did you mean PasteBufferTimeout?",
+		"slack.defaultteam isn't used by slack",
+		"unknown key users.alice.mattermost.defaultserver",
+		`users.alice.mattermost.hidereplies should be a bool, not "yes"`,
+	}, Check(v))
+
+	name, value, err := ProfileValue("mattermost", "joinexclude", []string{"#foo,#bar", "#baz"})
+	assert.NoError(t, err)
+	assert.Equal(t, "JoinExclude", name)
+	assert.Equal(t, []string{"#foo", "#bar", "#baz"}, value)
+
+	_, _, err = ProfileValue("slack", "PrefixMainTeam", []string{"true"})
+	assert.Error(t, err)
+
+	_, value, err = ProfileValue("mattermost", "unreadsummary", []string{"messages"})
+	assert.NoError(t, err)
+	assert.Equal(t, "messages", value)
+
+	_, value, err = ProfileValue("mattermost", "autoawayidle", []string{"15"})
+	assert.NoError(t, err)
+	assert.Equal(t, 15, value)
+
+	_, _, err = ProfileValue("mattermost", "autoawayidle", []string{"soon"})
+	assert.Error(t, err)
+
+	var buf bytes.Buffer
+
+	v.Set("mattermost.pass", "secret")
+	Dump(&buf, v)
+	assert.Contains(t, buf.String(), "Debug = true\n")
+	assert.Contains(t, buf.String(), "\n[slack]\nPrefix = \"slack\"\n")
+	assert.Contains(t, buf.String(), "Pass = \"<redacted>\"\n")
+	assert.NotContains(t, buf.String(), "secret")
+}
@@ -6,11 +6,13 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"strings"
 
 	"github.com/42wim/matterircd/config"
 	irckit "github.com/42wim/matterircd/mm-go-irckit"
+	"github.com/42wim/matterircd/sso"
 	"github.com/google/gops/agent"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
@@ -40,6 +42,10 @@ func main() {
 	flag.Bool("version", false, "show version")
 	flag.Bool("debug", false, "enable debug logging")
 
+	// config checking
+	flag.Bool("checkconfig", false, "check the config file for unknown keys and wrong values and exit")
+	flag.Bool("dumpconfig", false, "print the configuration with defaults and environment overrides applied and exit")
+
 	// bind related cfg
 	flag.String("bind", "127.0.0.1:6667", "interface:port to bind to, or a path to bind to a Unix socket.")
 
@@ -50,18 +56,36 @@ func main() {
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
 	pflag.Parse()
 
+	var problems []string
+
 	// Attempt to load values from the config file
 	if _, err := os.Stat(*flagConfig); err == nil {
 		v, err = config.LoadConfig(*flagConfig)
 		if err != nil {
 			log.Fatal(err)
 		}
+
+		// check before the flags are added to the settings
+		problems = config.Check(v)
 	} else {
 		v = viper.New()
 	}
 
 	v.BindPFlags(pflag.CommandLine)
 
+	if v.GetBool("checkconfig") {
+		checkConfig(*flagConfig, problems)
+	}
+
+	if v.GetBool("dumpconfig") {
+		config.Dump(os.Stdout, v)
+		return
+	}
+
+	for _, problem := range problems {
+		logger.Warnf("config %s: %s", *flagConfig, problem)
+	}
+
 	if v.GetBool("debug") {
 		logger.Info("enabling debug")
 		ourlog.Level = logrus.DebugLevel
@@ -95,6 +119,26 @@ func main() {
 		}()
 	}
 
+	if v.GetString("SSOBind") != "" {
+		sso.Logger = logger
+
+		baseURL := v.GetString("SSOURL")
+		if baseURL == "" {
+			baseURL = "http://" + v.GetString("SSOBind")
+		}
+
+		helper := sso.New(baseURL)
+		irckit.SetSSOHelper(helper)
+
+		go func() {
+			logger.Infof("SSO login helper listening on %s", v.GetString("SSOBind"))
+
+			if err := http.ListenAndServe(v.GetString("SSOBind"), helper); err != nil {
+				logger.Errorf("Can not listen on %s: %v", v.GetString("SSOBind"), err)
+			}
+		}()
+	}
+
 	// backwards compatible
 
 	if v.GetString("bind") != "" {
@@ -163,3 +207,22 @@ func start(socket net.Listener) {
 		}()
 	}
 }
+
+// checkConfig prints the problems of the config file and exits non-zero when there are any.
+func checkConfig(file string, problems []string) {
+	if _, err := os.Stat(file); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	for _, problem := range problems {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", file, problem)
+	}
+
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+
+	fmt.Printf("%s: ok\n", file)
+	os.Exit(0)
+}
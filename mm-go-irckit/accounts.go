@@ -0,0 +1,139 @@
+package irckit
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/42wim/matterircd/bridge"
+	"github.com/spf13/viper"
+)
+
+// account is a named bridge account from the configuration, eg [mattermost.accounts.work].
+// It has its own service bot (eg mattermost-work) and its own settings.
+type account struct {
+	name     string
+	protocol string
+	v        *viper.Viper
+}
+
+// loadAccounts returns the accounts configured for all protocols.
+func loadAccounts(v *viper.Viper) []*account {
+	var accounts []*account
+
+	for _, protocol := range services {
+		for name := range v.GetStringMap(protocol + ".accounts") {
+			accounts = append(accounts, &account{
+				name:     protocol + "-" + name,
+				protocol: protocol,
+				v:        accountConfig(v, protocol, name),
+			})
+		}
+	}
+
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].name < accounts[j].name
+	})
+
+	return accounts
+}
+
+// accountConfig returns a copy of the configuration where the settings of the account
+// override the ones of the protocol, so bridges can keep using eg mattermost.DefaultServer.
+func accountConfig(v *viper.Viper, protocol, name string) *viper.Viper {
+	av := bridge.CopyConfig(v)
+
+	// the prefix defaults to the account name instead of the one of the protocol
+	av.Set(protocol+".prefix", name)
+
+	if sub := v.Sub(protocol + ".accounts." + name); sub != nil {
+		for _, key := range sub.AllKeys() {
+			av.Set(protocol+"."+key, sub.Get(key))
+		}
+	}
+
+	return av
+}
+
+// serviceConfig returns the protocol and configuration used by a service bot.
+func (u *User) serviceConfig(service string) (string, *viper.Viper) {
+	for _, acc := range u.accounts {
+		if acc.name == service {
+			return acc.protocol, acc.v
+		}
+	}
+
+	return service, u.v
+}
+
+func (u *User) isService(nick string) bool {
+	if stringInSlice(nick, services) {
+		return true
+	}
+
+	for _, acc := range u.accounts {
+		if acc.name == nick {
+			return true
+		}
+	}
+
+	return false
+}
+
+// loginAccounts logs in to the accounts that have their credentials configured, but only for the
+// Users of the account. They need to authenticate with the password of their credential store.
+func (u *User) loginAccounts() {
+	if u.store == nil {
+		return
+	}
+
+	for _, acc := range u.accounts {
+		if !acc.allowed(u.storeUser) || u.session(acc.name) != nil {
+			continue
+		}
+
+		cred := bridge.Credentials{
+			Server: acc.v.GetString(acc.protocol + ".DefaultServer"),
+			Team:   acc.v.GetString(acc.protocol + ".DefaultTeam"),
+			Login:  acc.v.GetString(acc.protocol + ".Login"),
+			Pass:   acc.v.GetString(acc.protocol + ".Pass"),
+			Token:  acc.v.GetString(acc.protocol + ".Token"),
+		}
+
+		if (cred.Login == "" || cred.Pass == "") && cred.Token == "" {
+			continue
+		}
+
+		u.autoLogin(acc.name, cred)
+	}
+}
+
+// allowed returns whether the configured credentials of the account may be used by user.
+func (acc *account) allowed(user string) bool {
+	for _, name := range acc.v.GetStringSlice(acc.protocol + ".Users") {
+		if strings.EqualFold(name, user) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// autoLogin logs in to service with cred and lets its service bot report the result.
+func (u *User) autoLogin(service string, cred bridge.Credentials) {
+	svc, _ := u.Srv.HasUser(service)
+
+	if !u.isValidServer(cred.Server, service) {
+		u.MsgUser(svc, "not allowed to connect to "+cred.Server)
+		return
+	}
+
+	u.Credentials = cred
+
+	err := u.loginTo(service)
+	if err != nil {
+		u.MsgUser(svc, err.Error())
+		return
+	}
+
+	u.MsgUser(svc, "login OK")
+}
@@ -0,0 +1,46 @@
+package irckit
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+const accountsConfig = `
+[mattermost]
+DefaultServer = "chat.mycompany.com"
+JoinExclude = ["#town-square"]
+Prefix = "mm"
+
+[mattermost.accounts.customer]
+DefaultServer = "chat.customer.com"
+DefaultTeam = "customer"
+Users = ["Alice"]
+`
+
+func TestAccountConfig(t *testing.T) {
+	v := viper.New()
+	v.SetConfigType("toml")
+	assert.NoError(t, v.ReadConfig(strings.NewReader(accountsConfig)))
+
+	accounts := loadAccounts(v)
+	assert.Len(t, accounts, 1)
+
+	acc := accounts[0]
+	assert.Equal(t, "mattermost-customer", acc.name)
+	assert.Equal(t, "mattermost", acc.protocol)
+	assert.Equal(t, "chat.customer.com", acc.v.GetString("mattermost.DefaultServer"))
+	assert.Equal(t, "customer", acc.v.GetString("mattermost.DefaultTeam"))
+	assert.Equal(t, "customer", acc.v.GetString("mattermost.Prefix"))
+	assert.Equal(t, []string{"#town-square"}, acc.v.GetStringSlice("mattermost.JoinExclude"))
+
+	// only alice gets logged in with the credentials of the account
+	assert.True(t, acc.allowed("alice"))
+	assert.False(t, acc.allowed("bob"))
+	assert.False(t, acc.allowed(""))
+
+	// the global configuration isn't changed
+	assert.Equal(t, "chat.mycompany.com", v.GetString("mattermost.DefaultServer"))
+}
@@ -0,0 +1,145 @@
+package irckit
+
+import (
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// autoAwayInterval is how often we check if the user is idle.
+var autoAwayInterval = time.Minute
+
+// activityCommands show the user is at the keyboard, clients send PING, WHO, ISON and the like
+// by themselves so those don't count.
+var activityCommands = map[string]bool{
+	irc.PRIVMSG: true,
+	irc.NOTICE:  true,
+	irc.JOIN:    true,
+	irc.PART:    true,
+	irc.TOPIC:   true,
+	irc.INVITE:  true,
+	irc.KICK:    true,
+	irc.NICK:    true,
+	"MARKREAD":  true,
+}
+
+// activity is called for every command of the client, the sessions AutoAwayIdle set away are
+// set online again.
+func (u *User) activity(command string) {
+	if !activityCommands[command] {
+		return
+	}
+
+	var back []*session
+
+	u.awayMu.Lock()
+	u.lastActivity = time.Now()
+
+	for _, sess := range u.getSessions() {
+		if sess.autoAway {
+			sess.autoAway = false
+			back = append(back, sess)
+		}
+	}
+	u.awayMu.Unlock()
+
+	if len(back) == 0 {
+		return
+	}
+
+	go func() {
+		for _, sess := range back {
+			if err := sess.br.SetStatus("online"); err != nil {
+				logger.Errorf("setting %s online failed: %s", sess.name, err)
+			}
+		}
+
+		u.Srv.EncodeMessage(u, irc.RPL_UNAWAY, []string{u.Nick}, "You are no longer marked as being away")
+	}()
+}
+
+// setManualAway records an AWAY of the user, auto away leaves the status alone while we're away.
+func (u *User) setManualAway(away bool) {
+	u.awayMu.Lock()
+	defer u.awayMu.Unlock()
+
+	u.away = away
+
+	for _, sess := range u.getSessions() {
+		sess.autoAway = false
+	}
+}
+
+// autoAwayLoop sets the sessions away after AutoAwayIdle minutes without activity, until stop is closed.
+func (u *User) autoAwayLoop(stop chan struct{}) {
+	ticker := time.NewTicker(autoAwayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			u.checkIdle(now)
+		}
+	}
+}
+
+func (u *User) checkIdle(now time.Time) {
+	var idle []*session
+
+	u.awayMu.Lock()
+	for _, sess := range u.getSessions() {
+		minutes := sess.v.GetInt(sess.protocol + ".AutoAwayIdle")
+		if u.away || sess.autoAway || minutes <= 0 || now.Sub(u.lastActivity) < time.Duration(minutes)*time.Minute {
+			continue
+		}
+
+		sess.autoAway = true
+		idle = append(idle, sess)
+	}
+	u.awayMu.Unlock()
+
+	if len(idle) == 0 {
+		return
+	}
+
+	for _, sess := range idle {
+		logger.Debugf("%s is idle, setting %s away", u.Nick, sess.name)
+
+		if err := sess.br.SetStatus("away"); err != nil {
+			logger.Errorf("setting %s away failed: %s", sess.name, err)
+		}
+	}
+
+	u.Srv.EncodeMessage(u, irc.RPL_NOWAWAY, []string{u.Nick}, "You have been marked as being away")
+}
+
+// detach sets the sessions with AutoAwayDetach away when the client disconnects, it's done
+// before they're logged out.
+func (u *User) detach() {
+	u.awayMu.Lock()
+	if u.detached || u.away {
+		u.detached = true
+		u.awayMu.Unlock()
+
+		return
+	}
+
+	u.detached = true
+
+	var sessions []*session
+
+	for _, sess := range u.getSessions() {
+		if !sess.autoAway && sess.v.GetBool(sess.protocol+".AutoAwayDetach") {
+			sessions = append(sessions, sess)
+		}
+	}
+	u.awayMu.Unlock()
+
+	for _, sess := range sessions {
+		if err := sess.br.SetStatus("away"); err != nil {
+			logger.Errorf("setting %s away failed: %s", sess.name, err)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package irckit
+
+import (
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/42wim/matterircd/bridge"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// statusBridge records the statuses which are set.
+type statusBridge struct {
+	bridge.Bridger
+
+	sync.Mutex
+	statuses []string
+}
+
+func (b *statusBridge) SetStatus(status string) error {
+	b.Lock()
+	defer b.Unlock()
+
+	b.statuses = append(b.statuses, status)
+
+	return nil
+}
+
+func (b *statusBridge) set() []string {
+	b.Lock()
+	defer b.Unlock()
+
+	return append([]string{}, b.statuses...)
+}
+
+func TestAutoAway(t *testing.T) {
+	client, c := net.Pipe()
+	defer client.Close()
+
+	go ioutil.ReadAll(client)
+
+	u := NewUserNet(c)
+	u.Srv = NewServer("test")
+	u.Nick = "bob"
+
+	br := &statusBridge{}
+	sess := &session{name: "mattermost", protocol: "mattermost", br: br, v: bridge.NewConfig(viper.New())}
+	sess.v.Update(func(v *viper.Viper) { v.Set("mattermost.AutoAwayIdle", 10) })
+	u.sessions = []*session{sess}
+
+	now := time.Now()
+	u.lastActivity = now
+
+	u.checkIdle(now.Add(5 * time.Minute))
+	assert.Empty(t, br.set())
+
+	u.checkIdle(now.Add(10 * time.Minute))
+	u.checkIdle(now.Add(20 * time.Minute))
+	assert.Equal(t, []string{"away"}, br.set())
+
+	// clients ping by themselves
+	u.activity("PING")
+	assert.True(t, sess.autoAway)
+
+	u.activity("PRIVMSG")
+	assert.Eventually(t, func() bool { return len(br.set()) == 2 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"away", "online"}, br.set())
+
+	// an AWAY of the user is left alone
+	u.setManualAway(true)
+	u.checkIdle(time.Now().Add(time.Hour))
+	assert.Len(t, br.set(), 2)
+
+	u.setManualAway(false)
+	sess.v.Update(func(v *viper.Viper) { v.Set("mattermost.AutoAwayDetach", true) })
+	u.detach()
+	u.detach()
+	assert.Equal(t, []string{"away", "online", "away"}, br.set())
+}
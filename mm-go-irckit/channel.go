@@ -45,6 +45,9 @@ type Channel interface {
 	// Part removes the User from the channel (handler for PART).
 	Part(u *User, text string)
 
+	// BatchPart removes the users from the channel without sending a PART.
+	BatchPart(users []*User)
+
 	// Message transmits a message from a User to the channel (handler for PRIVMSG).
 	Message(u *User, text string)
 
@@ -71,6 +74,22 @@ type Channel interface {
 
 	// Spoof notice
 	SpoofNotice(from string, text string)
+
+	// Modes returns the modes of the channel, eg "np"
+	Modes() string
+
+	// SetModes sets the modes of the channel.
+	SetModes(modes string)
+
+	// UserModes returns the modes of a User in the channel, eg "o"
+	UserModes(u *User) string
+
+	// SetUserModes replaces the modes of the users in the channel, keyed by user ID,
+	// and tells the real users in the channel about the changes.
+	SetUserModes(from Prefixer, modes map[string]string)
+
+	// SetUserMode adds or removes a mode of a User in the channel, and tells the real users about it.
+	SetUserMode(from Prefixer, u *User, mode string, add bool)
 }
 
 type channel struct {
@@ -80,20 +99,24 @@ type channel struct {
 	id      string
 	service string
 
-	mu       sync.RWMutex
-	topic    string
-	usersIdx map[string]*User
+	mu        sync.RWMutex
+	topic     string
+	usersIdx  map[string]*User
+	modes     string
+	userModes map[string]string
 }
 
 // NewChannel returns a Channel implementation for a given Server.
 func NewChannel(server Server, channelID string, name string, service string) Channel {
 	return &channel{
-		created:  time.Now(),
-		server:   server,
-		id:       channelID,
-		name:     name,
-		service:  service,
-		usersIdx: make(map[string]*User),
+		created:   time.Now(),
+		server:    server,
+		id:        channelID,
+		name:      name,
+		service:   service,
+		usersIdx:  make(map[string]*User),
+		modes:     "n",
+		userModes: make(map[string]string),
 	}
 }
 
@@ -176,6 +199,7 @@ func (ch *channel) Part(u *User, text string) {
 	u.Encode(msg)
 
 	delete(ch.usersIdx, u.ID())
+	delete(ch.userModes, u.ID())
 
 	u.Lock()
 
@@ -192,6 +216,18 @@ func (ch *channel) Part(u *User, text string) {
 	ch.mu.Unlock()
 }
 
+func (ch *channel) BatchPart(users []*User) {
+	for _, u := range users {
+		ch.mu.Lock()
+		delete(ch.usersIdx, u.ID())
+		delete(ch.userModes, u.ID())
+		ch.mu.Unlock()
+		u.Lock()
+		delete(u.channels, ch)
+		u.Unlock()
+	}
+}
+
 // Unlink will disassociate the Channel from the Server.
 func (ch *channel) Unlink() {
 	ch.server.UnlinkChannel(ch)
@@ -408,11 +444,14 @@ func (ch *channel) Names() []string {
 	names := make([]string, 0, len(users))
 
 	for _, u := range users {
-		if strings.Contains(u.Roles, model.SYSTEM_ADMIN_ROLE_ID) {
-			names = append(names, "@"+u.Nick)
-		} else {
-			names = append(names, u.Nick)
+		prefix := modePrefix(ch.UserModes(u))
+
+		// channels without a bridge like &users show the system admins
+		if ch.service == "" && strings.Contains(u.Roles, model.SYSTEM_ADMIN_ROLE_ID) {
+			prefix = "@"
 		}
+
+		names = append(names, prefix+u.Nick)
 	}
 
 	// TODO: Append in sorted order?
@@ -462,3 +501,137 @@ func (ch *channel) SpoofMessage(from string, text string) {
 func (ch *channel) SpoofNotice(from string, text string) {
 	ch.Spoof(from, text, irc.NOTICE)
 }
+
+func (ch *channel) Modes() string {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+
+	return ch.modes
+}
+
+func (ch *channel) SetModes(modes string) {
+	ch.mu.Lock()
+	ch.modes = modes
+	ch.mu.Unlock()
+}
+
+func (ch *channel) UserModes(u *User) string {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+
+	return ch.userModes[u.ID()]
+}
+
+func (ch *channel) SetUserModes(from Prefixer, modes map[string]string) {
+	var changes []modeChange
+
+	ch.mu.Lock()
+
+	for id, u := range ch.usersIdx {
+		old, updated := ch.userModes[id], modes[id]
+
+		for _, mode := range old {
+			if !strings.ContainsRune(updated, mode) {
+				changes = append(changes, modeChange{mode: mode, nick: u.Nick})
+			}
+		}
+
+		for _, mode := range updated {
+			if !strings.ContainsRune(old, mode) {
+				changes = append(changes, modeChange{add: true, mode: mode, nick: u.Nick})
+			}
+		}
+	}
+
+	ch.userModes = make(map[string]string)
+
+	for id, mode := range modes {
+		ch.userModes[id] = mode
+	}
+
+	ch.mu.Unlock()
+
+	ch.sendModes(from, changes)
+}
+
+func (ch *channel) SetUserMode(from Prefixer, u *User, mode string, add bool) {
+	ch.mu.Lock()
+
+	modes := ch.userModes[u.ID()]
+	has := strings.Contains(modes, mode)
+
+	switch {
+	case add && !has:
+		ch.userModes[u.ID()] = modes + mode
+	case !add && has:
+		ch.userModes[u.ID()] = strings.Replace(modes, mode, "", 1)
+	default:
+		ch.mu.Unlock()
+		return
+	}
+
+	ch.mu.Unlock()
+
+	ch.sendModes(from, []modeChange{{add: add, mode: rune(mode[0]), nick: u.Nick}})
+}
+
+// modePrefix returns the NAMES/WHO prefix of the highest mode a user has in a channel.
+func modePrefix(modes string) string {
+	switch {
+	case strings.Contains(modes, "o"):
+		return "@"
+	case strings.Contains(modes, "v"):
+		return "+"
+	}
+
+	return ""
+}
+
+// modeChange is a mode of a user that got added or removed.
+type modeChange struct {
+	add  bool
+	mode rune
+	nick string
+}
+
+// sendModes tells the real users in the channel about mode changes, 4 changes per MODE.
+func (ch *channel) sendModes(from Prefixer, changes []modeChange) {
+	for len(changes) > 0 {
+		n := len(changes)
+		if n > 4 {
+			n = 4
+		}
+
+		modes := ""
+		params := []string{ch.name, ""}
+		sign := ' '
+
+		for _, change := range changes[:n] {
+			if change.add && sign != '+' {
+				sign = '+'
+				modes += "+"
+			} else if !change.add && sign != '-' {
+				sign = '-'
+				modes += "-"
+			}
+
+			modes += string(change.mode)
+			params = append(params, change.nick)
+		}
+
+		params[1] = modes
+		changes = changes[n:]
+
+		msg := &irc.Message{
+			Prefix:  from.Prefix(),
+			Command: irc.MODE,
+			Params:  params,
+		}
+
+		for _, to := range ch.Users() {
+			if !to.Ghost {
+				to.Encode(msg)
+			}
+		}
+	}
+}
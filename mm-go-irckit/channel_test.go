@@ -0,0 +1,34 @@
+package irckit
+
+import (
+	"testing"
+
+	"github.com/42wim/matterircd/bridge"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChannelNamesPrefix(t *testing.T) {
+	newGhost := func(nick, id string) *User {
+		u := NewUser(nil)
+		u.UserInfo = &bridge.UserInfo{Nick: nick, User: id, Ghost: true}
+
+		return u
+	}
+
+	alice := newGhost("alice", "ID1")
+	bob := newGhost("bob", "id2")
+	carol := newGhost("carol", "id3")
+
+	ch := NewChannel(nil, "chan1", "#test", "mattermost")
+	ch.BatchJoin([]*User{alice, bob, carol})
+
+	assert.Equal(t, []string{"alice", "bob", "carol"}, ch.Names())
+
+	ch.SetUserModes(alice, map[string]string{"id1": "o", "id2": "v"})
+	assert.Equal(t, []string{"+bob", "@alice", "carol"}, ch.Names())
+
+	ch.SetUserMode(alice, carol, "o", true)
+	ch.SetUserMode(alice, alice, "o", false)
+	assert.Equal(t, "o", ch.UserModes(carol))
+	assert.Equal(t, []string{"+bob", "@carol", "alice"}, ch.Names())
+}
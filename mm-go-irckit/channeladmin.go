@@ -0,0 +1,144 @@
+package irckit
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// createConfirmTimeout is how long a JOIN of a channel which doesn't exist waits for the
+// second JOIN confirming the channel should be created.
+const createConfirmTimeout = time.Minute
+
+// pendingChannel is a channel which gets created when its JOIN is confirmed.
+type pendingChannel struct {
+	requested time.Time
+	private   bool
+}
+
+// createChannel creates a channel which doesn't exist on the bridge. The first JOIN only asks for
+// a confirmation, so typos don't create channels. It returns an empty ID while waiting for it.
+func (u *User) createChannel(sess *session, name, channelName string, private bool) (string, error) {
+	key := strings.ToLower(name)
+
+	pending, ok := u.pendingChannels[key]
+	if !ok || time.Since(pending.requested) > createConfirmTimeout {
+		u.pendingChannels[key] = &pendingChannel{requested: time.Now(), private: private}
+
+		kind := "public"
+		if private {
+			kind = "private"
+		}
+
+		svc, _ := u.Srv.HasUser(sess.name)
+		u.MsgUser(svc, fmt.Sprintf("%s doesn't exist, JOIN it again within a minute to create it as %s channel", name, kind))
+
+		if !private {
+			u.MsgUser(svc, fmt.Sprintf("use JOIN %s private or MODE %s +p first to create a private channel", name, name))
+		}
+
+		return "", nil
+	}
+
+	delete(u.pendingChannels, key)
+
+	return sess.br.CreateChannel(channelName, pending.private || private)
+}
+
+// setPendingPrivate makes a channel waiting for its JOIN confirmation private.
+func (u *User) setPendingPrivate(name string) bool {
+	pending, ok := u.pendingChannels[strings.ToLower(name)]
+	if !ok || time.Since(pending.requested) > createConfirmTimeout {
+		return false
+	}
+
+	pending.private = true
+
+	return true
+}
+
+// isPrivateKey returns whether the key of the i-th channel of a JOIN asks for a private channel.
+func isPrivateKey(keys []string, i int) bool {
+	if i >= len(keys) {
+		return false
+	}
+
+	return strings.EqualFold(keys[i], "private") || keys[i] == "+p"
+}
+
+// channelIDByName returns the bridge ID of an IRC channel name of the session.
+func (u *User) channelIDByName(sess *session, name string) string {
+	if ch, ok := u.Srv.HasChannel(name); ok && ch.Service() == sess.name {
+		return ch.ID()
+	}
+
+	return sess.br.GetChannelID(sess.bridgeName(name), sess.br.GetMe().TeamID)
+}
+
+func channelCmd(u *User, toUser *User, args []string, service string) {
+	if len(args) < 2 || !strings.HasPrefix(args[1], "#") {
+		u.MsgUser(toUser, "need CHANNEL CREATE <#channel> [private], CHANNEL RENAME <#channel> <newname>,")
+		u.MsgUser(toUser, "CHANNEL PURPOSE <#channel> <text>, CHANNEL ARCHIVE <#channel> or CHANNEL UNARCHIVE <#channel>")
+		return
+	}
+
+	sess := u.session(service)
+	name := args[1]
+	subcmd := strings.ToLower(args[0])
+
+	if subcmd == "create" || subcmd == "unarchive" {
+		var (
+			channelID string
+			err       error
+		)
+
+		if subcmd == "create" {
+			channelID, err = sess.br.CreateChannel(sess.bridgeName(name), len(args) > 2 && strings.EqualFold(args[2], "private"))
+		} else {
+			channelID, err = sess.br.UnarchiveChannel(sess.bridgeName(name))
+		}
+
+		if err != nil {
+			u.MsgUser(toUser, fmt.Sprintf("%s %s failed: %s", subcmd, name, err))
+			return
+		}
+
+		sess.br.UpdateChannels()
+		u.syncChannel(sess, channelID, sess.channelName(channelID))
+		u.MsgUser(toUser, fmt.Sprintf("%s %sd", name, subcmd))
+
+		return
+	}
+
+	channelID := u.channelIDByName(sess, name)
+	if channelID == "" {
+		u.MsgUser(toUser, "channel does not exist")
+		return
+	}
+
+	var err error
+
+	switch subcmd {
+	case "rename":
+		if len(args) != 3 {
+			u.MsgUser(toUser, "need CHANNEL RENAME <#channel> <newname>")
+			return
+		}
+
+		err = sess.br.RenameChannel(channelID, sess.bridgeName(args[2]))
+	case "purpose":
+		err = sess.br.SetPurpose(channelID, strings.Join(args[2:], " "))
+	case "archive":
+		err = sess.br.ArchiveChannel(channelID)
+	default:
+		u.MsgUser(toUser, "need CHANNEL CREATE, RENAME, PURPOSE, ARCHIVE or UNARCHIVE")
+		return
+	}
+
+	if err != nil {
+		u.MsgUser(toUser, fmt.Sprintf("%s %s failed: %s", subcmd, name, err))
+		return
+	}
+
+	u.MsgUser(toUser, fmt.Sprintf("%s of %s done", subcmd, name))
+}
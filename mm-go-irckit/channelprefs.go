@@ -0,0 +1,108 @@
+package irckit
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/42wim/matterircd/bridge"
+)
+
+// What MutedChannels does with channels which are muted on the bridge.
+const (
+	mutedJoin     = "join"
+	mutedPart     = "part"
+	mutedMessages = "messages"
+	mutedNotice   = "notice"
+)
+
+// mutedPolicy returns what MutedChannels says to do with a channel, it's "" when the channel isn't
+// muted on the bridge or muted channels are joined like any other.
+func (u *User) mutedPolicy(sess *session, channelID string) string {
+	policy := strings.ToLower(sess.v.GetString(sess.protocol + ".MutedChannels"))
+	if policy == "" || policy == mutedJoin {
+		return ""
+	}
+
+	info := sess.br.GetChannel(channelID)
+	if info == nil || info.Direct || !info.Muted {
+		return ""
+	}
+
+	return policy
+}
+
+// handleChannelPrefsEvent joins or parts a channel which got (un)muted when MutedChannels is "part".
+func (u *User) handleChannelPrefsEvent(sess *session, event *bridge.ChannelPrefsEvent) {
+	if !strings.EqualFold(sess.v.GetString(sess.protocol+".MutedChannels"), mutedPart) {
+		return
+	}
+
+	if info := sess.br.GetChannel(event.ChannelID); info == nil || info.Direct {
+		return
+	}
+
+	ch, exists := u.Srv.HasChannel(event.ChannelID)
+	joined := exists && ch.HasUser(u)
+
+	switch mayJoin := u.mayJoin(sess, event.ChannelID); {
+	case mayJoin && !joined:
+		u.syncChannel(sess, event.ChannelID, sess.channelName(event.ChannelID))
+	case !mayJoin && joined:
+		ch.Part(u, "muted")
+	}
+}
+
+// channelPrefsCmd handles mute, unmute, favorite and unfavorite, without a channel the muted or
+// favorite channels are listed.
+func channelPrefsCmd(cmd string, set bool) func(u *User, toUser *User, args []string, service string) {
+	return func(u *User, toUser *User, args []string, service string) {
+		sess := u.session(service)
+
+		if len(args) == 0 {
+			var names []string
+
+			for _, info := range sess.br.GetChannels() {
+				if (cmd == "mute" && info.Muted) || (cmd == "favorite" && info.Favorite) {
+					names = append(names, sess.channelName(info.ID))
+				}
+			}
+
+			if len(names) == 0 {
+				u.MsgUser(toUser, "no channels")
+				return
+			}
+
+			u.MsgUser(toUser, strings.Join(names, " "))
+
+			return
+		}
+
+		done := cmd
+		if !set {
+			done = "un" + cmd
+		}
+
+		for _, name := range args {
+			channelID := u.channelIDByName(sess, name)
+			if channelID == "" {
+				u.MsgUser(toUser, fmt.Sprintf("%s does not exist", name))
+				continue
+			}
+
+			var err error
+
+			if cmd == "mute" {
+				err = sess.br.MuteChannel(channelID, set)
+			} else {
+				err = sess.br.FavoriteChannel(channelID, set)
+			}
+
+			if err != nil {
+				u.MsgUser(toUser, fmt.Sprintf("%s %s failed: %s", done, name, err))
+				continue
+			}
+
+			u.MsgUser(toUser, fmt.Sprintf("%s %sd", name, done))
+		}
+	}
+}
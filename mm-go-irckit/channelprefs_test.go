@@ -0,0 +1,73 @@
+package irckit
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/42wim/matterircd/bridge"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// prefsBridge has a single channel, c1 named general, which can be muted.
+type prefsBridge struct {
+	meBridge
+	muted bool
+}
+
+func (b *prefsBridge) GetChannel(channelID string) *bridge.ChannelInfo {
+	return &bridge.ChannelInfo{ID: channelID, Name: "general", Muted: b.muted}
+}
+
+func (b *prefsBridge) GetChannelName(channelID string) string {
+	return "general"
+}
+
+func (b *prefsBridge) GetChannelUsers(channelID string) ([]*bridge.UserInfo, error) {
+	return nil, nil
+}
+
+func (b *prefsBridge) GetChannelMembers(channelID string) ([]*bridge.ChannelMember, error) {
+	return nil, nil
+}
+
+func (b *prefsBridge) Topic(channelID string) string {
+	return "welcome"
+}
+
+func TestMutedChannelsPart(t *testing.T) {
+	client, c := net.Pipe()
+	defer client.Close()
+
+	go ioutil.ReadAll(client)
+
+	srv := NewServer("matterircd").(*server)
+	u := NewUserBridge(c, srv, viper.New())
+	u.Nick = "bob"
+	srv.Add(u)
+	srv.u = u
+
+	br := &prefsBridge{}
+	sess := u.newSession("mattermost", "mattermost", viper.New())
+	sess.br = br
+	u.addSession(sess)
+
+	u.syncChannel(sess, "c1", "general")
+	ch, _ := srv.HasChannel("c1")
+	assert.True(t, ch.HasUser(u))
+
+	// muted channels are joined like any other by default
+	br.muted = true
+	u.handleChannelPrefsEvent(sess, &bridge.ChannelPrefsEvent{ChannelID: "c1", Muted: true})
+	assert.True(t, ch.HasUser(u))
+
+	sess.v.Update(func(v *viper.Viper) { v.Set("mattermost.MutedChannels", "part") })
+
+	u.handleChannelPrefsEvent(sess, &bridge.ChannelPrefsEvent{ChannelID: "c1", Muted: true})
+	assert.False(t, ch.HasUser(u))
+
+	br.muted = false
+	u.handleChannelPrefsEvent(sess, &bridge.ChannelPrefsEvent{ChannelID: "c1"})
+	assert.True(t, ch.HasUser(u))
+}
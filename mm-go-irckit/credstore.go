@@ -0,0 +1,285 @@
+package irckit
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/42wim/matterircd/bridge"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	storeKeyIterations = 100000
+	storeSaltSize      = 16
+)
+
+var (
+	errWrongPassword = errors.New("wrong password")
+	errNoStore       = errors.New("no credential store, create one with ACCOUNT CREATE <password>")
+)
+
+// credentialStore keeps the credentials of the accounts of a user, encrypted with
+// a key derived from the matterircd password of that user.
+type credentialStore struct {
+	path     string
+	salt     []byte
+	key      []byte
+	accounts map[string]bridge.Credentials
+}
+
+// storeFile is the on-disk format of a credential store.
+type storeFile struct {
+	Salt  []byte `json:"salt"`
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+// newCredentialStore returns an empty store of user name in dir, which isn't written yet.
+func newCredentialStore(dir, name, password string) (*credentialStore, error) {
+	path, err := storePath(dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if password == "" {
+		return nil, errWrongPassword
+	}
+
+	return &credentialStore{
+		path:     path,
+		accounts: make(map[string]bridge.Credentials),
+	}, nil
+}
+
+// storePath returns the file of the store of user name in dir.
+func storePath(dir, name string) (string, error) {
+	name = strings.ToLower(name)
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		return "", fmt.Errorf("invalid user name %q", name)
+	}
+
+	return filepath.Join(dir, name+".json"), nil
+}
+
+// createCredentialStore creates the store of user name in dir, protected by password.
+func createCredentialStore(dir, name, password string) (*credentialStore, error) {
+	s, err := newCredentialStore(dir, name, password)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = os.Stat(s.path); err == nil {
+		return nil, fmt.Errorf("the credential store of %s already exists", strings.ToLower(name))
+	}
+
+	s.salt = make([]byte, storeSaltSize)
+	if _, err = rand.Read(s.salt); err != nil {
+		return nil, err
+	}
+
+	s.key = deriveKey(password, s.salt)
+
+	if err = s.save(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// openCredentialStore unlocks the store of user name in dir, it fails when the store doesn't exist.
+func openCredentialStore(dir, name, password string) (*credentialStore, error) {
+	s, err := newCredentialStore(dir, name, password)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, errNoStore
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var f storeFile
+
+	if err = json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("credential store %s is corrupt: %s", s.path, err)
+	}
+
+	s.salt = f.Salt
+	s.key = deriveKey(password, s.salt)
+
+	gcm, err := newGCM(s.key)
+	if err != nil {
+		return nil, err
+	}
+
+	plain, err := gcm.Open(nil, f.Nonce, f.Data, nil)
+	if err != nil {
+		return nil, errWrongPassword
+	}
+
+	if err = json.Unmarshal(plain, &s.accounts); err != nil {
+		return nil, fmt.Errorf("credential store %s is corrupt: %s", s.path, err)
+	}
+
+	return s, nil
+}
+
+func (s *credentialStore) save() error {
+	plain, err := json.Marshal(s.accounts)
+	if err != nil {
+		return err
+	}
+
+	gcm, err := newGCM(s.key)
+	if err != nil {
+		return err
+	}
+
+	f := storeFile{
+		Salt:  s.salt,
+		Nonce: make([]byte, gcm.NonceSize()),
+	}
+
+	if _, err = rand.Read(f.Nonce); err != nil {
+		return err
+	}
+
+	f.Data = gcm.Seal(nil, f.Nonce, plain, nil)
+
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(s.path, data)
+}
+
+func (s *credentialStore) add(service string, cred bridge.Credentials) error {
+	s.accounts[service] = cred
+	return s.save()
+}
+
+func (s *credentialStore) remove(service string) error {
+	if _, ok := s.accounts[service]; !ok {
+		return fmt.Errorf("no credentials stored for %s", service)
+	}
+
+	delete(s.accounts, service)
+
+	return s.save()
+}
+
+// services returns the services which have credentials stored, sorted.
+func (s *credentialStore) services() []string {
+	names := make([]string, 0, len(s.accounts))
+	for service := range s.accounts {
+		names = append(names, service)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// deriveKey derives a 256 bit key from the password using PBKDF2 with HMAC-SHA256.
+func deriveKey(password string, salt []byte) []byte {
+	return pbkdf2.Key([]byte(password), salt, storeKeyIterations, 32, sha256.New)
+}
+
+// unlockStore opens the credential store of user name.
+func (u *User) unlockStore(name, password string) error {
+	dir := u.v.GetString("CredentialStore")
+	if dir == "" {
+		return errors.New("the credential store is not enabled")
+	}
+
+	store, err := openCredentialStore(dir, name, password)
+	if err != nil {
+		logger.Errorf("unlocking credential store of %s failed: %s", name, err)
+		return err
+	}
+
+	u.store = store
+	u.storeUser = strings.ToLower(name)
+
+	return nil
+}
+
+// hasStore returns true when user name has a credential store.
+func (u *User) hasStore(name string) bool {
+	dir := u.v.GetString("CredentialStore")
+	if dir == "" {
+		return false
+	}
+
+	path, err := storePath(dir, name)
+	if err != nil {
+		return false
+	}
+
+	_, err = os.Stat(path)
+
+	return err == nil
+}
+
+// createStore creates the credential store of user name and unlocks it.
+func (u *User) createStore(name, password string) error {
+	dir := u.v.GetString("CredentialStore")
+	if dir == "" {
+		return errors.New("the credential store is not enabled")
+	}
+
+	store, err := createCredentialStore(dir, name, password)
+	if err != nil {
+		logger.Errorf("creating credential store of %s failed: %s", name, err)
+		return err
+	}
+
+	u.store = store
+	u.storeUser = strings.ToLower(name)
+
+	return nil
+}
+
+// loginStoredAccounts logs in to all the accounts in the credential store we're not logged in to yet.
+func (u *User) loginStoredAccounts() {
+	if u.store == nil {
+		return
+	}
+
+	for _, service := range u.store.services() {
+		if !u.isService(service) {
+			logger.Infof("skipping stored credentials of unknown service %s", service)
+			continue
+		}
+
+		if u.session(service) != nil {
+			continue
+		}
+
+		u.autoLogin(service, u.store.accounts[service])
+	}
+}
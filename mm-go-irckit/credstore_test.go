@@ -0,0 +1,58 @@
+package irckit
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/42wim/matterircd/bridge"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCredentialStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matterircd")
+	assert.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	// a missing store doesn't accept any password
+	_, err = openCredentialStore(dir, "alice", "secret")
+	assert.Equal(t, errNoStore, err)
+
+	store, err := createCredentialStore(dir, "Alice", "secret")
+	assert.NoError(t, err)
+	assert.Empty(t, store.services())
+
+	_, err = createCredentialStore(dir, "alice", "other")
+	assert.Error(t, err)
+
+	cred := bridge.Credentials{Server: "chat.example.com", Team: "team", Login: "alice", Pass: "hunter2"}
+	assert.NoError(t, store.add("mattermost", cred))
+	assert.NoError(t, store.add("slack", bridge.Credentials{Token: "xoxp-token"}))
+
+	data, err := ioutil.ReadFile(store.path)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), "hunter2")
+	assert.NotContains(t, string(data), "xoxp-token")
+
+	_, err = openCredentialStore(dir, "alice", "wrong")
+	assert.Equal(t, errWrongPassword, err)
+
+	store, err = openCredentialStore(dir, "alice", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"mattermost", "slack"}, store.services())
+	assert.Equal(t, cred, store.accounts["mattermost"])
+
+	assert.NoError(t, store.remove("slack"))
+	assert.Error(t, store.remove("slack"))
+
+	_, err = openCredentialStore(dir, "../alice", "secret")
+	assert.Error(t, err)
+
+	// without a store a single PASS is a slack token
+	u := &User{v: viper.New()}
+	u.v.Set("CredentialStore", dir)
+	assert.True(t, u.hasStore("Alice"))
+	assert.False(t, u.hasStore("bob"))
+}
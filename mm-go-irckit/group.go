@@ -0,0 +1,124 @@
+package irckit
+
+import (
+	"fmt"
+	"strings"
+)
+
+// groupNicks returns the nicks of a group message channel name like &group:alice+bob, nil when the
+// name isn't a group of this session.
+func (s *session) groupNicks(name string) []string {
+	prefix := "&group:"
+	if s.isNamespaced() {
+		prefix = "&" + s.prefix + ":group:"
+	}
+
+	if !strings.HasPrefix(strings.ToLower(name), prefix) {
+		return nil
+	}
+
+	var nicks []string
+
+	for _, nick := range strings.Split(name[len(prefix):], "+") {
+		if nick != "" {
+			nicks = append(nicks, nick)
+		}
+	}
+
+	return nicks
+}
+
+// ghostByNick returns the user ID of a nick on the bridge of the session.
+func (u *User) ghostByNick(sess *session, nick string) (string, bool) {
+	for _, name := range []string{nick, nick + "|" + sess.prefix} {
+		if other, ok := u.Srv.HasUser(name); ok && other.Ghost && other.br == sess.br {
+			return other.User, true
+		}
+	}
+
+	info := sess.br.GetUserByUsername(strings.TrimSuffix(nick, "|"+sess.prefix))
+	if info == nil || info.User == "" {
+		return "", false
+	}
+
+	return info.User, true
+}
+
+// openGroup opens the group message channel with the nicks and joins it.
+func (u *User) openGroup(sess *session, nicks []string) (Channel, error) {
+	userIDs := make([]string, 0, len(nicks))
+
+	for _, nick := range nicks {
+		userID, ok := u.ghostByNick(sess, nick)
+		if !ok {
+			return nil, fmt.Errorf("user %s does not exist", nick)
+		}
+
+		userIDs = append(userIDs, userID)
+	}
+
+	channelID, err := sess.br.CreateGroup(userIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	sess.br.UpdateChannels()
+
+	ch := u.channel(sess, channelID)
+	u.syncChannel(sess, channelID, sess.channelName(channelID))
+	ch.Join(u)
+
+	return ch, nil
+}
+
+// groupMembers returns the nicks of the other members of a group message channel.
+func (u *User) groupMembers(sess *session, ch Channel) []string {
+	var nicks []string
+
+	for _, other := range ch.Users() {
+		if other.Ghost && other.br == sess.br && other.User != sess.br.GetMe().User {
+			nicks = append(nicks, other.Nick)
+		}
+	}
+
+	return nicks
+}
+
+// changeGroup opens a group message channel with a member added or removed, the members of an
+// existing group can't be changed on mattermost and slack.
+func (u *User) changeGroup(sess *session, ch Channel, nick string, add bool) error {
+	var nicks []string
+
+	for _, member := range u.groupMembers(sess, ch) {
+		if !strings.EqualFold(member, nick) {
+			nicks = append(nicks, member)
+		}
+	}
+
+	if add {
+		nicks = append(nicks, nick)
+	}
+
+	if len(nicks) < 2 {
+		return fmt.Errorf("a group needs at least 2 other members")
+	}
+
+	_, err := u.openGroup(sess, nicks)
+
+	return err
+}
+
+func groupCmd(u *User, toUser *User, args []string, service string) {
+	if len(args) < 2 {
+		u.MsgUser(toUser, "need GROUP <nick> <nick> [<nick>...]")
+		return
+	}
+
+	ch, err := u.openGroup(u.session(service), args)
+	if err != nil {
+		u.MsgUser(toUser, fmt.Sprintf("group failed: %s", err))
+		return
+	}
+
+	u.MsgUser(toUser, fmt.Sprintf("opened %s", ch.String()))
+}
@@ -0,0 +1,135 @@
+package irckit
+
+import (
+	"strings"
+
+	"github.com/42wim/matterircd/bridge"
+)
+
+// mentionsChannel receives a copy of the messages of all bridges which mention us.
+const mentionsChannel = "&mentions"
+
+// copyMention sends a copy of a message which mentions us to &mentions, with the channel it's from.
+func (u *User) copyMention(sess *session, event *bridge.ChannelMessageEvent) {
+	// parting &mentions turns it off, see partMentions
+	ch := u.Srv.Channel(mentionsChannel)
+	if !ch.HasUser(u) {
+		return
+	}
+
+	nick := u.createUserFromInfo(sess, event.Sender).Nick + "/" + u.channel(sess, event.ChannelID).String()
+	ch.SpoofMessage(nick, event.Text)
+
+	u.mentionsMu.Lock()
+	u.mentioned[event.ChannelID] = sess
+	u.mentionsMu.Unlock()
+}
+
+// joinMentions joins &mentions, on login only when we didn't part it. JOIN &mentions turns it on again.
+func (u *User) joinMentions(join bool) {
+	u.mentionsMu.Lock()
+	if join {
+		u.mentionsParted = false
+	}
+	parted := u.mentionsParted
+	u.mentionsMu.Unlock()
+
+	if !parted {
+		u.Srv.Channel(mentionsChannel).Join(u)
+	}
+}
+
+// partMentions parts &mentions, which turns off copying mentions to it.
+func (u *User) partMentions(reason string) {
+	u.mentionsMu.Lock()
+	u.mentionsParted = true
+	u.mentionsMu.Unlock()
+
+	if ch, ok := u.Srv.HasChannel(mentionsChannel); ok && ch.HasUser(u) {
+		ch.Part(u, reason)
+	}
+}
+
+// markMentionsViewed marks the channels of the mentions in &mentions as viewed, for the bridges
+// with MarkMentionsViewed. It's done when we say something in &mentions.
+func (u *User) markMentionsViewed() {
+	u.mentionsMu.Lock()
+	mentioned := u.mentioned
+	u.mentioned = make(map[string]*session)
+	u.mentionsMu.Unlock()
+
+	for channelID, sess := range mentioned {
+		if u.session(sess.name) != sess || !sess.v.GetBool(sess.protocol+".MarkMentionsViewed") {
+			continue
+		}
+
+		sess.br.UpdateLastViewed(channelID)
+	}
+}
+
+// nickPunctuation can follow a nick, eg "alice: ping" or "ask alice, bob."
+const nickPunctuation = ":,.!?;"
+
+// translateMentions turns the nicks of the members of a channel in a message we send into
+// mentions on the bridge, eg "alice: ping" becomes "@alice: ping" on mattermost. Only a nick
+// addressed at the start ("alice:" or "alice,", regardless of case) or written as @alice is
+// converted, with TranslateInlineNicks also a nick anywhere else. "\alice" escapes the conversion.
+func (u *User) translateMentions(sess *session, ch Channel, text string) string {
+	key := sess.protocol + ".TranslateMentions"
+	if sess.v.IsSet(key) && !sess.v.GetBool(key) {
+		return text
+	}
+
+	members := make(map[string]string)
+
+	for _, other := range ch.Users() {
+		if other.Ghost && other.br == sess.br && !other.Me {
+			members[other.Nick] = other.User
+		}
+	}
+
+	if len(members) == 0 {
+		return text
+	}
+
+	inline := sess.v.GetBool(sess.protocol + ".TranslateInlineNicks")
+
+	words := strings.Split(text, " ")
+
+	for i, word := range words {
+		nick := strings.TrimRight(word, nickPunctuation)
+		punctuation := word[len(nick):]
+
+		escaped := strings.HasPrefix(nick, `\`)
+		nick = strings.TrimPrefix(nick, `\`)
+
+		addressed := i == 0 && (strings.HasPrefix(punctuation, ":") || strings.HasPrefix(punctuation, ","))
+		if !addressed && !inline && !strings.HasPrefix(nick, "@") {
+			continue
+		}
+
+		userID, ok := members[strings.TrimPrefix(nick, "@")]
+		if !ok && addressed {
+			for member, id := range members {
+				if strings.EqualFold(member, nick) {
+					userID, ok = id, true
+				}
+			}
+		}
+
+		if !ok {
+			continue
+		}
+
+		if escaped {
+			words[i] = nick + punctuation
+			continue
+		}
+
+		if mention := sess.br.MentionUser(userID); mention != "" {
+			words[i] = mention + punctuation
+		}
+	}
+
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,87 @@
+package irckit
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/42wim/matterircd/bridge"
+	"github.com/sorcix/irc"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// mentionBridge only implements MentionUser, like mattermost.
+type mentionBridge struct {
+	bridge.Bridger
+}
+
+func (b *mentionBridge) MentionUser(userID string) string {
+	return "@" + userID
+}
+
+func TestTranslateMentions(t *testing.T) {
+	br := &mentionBridge{}
+	sess := &session{protocol: "mattermost", br: br, v: bridge.NewConfig(viper.New())}
+
+	alice := NewUser(nil)
+	alice.UserInfo = &bridge.UserInfo{Nick: "alice", User: "alice.smith", Ghost: true}
+	alice.br = br
+
+	ch := NewChannel(nil, "chan1", "#test", "mattermost")
+	ch.BatchJoin([]*User{alice})
+
+	u := &User{}
+
+	assert.Equal(t, "@alice.smith: ping", u.translateMentions(sess, ch, "alice: ping"))
+	assert.Equal(t, "@alice.smith, see above", u.translateMentions(sess, ch, "Alice, see above"))
+	assert.Equal(t, "ask @alice.smith.", u.translateMentions(sess, ch, "ask @alice."))
+	assert.Equal(t, "@alice.smith ping", u.translateMentions(sess, ch, "@alice ping"))
+	assert.Equal(t, "alice: not a mention", u.translateMentions(sess, ch, `\alice: not a mention`))
+	assert.Equal(t, "@alice not a mention", u.translateMentions(sess, ch, `\@alice not a mention`))
+
+	// nicks which are ordinary words are only converted when they address someone
+	assert.Equal(t, "ask alice.", u.translateMentions(sess, ch, "ask alice."))
+	assert.Equal(t, "ask Alice or bob", u.translateMentions(sess, ch, "ask Alice or bob"))
+	assert.Equal(t, "alice is here", u.translateMentions(sess, ch, "alice is here"))
+	assert.Equal(t, "ask @Alice", u.translateMentions(sess, ch, "ask @Alice"))
+
+	// inline nicks have to match exactly
+	sess.v.Update(func(v *viper.Viper) { v.Set("mattermost.TranslateInlineNicks", true) })
+	assert.Equal(t, "see above @alice.smith", u.translateMentions(sess, ch, "see above alice"))
+	assert.Equal(t, "ask @alice.smith.", u.translateMentions(sess, ch, "ask alice."))
+	assert.Equal(t, "ask Alice or bob", u.translateMentions(sess, ch, "ask Alice or bob"))
+	assert.Equal(t, "see above alice", u.translateMentions(sess, ch, `see above \alice`))
+
+	sess.v.Update(func(v *viper.Viper) { v.Set("mattermost.TranslateMentions", false) })
+	assert.Equal(t, "alice: ping", u.translateMentions(sess, ch, "alice: ping"))
+}
+
+func TestPartMentions(t *testing.T) {
+	client, c := net.Pipe()
+	defer client.Close()
+
+	go ioutil.ReadAll(client)
+
+	srv := NewServer("matterircd").(*server)
+	u := NewUserNet(c)
+	u.Srv = srv
+	u.Nick = "bob"
+	srv.Add(u)
+	srv.u = u
+
+	u.joinMentions(false)
+	ch, _ := srv.HasChannel(mentionsChannel)
+	assert.True(t, ch.HasUser(u))
+
+	CmdPart(srv, u, &irc.Message{Command: irc.PART, Params: []string{mentionsChannel}})
+	assert.False(t, ch.HasUser(u))
+
+	// not joined again on login
+	u.joinMentions(false)
+	assert.False(t, ch.HasUser(u))
+
+	CmdJoin(srv, u, &irc.Message{Command: irc.JOIN, Params: []string{mentionsChannel}})
+	ch, _ = srv.HasChannel(mentionsChannel)
+	assert.True(t, ch.HasUser(u))
+}
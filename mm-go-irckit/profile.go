@@ -0,0 +1,212 @@
+package irckit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/42wim/matterircd/bridge"
+	"github.com/42wim/matterircd/config"
+	"github.com/pelletier/go-toml"
+	"github.com/spf13/viper"
+)
+
+// profileNames returns the names the profiles of a session are keyed by: the IRC nick and the
+// login and username of the bridge account. The profiles of later names win.
+func (u *User) profileNames(sess *session) []string {
+	names := []string{u.Nick, sess.credentials.Login}
+
+	if sess.br != nil {
+		if me := sess.br.GetMe(); me != nil {
+			names = append(names, me.Username)
+		}
+	}
+
+	return names
+}
+
+// refreshConfig updates the configuration of a session to the one of its service with the
+// [users.<name>.<protocol>] sections and the profile file of the user applied.
+func (u *User) refreshConfig(sess *session) {
+	_, base := u.serviceConfig(sess.name)
+	fresh := bridge.CopyConfig(base)
+
+	users := base.GetStringMap("users")
+
+	for _, name := range u.profileNames(sess) {
+		if name == "" {
+			continue
+		}
+
+		protocols, _ := users[strings.ToLower(name)].(map[string]interface{})
+		applyProfile(fresh, sess.protocol, protocols[sess.protocol])
+	}
+
+	if path, err := u.profilePath(sess); err != nil {
+		logger.Errorf("profile of %s: %s", sess.name, err)
+	} else if path != "" {
+		profile, err := loadProfile(path)
+		if err != nil {
+			logger.Errorf("loading profile %s failed: %s", path, err)
+		}
+
+		applyProfile(fresh, sess.protocol, profile[sess.name])
+	}
+
+	// this also drops the changes made by JOIN and PART
+	sess.v.Store(fresh)
+}
+
+// applyProfile sets the options of a profile table in the section of protocol.
+func applyProfile(v *viper.Viper, protocol string, profile interface{}) {
+	table, _ := profile.(map[string]interface{})
+
+	for key, value := range table {
+		if !isProfileOption(protocol, key) {
+			logger.Warnf("ignoring %s in a profile, it can't be set per user", key)
+			continue
+		}
+
+		v.Set(protocol+"."+key, value)
+	}
+}
+
+func isProfileOption(protocol, key string) bool {
+	for _, name := range config.ProfileOptions(protocol) {
+		if strings.EqualFold(name, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// profilePath returns the file with the profile of the user of a session, it's "" when ProfileDir
+// isn't set or we're not logged in yet.
+func (u *User) profilePath(sess *session) (string, error) {
+	dir := u.v.GetString("ProfileDir")
+	if dir == "" || sess.br == nil || sess.br.GetMe() == nil {
+		return "", nil
+	}
+
+	name := strings.ToLower(sess.br.GetMe().Username)
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		return "", fmt.Errorf("invalid user name %q", name)
+	}
+
+	return filepath.Join(dir, name+".toml"), nil
+}
+
+// loadProfile reads a profile file, it has a table per service, eg [mattermost].
+func loadProfile(path string) (map[string]interface{}, error) {
+	tree, err := toml.LoadFile(path)
+	if os.IsNotExist(err) {
+		return make(map[string]interface{}), nil
+	}
+
+	if err != nil {
+		return make(map[string]interface{}), err
+	}
+
+	return tree.ToMap(), nil
+}
+
+func saveProfile(path string, profile map[string]interface{}) error {
+	tree, err := toml.TreeFromMap(profile)
+	if err != nil {
+		return err
+	}
+
+	data, err := tree.ToTomlString()
+	if err != nil {
+		return err
+	}
+
+	return writeFile(path, []byte(data))
+}
+
+// setProfile changes an option in the profile file of the user of a session, a nil value removes it.
+func (u *User) setProfile(sess *session, key string, value interface{}) error {
+	path, err := u.profilePath(sess)
+	if err != nil {
+		return err
+	}
+
+	if path == "" {
+		return fmt.Errorf("ProfileDir isn't set")
+	}
+
+	profile, err := loadProfile(path)
+	if err != nil {
+		return err
+	}
+
+	table, _ := profile[sess.name].(map[string]interface{})
+	if table == nil {
+		table = make(map[string]interface{})
+	}
+
+	key = strings.ToLower(key)
+
+	if value == nil {
+		delete(table, key)
+	} else {
+		table[key] = value
+	}
+
+	if len(table) == 0 {
+		delete(profile, sess.name)
+	} else {
+		profile[sess.name] = table
+	}
+
+	return saveProfile(path, profile)
+}
+
+func setCmd(u *User, toUser *User, args []string, service string) {
+	sess := u.session(service)
+
+	if len(args) == 0 {
+		for _, name := range config.ProfileOptions(sess.protocol) {
+			u.MsgUser(toUser, fmt.Sprintf("%s = %v", name, sess.v.Get(sess.protocol+"."+strings.ToLower(name))))
+		}
+
+		return
+	}
+
+	var (
+		name  string
+		value interface{}
+		err   error
+	)
+
+	// without a value the option is removed from the profile
+	if len(args) == 1 {
+		name = args[0]
+		if !isProfileOption(sess.protocol, name) {
+			_, _, err = config.ProfileValue(sess.protocol, name, nil)
+		}
+	} else {
+		name, value, err = config.ProfileValue(sess.protocol, args[0], args[1:])
+	}
+
+	if err != nil {
+		u.MsgUser(toUser, err.Error())
+		return
+	}
+
+	if err = u.setProfile(sess, name, value); err != nil {
+		u.MsgUser(toUser, fmt.Sprintf("%s is changed for this connection only, saving failed: %s", name, err))
+		sess.v.Update(func(v *viper.Viper) {
+			v.Set(sess.protocol+"."+strings.ToLower(name), value)
+		})
+	} else {
+		u.refreshConfig(sess)
+		u.MsgUser(toUser, fmt.Sprintf("%s = %v", name, sess.v.Get(sess.protocol+"."+strings.ToLower(name))))
+	}
+
+	for _, change := range u.reloadJoins(sess) {
+		u.MsgUser(toUser, change)
+	}
+}
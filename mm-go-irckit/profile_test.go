@@ -0,0 +1,67 @@
+package irckit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/42wim/matterircd/bridge"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+const profileConfig = `
+[mattermost]
+JoinExclude = ["#town-square"]
+
+[users.alice.mattermost]
+HideReplies = true
+DefaultServer = "chat.evil.com"
+`
+
+func TestRefreshConfig(t *testing.T) {
+	v := viper.New()
+	v.SetConfigType("toml")
+	assert.NoError(t, v.ReadConfig(strings.NewReader(profileConfig)))
+
+	u := &User{UserInfo: &bridge.UserInfo{Nick: "Alice"}, v: v}
+	sess := &session{name: "mattermost", protocol: "mattermost", v: bridge.NewConfig(bridge.CopyConfig(v))}
+
+	// a JOIN override is dropped
+	sess.v.Update(func(v *viper.Viper) { v.Set("mattermost.joininclude", []string{"#off-topic"}) })
+	u.refreshConfig(sess)
+
+	assert.True(t, sess.v.GetBool("mattermost.HideReplies"))
+	assert.Empty(t, sess.v.GetStringSlice("mattermost.JoinInclude"))
+	assert.Equal(t, []string{"#town-square"}, sess.v.GetStringSlice("mattermost.JoinExclude"))
+	assert.Empty(t, sess.v.GetString("mattermost.DefaultServer"))
+
+	// the global configuration isn't changed
+	assert.False(t, v.GetBool("mattermost.HideReplies"))
+}
+
+func TestProfileFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matterircd")
+	assert.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "profiles", "alice.toml")
+
+	profile, err := loadProfile(path)
+	assert.NoError(t, err)
+	assert.Empty(t, profile)
+
+	profile["mattermost"] = map[string]interface{}{"joinexclude": []string{"#foo", "#bar"}, "hidereplies": true}
+	assert.NoError(t, saveProfile(path, profile))
+
+	profile, err = loadProfile(path)
+	assert.NoError(t, err)
+
+	v := viper.New()
+	applyProfile(v, "mattermost", profile["mattermost"])
+	assert.Equal(t, []string{"#foo", "#bar"}, v.GetStringSlice("mattermost.joinexclude"))
+	assert.True(t, v.GetBool("mattermost.hidereplies"))
+}
@@ -0,0 +1,156 @@
+package irckit
+
+import (
+	"strings"
+	"time"
+
+	"github.com/42wim/matterircd/bridge"
+	"github.com/sorcix/irc"
+)
+
+// capReadMarker is the IRCv3 capability for syncing read markers with the client, see
+// https://ircv3.net/specs/extensions/read-marker
+const capReadMarker = "draft/read-marker"
+
+// markReadFormat is the timestamp format of MARKREAD.
+const markReadFormat = "2006-01-02T15:04:05.000Z"
+
+// hasCap returns whether the client enabled a capability.
+func (u *User) hasCap(name string) bool {
+	u.RLock()
+	defer u.RUnlock()
+
+	return u.caps[name]
+}
+
+// setCap enables or disables a capability of the client.
+func (u *User) setCap(name string, enabled bool) {
+	u.Lock()
+	defer u.Unlock()
+
+	if u.caps == nil {
+		u.caps = make(map[string]bool)
+	}
+
+	if enabled {
+		u.caps[name] = true
+	} else {
+		delete(u.caps, name)
+	}
+}
+
+// markReadParam returns the timestamp parameter of MARKREAD, millis is 0 when there's no read marker.
+func markReadParam(millis int64) string {
+	if millis == 0 {
+		return "timestamp=*"
+	}
+
+	return "timestamp=" + time.Unix(0, millis*int64(time.Millisecond)).UTC().Format(markReadFormat)
+}
+
+// parseMarkReadParam returns the time of a timestamp parameter of MARKREAD in milliseconds.
+func parseMarkReadParam(param string) (int64, bool) {
+	if !strings.HasPrefix(param, "timestamp=") {
+		return 0, false
+	}
+
+	ts, err := time.Parse(time.RFC3339Nano, strings.TrimPrefix(param, "timestamp="))
+	if err != nil {
+		return 0, false
+	}
+
+	return ts.UnixNano() / int64(time.Millisecond), true
+}
+
+// sendMarkRead tells the client a channel was read up to viewedAt, when it supports read markers.
+func (u *User) sendMarkRead(sess *session, channelID string, viewedAt int64) {
+	if !u.hasCap(capReadMarker) {
+		return
+	}
+
+	u.Srv.EncodeMessage(u, "MARKREAD", []string{u.unreadName(sess, channelID), markReadParam(viewedAt)}, "")
+}
+
+func (u *User) handleChannelViewedEvent(sess *session, event *bridge.ChannelViewedEvent) {
+	u.sendMarkRead(sess, event.ChannelID, event.ViewedAt)
+}
+
+// directChannelID returns the ID of the direct message channel with a user, "" when we don't know it.
+func (u *User) directChannelID(sess *session, nick string) string {
+	for _, channel := range sess.br.GetChannels() {
+		if channel.Direct && u.unreadName(sess, channel.ID) == nick {
+			return channel.ID
+		}
+	}
+
+	return ""
+}
+
+// CmdMarkRead is a handler for the MARKREAD command of the read-marker capability. The bridges can
+// only mark a channel as read up to now, so a newer timestamp than the one of the bridge does that.
+func CmdMarkRead(s Server, u *User, msg *irc.Message) error {
+	params := msg.Params
+	if msg.Trailing != "" {
+		params = append(params, msg.Trailing)
+	}
+
+	target := params[0]
+
+	var (
+		sess      *session
+		channelID string
+		userID    string
+	)
+
+	if ch, exists := s.HasChannel(target); exists {
+		sess = u.sessionForChannel(ch)
+		channelID = ch.ID()
+	} else if other, exists := s.HasUser(target); exists && other.Ghost {
+		for _, candidate := range u.getSessions() {
+			if candidate.br == other.br {
+				sess = candidate
+			}
+		}
+
+		if sess != nil {
+			channelID = u.directChannelID(sess, other.Nick)
+			userID = other.User
+		}
+	}
+
+	var viewedAt int64
+
+	switch {
+	case target == mentionsChannel:
+	case sess == nil:
+		return s.EncodeMessage(u, "FAIL", []string{"MARKREAD", "INVALID_PARAMS", target}, "No such nick/channel")
+	case channelID != "":
+		viewedAt = sess.br.GetLastViewedAt(channelID)
+	}
+
+	if len(params) < 2 {
+		return s.EncodeMessage(u, "MARKREAD", []string{target, markReadParam(viewedAt)}, "")
+	}
+
+	ts, ok := parseMarkReadParam(params[1])
+	if !ok {
+		return s.EncodeMessage(u, "FAIL", []string{"MARKREAD", "INVALID_PARAMS", target}, "Invalid timestamp")
+	}
+
+	if ts > viewedAt {
+		switch {
+		case target == mentionsChannel:
+			u.markMentionsViewed()
+		case channelID != "":
+			sess.br.UpdateLastViewed(channelID)
+		default:
+			if err := sess.br.UpdateLastViewedUser(userID); err != nil {
+				return s.EncodeMessage(u, "FAIL", []string{"MARKREAD", "INTERNAL_ERROR", target}, err.Error())
+			}
+		}
+
+		viewedAt = ts
+	}
+
+	return s.EncodeMessage(u, "MARKREAD", []string{target, markReadParam(viewedAt)}, "")
+}
@@ -0,0 +1,26 @@
+package irckit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarkReadParam(t *testing.T) {
+	assert.Equal(t, "timestamp=*", markReadParam(0))
+	assert.Equal(t, "timestamp=2021-03-04T05:06:07.089Z", markReadParam(1614834367089))
+
+	millis, ok := parseMarkReadParam("timestamp=2021-03-04T05:06:07.089Z")
+	assert.True(t, ok)
+	assert.Equal(t, int64(1614834367089), millis)
+
+	millis, ok = parseMarkReadParam("timestamp=2021-03-04T06:06:07.089+01:00")
+	assert.True(t, ok)
+	assert.Equal(t, int64(1614834367089), millis)
+
+	_, ok = parseMarkReadParam("timestamp=*")
+	assert.False(t, ok)
+
+	_, ok = parseMarkReadParam("2021-03-04T05:06:07.089Z")
+	assert.False(t, ok)
+}
@@ -0,0 +1,132 @@
+package irckit
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/42wim/matterircd/bridge"
+)
+
+// configReloadEvent asks the event loop of a session to apply the reloaded config file.
+type configReloadEvent struct{}
+
+// requestReload is called by the config file watcher, the reload is done by the loop of the user.
+// A reload which is still pending covers this change too.
+func (u *User) requestReload() {
+	select {
+	case u.reloads <- struct{}{}:
+	default:
+	}
+}
+
+// reloadConfig applies a changed config file to the user and hands it to the event loops of the
+// sessions which are logged in, they tell the user what changed.
+func (u *User) reloadConfig() {
+	var changes []string
+
+	if timeout := u.pasteBufferTimeout(); timeout != u.pasteTimeout {
+		u.pasteTimeout = timeout
+		changes = append(changes, fmt.Sprintf("paste buffer timeout is now %s", timeout))
+	}
+
+	// accounts have a copy of the configuration
+	for _, acc := range u.accounts {
+		fresh := accountConfig(u.v, acc.protocol, strings.TrimPrefix(acc.name, acc.protocol+"-"))
+		for _, key := range fresh.AllKeys() {
+			acc.v.Set(key, fresh.Get(key))
+		}
+	}
+
+	sessions := u.getSessions()
+
+	for _, sess := range sessions {
+		sess := sess
+
+		// the bridge may be sending an event itself
+		go func() {
+			sess.events <- &bridge.Event{Type: "config_reload", Data: &configReloadEvent{}}
+		}()
+	}
+
+	if len(changes) == 0 && len(sessions) > 0 {
+		return
+	}
+
+	svc, ok := u.Srv.HasUser(services[0])
+	if len(sessions) > 0 {
+		svc, ok = u.Srv.HasUser(sessions[0].name)
+	}
+
+	if ok {
+		u.reportReload(svc, changes)
+	}
+}
+
+// handleConfigReloadEvent applies the reloaded config file to a session.
+func (u *User) handleConfigReloadEvent(sess *session) {
+	// logged out while the event was on its way
+	if u.session(sess.name) != sess {
+		return
+	}
+
+	svc, ok := u.Srv.HasUser(sess.name)
+
+	// slack checks Restrict against the team instead of the server, on login
+	if sess.protocol != "slack" && !u.isValidServer(sess.credentials.Server, sess.name) {
+		u.logoutFrom(sess)
+
+		if ok {
+			u.reportReload(svc, []string{fmt.Sprintf("logged out, %s isn't in Restrict anymore", sess.credentials.Server)})
+		}
+
+		return
+	}
+
+	// the config file wins over the changes made by JOIN and PART
+	u.refreshConfig(sess)
+
+	changes := u.reloadJoins(sess)
+
+	if ok {
+		u.reportReload(svc, changes)
+	}
+}
+
+// reportReload tells the user what changed after a reload of the config file.
+func (u *User) reportReload(svc *User, changes []string) {
+	if len(changes) == 0 {
+		u.MsgUser(svc, "configuration reloaded, nothing to change")
+		return
+	}
+
+	u.MsgUser(svc, "configuration reloaded:")
+
+	for _, change := range changes {
+		u.MsgUser(svc, change)
+	}
+}
+
+// reloadJoins joins the channels which are included now and parts the ones which are excluded now.
+func (u *User) reloadJoins(sess *session) []string {
+	var changes []string
+
+	for _, brchannel := range sess.br.GetChannels() {
+		if brchannel.Direct || strings.Contains(brchannel.Name, "__") {
+			continue
+		}
+
+		ch, exists := u.Srv.HasChannel(brchannel.ID)
+		joined := exists && ch.HasUser(u)
+
+		switch mayJoin := u.mayJoin(sess, brchannel.ID); {
+		case mayJoin && !joined:
+			u.syncChannel(sess, brchannel.ID, sess.channelName(brchannel.ID))
+			changes = append(changes, "joined "+sess.channelName(brchannel.ID))
+		case !mayJoin && joined:
+			ch.Part(u, "excluded by the configuration")
+			changes = append(changes, "parted "+ch.String())
+		}
+	}
+
+	return changes
+}
@@ -0,0 +1,63 @@
+package irckit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/42wim/matterircd/bridge"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// logoutBridge is a bridge which remembers it was logged out.
+type logoutBridge struct {
+	meBridge
+	loggedOut bool
+}
+
+func (b *logoutBridge) Logout() error {
+	b.loggedOut = true
+	return nil
+}
+
+func TestRequestReload(t *testing.T) {
+	u := NewUser(nil)
+
+	// changes while a reload is pending don't queue up
+	u.requestReload()
+	u.requestReload()
+	assert.Len(t, u.reloads, 1)
+}
+
+func TestReloadConfig(t *testing.T) {
+	u := NewUser(nil)
+	u.v = viper.New()
+	u.Srv = NewServer("test")
+
+	br := &logoutBridge{meBridge: meBridge{user: "me"}}
+	sess := u.newSession("mattermost", "mattermost", viper.New())
+	sess.br = br
+	sess.credentials.Server = "chat.example.com"
+	sess.events = make(chan *bridge.Event)
+	u.addSession(sess)
+
+	// the session applies the reload in its own event loop
+	u.reloadConfig()
+
+	select {
+	case event := <-sess.events:
+		assert.Equal(t, &configReloadEvent{}, event.Data)
+	case <-time.After(time.Second):
+		t.Fatal("reload wasn't sent to the session")
+	}
+
+	u.v.Set("mattermost.Restrict", []string{"other.example.com"})
+	u.handleConfigReloadEvent(sess)
+	assert.True(t, br.loggedOut)
+	assert.Empty(t, u.getSessions())
+
+	// a session which is gone ignores the reload
+	br.loggedOut = false
+	u.handleConfigReloadEvent(sess)
+	assert.False(t, br.loggedOut)
+}
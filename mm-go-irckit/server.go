@@ -1,6 +1,7 @@
 package irckit
 
 import (
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"strings"
@@ -8,6 +9,7 @@ import (
 	"time"
 
 	"github.com/42wim/matterircd/bridge"
+	"github.com/42wim/matterircd/config"
 	"github.com/sorcix/irc"
 )
 
@@ -66,11 +68,15 @@ type Server interface {
 
 	Add(u *User) bool
 	BatchAdd(users []*User)
+	Remove(u *User)
 	Handle(u *User)
 	Logout(u *User)
 	ChannelCount() int
 	UserCount() int
 	EncodeMessage(u *User, cmd string, params []string, trailing string) error
+
+	// ISupport sends the features of the server (RPL_ISUPPORT) to the User.
+	ISupport(u *User) error
 }
 
 // ServerConfig produces a Server setup with configuration options.
@@ -173,10 +179,42 @@ func (s *server) HasUser(nick string) (*User, bool) {
 			return u, true
 		}
 	}
+	// nicks are case insensitive (CASEMAPPING=ascii), an exact match wins
+	for _, u := range s.users {
+		u := u
+		if equalFoldASCII(u.Nick, nick) {
+			return u, true
+		}
+	}
 	//	u, exists := s.users[ID(nick)]
 	return nil, false
 }
 
+// equalFoldASCII compares nicks the way CASEMAPPING=ascii does, only A-Z and a-z are folded.
+func equalFoldASCII(a, b string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := 0; i < len(a); i++ {
+		ca, cb := a[i], b[i]
+
+		if 'A' <= ca && ca <= 'Z' {
+			ca += 'a' - 'A'
+		}
+
+		if 'A' <= cb && cb <= 'Z' {
+			cb += 'a' - 'A'
+		}
+
+		if ca != cb {
+			return false
+		}
+	}
+
+	return true
+}
+
 func (s *server) HasUserID(userID string) (*User, bool) {
 	s.RLock()
 	u, exists := s.users[strings.ToLower(userID)]
@@ -228,8 +266,7 @@ func (s *server) Channel(channelID string) Channel {
 	s.Lock()
 	ch, ok := s.channels[channelID]
 	if !ok {
-		service := s.u.br.Protocol()
-		name := s.u.br.GetChannelName(channelID)
+		service, name := s.u.channelInfo(channelID)
 		newFn := s.config.NewChannel
 		ch = newFn(s, channelID, name, service)
 		fmt.Println("new channel id:", channelID, "name:", name)
@@ -245,11 +282,11 @@ func (s *server) Channel(channelID string) Channel {
 // UnlinkChannel unlinks the channel from the server's storage, returns whether it existed.
 func (s *server) UnlinkChannel(ch Channel) {
 	s.Lock()
-	chStored := s.channels[ch.String()]
-	r := chStored == ch
-	if r {
-		delete(s.channels, ch.String())
-		delete(s.channels, ch.ID())
+	// the channel is stored by name and by the bridge ID, which isn't always lowercase
+	for key, stored := range s.channels {
+		if stored == ch {
+			delete(s.channels, key)
+		}
 	}
 	s.Unlock()
 }
@@ -272,7 +309,11 @@ func (s *server) Quit(u *User, message string) {
 	delete(s.users, u.ID())
 	s.Unlock()
 
-	u.br.Logout()
+	u.detach()
+
+	for _, sess := range u.getSessions() {
+		sess.br.Logout()
+	}
 }
 
 // Len returns the number of users connected to the server.
@@ -318,10 +359,76 @@ func (s *server) welcome(u *User) error {
 	if err != nil {
 		return err
 	}
+	if err = s.ISupport(u); err != nil {
+		return err
+	}
 	// Always include motd, even if it's empty? Seems some clients expect it (libpurple?).
 	return CmdMotd(s, u, nil)
 }
 
+// ISupport sends the features of the server, the limits depend on the bridges the user is logged in to
+// so it's sent again after every login. Nicks are cut at MaxNickLen, topics and posts are limited by
+// the strictest bridge.
+func (s *server) ISupport(u *User) error {
+	channelLen, topicLen, postLen := 0, 0, 0
+
+	for _, sess := range u.getSessions() {
+		limits := sess.br.GetLimits()
+
+		prefixLen := 0
+		if sess.isNamespaced() {
+			prefixLen = len(sess.prefix + ":")
+		}
+
+		if limits.ChannelLen > 0 && limits.ChannelLen+prefixLen > channelLen {
+			channelLen = limits.ChannelLen + prefixLen
+		}
+
+		topicLen = minLimit(topicLen, limits.TopicLen)
+		postLen = minLimit(postLen, limits.PostLen)
+	}
+
+	tokens := []string{
+		"NETWORK=" + s.config.Name,
+		"CASEMAPPING=ascii",
+		"CHANTYPES=#&",
+		// b only lists the (empty) ban list
+		"CHANMODES=b,,,mnps",
+		"PREFIX=(ov)@+",
+		"MODES=4",
+		fmt.Sprintf("NICKLEN=%d", s.config.MaxNickLen),
+	}
+
+	if channelLen > 0 {
+		tokens = append(tokens, fmt.Sprintf("CHANNELLEN=%d", channelLen))
+	}
+
+	if topicLen > 0 {
+		tokens = append(tokens, fmt.Sprintf("TOPICLEN=%d", topicLen))
+	}
+
+	if postLen > 0 {
+		// not a standard token, so it's prefixed
+		tokens = append(tokens, fmt.Sprintf("matterircd.org/POSTLEN=%d", postLen))
+	}
+
+	return u.Encode(&irc.Message{
+		Prefix:   s.Prefix(),
+		Command:  irc.RPL_ISUPPORT,
+		Params:   append([]string{u.Nick}, tokens...),
+		Trailing: "are supported by this server",
+	})
+}
+
+// minLimit returns the smallest of two limits, 0 means unlimited.
+func minLimit(a, b int) int {
+	if a == 0 || (b > 0 && b < a) {
+		return b
+	}
+
+	return a
+}
+
 func (s *server) EncodeMessage(u *User, cmd string, params []string, trailing string) error {
 	return u.Encode(&irc.Message{
 		Prefix:   s.Prefix(),
@@ -338,11 +445,45 @@ func (s *server) Handle(u *User) {
 func (s *server) handle(u *User) {
 	var partMsg string
 	defer s.Quit(u, partMsg)
-	for msg := range u.DecodeCh {
+
+	// apply changes of the config file while connected, in this loop instead of the watcher
+	unsubscribe := config.Subscribe(u.requestReload)
+	defer unsubscribe()
+
+	u.awayMu.Lock()
+	u.lastActivity = time.Now()
+	u.awayMu.Unlock()
+
+	stopAutoAway := make(chan struct{})
+	defer close(stopAutoAway)
+
+	go u.autoAwayLoop(stopAutoAway)
+
+	for {
+		var msg *irc.Message
+
+		select {
+		case <-u.reloads:
+			u.reloadConfig()
+			continue
+		case l := <-u.ssoLogins:
+			u.finishSSOLogin(l)
+			continue
+		case m, ok := <-u.DecodeCh:
+			if !ok {
+				return
+			}
+
+			msg = m
+		}
+
 		if msg == nil {
 			// Ignore empty messages
 			continue
 		}
+
+		u.activity(msg.Command)
+
 		go func(msg *irc.Message) {
 			err := s.commands.Run(s, u, msg)
 			logger.Debugf("Executed %#v %#v", msg, err)
@@ -371,6 +512,15 @@ func (s *server) Add(u *User) (ok bool) {
 	return s.add(u)
 }
 
+func (s *server) Remove(u *User) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.users[u.ID()] == u {
+		delete(s.users, u.ID())
+	}
+}
+
 func (s *server) add(u *User) (ok bool) {
 	s.Lock()
 	defer s.Unlock()
@@ -391,6 +541,10 @@ func (s *server) handshake(u *User) error {
 
 	// Consume N messages then give up.
 	i := handshakeMsgTolerance
+	// capabilities are being negotiated, wait for CAP END
+	negotiating := false
+	// SASL PLAIN authentication in progress
+	var sasl saslState
 	// Read messages until we filled in USER details.
 	for msg := range u.DecodeCh {
 		// fmt.Printf("in handshake %#v\n", msg)
@@ -406,7 +560,7 @@ func (s *server) handshake(u *User) error {
 
 		// apparently NICK message can have a : prefix on connection
 		// https://github.com/42wim/matterircd/issues/32
-		if (msg.Command == irc.NICK || msg.Command == irc.PASS) && msg.Trailing != "" {
+		if (msg.Command == irc.NICK || msg.Command == irc.PASS || msg.Command == irc.AUTHENTICATE) && msg.Trailing != "" {
 			msg.Params = append(msg.Params, msg.Trailing)
 		}
 		if len(msg.Params) < 1 {
@@ -421,9 +575,14 @@ func (s *server) handshake(u *User) error {
 			u.Real = msg.Trailing
 		case irc.PASS:
 			u.Pass = msg.Params
+		case irc.CAP:
+			negotiating = strings.ToUpper(msg.Params[0]) != "END"
+			s.handleCap(u, msg)
+		case irc.AUTHENTICATE:
+			s.handleAuthenticate(u, msg, &sasl)
 		}
 
-		if u.Nick == "" || u.User == "" {
+		if u.Nick == "" || u.User == "" || negotiating {
 			// Wait for both to be set before proceeding
 			continue
 		}
@@ -438,10 +597,25 @@ func (s *server) handshake(u *User) error {
 		}
 		s.u = u
 
+		// the credential store is named after the USER, unless SASL specified one
+		if u.storeUser == "" {
+			u.storeUser = strings.ToLower(u.User)
+		}
+
 		err := s.welcome(u)
-		if err == nil && u.Pass != nil {
+
+		switch {
+		case err != nil || u.Pass == nil:
+		case len(u.Pass) == 1 && !isMattermostToken(u.Pass[0]) && (u.store != nil || u.hasStore(u.storeUser)):
+			// when we have a credential store a single PASS is its password, otherwise a slack token
+			if u.store == nil {
+				if serr := u.unlockStore(u.storeUser, u.Pass[0]); serr != nil {
+					s.EncodeMessage(u, irc.NOTICE, []string{u.Nick}, "credential store: "+serr.Error())
+				}
+			}
+		default:
 			service := "mattermost"
-			if len(u.Pass) == 1 {
+			if len(u.Pass) == 1 && !isMattermostToken(u.Pass[0]) {
 				service = "slack"
 			}
 			login(u, &User{
@@ -456,11 +630,145 @@ func (s *server) handshake(u *User) error {
 				u.Pass,
 				service)
 		}
+
+		if err == nil {
+			u.loginAccounts()
+			u.loginStoredAccounts()
+		}
+
 		return err
 	}
 	return ErrHandshakeFailed
 }
 
+// handleCap handles the capability negotiation, we support read markers and sasl, the latter
+// only when there's a credential store to authenticate against.
+func (s *server) handleCap(u *User, msg *irc.Message) {
+	nick := u.Nick
+	if nick == "" {
+		nick = "*"
+	}
+
+	caps := []string{capReadMarker}
+
+	if u.v.GetString("CredentialStore") != "" {
+		caps = append(caps, "sasl")
+	}
+
+	switch strings.ToUpper(msg.Params[0]) {
+	case "LS":
+		// version 302 supports capability values
+		if len(msg.Params) > 1 && msg.Params[1] >= "302" {
+			for i, c := range caps {
+				if c == "sasl" {
+					caps[i] = "sasl=PLAIN"
+				}
+			}
+		}
+
+		s.EncodeMessage(u, irc.CAP, []string{nick, "LS"}, strings.Join(caps, " "))
+	case "LIST":
+		var enabled []string
+
+		for _, c := range caps {
+			if u.hasCap(c) {
+				enabled = append(enabled, c)
+			}
+		}
+
+		s.EncodeMessage(u, irc.CAP, []string{nick, "LIST"}, strings.Join(enabled, " "))
+	case "REQ":
+		requested := strings.Join(msg.Params[1:], " ")
+		if msg.Trailing != "" {
+			requested = msg.Trailing
+		}
+
+		for _, c := range strings.Fields(requested) {
+			if !stringInSlice(strings.TrimPrefix(c, "-"), caps) {
+				s.EncodeMessage(u, irc.CAP, []string{nick, "NAK"}, requested)
+				return
+			}
+		}
+
+		// a - in front disables the capability
+		for _, c := range strings.Fields(requested) {
+			u.setCap(strings.TrimPrefix(c, "-"), !strings.HasPrefix(c, "-"))
+		}
+
+		s.EncodeMessage(u, irc.CAP, []string{nick, "ACK"}, requested)
+	}
+}
+
+// saslChunkLen is the length of a full AUTHENTICATE chunk, more chunks follow it.
+const saslChunkLen = 400
+
+// saslMaxLen is the maximum length of the base64 encoded SASL credentials.
+const saslMaxLen = 4 * saslChunkLen
+
+// saslState is a SASL PLAIN authentication in progress, with the chunks received so far.
+type saslState struct {
+	started bool
+	data    string
+}
+
+// handleAuthenticate handles SASL PLAIN authentication, which unlocks the credential store.
+func (s *server) handleAuthenticate(u *User, msg *irc.Message, sasl *saslState) {
+	nick := u.Nick
+	if nick == "" {
+		nick = "*"
+	}
+
+	switch {
+	case msg.Params[0] == "*":
+		*sasl = saslState{}
+		s.EncodeMessage(u, irc.ERR_SASLABORTED, []string{nick}, "SASL authentication aborted")
+		return
+	case !sasl.started && strings.ToUpper(msg.Params[0]) == "PLAIN":
+		sasl.started = true
+		u.Encode(&irc.Message{Command: irc.AUTHENTICATE, Params: []string{"+"}})
+		return
+	case !sasl.started:
+		s.EncodeMessage(u, irc.RPL_SASLMECHS, []string{nick, "PLAIN"}, "are available SASL mechanisms")
+		s.EncodeMessage(u, irc.ERR_SASLFAIL, []string{nick}, "SASL authentication failed")
+		return
+	}
+
+	// "+" is an empty chunk, ending credentials that are a multiple of the chunk length
+	if msg.Params[0] != "+" {
+		sasl.data += msg.Params[0]
+	}
+
+	if len(sasl.data) > saslMaxLen {
+		*sasl = saslState{}
+		s.EncodeMessage(u, irc.ERR_SASLTOOLONG, []string{nick}, "SASL message too long")
+		return
+	}
+
+	if len(msg.Params[0]) == saslChunkLen {
+		return
+	}
+
+	encoded := sasl.data
+	*sasl = saslState{}
+
+	// authzid \0 authcid \0 password
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	fields := strings.Split(string(data), "\x00")
+
+	if err != nil || len(fields) != 3 {
+		s.EncodeMessage(u, irc.ERR_SASLFAIL, []string{nick}, "SASL authentication failed")
+		return
+	}
+
+	if err = u.unlockStore(fields[1], fields[2]); err != nil {
+		s.EncodeMessage(u, irc.ERR_SASLFAIL, []string{nick}, "SASL authentication failed")
+		return
+	}
+
+	s.EncodeMessage(u, irc.RPL_LOGGEDIN, []string{nick, u.Prefix().String(), fields[1]}, "You are now logged in as "+fields[1])
+	s.EncodeMessage(u, irc.RPL_SASLSUCCESS, []string{nick}, "SASL authentication successful")
+}
+
 func (s *server) Logout(user *User) {
 	channels := user.Channels()
 	for _, ch := range channels {
@@ -1,12 +1,15 @@
 package irckit
 
 import (
+	"errors"
 	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
 
+	"github.com/42wim/matterircd/bridge"
 	"github.com/sorcix/irc"
+	"github.com/spf13/viper"
 )
 
 func DefaultCommands() Commands {
@@ -19,6 +22,7 @@ func DefaultCommands() Commands {
 	cmds.Add(Handler{Command: irc.KICK, Call: CmdKick, MinParams: 1, LoggedIn: true})
 	cmds.Add(Handler{Command: irc.LIST, Call: CmdList, LoggedIn: true})
 	cmds.Add(Handler{Command: irc.LUSERS, Call: CmdLusers})
+	cmds.Add(Handler{Command: "MARKREAD", Call: CmdMarkRead, MinParams: 1, LoggedIn: true})
 	cmds.Add(Handler{Command: irc.MODE, Call: CmdMode, MinParams: 1, LoggedIn: true})
 	cmds.Add(Handler{Command: irc.MOTD, Call: CmdMotd})
 	cmds.Add(Handler{Command: irc.NAMES, Call: CmdNames, MinParams: 1, LoggedIn: true})
@@ -35,12 +39,20 @@ func DefaultCommands() Commands {
 }
 
 func CmdAway(s Server, u *User, msg *irc.Message) error {
+	u.setManualAway(msg.Trailing != "")
+
 	if msg.Trailing == "" {
-		u.br.SetStatus("online")
+		for _, sess := range u.getSessions() {
+			u.setBack(sess)
+		}
+
 		return s.EncodeMessage(u, irc.RPL_UNAWAY, []string{u.Nick}, "You are no longer marked as being away")
 	}
 
-	u.br.SetStatus("away")
+	for _, sess := range u.getSessions() {
+		u.setAway(sess, msg.Trailing)
+	}
+
 	return s.EncodeMessage(u, irc.RPL_NOWAWAY, []string{u.Nick}, "You have been marked as being away")
 }
 
@@ -53,8 +65,17 @@ func CmdInvite(s Server, u *User, msg *irc.Message) error {
 	}
 
 	if ch, exists := s.HasChannel(channel); exists {
+		sess := u.sessionForChannel(ch)
+		if sess == nil {
+			return nil
+		}
+
+		if sess.groupNicks(ch.String()) != nil {
+			return u.changeGroup(sess, ch, other.Nick, true)
+		}
+
 		logger.Debugf("inviting %s to %s", other.User, ch.ID())
-		err := u.br.Invite(ch.ID(), other.User)
+		err := sess.br.Invite(ch.ID(), other.User)
 		if err != nil {
 			return err
 		}
@@ -96,7 +117,16 @@ func CmdKick(s Server, u *User, msg *irc.Message) error {
 	}
 
 	if ch, exists := s.HasChannel(channel); exists {
-		err := u.br.Kick(ch.ID(), other.User)
+		sess := u.sessionForChannel(ch)
+		if sess == nil {
+			return nil
+		}
+
+		if sess.groupNicks(ch.String()) != nil {
+			return u.changeGroup(sess, ch, other.Nick, false)
+		}
+
+		err := sess.br.Kick(ch.ID(), other.User)
 		if err != nil {
 			return err
 		}
@@ -107,15 +137,47 @@ func CmdKick(s Server, u *User, msg *irc.Message) error {
 
 // CmdJoin is a handler for the /JOIN command.
 func CmdJoin(s Server, u *User, msg *irc.Message) error {
-	var sync func(string, string)
+	var (
+		sync func(*session, string, string)
+		keys []string
+	)
+
+	if len(msg.Params) > 1 {
+		keys = strings.Split(msg.Params[1], ",")
+	}
 
 	channels := strings.Split(msg.Params[0], ",")
-	for _, channel := range channels {
-		channelName := strings.Replace(channel, "#", "", 1)
-		// you can only join existing channels
-		var err error
+	for i, channel := range channels {
+		if strings.EqualFold(channel, mentionsChannel) {
+			u.joinMentions(true)
+			continue
+		}
+
+		sess, channelName := u.sessionForName(channel)
+		if sess == nil {
+			s.EncodeMessage(u, irc.ERR_NOSUCHCHANNEL, []string{u.Nick, channel}, "No such channel")
+			continue
+		}
+
+		if nicks := sess.groupNicks(channel); nicks != nil {
+			if _, err := u.openGroup(sess, nicks); err != nil {
+				logger.Errorf("Cannot open group %s: %v", channel, err)
+				s.EncodeMessage(u, irc.ERR_NOSUCHCHANNEL, []string{u.Nick, channel}, err.Error())
+			}
+
+			continue
+		}
+
+		// a channel that doesn't exist can be created
+		channelID, topic, err := sess.br.Join(channelName)
+		if errors.Is(err, bridge.ErrNoSuchChannel) {
+			channelID, err = u.createChannel(sess, channel, channelName, isPrivateKey(keys, i))
+			if err == nil && channelID == "" {
+				// waiting for the confirmation
+				continue
+			}
+		}
 
-		channelID, topic, err := u.br.Join(channelName)
 		if err != nil {
 			logger.Errorf("Cannot join channel %s, id %s, err: %v", channelName, channelID, err)
 			s.EncodeMessage(u, irc.ERR_INVITEONLYCHAN, []string{u.Nick, channel}, "Cannot join channel (+i)")
@@ -130,18 +192,18 @@ func CmdJoin(s Server, u *User, msg *irc.Message) error {
 		u.v.Set(key string, value interface{})
 		*/
 		// if we joined, remove channel from exclude and add to include
-		u.v.Set(u.br.Protocol()+".joinexclude", removeStringInSlice(channel, u.v.GetStringSlice(u.br.Protocol()+".joinexclude")))
+		sess.v.Update(func(v *viper.Viper) {
+			v.Set(sess.protocol+".joinexclude", removeStringInSlice("#"+channelName, v.GetStringSlice(sess.protocol+".joinexclude")))
 
-		if len(u.v.GetStringSlice(u.br.Protocol()+".joininclude")) > 0 {
-			channels := u.v.GetStringSlice(u.br.Protocol() + ".joininclude")
-			channels = append(channels, channel)
-			u.v.Set(u.br.Protocol()+".joininclude", channels)
-		}
+			if channels := v.GetStringSlice(sess.protocol + ".joininclude"); len(channels) > 0 {
+				v.Set(sess.protocol+".joininclude", append(channels, "#"+channelName))
+			}
+		})
 
-		ch := s.Channel(channelID)
+		ch := u.channel(sess, channelID)
 		ch.Topic(u, topic)
 
-		sync(channelID, channelName)
+		sync(sess, channelID, channelName)
 
 		ch.Join(u)
 	}
@@ -159,18 +221,21 @@ func CmdList(s Server, u *User, msg *irc.Message) error {
 		Trailing: "Channel Users Topic",
 	})
 
-	info, err := u.br.List()
-	if err != nil {
-		return err
-	}
+	for _, sess := range u.getSessions() {
+		info, err := sess.br.List()
+		if err != nil {
+			logger.Errorf("listing the channels of %s failed: %s", sess.name, err)
+			continue
+		}
 
-	for channelName, topic := range info {
-		r = append(r, &irc.Message{
-			Prefix:   s.Prefix(),
-			Command:  irc.RPL_LIST,
-			Params:   []string{u.Nick, channelName, "0", topic},
-			Trailing: "",
-		})
+		for channelName, topic := range info {
+			r = append(r, &irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  irc.RPL_LIST,
+				Params:   []string{u.Nick, sess.ircName(channelName), "0", topic},
+				Trailing: "",
+			})
+		}
 	}
 
 	r = append(r, &irc.Message{
@@ -196,25 +261,121 @@ func CmdMode(s Server, u *User, msg *irc.Message) error {
 	if len(msg.Params) > 1 {
 		modetype = msg.Params[1]
 	}
-	switch modetype {
-	case "":
+
+	ch, exists := s.HasChannel(channel)
+
+	// channels waiting to be created can be made private
+	if sess, _ := u.sessionForName(channel); !exists && sess != nil && modetype == "+p" && u.setPendingPrivate(channel) {
+		svc, _ := s.HasUser(sess.name)
+		u.MsgUser(svc, channel+" will be created as private channel, JOIN it again to create it")
+		return nil
+	}
+
+	switch {
+	case modetype == "":
+		modes := "+"
+		if exists {
+			modes += ch.Modes()
+		}
 		r = append(r, &irc.Message{
-			Prefix:   s.Prefix(),
-			Command:  irc.RPL_CHANNELMODEIS,
-			Params:   []string{u.Nick, channel},
-			Trailing: " " + " ",
+			Prefix:  s.Prefix(),
+			Command: irc.RPL_CHANNELMODEIS,
+			Params:  []string{u.Nick, channel, modes},
 		})
-	case "b":
+	case modetype == "b":
 		r = append(r, &irc.Message{
 			Prefix:   s.Prefix(),
 			Command:  irc.RPL_ENDOFBANLIST,
 			Params:   []string{u.Nick, channel},
 			Trailing: "End of channel ban list",
 		})
+	case exists:
+		r = append(r, changeChannelModes(s, u, ch, modetype, msg.Params[2:])...)
 	}
 	return u.Encode(r...)
 }
 
+// changeChannelModes handles MODE #channel +o/-o nick, the only modes which can be changed.
+func changeChannelModes(s Server, u *User, ch Channel, modes string, nicks []string) []*irc.Message {
+	r := []*irc.Message{}
+	sess := u.sessionForChannel(ch)
+	add := true
+
+	for _, mode := range modes {
+		switch mode {
+		case '+', '-':
+			add = mode == '+'
+			continue
+		case 'o':
+		default:
+			r = append(r, &irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  irc.ERR_UNKNOWNMODE,
+				Params:   []string{u.Nick, string(mode)},
+				Trailing: "is unknown mode char to me for " + ch.String(),
+			})
+			continue
+		}
+
+		if len(nicks) == 0 {
+			break
+		}
+
+		nick := nicks[0]
+		nicks = nicks[1:]
+
+		other, ok := s.HasUser(nick)
+		if !ok {
+			r = append(r, &irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  irc.ERR_NOSUCHNICK,
+				Params:   []string{u.Nick, nick},
+				Trailing: "No such nick/channel",
+			})
+			continue
+		}
+
+		if !ch.HasUser(other) {
+			r = append(r, &irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  irc.ERR_USERNOTINCHANNEL,
+				Params:   []string{u.Nick, nick, ch.String()},
+				Trailing: "They aren't on that channel",
+			})
+			continue
+		}
+
+		if sess == nil {
+			r = append(r, &irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  irc.ERR_CHANOPRIVSNEEDED,
+				Params:   []string{u.Nick, ch.String()},
+				Trailing: "Modes of this channel can't be changed",
+			})
+			continue
+		}
+
+		userID := other.User
+		if other == u {
+			userID = sess.br.GetMe().User
+		}
+
+		if err := sess.br.SetChannelAdmin(ch.ID(), userID, add); err != nil {
+			r = append(r, &irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  irc.ERR_CHANOPRIVSNEEDED,
+				Params:   []string{u.Nick, ch.String()},
+				Trailing: err.Error(),
+			})
+			continue
+		}
+
+		ch.SetUserMode(u, other, "o", add)
+	}
+
+	return r
+}
+
 // CmdMotd is a handler for the /MOTD command.
 func CmdMotd(s Server, u *User, _ *irc.Message) error {
 	motd := s.Motd()
@@ -263,14 +424,25 @@ func CmdNames(s Server, u *User, msg *irc.Message) error {
 
 // CmdNick is a handler for the /NICK command.
 func CmdNick(s Server, u *User, msg *irc.Message) error {
-	// only update mattermost nick if we're logged in
-	err := u.br.Nick(msg.Params[0])
-	if err != nil {
-		s.EncodeMessage(u, irc.ERR_ERRONEUSNICKNAME, []string{u.Nick}, "Erroneus nickname")
-		return err
+	sessions := u.getSessions()
+	failed := 0
+
+	// only update the bridge nicks if we're logged in, a bridge refusing it doesn't stop the others
+	for _, sess := range sessions {
+		if err := sess.br.Nick(msg.Params[0]); err != nil {
+			logger.Errorf("changing nick on %s failed: %s", sess.name, err)
+			s.EncodeMessage(u, irc.NOTICE, []string{u.Nick}, fmt.Sprintf("changing your nick on %s failed: %s", sess.name, err))
+			failed++
+		}
+	}
+
+	// keep the nick when none of the bridges took it
+	if len(sessions) > 0 && failed == len(sessions) {
+		return s.EncodeMessage(u, irc.ERR_ERRONEUSNICKNAME, []string{u.Nick, msg.Params[0]}, "Erroneus nickname")
 	}
 
 	s.RenameUser(u, msg.Params[0])
+
 	return nil
 }
 
@@ -280,7 +452,12 @@ func CmdPart(s Server, u *User, msg *irc.Message) error {
 
 	channels := strings.Split(msg.Params[0], ",")
 	for _, chName := range channels {
-		// we can not leave & channels
+		if strings.EqualFold(chName, mentionsChannel) {
+			u.partMentions(msg.Trailing)
+			continue
+		}
+
+		// we can not leave the other & channels
 		if strings.HasPrefix(chName, "&") {
 			continue
 		}
@@ -290,11 +467,15 @@ func CmdPart(s Server, u *User, msg *irc.Message) error {
 			err = s.EncodeMessage(u, irc.ERR_NOSUCHCHANNEL, []string{chName}, "No such channel")
 			continue
 		}
+		sess := u.sessionForChannel(ch)
+		if sess == nil {
+			continue
+		}
 		// first part on irc
 		ch.Part(u, msg.Trailing)
 		// now part on mattermost/slack
-		if !u.v.GetBool(u.br.Protocol() + ".PartFake") {
-			err = u.br.Part(ch.ID())
+		if !sess.v.GetBool(sess.protocol + ".PartFake") {
+			err = sess.br.Part(ch.ID())
 			if err != nil {
 				return err
 			}
@@ -303,12 +484,14 @@ func CmdPart(s Server, u *User, msg *irc.Message) error {
 		for _, k := range ch.Users() {
 			ch.Part(k, "")
 			// if we parted, remove channel from include
-			u.v.Set(u.br.Protocol()+".joininclude",
-				removeStringInSlice(chName, u.v.GetStringSlice(u.br.Protocol()+".joininclude")))
+			sess.v.Update(func(v *viper.Viper) {
+				v.Set(sess.protocol+".joininclude",
+					removeStringInSlice("#"+sess.bridgeName(chName), v.GetStringSlice(sess.protocol+".joininclude")))
+			})
 		}
-	}
 
-	u.br.UpdateChannels()
+		sess.br.UpdateChannels()
+	}
 
 	return err
 }
@@ -339,6 +522,12 @@ func CmdPrivMsg(s Server, u *User, msg *irc.Message) error {
 		return nil
 	}
 
+	// saying something in &mentions means we've read them
+	if query == mentionsChannel {
+		u.markMentionsViewed()
+		return nil
+	}
+
 	msg.Trailing = strings.ReplaceAll(msg.Trailing, "\r", "")
 	// fix non-rfc clients
 	if !strings.HasPrefix(msg.Trailing, ":") {
@@ -359,9 +548,14 @@ func CmdPrivMsg(s Server, u *User, msg *irc.Message) error {
 
 	// are we sending to a channel
 	if ch, exists := s.HasChannel(query); exists {
-		err = u.br.MsgChannel(ch.ID(), msg.Trailing)
+		sess := u.sessionForChannel(ch)
+		if sess == nil {
+			return nil
+		}
+
+		err = sess.br.MsgChannel(ch.ID(), u.translateMentions(sess, ch, msg.Trailing))
 		if err != nil {
-			u.MsgSpoofUser(u, u.br.Protocol(), "msg: "+msg.Trailing+" could not be send: "+err.Error())
+			u.MsgSpoofUser(u, sess.name, "msg: "+msg.Trailing+" could not be send: "+err.Error())
 		}
 		return nil
 	}
@@ -369,12 +563,12 @@ func CmdPrivMsg(s Server, u *User, msg *irc.Message) error {
 	// or a user
 	if toUser, exists := s.HasUser(query); exists {
 		switch {
-		case query == "mattermost" || query == "slack":
+		case u.isService(query):
 			go u.handleServiceBot(query, toUser, msg.Trailing)
 			msg.Trailing = "<redacted>"
-		case toUser.Ghost, toUser.Me:
+		case (toUser.Ghost || toUser.Me) && toUser.br != nil:
 			logger.Tracef("sending message %s to user %s", msg.Trailing, toUser.User)
-			err = u.br.MsgUser(toUser.User, msg.Trailing)
+			err = toUser.br.MsgUser(toUser.User, msg.Trailing)
 			if err != nil {
 				return err
 			}
@@ -395,7 +589,12 @@ func CmdQuit(s Server, u *User, msg *irc.Message) error {
 	s.EncodeMessage(u, irc.QUIT, []string{}, partMsg)
 	s.EncodeMessage(u, irc.ERROR, []string{}, "You will be missed.")
 
-	u.br.Logout()
+	u.detach()
+
+	for _, sess := range u.getSessions() {
+		sess.br.Logout()
+	}
+
 	u.Srv.Logout(u)
 
 	u.Conn.Close()
@@ -406,11 +605,18 @@ func CmdQuit(s Server, u *User, msg *irc.Message) error {
 // CmdTopic is a handler for the /TOPIC command.
 func CmdTopic(s Server, u *User, msg *irc.Message) error {
 	channelname := msg.Params[0]
-	ch := s.Channel(channelname)
+
+	ch, exists := s.HasChannel(channelname)
+	if !exists {
+		return s.EncodeMessage(u, irc.ERR_NOSUCHCHANNEL, []string{u.Nick, channelname}, "No such channel")
+	}
 
 	if msg.Trailing != "" {
 		ch.Topic(u, msg.Trailing)
-		u.br.SetTopic(ch.ID(), msg.Trailing)
+
+		if sess := u.sessionForChannel(ch); sess != nil {
+			sess.br.SetTopic(ch.ID(), msg.Trailing)
+		}
 	} else {
 		r := make([]*irc.Message, 0, ch.Len()+1)
 
@@ -451,13 +657,21 @@ func CmdWho(s Server, u *User, msg *irc.Message) error {
 
 	r := make([]*irc.Message, 0, ch.Len()+1)
 
-	statuses, _ := u.br.StatusUsers()
+	statuses := make(map[string]string)
+
+	for _, sess := range u.getSessions() {
+		brStatuses, _ := sess.br.StatusUsers()
+		for user, status := range brStatuses {
+			statuses[user] = status
+		}
+	}
 
 	for _, other := range ch.Users() {
 		status := "H"
 		if statuses[other.User] != "online" {
 			status = "G"
 		}
+		status += modePrefix(ch.UserModes(other))
 		// <me> <channel> <user> <host> <server> <nick> [H/G]: 0 <real>
 		r = append(r, &irc.Message{
 			Prefix:   s.Prefix(),
@@ -502,14 +716,28 @@ func CmdWhois(s Server, u *User, msg *irc.Message) error {
 			Trailing: chlist,
 		})
 
-		status, _ := u.br.StatusUser(other.User)
+		status := "online"
+		if other.br != nil {
+			status, _ = other.br.StatusUser(other.User)
+		}
+
+		custom := customStatus(other.UserInfo)
 
 		if status != "online" {
 			r = append(r, &irc.Message{
 				Prefix:   s.Prefix(),
 				Params:   []string{u.Nick, other.Nick},
 				Command:  irc.RPL_AWAY,
-				Trailing: status,
+				Trailing: awayReason(status, custom),
+			})
+		}
+
+		if custom != nil {
+			r = append(r, &irc.Message{
+				Prefix:   s.Prefix(),
+				Params:   []string{u.Nick, other.Nick},
+				Command:  rplWhoisSpecial,
+				Trailing: "custom status: " + custom.String(),
 			})
 		}
 
@@ -0,0 +1,193 @@
+package irckit
+
+import (
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/42wim/matterircd/bridge"
+	"github.com/sirupsen/logrus"
+	"github.com/sorcix/irc"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	// set once, the goroutines of one test may still log while the next one runs
+	SetLogger(logrus.NewEntry(logrus.New()))
+
+	os.Exit(m.Run())
+}
+
+// limitsBridge is a logged in bridge with the given limits.
+type limitsBridge struct {
+	meBridge
+	limits bridge.Limits
+}
+
+func (b *limitsBridge) GetLimits() *bridge.Limits {
+	return &b.limits
+}
+
+func TestISupport(t *testing.T) {
+	client, c := net.Pipe()
+	defer client.Close()
+
+	u := NewUserNet(c)
+	u.Nick = "bob"
+	u.v = viper.New()
+
+	mm := u.newSession("mattermost", "mattermost", viper.New())
+	mm.br = &limitsBridge{limits: bridge.Limits{NickLen: 64, ChannelLen: 130, TopicLen: 1024, PostLen: 16383}}
+	u.addSession(mm)
+
+	slack := u.newSession("slack", "slack", viper.New())
+	slack.br = &limitsBridge{limits: bridge.Limits{NickLen: 80, ChannelLen: 81, TopicLen: 250, PostLen: 40000}}
+	u.addSession(slack)
+
+	matrix := u.newSession("matrix", "matrix", viper.New())
+	matrix.br = &limitsBridge{limits: bridge.Limits{NickLen: 255}}
+	u.addSession(matrix)
+
+	srv := NewServer("matterircd")
+
+	go srv.ISupport(u)
+
+	msg, err := irc.NewDecoder(client).Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, irc.RPL_ISUPPORT, msg.Command)
+	assert.Equal(t, "bob NETWORK=matterircd CASEMAPPING=ascii CHANTYPES=#& CHANMODES=b,,,mnps PREFIX=(ov)@+ MODES=4 "+
+		"NICKLEN=32 CHANNELLEN=133 TOPICLEN=250 matterircd.org/POSTLEN=16383", strings.Join(msg.Params, " "))
+}
+
+func TestHasUserCaseMapping(t *testing.T) {
+	srv := NewServer("matterircd")
+
+	alice := NewUser(nil)
+	alice.Nick = "Alice"
+	srv.Add(alice)
+
+	u, ok := srv.HasUser("aLICE")
+	assert.True(t, ok)
+	assert.Equal(t, alice, u)
+
+	_, ok = srv.HasUser("alicé")
+	assert.False(t, ok)
+}
+
+func TestAuthenticateChunks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matterircd")
+	assert.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	// exactly one full chunk, "+" ends it
+	password := strings.Repeat("x", 293)
+	_, err = createCredentialStore(dir, "alice", password)
+	assert.NoError(t, err)
+
+	client, c := net.Pipe()
+	defer client.Close()
+
+	u := NewUserNet(c)
+	u.Nick = "alice"
+	u.v = viper.New()
+	u.v.Set("CredentialStore", dir)
+
+	srv := NewServer("matterircd").(*server)
+	dec := irc.NewDecoder(client)
+
+	var sasl saslState
+
+	authenticate := func(param string) *irc.Message {
+		go srv.handleAuthenticate(u, &irc.Message{Command: irc.AUTHENTICATE, Params: []string{param}}, &sasl)
+
+		msg, err := dec.Decode()
+		assert.NoError(t, err)
+
+		return msg
+	}
+
+	assert.Equal(t, irc.AUTHENTICATE, authenticate("PLAIN").Command)
+
+	chunk := base64.StdEncoding.EncodeToString([]byte("\x00alice\x00" + password))
+	assert.Len(t, chunk, saslChunkLen)
+
+	srv.handleAuthenticate(u, &irc.Message{Command: irc.AUTHENTICATE, Params: []string{chunk}}, &sasl)
+	assert.Nil(t, u.store)
+
+	assert.Equal(t, irc.RPL_LOGGEDIN, authenticate("+").Command)
+
+	msg, err := dec.Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, irc.RPL_SASLSUCCESS, msg.Command)
+	assert.NotNil(t, u.store)
+
+	// too many chunks
+	authenticate("PLAIN")
+
+	for i := 0; i < 4; i++ {
+		srv.handleAuthenticate(u, &irc.Message{Command: irc.AUTHENTICATE, Params: []string{chunk}}, &sasl)
+	}
+
+	assert.Equal(t, irc.ERR_SASLTOOLONG, authenticate(chunk).Command)
+}
+
+// nickBridge is a bridge which refuses nick changes with err.
+type nickBridge struct {
+	meBridge
+	err error
+}
+
+func (b *nickBridge) Nick(name string) error {
+	return b.err
+}
+
+func TestCmdNick(t *testing.T) {
+	client, c := net.Pipe()
+	defer client.Close()
+
+	u := NewUserNet(c)
+	u.Nick = "bob"
+	u.v = viper.New()
+
+	mm := u.newSession("mattermost", "mattermost", viper.New())
+	mm.br = &nickBridge{err: errors.New("nick taken")}
+	u.addSession(mm)
+
+	slack := u.newSession("slack", "slack", viper.New())
+	slack.br = &nickBridge{}
+	u.addSession(slack)
+
+	srv := NewServer("matterircd")
+	srv.Add(u)
+
+	// slack takes it, mattermost's failure is reported
+	go func() {
+		CmdNick(srv, u, &irc.Message{Command: irc.NICK, Params: []string{"robert"}})
+		client.Close()
+	}()
+
+	var msgs []*irc.Message
+
+	dec := irc.NewDecoder(client)
+
+	for {
+		msg, err := dec.Decode()
+		if err != nil {
+			break
+		}
+
+		msgs = append(msgs, msg)
+	}
+
+	assert.Len(t, msgs, 2)
+	assert.Equal(t, irc.NOTICE, msgs[0].Command)
+	assert.Contains(t, msgs[0].Trailing, "mattermost")
+	assert.Equal(t, irc.NICK, msgs[1].Command)
+	assert.Equal(t, "robert", u.Nick)
+}
@@ -9,9 +9,17 @@ import (
 	"unicode"
 
 	"github.com/42wim/matterircd/bridge"
+	"github.com/42wim/matterircd/sso"
 	"github.com/mattermost/mattermost-server/v5/model"
 )
 
+// ssoHelper is the local web page used by LOGIN SSO, nil when it's not enabled.
+var ssoHelper *sso.Helper
+
+func SetSSOHelper(h *sso.Helper) {
+	ssoHelper = h
+}
+
 type CommandHandler interface {
 	handle(u *User, c *Command, args []string, service string)
 }
@@ -29,7 +37,14 @@ func logout(u *User, toUser *User, args []string, service string) {
 		u.MsgUser(toUser, "login or logout in progress. Please wait")
 		return
 	}
-	u.br.Logout()
+
+	err := u.logoutFrom(u.session(service))
+	if err != nil {
+		u.MsgUser(toUser, err.Error())
+		return
+	}
+
+	u.MsgUser(toUser, "logout OK")
 }
 
 func login(u *User, toUser *User, args []string, service string) {
@@ -38,7 +53,9 @@ func login(u *User, toUser *User, args []string, service string) {
 		return
 	}
 
-	if service == "slack" {
+	protocol, v := u.serviceConfig(service)
+
+	if protocol == "slack" {
 		var err error
 
 		if len(args) != 1 && len(args) != 3 {
@@ -63,8 +80,8 @@ func login(u *User, toUser *User, args []string, service string) {
 			}
 		}
 
-		if u.br != nil {
-			err = u.br.Logout()
+		if sess := u.session(service); sess != nil {
+			err = u.logoutFrom(sess)
 			if err != nil {
 				u.MsgUser(toUser, err.Error())
 				return
@@ -74,33 +91,97 @@ func login(u *User, toUser *User, args []string, service string) {
 		u.inprogress = true
 		defer func() { u.inprogress = false }()
 
-		err = u.loginTo("slack")
+		err = u.loginTo(service)
 		if err != nil {
 			u.MsgUser(toUser, err.Error())
 			return
 		}
 
 		u.MsgUser(toUser, "login OK")
-		if u.Credentials.Token != "" {
-			u.MsgUser(toUser, "token used: "+u.Credentials.Token)
+
+		return
+	}
+
+	if protocol == "rocketchat" || protocol == "matrix" {
+		cred := bridge.Credentials{
+			Server: v.GetString(protocol + ".DefaultServer"),
+		}
+
+		tokenHelp := "when using a personal token replace <login> with your user id and <pass> with token=<yourtoken>"
+		if protocol == "matrix" {
+			tokenHelp = "when using an access token replace <pass> with token=<yourtoken>"
+		}
+
+		switch {
+		case len(args) == 3:
+			cred.Server, cred.Login, cred.Pass = args[0], args[1], args[2]
+		case len(args) == 2 && cred.Server != "":
+			cred.Login, cred.Pass = args[0], args[1]
+		case cred.Server != "":
+			u.MsgUser(toUser, "need LOGIN <login> <pass>")
+			u.MsgUser(toUser, tokenHelp)
+			return
+		default:
+			u.MsgUser(toUser, "need LOGIN <server> <login> <pass>")
+			u.MsgUser(toUser, tokenHelp)
+			return
+		}
+
+		if !u.isValidServer(cred.Server, service) {
+			u.MsgUser(toUser, "not allowed to connect to "+cred.Server)
+			return
+		}
+
+		if sess := u.session(service); sess != nil {
+			err := u.logoutFrom(sess)
+			if err != nil {
+				u.MsgUser(toUser, err.Error())
+				return
+			}
+		}
+
+		u.inprogress = true
+		defer func() { u.inprogress = false }()
+
+		u.Credentials = cred
+
+		err := u.loginTo(service)
+		if err != nil {
+			u.MsgUser(toUser, err.Error())
+			return
 		}
 
+		u.MsgUser(toUser, "login OK")
+
+		return
+	}
+
+	if len(args) > 0 && strings.EqualFold(args[0], "sso") {
+		loginSSO(u, toUser, args[1:], service)
 		return
 	}
 
 	cred := bridge.Credentials{}
 	datalen := 4
+	tokenHelp := "instead of <login> <pass> you can use token=<personaltoken> or MMAUTHTOKEN=<sessiontoken>, add mfa=<code> when your account uses MFA"
+
+	args, cred.MFAToken = splitMFAToken(args)
 
-	if u.v.GetString("mattermost.DefaultTeam") != "" {
-		cred.Team = u.v.GetString("mattermost.DefaultTeam")
+	if v.GetString("mattermost.DefaultTeam") != "" {
+		cred.Team = v.GetString("mattermost.DefaultTeam")
 		datalen--
 	}
 
-	if u.v.GetString("mattermost.DefaultServer") != "" {
-		cred.Server = u.v.GetString("mattermost.DefaultServer")
+	if v.GetString("mattermost.DefaultServer") != "" {
+		cred.Server = v.GetString("mattermost.DefaultServer")
 		datalen--
 	}
 
+	// token logins don't need a login
+	if len(args) == datalen-1 && isMattermostToken(args[len(args)-1]) {
+		args = append(args[:len(args)-1:len(args)-1], "", args[len(args)-1])
+	}
+
 	if len(args) == datalen {
 		cred.Pass = args[len(args)-1]
 		cred.Login = args[len(args)-2]
@@ -124,18 +205,18 @@ func login(u *User, toUser *User, args []string, service string) {
 		// no server or team
 		case cred.Team != "" && cred.Server != "":
 			u.MsgUser(toUser, "need LOGIN <login> <pass>")
-			u.MsgUser(toUser, "when using a personal token replace <pass> with token=<yourtoken>")
+			u.MsgUser(toUser, tokenHelp)
 		// server missing
 		case cred.Team != "":
 			u.MsgUser(toUser, "need LOGIN <server> <login> <pass>")
-			u.MsgUser(toUser, "when using a personal token replace <pass> with token=<yourtoken>")
+			u.MsgUser(toUser, tokenHelp)
 		// team missing
 		case cred.Server != "":
 			u.MsgUser(toUser, "need LOGIN <team> <login> <pass>")
-			u.MsgUser(toUser, "when using a personal token replace <pass> with token=<yourtoken>")
+			u.MsgUser(toUser, tokenHelp)
 		default:
 			u.MsgUser(toUser, "need LOGIN <server> <team> <login> <pass>")
-			u.MsgUser(toUser, "when using a personal token replace <pass> with token=<yourtoken>")
+			u.MsgUser(toUser, tokenHelp)
 		}
 
 		return
@@ -146,8 +227,8 @@ func login(u *User, toUser *User, args []string, service string) {
 		return
 	}
 
-	if u.br != nil {
-		err := u.br.Logout()
+	if sess := u.session(service); sess != nil {
+		err := u.logoutFrom(sess)
 		if err != nil {
 			u.MsgUser(toUser, err.Error())
 			return
@@ -156,7 +237,7 @@ func login(u *User, toUser *User, args []string, service string) {
 
 	u.Credentials = cred
 
-	err := u.loginTo("mattermost")
+	err := u.loginTo(service)
 	if err != nil {
 		u.MsgUser(toUser, err.Error())
 		return
@@ -165,13 +246,212 @@ func login(u *User, toUser *User, args []string, service string) {
 	u.MsgUser(toUser, "login OK")
 }
 
+func accountCmd(u *User, toUser *User, args []string, service string) {
+	if len(args) == 0 {
+		u.MsgUser(toUser, "need ACCOUNT ADD, ACCOUNT REMOVE, ACCOUNT LIST, ACCOUNT CREATE <password> or ACCOUNT UNLOCK <password>")
+		u.MsgUser(toUser, "ACCOUNT CREATE creates your credential store, protected by the password")
+		u.MsgUser(toUser, "ACCOUNT ADD stores the credentials of your current "+service+" login encrypted in the credential store")
+		u.MsgUser(toUser, "on the next connect they're used to login automatically after PASS or SASL unlocked the store")
+		return
+	}
+
+	subcmd := strings.ToLower(args[0])
+
+	switch subcmd {
+	case "create":
+		if len(args) != 2 {
+			u.MsgUser(toUser, "need ACCOUNT CREATE <password>")
+			return
+		}
+
+		if err := u.createStore(u.storeUser, args[1]); err != nil {
+			u.MsgUser(toUser, err.Error())
+			return
+		}
+
+		u.MsgUser(toUser, "credential store of "+u.storeUser+" created")
+
+		return
+	case "unlock":
+		if len(args) != 2 {
+			u.MsgUser(toUser, "need ACCOUNT UNLOCK <password>")
+			return
+		}
+
+		if err := u.unlockStore(u.storeUser, args[1]); err != nil {
+			u.MsgUser(toUser, err.Error())
+			return
+		}
+
+		u.MsgUser(toUser, "credential store of "+u.storeUser+" unlocked")
+		u.loginAccounts()
+		u.loginStoredAccounts()
+
+		return
+	}
+
+	if u.store == nil {
+		if u.v.GetString("CredentialStore") == "" {
+			u.MsgUser(toUser, "the credential store is not enabled")
+			return
+		}
+
+		u.MsgUser(toUser, "the credential store is locked, use ACCOUNT UNLOCK <password> or ACCOUNT CREATE <password> first")
+
+		return
+	}
+
+	switch subcmd {
+	case "add":
+		sess := u.session(service)
+		if sess == nil {
+			u.MsgUser(toUser, "You're not logged in. Use LOGIN first.")
+			return
+		}
+
+		// MFA codes can only be used once
+		cred := sess.credentials
+		cred.MFAToken = ""
+
+		if err := u.store.add(service, cred); err != nil {
+			u.MsgUser(toUser, err.Error())
+			return
+		}
+
+		u.MsgUser(toUser, "credentials of "+service+" stored")
+	case "remove":
+		if err := u.store.remove(service); err != nil {
+			u.MsgUser(toUser, err.Error())
+			return
+		}
+
+		u.MsgUser(toUser, "credentials of "+service+" removed")
+	case "list":
+		if len(u.store.services()) == 0 {
+			u.MsgUser(toUser, "no credentials stored")
+			return
+		}
+
+		for _, name := range u.store.services() {
+			cred := u.store.accounts[name]
+			login := cred.Login
+			if login == "" || cred.Token != "" || strings.HasPrefix(cred.Pass, "token=") {
+				login += " (personal token)"
+			}
+
+			u.MsgUser(toUser, fmt.Sprintf("%s: %s %s %s", name, cred.Server, cred.Team, strings.TrimSpace(login)))
+		}
+	default:
+		u.MsgUser(toUser, "need ACCOUNT ADD, ACCOUNT REMOVE, ACCOUNT LIST, ACCOUNT CREATE <password> or ACCOUNT UNLOCK <password>")
+	}
+}
+
+// loginSSO lets the user get the session token of a SSO login with the SSO helper page
+// and logs in with it once it's handed back.
+func loginSSO(u *User, toUser *User, args []string, service string) {
+	if ssoHelper == nil {
+		u.MsgUser(toUser, "the SSO login helper is not enabled, set SSOBind in matterircd.toml")
+		return
+	}
+
+	_, v := u.serviceConfig(service)
+	cred := bridge.Credentials{
+		Server: v.GetString("mattermost.DefaultServer"),
+		Team:   v.GetString("mattermost.DefaultTeam"),
+	}
+
+	if len(args) > 0 {
+		cred.Server = args[0]
+	}
+
+	if len(args) > 1 {
+		cred.Team = args[1]
+	}
+
+	if cred.Server == "" || cred.Team == "" || len(args) > 2 {
+		u.MsgUser(toUser, "need LOGIN SSO <server> <team>")
+		return
+	}
+
+	if !u.isValidServer(cred.Server, service) {
+		u.MsgUser(toUser, "not allowed to connect to "+cred.Server)
+		return
+	}
+
+	uriScheme := "https://"
+	if v.GetBool("mattermost.Insecure") {
+		uriScheme = "http://"
+	}
+
+	url, result, err := ssoHelper.Start(uriScheme + cred.Server)
+	if err != nil {
+		u.MsgUser(toUser, err.Error())
+		return
+	}
+
+	u.MsgUser(toUser, "open "+url+" in your browser to finish the SSO login")
+
+	go func() {
+		token, ok := <-result
+		if !ok {
+			u.MsgUser(toUser, "SSO login expired")
+			return
+		}
+
+		cred.Pass = "MMAUTHTOKEN=" + token
+
+		// the loop of the user logs in, it's gone when the client disconnected
+		select {
+		case u.ssoLogins <- &ssoLogin{toUser: toUser, service: service, cred: cred}:
+		default:
+			u.MsgUser(toUser, "another SSO login is pending. Please wait")
+		}
+	}()
+}
+
+// ssoLogin is a finished SSO login, loginSSO hands it to the loop of the user.
+type ssoLogin struct {
+	toUser  *User
+	service string
+	cred    bridge.Credentials
+}
+
+// finishSSOLogin logs in with the token of a SSO login, it's called by the loop of the user.
+func (u *User) finishSSOLogin(l *ssoLogin) {
+	if u.inprogress {
+		u.MsgUser(l.toUser, "login or logout in progress. Please wait")
+		return
+	}
+
+	u.inprogress = true
+	defer func() { u.inprogress = false }()
+
+	if sess := u.session(l.service); sess != nil {
+		if err := u.logoutFrom(sess); err != nil {
+			u.MsgUser(l.toUser, err.Error())
+			return
+		}
+	}
+
+	u.Credentials = l.cred
+
+	if err := u.loginTo(l.service); err != nil {
+		u.MsgUser(l.toUser, err.Error())
+		return
+	}
+
+	u.MsgUser(l.toUser, "login OK")
+}
+
 func search(u *User, toUser *User, args []string, service string) {
-	if service == "slack" {
+	if protocol, _ := u.serviceConfig(service); protocol == "slack" || protocol == "rocketchat" || protocol == "matrix" {
 		u.MsgUser(toUser, "not implemented")
 		return
 	}
 
-	list := u.br.SearchPosts(strings.Join(args, " "))
+	sess := u.session(service)
+
+	list := sess.br.SearchPosts(strings.Join(args, " "))
 	if list == nil || len(list.(*model.PostList).Order) == 0 {
 		u.MsgUser(toUser, "no results")
 		return
@@ -185,12 +465,12 @@ func search(u *User, toUser *User, args []string, service string) {
 		}
 
 		timestamp := time.Unix(postlist.Posts[postlist.Order[i]].CreateAt/1000, 0).Format("January 02, 2006 15:04")
-		channelname := u.br.GetChannelName(postlist.Posts[postlist.Order[i]].ChannelId)
+		channelname := sess.channelName(postlist.Posts[postlist.Order[i]].ChannelId)
 
-		nick := u.br.GetUser(postlist.Posts[postlist.Order[i]].UserId).Nick
+		nick := u.createUserFromInfo(sess, sess.br.GetUser(postlist.Posts[postlist.Order[i]].UserId)).Nick
 
-		u.MsgUser(toUser, "#"+channelname+" <"+nick+"> "+timestamp)
-		u.MsgUser(toUser, strings.Repeat("=", len("#"+channelname+" <"+nick+"> "+timestamp)))
+		u.MsgUser(toUser, channelname+" <"+nick+"> "+timestamp)
+		u.MsgUser(toUser, strings.Repeat("=", len(channelname+" <"+nick+"> "+timestamp)))
 
 		for _, post := range strings.Split(postlist.Posts[postlist.Order[i]].Message, "\n") {
 			if post != "" {
@@ -199,7 +479,7 @@ func search(u *User, toUser *User, args []string, service string) {
 		}
 
 		if len(postlist.Posts[postlist.Order[i]].FileIds) > 0 {
-			for _, fname := range u.br.GetFileLinks(postlist.Posts[postlist.Order[i]].FileIds) {
+			for _, fname := range sess.br.GetFileLinks(postlist.Posts[postlist.Order[i]].FileIds) {
 				u.MsgUser(toUser, "download file - "+fname)
 			}
 		}
@@ -210,12 +490,12 @@ func search(u *User, toUser *User, args []string, service string) {
 }
 
 func searchUsers(u *User, toUser *User, args []string, service string) {
-	if service == "slack" {
+	if protocol, _ := u.serviceConfig(service); protocol == "slack" {
 		u.MsgUser(toUser, "not implemented")
 		return
 	}
 
-	users, err := u.br.SearchUsers(strings.Join(args, " "))
+	users, err := u.session(service).br.SearchUsers(strings.Join(args, " "))
 	if err != nil {
 		u.MsgUser(toUser, fmt.Sprint("Error", err.Error()))
 		return
@@ -227,7 +507,7 @@ func searchUsers(u *User, toUser *User, args []string, service string) {
 }
 
 func scrollback(u *User, toUser *User, args []string, service string) {
-	if service == "slack" {
+	if protocol, _ := u.serviceConfig(service); protocol == "slack" {
 		u.MsgUser(toUser, "not implemented")
 		return
 	}
@@ -251,9 +531,10 @@ func scrollback(u *User, toUser *User, args []string, service string) {
 		return
 	}
 
-	args[0] = strings.ReplaceAll(args[0], "#", "")
+	sess := u.session(service)
+	args[0] = sess.bridgeName(args[0])
 
-	list := u.br.GetPosts(u.br.GetChannelID(args[0], u.br.GetMe().TeamID), limit)
+	list := sess.br.GetPosts(sess.br.GetChannelID(args[0], sess.br.GetMe().TeamID), limit)
 	if list == nil || len(list.(*model.PostList).Order) == 0 {
 		u.MsgUser(toUser, "no results")
 		return
@@ -262,7 +543,7 @@ func scrollback(u *User, toUser *User, args []string, service string) {
 	postlist := list.(*model.PostList)
 
 	for i := len(postlist.Order) - 1; i >= 0; i-- {
-		nick := u.br.GetUser(postlist.Posts[postlist.Order[i]].UserId).Nick
+		nick := u.createUserFromInfo(sess, sess.br.GetUser(postlist.Posts[postlist.Order[i]].UserId)).Nick
 
 		for _, post := range strings.Split(postlist.Posts[postlist.Order[i]].Message, "\n") {
 			if post != "" {
@@ -271,7 +552,7 @@ func scrollback(u *User, toUser *User, args []string, service string) {
 		}
 
 		if len(postlist.Posts[postlist.Order[i]].FileIds) > 0 {
-			for _, fname := range u.br.GetFileLinks(postlist.Posts[postlist.Order[i]].FileIds) {
+			for _, fname := range sess.br.GetFileLinks(postlist.Posts[postlist.Order[i]].FileIds) {
 				u.MsgUser(toUser, "<"+nick+"> download file - "+fname)
 			}
 		}
@@ -279,12 +560,13 @@ func scrollback(u *User, toUser *User, args []string, service string) {
 }
 
 func updatelastviewed(u *User, toUser *User, args []string, service string) {
-	if service == "slack" {
+	if protocol, _ := u.serviceConfig(service); protocol == "slack" {
 		u.MsgUser(toUser, "not implemented")
 		return
 	}
 
 	channelID := ""
+	sess := u.session(service)
 
 	if len(args) != 1 {
 		u.MsgUser(toUser, "need UPDATELASTVIEWED <channel>")
@@ -293,15 +575,13 @@ func updatelastviewed(u *User, toUser *User, args []string, service string) {
 	}
 
 	if strings.Contains(args[0], "#") {
-		args[0] = strings.ReplaceAll(args[0], "#", "")
-
-		channelID = u.br.GetChannelID(args[0], u.br.GetMe().TeamID)
+		channelID = sess.br.GetChannelID(sess.bridgeName(args[0]), sess.br.GetMe().TeamID)
 		if channelID == "" {
 			u.MsgUser(toUser, "channel does not exist")
 			return
 		}
 	} else if updateUser, exists := u.Srv.HasUser(args[0]); exists && updateUser.Ghost {
-		err := u.br.UpdateLastViewedUser(updateUser.User)
+		err := sess.br.UpdateLastViewedUser(updateUser.User)
 		if err != nil {
 			u.MsgUser(toUser, fmt.Sprintf("updatelastviewed for %#v failed: %s", updateUser.User, err))
 			return
@@ -312,15 +592,26 @@ func updatelastviewed(u *User, toUser *User, args []string, service string) {
 		return
 	}
 
-	u.br.UpdateLastViewed(channelID)
+	sess.br.UpdateLastViewed(channelID)
 	u.MsgUser(toUser, fmt.Sprintf("set viewed for %s", args[0]))
 }
 
 var cmds = map[string]Command{
+	"account":          {handler: accountCmd, minParams: 0, maxParams: 2},
+	"channel":          {handler: channelCmd, login: true, minParams: 2, maxParams: -1},
+	"customstatus":     {handler: customStatusCmd, login: true, minParams: 0, maxParams: -1},
+	"favorite":         {handler: channelPrefsCmd("favorite", true), login: true, minParams: 0, maxParams: -1},
+	"group":            {handler: groupCmd, login: true, minParams: 2, maxParams: -1},
 	"logout":           {handler: logout, login: true, minParams: 0, maxParams: 0},
-	"login":            {handler: login, minParams: 2, maxParams: 4},
+	"login":            {handler: login, minParams: 1, maxParams: 5},
+	"mute":             {handler: channelPrefsCmd("mute", true), login: true, minParams: 0, maxParams: -1},
 	"search":           {handler: search, login: true, minParams: 1, maxParams: -1},
 	"searchusers":      {handler: searchUsers, login: true, minParams: 1, maxParams: -1},
+	"set":              {handler: setCmd, login: true, minParams: 0, maxParams: -1},
+	"status":           {handler: statusCmd, login: true, minParams: 0, maxParams: 2},
+	"unfavorite":       {handler: channelPrefsCmd("favorite", false), login: true, minParams: 1, maxParams: -1},
+	"unmute":           {handler: channelPrefsCmd("mute", false), login: true, minParams: 1, maxParams: -1},
+	"unread":           {handler: unreadCmd, login: true, minParams: 0, maxParams: 0},
 	"scrollback":       {handler: scrollback, login: true, minParams: 2, maxParams: 2},
 	"updatelastviewed": {handler: updatelastviewed, login: true, minParams: 1, maxParams: 1},
 }
@@ -345,7 +636,7 @@ func (u *User) handleServiceBot(service string, toUser *User, msg string) {
 	}
 
 	if cmd.login {
-		if u.br == nil {
+		if u.session(service) == nil {
 			u.MsgUser(toUser, "You're not logged in. Use LOGIN first.")
 			return
 		}
@@ -104,3 +104,17 @@ func TestParseCommandString(t *testing.T) {
 		}
 	}
 }
+
+func TestSplitMFAToken(t *testing.T) {
+	args, code := splitMFAToken([]string{"server", "team", "user", "password", "mfa=123456"})
+	assert.Equal(t, []string{"server", "team", "user", "password"}, args)
+	assert.Equal(t, "123456", code)
+
+	args, code = splitMFAToken([]string{"user", "password"})
+	assert.Equal(t, []string{"user", "password"}, args)
+	assert.Equal(t, "", code)
+
+	assert.True(t, isMattermostToken("token=abc"))
+	assert.True(t, isMattermostToken("MMAUTHTOKEN=abc"))
+	assert.False(t, isMattermostToken("password"))
+}
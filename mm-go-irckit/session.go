@@ -0,0 +1,262 @@
+package irckit
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"github.com/42wim/matterircd/bridge"
+	"github.com/spf13/viper"
+)
+
+// defaultPrefixes are used to namespace the channels and nicks of a bridge when
+// you're logged in to more than one. They can be overridden with <protocol>.Prefix.
+var defaultPrefixes = map[string]string{
+	"mattermost": "mm",
+	"slack":      "slack",
+	"rocketchat": "rc",
+	"matrix":     "matrix",
+}
+
+// session is a bridge the user is logged in to.
+type session struct {
+	// name of the service bot handling this session
+	name        string
+	protocol    string
+	prefix      string
+	credentials bridge.Credentials
+	br          bridge.Bridger
+	v           *bridge.Config
+	settings    *bridge.Settings
+	templates   *bridge.Templates
+	// events is handled by handleEventChan, the bridge sends its events here
+	events chan *bridge.Event
+
+	// namespaced is 1 when the channel names are prefixed with "prefix:", use isNamespaced
+	namespaced int32
+	// awayCustomStatus is true when AWAY set the custom status, it's cleared when we're back.
+	// Guarded by the awayMu of the user.
+	awayCustomStatus bool
+	// autoAway is true when AutoAwayIdle set us away, guarded by the awayMu of the user
+	autoAway bool
+}
+
+// isNamespaced returns whether the channel names of the session are prefixed, the first session
+// gets namespaced when another one logs in.
+func (s *session) isNamespaced() bool {
+	return atomic.LoadInt32(&s.namespaced) == 1
+}
+
+// ircName converts a bridge channel name (eg #general) to the name used on IRC.
+func (s *session) ircName(name string) string {
+	if !s.isNamespaced() || (!strings.HasPrefix(name, "#") && !strings.HasPrefix(name, "&")) {
+		return name
+	}
+
+	return name[:1] + s.prefix + ":" + name[1:]
+}
+
+// bridgeName converts an IRC channel name to the name used on the bridge, without #.
+func (s *session) bridgeName(name string) string {
+	name = strings.TrimPrefix(name, "#")
+
+	if s.isNamespaced() {
+		name = strings.TrimPrefix(name, s.prefix+":")
+	}
+
+	return name
+}
+
+// channelName returns the IRC name of a bridge channel.
+func (s *session) channelName(channelID string) string {
+	if channelID == s.messagesChannel() {
+		return channelID
+	}
+
+	return s.ircName(s.br.GetChannelName(channelID))
+}
+
+// messagesChannel returns the channel that receives the messages of channels not joined on IRC.
+func (s *session) messagesChannel() string {
+	if !s.isNamespaced() {
+		return "&messages"
+	}
+
+	return "&" + s.prefix + ":messages"
+}
+
+// newSession creates a session for a service, it gets added when the login succeeds.
+func (u *User) newSession(name, protocol string, v *viper.Viper) *session {
+	prefix := v.GetString(protocol + ".Prefix")
+	if prefix == "" {
+		prefix = defaultPrefixes[protocol]
+	}
+
+	sess := &session{
+		name:        name,
+		protocol:    protocol,
+		prefix:      prefix,
+		credentials: u.Credentials,
+		v:           bridge.NewConfig(v),
+	}
+
+	// only a single session can use the plain channel names
+	if u.v.GetBool("NamespaceChannels") || len(u.getSessions()) > 0 {
+		sess.namespaced = 1
+	}
+
+	sess.settings = bridge.NewSettings(sess.v, protocol, func(channelID string) string {
+		return sess.br.GetChannelName(channelID)
+	})
+	sess.templates = bridge.NewTemplates(sess.settings, nil)
+
+	return sess
+}
+
+// addSession adds a logged in session, it returns the sessions which got namespaced because
+// they're not the only one anymore.
+func (u *User) addSession(sess *session) []*session {
+	u.sessionsMu.Lock()
+	defer u.sessionsMu.Unlock()
+
+	u.sessions = append(u.sessions, sess)
+
+	// the first bridge is the one we're representing on IRC
+	if u.br == nil {
+		u.setPrimary(sess.br)
+	}
+
+	var namespaced []*session
+
+	for _, other := range u.sessions {
+		if len(u.sessions) > 1 && atomic.CompareAndSwapInt32(&other.namespaced, 0, 1) {
+			namespaced = append(namespaced, other)
+		}
+	}
+
+	return namespaced
+}
+
+// setPrimary sets the bridge we're representing on IRC, nil when we're not logged in anymore.
+func (u *User) setPrimary(br bridge.Bridger) {
+	u.br = br
+	u.Me = br != nil
+
+	if br != nil {
+		u.User = br.GetMe().User
+	}
+}
+
+func (u *User) removeSession(sess *session) {
+	u.sessionsMu.Lock()
+	defer u.sessionsMu.Unlock()
+
+	var sessions []*session
+
+	for _, other := range u.sessions {
+		if other != sess {
+			sessions = append(sessions, other)
+		}
+	}
+
+	u.sessions = sessions
+
+	for channelID, other := range u.channelSessions {
+		if other == sess {
+			delete(u.channelSessions, channelID)
+		}
+	}
+
+	if u.br == sess.br {
+		u.setPrimary(nil)
+
+		if len(sessions) > 0 {
+			u.setPrimary(sessions[0].br)
+		}
+	}
+}
+
+func (u *User) getSessions() []*session {
+	u.sessionsMu.RLock()
+	defer u.sessionsMu.RUnlock()
+
+	return append([]*session{}, u.sessions...)
+}
+
+// session returns the session of the specified service, or nil when not logged in.
+func (u *User) session(name string) *session {
+	for _, sess := range u.getSessions() {
+		if sess.name == name {
+			return sess
+		}
+	}
+
+	return nil
+}
+
+// sessionForChannel returns the session an IRC channel belongs to, nil for channels like &users.
+func (u *User) sessionForChannel(ch Channel) *session {
+	return u.session(ch.Service())
+}
+
+// sessionForName returns the session an IRC channel name belongs to, and the name on that bridge.
+func (u *User) sessionForName(name string) (*session, string) {
+	sessions := u.getSessions()
+
+	for _, sess := range sessions {
+		if sess.isNamespaced() && (strings.HasPrefix(name, "#"+sess.prefix+":") || strings.HasPrefix(name, "&"+sess.prefix+":")) {
+			return sess, sess.bridgeName(name)
+		}
+	}
+
+	for _, sess := range sessions {
+		if !sess.isNamespaced() {
+			return sess, sess.bridgeName(name)
+		}
+	}
+
+	return nil, ""
+}
+
+// channel returns the IRC channel of a bridge channel.
+func (u *User) channel(sess *session, channelID string) Channel {
+	if sess == nil {
+		return u.Srv.Channel(channelID)
+	}
+
+	u.sessionsMu.Lock()
+	u.channelSessions[channelID] = sess
+	u.sessionsMu.Unlock()
+
+	return u.Srv.Channel(channelID)
+}
+
+// channelInfo returns the service and IRC name of a channel ID.
+func (u *User) channelInfo(channelID string) (string, string) {
+	u.sessionsMu.RLock()
+	sess, ok := u.channelSessions[channelID]
+	u.sessionsMu.RUnlock()
+
+	if !ok {
+		return "", channelID
+	}
+
+	return sess.name, sess.channelName(channelID)
+}
+
+// ghostInfo returns the info used for a ghost of the session. When the nick is already
+// in use by someone else, the prefix of the bridge gets added.
+func (u *User) ghostInfo(sess *session, info *bridge.UserInfo) *bridge.UserInfo {
+	if sess == nil {
+		return info
+	}
+
+	other, ok := u.Srv.HasUser(info.Nick)
+	if !ok || other.ID() == strings.ToLower(info.User) {
+		return info
+	}
+
+	ghostInfo := *info
+	ghostInfo.Nick = info.Nick + "|" + sess.prefix
+
+	return &ghostInfo
+}
@@ -0,0 +1,67 @@
+package irckit
+
+import (
+	"testing"
+
+	"github.com/42wim/matterircd/bridge"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// meBridge is a bridge logged in as user.
+type meBridge struct {
+	bridge.Bridger
+	user string
+}
+
+func (b *meBridge) GetMe() *bridge.UserInfo {
+	return &bridge.UserInfo{User: b.user, Me: true}
+}
+
+func TestSessionNames(t *testing.T) {
+	plain := &session{prefix: "mm"}
+	namespaced := &session{prefix: "slack", namespaced: 1}
+
+	assert.Equal(t, "#town-square", plain.ircName("#town-square"))
+	assert.Equal(t, "&messages", plain.messagesChannel())
+	assert.Equal(t, "town-square", plain.bridgeName("#town-square"))
+
+	assert.Equal(t, "#slack:general", namespaced.ircName("#general"))
+	assert.Equal(t, "&slack:messages", namespaced.messagesChannel())
+	assert.Equal(t, "general", namespaced.bridgeName("#slack:general"))
+	assert.Equal(t, "general", namespaced.bridgeName("#general"))
+
+	assert.Equal(t, "&slack:group:alice+bob", namespaced.ircName("&group:alice+bob"))
+	assert.Equal(t, []string{"alice", "bob"}, namespaced.groupNicks("&slack:group:alice+bob"))
+	assert.Equal(t, []string{"alice", "bob"}, plain.groupNicks("&group:alice+bob"))
+	assert.Nil(t, plain.groupNicks("#group:alice+bob"))
+}
+
+func TestSessionNamespacing(t *testing.T) {
+	u := NewUser(nil)
+	u.v = viper.New()
+
+	mm := u.newSession("mattermost", "mattermost", viper.New())
+	mm.br = &meBridge{user: "mmuser"}
+	assert.False(t, mm.isNamespaced())
+	assert.Empty(t, u.addSession(mm))
+	assert.Equal(t, "mmuser", u.User)
+
+	// the first session gets namespaced as well once there's a second one
+	slack := u.newSession("slack", "slack", viper.New())
+	slack.br = &meBridge{user: "slackuser"}
+	assert.True(t, slack.isNamespaced())
+	assert.Equal(t, []*session{mm}, u.addSession(slack))
+	assert.True(t, mm.isNamespaced())
+	assert.Equal(t, "#mm:town-square", mm.ircName("#town-square"))
+
+	// slack takes over when the primary session logs out
+	u.removeSession(mm)
+	assert.Equal(t, slack.br, u.br)
+	assert.Equal(t, "slackuser", u.User)
+	assert.True(t, u.Me)
+
+	u.removeSession(slack)
+	assert.Nil(t, u.br)
+	assert.False(t, u.Me)
+}
@@ -0,0 +1,266 @@
+package irckit
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/42wim/matterircd/bridge"
+)
+
+// rplWhoisSpecial is used for the custom status in WHOIS.
+const rplWhoisSpecial = "320"
+
+var statusEmojiRegexp = regexp.MustCompile(`^:([\w+-]+):$`)
+
+// parseStatusDuration parses when a status ends, a duration like 30m, 2h or 3d, or "today".
+func parseStatusDuration(word string, now time.Time) (time.Time, bool) {
+	if strings.EqualFold(word, "today") {
+		year, month, day := now.Date()
+		return time.Date(year, month, day, 23, 59, 59, 0, now.Location()), true
+	}
+
+	if strings.HasSuffix(word, "d") {
+		if days, err := strconv.Atoi(strings.TrimSuffix(word, "d")); err == nil && days > 0 {
+			return now.AddDate(0, 0, days), true
+		}
+	}
+
+	if d, err := time.ParseDuration(word); err == nil && d > 0 {
+		return now.Add(d), true
+	}
+
+	return time.Time{}, false
+}
+
+// parseCustomStatus parses "[duration] [:emoji:] [text]", the custom status is nil without
+// emoji and text. until is when the status ends, zero when it doesn't.
+func parseCustomStatus(words []string, now time.Time) (time.Time, *bridge.CustomStatus) {
+	var until time.Time
+
+	if len(words) > 0 {
+		var ok bool
+		if until, ok = parseStatusDuration(words[0], now); ok {
+			words = words[1:]
+		}
+	}
+
+	return until, newCustomStatus(words, until)
+}
+
+// newCustomStatus makes a custom status of "[:emoji:] [text]", nil without emoji and text.
+func newCustomStatus(words []string, until time.Time) *bridge.CustomStatus {
+	custom := &bridge.CustomStatus{ExpiresAt: until}
+
+	if len(words) > 0 {
+		if m := statusEmojiRegexp.FindStringSubmatch(words[0]); m != nil {
+			custom.Emoji = m[1]
+			words = words[1:]
+		}
+	}
+
+	custom.Text = strings.Join(words, " ")
+
+	if custom.Emoji == "" && custom.Text == "" {
+		return nil
+	}
+
+	return custom
+}
+
+// parseAway parses the text of AWAY, "[+dnd] [+duration] [:emoji:] [text]". The options need a +
+// so an away text starting with eg "today" is just text.
+func parseAway(text string, now time.Time) (dnd bool, until time.Time, custom *bridge.CustomStatus) {
+	words := strings.Fields(text)
+
+	for len(words) > 0 && strings.HasPrefix(words[0], "+") {
+		option := words[0][1:]
+
+		if strings.EqualFold(option, "dnd") {
+			dnd = true
+		} else if t, ok := parseStatusDuration(option, now); ok {
+			until = t
+		} else {
+			break
+		}
+
+		words = words[1:]
+	}
+
+	return dnd, until, newCustomStatus(words, until)
+}
+
+// setAway sets a session away. With AwayCustomStatus the text of AWAY can set do not disturb and
+// becomes the custom status until we're back, see parseAway.
+func (u *User) setAway(sess *session, text string) {
+	if !sess.v.GetBool(sess.protocol + ".AwayCustomStatus") {
+		sess.br.SetStatus("away")
+		return
+	}
+
+	dnd, until, custom := parseAway(text, time.Now())
+
+	if !dnd {
+		sess.br.SetStatus("away")
+	} else if err := sess.br.SetDND(until); err != nil {
+		logger.Debugf("setting dnd on %s failed: %s", sess.name, err)
+		sess.br.SetStatus("away")
+	}
+
+	if custom == nil {
+		return
+	}
+
+	if err := sess.br.SetCustomStatus(custom); err != nil {
+		logger.Debugf("setting custom status on %s failed: %s", sess.name, err)
+		return
+	}
+
+	u.setAwayCustomStatus(sess, true)
+}
+
+// setBack sets a session online again and clears the custom status AWAY set.
+func (u *User) setBack(sess *session) {
+	sess.br.SetStatus("online")
+
+	if !u.setAwayCustomStatus(sess, false) {
+		return
+	}
+
+	if err := sess.br.SetCustomStatus(nil); err != nil {
+		logger.Debugf("clearing custom status on %s failed: %s", sess.name, err)
+		u.setAwayCustomStatus(sess, true)
+	}
+}
+
+// setAwayCustomStatus records whether the custom status of a session was set by AWAY, it returns
+// the previous value.
+func (u *User) setAwayCustomStatus(sess *session, set bool) bool {
+	u.awayMu.Lock()
+	defer u.awayMu.Unlock()
+
+	was := sess.awayCustomStatus
+	sess.awayCustomStatus = set
+
+	return was
+}
+
+// customStatus returns the custom status of a user, nil when it expired.
+func customStatus(info *bridge.UserInfo) *bridge.CustomStatus {
+	custom := info.CustomStatus
+	if custom != nil && !custom.ExpiresAt.IsZero() && custom.ExpiresAt.Before(time.Now()) {
+		return nil
+	}
+
+	return custom
+}
+
+// awayReason returns the away reason of a user with its status and custom status, eg "dnd: :calendar: meeting".
+func awayReason(status string, custom *bridge.CustomStatus) string {
+	if custom == nil {
+		return status
+	}
+
+	return status + ": " + custom.String()
+}
+
+// statusCmd shows our status or sets it, eg status dnd 2h
+func statusCmd(u *User, toUser *User, args []string, service string) {
+	sess := u.session(service)
+	me := sess.br.GetMe()
+
+	if len(args) == 0 {
+		status, err := sess.br.StatusUser(me.User)
+		if err != nil {
+			u.MsgUser(toUser, err.Error())
+			return
+		}
+
+		u.MsgUser(toUser, "status: "+status)
+
+		if custom := customStatus(sess.br.GetUser(me.User)); custom != nil {
+			u.MsgUser(toUser, "custom status: "+custom.String())
+		}
+
+		return
+	}
+
+	status := strings.ToLower(args[0])
+
+	var err error
+
+	switch status {
+	case "dnd":
+		var until time.Time
+
+		if len(args) > 1 {
+			var ok bool
+
+			until, ok = parseStatusDuration(args[1], time.Now())
+			if !ok {
+				u.MsgUser(toUser, fmt.Sprintf("invalid duration %s, use eg 30m, 2h, 3d or today", args[1]))
+				return
+			}
+		}
+
+		err = sess.br.SetDND(until)
+	case "online", "away", "offline":
+		err = sess.br.SetStatus(status)
+	default:
+		u.MsgUser(toUser, "need STATUS [online|away|offline|dnd [duration]]")
+		u.MsgUser(toUser, "e.g. STATUS dnd 2h")
+		return
+	}
+
+	if err != nil {
+		u.MsgUser(toUser, fmt.Sprintf("setting status failed: %s", err))
+		return
+	}
+
+	u.MsgUser(toUser, "status set to "+strings.Join(args, " "))
+}
+
+// customStatusCmd shows, sets or clears our custom status, eg customstatus 1h :coffee: lunch
+func customStatusCmd(u *User, toUser *User, args []string, service string) {
+	sess := u.session(service)
+
+	if len(args) == 0 {
+		custom := customStatus(sess.br.GetUser(sess.br.GetMe().User))
+		if custom == nil {
+			u.MsgUser(toUser, "no custom status")
+			return
+		}
+
+		u.MsgUser(toUser, "custom status: "+custom.String())
+
+		return
+	}
+
+	var custom *bridge.CustomStatus
+
+	if len(args) != 1 || !strings.EqualFold(args[0], "clear") {
+		_, custom = parseCustomStatus(args, time.Now())
+		if custom == nil {
+			u.MsgUser(toUser, "need CUSTOMSTATUS [duration] [:emoji:] <text> or CUSTOMSTATUS clear")
+			u.MsgUser(toUser, "e.g. CUSTOMSTATUS 1h :coffee: lunch")
+			return
+		}
+	}
+
+	if err := sess.br.SetCustomStatus(custom); err != nil {
+		u.MsgUser(toUser, fmt.Sprintf("setting custom status failed: %s", err))
+		return
+	}
+
+	// it's ours now, coming back from AWAY doesn't clear it
+	u.setAwayCustomStatus(sess, false)
+
+	if custom == nil {
+		u.MsgUser(toUser, "custom status cleared")
+		return
+	}
+
+	u.MsgUser(toUser, "custom status set to "+custom.String())
+}
@@ -0,0 +1,60 @@
+package irckit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/42wim/matterircd/bridge"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCustomStatus(t *testing.T) {
+	now := time.Date(2021, 3, 4, 10, 0, 0, 0, time.UTC)
+
+	until, custom := parseCustomStatus([]string{"2h", ":calendar:", "in", "a", "meeting"}, now)
+	assert.Equal(t, now.Add(2*time.Hour), until)
+	assert.Equal(t, &bridge.CustomStatus{Emoji: "calendar", Text: "in a meeting", ExpiresAt: until}, custom)
+
+	until, custom = parseCustomStatus([]string{"today"}, now)
+	assert.Equal(t, time.Date(2021, 3, 4, 23, 59, 59, 0, time.UTC), until)
+	assert.Nil(t, custom)
+
+	until, custom = parseCustomStatus([]string{"3d", "on", "vacation"}, now)
+	assert.Equal(t, now.AddDate(0, 0, 3), until)
+	assert.Equal(t, "on vacation", custom.Text)
+
+	until, custom = parseCustomStatus([]string{"back", "in", "5", "minutes"}, now)
+	assert.True(t, until.IsZero())
+	assert.Equal(t, &bridge.CustomStatus{Text: "back in 5 minutes"}, custom)
+}
+
+func TestParseAway(t *testing.T) {
+	now := time.Date(2021, 3, 4, 10, 0, 0, 0, time.UTC)
+
+	dnd, until, custom := parseAway("+dnd +1h :calendar: meeting", now)
+	assert.True(t, dnd)
+	assert.Equal(t, now.Add(time.Hour), until)
+	assert.Equal(t, &bridge.CustomStatus{Emoji: "calendar", Text: "meeting", ExpiresAt: until}, custom)
+
+	// without + it's just text
+	dnd, until, custom = parseAway("dnd today, call me", now)
+	assert.False(t, dnd)
+	assert.True(t, until.IsZero())
+	assert.Equal(t, &bridge.CustomStatus{Text: "dnd today, call me"}, custom)
+
+	dnd, until, custom = parseAway("+today", now)
+	assert.False(t, dnd)
+	assert.Equal(t, time.Date(2021, 3, 4, 23, 59, 59, 0, time.UTC), until)
+	assert.Nil(t, custom)
+
+	_, _, custom = parseAway("+1 for that", now)
+	assert.Equal(t, &bridge.CustomStatus{Text: "+1 for that"}, custom)
+}
+
+func TestAwayReason(t *testing.T) {
+	assert.Equal(t, "away", awayReason("away", nil))
+	assert.Equal(t, "dnd: :calendar: meeting", awayReason("dnd", &bridge.CustomStatus{Emoji: "calendar", Text: "meeting"}))
+
+	expired := &bridge.UserInfo{CustomStatus: &bridge.CustomStatus{Text: "lunch", ExpiresAt: time.Now().Add(-time.Minute)}}
+	assert.Nil(t, customStatus(expired))
+}
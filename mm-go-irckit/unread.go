@@ -0,0 +1,104 @@
+package irckit
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/42wim/matterircd/bridge"
+)
+
+// Where UnreadSummary sends the summary of the unread messages on login.
+const (
+	unreadService  = "service"
+	unreadMessages = "messages"
+	unreadNone     = "none"
+)
+
+// unreadSummary returns the lines of a summary of the unread messages, the channels with mentions first.
+func (u *User) unreadSummary(sess *session, unread []*bridge.Unread) []string {
+	if len(unread) == 0 {
+		return []string{"no unread messages"}
+	}
+
+	sort.Slice(unread, func(i, j int) bool {
+		if unread[i].Mentions != unread[j].Mentions {
+			return unread[i].Mentions > unread[j].Mentions
+		}
+
+		return unread[i].Messages > unread[j].Messages
+	})
+
+	var messages, mentions int64
+
+	lines := []string{""}
+
+	for _, channel := range unread {
+		messages += channel.Messages
+		mentions += channel.Mentions
+
+		line := fmt.Sprintf("%s: %d unread", u.unreadName(sess, channel.ChannelID), channel.Messages)
+		if channel.Mentions > 0 {
+			line += fmt.Sprintf(", %d mentions", channel.Mentions)
+		}
+
+		lines = append(lines, line)
+	}
+
+	lines[0] = fmt.Sprintf("%d unread messages and %d mentions in %d channels:", messages, mentions, len(unread))
+
+	return lines
+}
+
+// unreadName returns the IRC channel name of a channel, or the nick for direct messages.
+func (u *User) unreadName(sess *session, channelID string) string {
+	name := sess.br.GetChannelName(channelID)
+
+	// mattermost and rocketchat direct messages are named after the user IDs
+	if strings.Contains(name, "__") {
+		for _, userID := range strings.Split(strings.TrimPrefix(name, "#"), "__") {
+			if userID != sess.br.GetMe().User {
+				return u.createUserFromInfo(sess, sess.br.GetUser(userID)).Nick
+			}
+		}
+	}
+
+	return sess.channelName(channelID)
+}
+
+// sendUnreadSummary sends the summary of the unread messages to where UnreadSummary says.
+func (u *User) sendUnreadSummary(sess *session, unread []*bridge.Unread) {
+	lines := u.unreadSummary(sess, unread)
+
+	switch strings.ToLower(sess.v.GetString(sess.protocol + ".UnreadSummary")) {
+	case unreadNone:
+	case unreadMessages:
+		ch := u.channel(sess, sess.messagesChannel())
+		for _, line := range lines {
+			ch.SpoofNotice(sess.name, line)
+		}
+	default:
+		svc, ok := u.Srv.HasUser(sess.name)
+		if !ok {
+			return
+		}
+
+		for _, line := range lines {
+			u.MsgUser(svc, line)
+		}
+	}
+}
+
+func unreadCmd(u *User, toUser *User, args []string, service string) {
+	sess := u.session(service)
+
+	unread, err := sess.br.GetUnread()
+	if err != nil {
+		u.MsgUser(toUser, err.Error())
+		return
+	}
+
+	for _, line := range u.unreadSummary(sess, unread) {
+		u.MsgUser(toUser, line)
+	}
+}
@@ -0,0 +1,35 @@
+package irckit
+
+import (
+	"testing"
+
+	"github.com/42wim/matterircd/bridge"
+	"github.com/stretchr/testify/assert"
+)
+
+// unreadBridge names channels after their ID.
+type unreadBridge struct {
+	bridge.Bridger
+}
+
+func (b *unreadBridge) GetChannelName(channelID string) string {
+	return "#" + channelID
+}
+
+func TestUnreadSummary(t *testing.T) {
+	u := &User{}
+	sess := &session{protocol: "mattermost", br: &unreadBridge{}}
+
+	assert.Equal(t, []string{"no unread messages"}, u.unreadSummary(sess, nil))
+
+	assert.Equal(t, []string{
+		"15 unread messages and 2 mentions in 3 channels:",
+		"#devops: 3 unread, 2 mentions",
+		"#town-square: 10 unread",
+		"#off-topic: 2 unread",
+	}, u.unreadSummary(sess, []*bridge.Unread{
+		{ChannelID: "off-topic", Messages: 2},
+		{ChannelID: "town-square", Messages: 10},
+		{ChannelID: "devops", Messages: 3, Mentions: 2},
+	}))
+}
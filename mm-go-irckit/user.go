@@ -20,8 +20,10 @@ func NewUser(c Conn) *User {
 		UserInfo: &bridge.UserInfo{
 			Host: "*",
 		},
-		channels: map[Channel]struct{}{},
-		DecodeCh: make(chan *irc.Message),
+		channels:  map[Channel]struct{}{},
+		DecodeCh:  make(chan *irc.Message),
+		reloads:   make(chan struct{}, 1),
+		ssoLogins: make(chan *ssoLogin, 1),
 	}
 }
 
@@ -44,8 +46,14 @@ type User struct {
 
 	BufferedMsg *irc.Message
 	DecodeCh    chan *irc.Message
+	// reloads has a pending reload of the config file, see requestReload
+	reloads chan struct{}
+	// ssoLogins has a finished SSO login to log in with, see loginSSO
+	ssoLogins chan *ssoLogin
 
 	channels map[Channel]struct{}
+	// caps are the IRCv3 capabilities the client enabled
+	caps map[string]bool
 
 	v *viper.Viper
 
@@ -130,7 +138,7 @@ func (u *User) Encode(msgs ...*irc.Message) (err error) {
 	}
 
 	for _, msg := range msgs {
-		if msg.Command == "PRIVMSG" && (msg.Prefix.Name == "slack" || msg.Prefix.Name == "mattermost") && msg.Prefix.Host == "service" && strings.Contains(msg.Trailing, "token") {
+		if msg.Command == "PRIVMSG" && u.isService(msg.Prefix.Name) && msg.Prefix.Host == "service" && strings.Contains(msg.Trailing, "token") {
 			logger.Debugf("-> %s %s %s", msg.Command, msg.Prefix.Name, "[token redacted]")
 
 			err := u.Conn.Encode(msg)
@@ -152,6 +160,17 @@ func (u *User) Encode(msgs ...*irc.Message) (err error) {
 	return nil
 }
 
+// pasteBufferTimeout returns how long PRIVMSGs are buffered to join pasted lines.
+func (u *User) pasteBufferTimeout() time.Duration {
+	bufferTimeout := u.v.GetInt("PasteBufferTimeout")
+	// we need at least 100
+	if bufferTimeout < 100 {
+		bufferTimeout = 100
+	}
+
+	return time.Duration(bufferTimeout) * time.Millisecond
+}
+
 // Decode will receive and return a decoded message, or an error.
 // nolint:funlen,gocognit,gocyclo
 func (u *User) Decode() {
@@ -162,13 +181,9 @@ func (u *User) Decode() {
 	}
 	buffer := make(chan *irc.Message)
 	stop := make(chan struct{})
-	bufferTimeout := u.v.GetInt("PasteBufferTimeout")
-	// we need at least 100
-	if bufferTimeout < 100 {
-		bufferTimeout = 100
-	}
-	logger.Debugf("using paste buffer timeout: %#v\n", bufferTimeout)
-	t := timer.NewTimer(time.Duration(bufferTimeout) * time.Millisecond)
+	bufferTimeout := u.pasteBufferTimeout()
+	logger.Debugf("using paste buffer timeout: %s\n", bufferTimeout)
+	t := timer.NewTimer(bufferTimeout)
 	t.Stop()
 	go func(buffer chan *irc.Message, stop chan struct{}) {
 		for {
@@ -177,8 +192,8 @@ func (u *User) Decode() {
 				// are we starting a new buffer ?
 				if u.BufferedMsg == nil {
 					u.BufferedMsg = msg
-					// start timer now
-					t.Reset(time.Duration(bufferTimeout) * time.Millisecond)
+					// start timer now, the timeout can change when the config is reloaded
+					t.Reset(u.pasteBufferTimeout())
 				} else {
 					// make sure we're sending to the same recipient in the buffer
 					if u.BufferedMsg.Params[0] == msg.Params[0] {
@@ -218,12 +233,18 @@ func (u *User) Decode() {
 		}
 
 		dmsg := fmt.Sprintf("<- %s", msg)
-		if msg.Command == "PRIVMSG" && msg.Params != nil && (msg.Params[0] == "slack" || msg.Params[0] == "mattermost") {
+		if msg.Command == "PRIVMSG" && msg.Params != nil && u.isService(msg.Params[0]) {
 			// Don't log sensitive information
 			trail := strings.Split(msg.Trailing, " ")
 			if (msg.Trailing != "" && trail[0] == "login") || (len(msg.Params) > 1 && msg.Params[1] == "login") {
 				dmsg = fmt.Sprintf("<- PRIVMSG %s :login [redacted]", msg.Params[0])
 			}
+			if msg.Trailing != "" && strings.EqualFold(trail[0], "account") {
+				dmsg = fmt.Sprintf("<- PRIVMSG %s :account [redacted]", msg.Params[0])
+			}
+		}
+		if msg.Command == irc.PASS || msg.Command == irc.AUTHENTICATE {
+			dmsg = fmt.Sprintf("<- %s [redacted]", msg.Command)
 		}
 		// PRIVMSG can be buffered
 		if msg.Command == "PRIVMSG" {
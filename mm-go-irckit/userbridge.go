@@ -4,10 +4,13 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/42wim/matterircd/bridge"
+	"github.com/42wim/matterircd/bridge/matrix"
 	"github.com/42wim/matterircd/bridge/mattermost"
+	"github.com/42wim/matterircd/bridge/rocketchat"
 	"github.com/42wim/matterircd/bridge/slack"
 	"github.com/davecgh/go-spew/spew"
 	"github.com/mattermost/mattermost-server/v5/model"
@@ -21,6 +24,33 @@ type UserBridge struct {
 	Credentials bridge.Credentials
 	br          bridge.Bridger // nolint:structcheck
 	inprogress  bool           //nolint:structcheck
+	accounts    []*account
+
+	// store has the stored credentials, unlocked by PASS, SASL or the account command
+	store     *credentialStore
+	storeUser string
+
+	sessionsMu      sync.RWMutex
+	sessions        []*session
+	channelSessions map[string]*session
+
+	// pendingChannels are channels waiting for the JOIN confirming they should be created
+	pendingChannels map[string]*pendingChannel
+
+	// pasteTimeout is the paste buffer timeout of the last (re)load of the config
+	pasteTimeout time.Duration
+
+	// mentioned has the channels of the messages in &mentions since we last said something there
+	mentionsMu sync.Mutex
+	mentioned  map[string]*session
+	// mentionsParted is true when we parted &mentions, it isn't joined on login then
+	mentionsParted bool
+
+	// awayMu guards the auto away state, away is true after an AWAY with text
+	awayMu       sync.Mutex
+	lastActivity time.Time
+	away         bool
+	detached     bool
 }
 
 func NewUserBridge(c net.Conn, srv Server, cfg *viper.Viper) *User {
@@ -32,78 +62,131 @@ func NewUserBridge(c net.Conn, srv Server, cfg *viper.Viper) *User {
 
 	u.Srv = srv
 	u.v = cfg
+	u.channelSessions = make(map[string]*session)
+	u.pendingChannels = make(map[string]*pendingChannel)
+	u.mentioned = make(map[string]*session)
+	u.accounts = loadAccounts(cfg)
+	u.pasteTimeout = u.pasteBufferTimeout()
 
 	// used for login
 	u.createService("mattermost", "loginservice")
 	u.createService("slack", "loginservice")
+	u.createService("rocketchat", "loginservice")
+	u.createService("matrix", "loginservice")
+
+	for _, acc := range u.accounts {
+		u.createService(acc.name, "loginservice")
+	}
+
 	return u
 }
 
-func (u *User) handleEventChan(events chan *bridge.Event) {
+func (u *User) handleEventChan(sess *session, events chan *bridge.Event) {
 	for event := range events {
 		logger.Tracef("eventchan %s", spew.Sdump(event))
 		switch e := event.Data.(type) {
 		case *bridge.ChannelMessageEvent:
-			u.handleChannelMessageEvent(e)
+			u.handleChannelMessageEvent(sess, e)
 		case *bridge.DirectMessageEvent:
-			u.handleDirectMessageEvent(e)
+			u.handleDirectMessageEvent(sess, e)
 		case *bridge.ChannelTopicEvent:
-			u.handleChannelTopicEvent(e)
+			u.handleChannelTopicEvent(sess, e)
 		case *bridge.FileEvent:
-			u.handleFileEvent(e)
+			u.handleFileEvent(sess, e)
 		case *bridge.ChannelAddEvent:
-			u.handleChannelAddEvent(e)
+			u.handleChannelAddEvent(sess, e)
 		case *bridge.ChannelRemoveEvent:
-			u.handleChannelRemoveEvent(e)
+			u.handleChannelRemoveEvent(sess, e)
 		case *bridge.ChannelCreateEvent:
-			u.handleChannelCreateEvent(e)
+			u.handleChannelCreateEvent(sess, e)
 		case *bridge.ChannelDeleteEvent:
-			u.handleChannelDeleteEvent(e)
+			u.handleChannelDeleteEvent(sess, e)
 		case *bridge.UserUpdateEvent:
-			u.handleUserUpdateEvent(e)
+			u.handleUserUpdateEvent(sess, e)
 		case *bridge.StatusChangeEvent:
-			u.handleStatusChangeEvent(e)
+			u.handleStatusChangeEvent(sess, e)
+		case *bridge.SessionExpiredEvent:
+			u.handleSessionExpiredEvent(sess, e)
+		case *bridge.ChannelUpdateEvent:
+			u.handleChannelUpdateEvent(sess, e)
+		case *bridge.ChannelMemberUpdateEvent:
+			u.handleChannelMemberUpdateEvent(sess, e)
+		case *bridge.ChannelPrefsEvent:
+			u.handleChannelPrefsEvent(sess, e)
+		case *bridge.ChannelViewedEvent:
+			u.handleChannelViewedEvent(sess, e)
+		case *configReloadEvent:
+			u.handleConfigReloadEvent(sess)
 		}
 	}
 }
 
-func (u *User) handleChannelTopicEvent(event *bridge.ChannelTopicEvent) {
-	tu, _ := u.Srv.HasUser(event.Sender)
-	ch := u.Srv.Channel(event.ChannelID)
+func (u *User) handleSessionExpiredEvent(sess *session, event *bridge.SessionExpiredEvent) {
+	svc, _ := u.Srv.HasUser(sess.name)
+
+	switch {
+	case event.Restored:
+		u.MsgUser(svc, "your session expired, logged in again")
+		return
+	case event.Err != nil:
+		u.MsgUser(svc, "your session expired and logging in again failed: "+event.Err.Error())
+		u.MsgUser(svc, "use LOGIN to login again")
+	default:
+		u.MsgUser(svc, "your session expired, use LOGIN to login again")
+	}
+
+	// the dead session can't be used anymore
+	if err := u.logoutFrom(sess); err != nil {
+		logger.Errorf("logout from %s failed: %s", sess.name, err)
+	}
+}
+
+func (u *User) handleChannelTopicEvent(sess *session, event *bridge.ChannelTopicEvent) {
+	tu, ok := u.Srv.HasUser(event.Sender)
+	if !ok {
+		tu, _ = u.Srv.HasUser(sess.name)
+	}
+
+	ch := u.channel(sess, event.ChannelID)
 	ch.Topic(tu, event.Text)
 }
 
-func (u *User) handleDirectMessageEvent(event *bridge.DirectMessageEvent) {
+func (u *User) handleDirectMessageEvent(sess *session, event *bridge.DirectMessageEvent) {
 	if event.Sender.Me {
 		u.MsgSpoofUser(u, u.Nick, event.Text)
 	} else {
-		u.MsgSpoofUser(u.createUserFromInfo(event.Sender), event.Receiver.Nick, event.Text)
+		u.MsgSpoofUser(u.createUserFromInfo(sess, event.Sender), u.createUserFromInfo(sess, event.Receiver).Nick, event.Text)
 	}
 }
 
-func (u *User) handleChannelAddEvent(event *bridge.ChannelAddEvent) {
-	ch := u.Srv.Channel(event.ChannelID)
+func (u *User) handleChannelAddEvent(sess *session, event *bridge.ChannelAddEvent) {
+	ch := u.channel(sess, event.ChannelID)
 
 	for _, added := range event.Added {
 		if added.Me {
-			u.syncChannel(event.ChannelID, u.br.GetChannelName(event.ChannelID))
+			u.syncChannel(sess, event.ChannelID, sess.channelName(event.ChannelID))
 			continue
 		}
 
-		ghost := u.createUserFromInfo(added)
+		ghost := u.createUserFromInfo(sess, added)
+
+		if sess.settings.Bool(event.ChannelID, "HideJoinLeave") {
+			ch.BatchJoin([]*User{ghost})
+			continue
+		}
 
 		ch.Join(ghost)
 
 		if event.Adder != nil && added.Nick != event.Adder.Nick && event.Adder.Nick != "system" {
-			ch.SpoofMessage("system", "added "+added.Nick+" to the channel by "+event.Adder.Nick)
+			ch.SpoofMessage("system", "added "+ghost.Nick+" to the channel by "+u.createUserFromInfo(sess, event.Adder).Nick)
 		}
 	}
 }
 
-func (u *User) handleChannelRemoveEvent(event *bridge.ChannelRemoveEvent) {
+func (u *User) handleChannelRemoveEvent(sess *session, event *bridge.ChannelRemoveEvent) {
 	spew.Dump(event)
 
-	ch := u.Srv.Channel(event.ChannelID)
+	ch := u.channel(sess, event.ChannelID)
 
 	for _, removed := range event.Removed {
 		if removed.Me {
@@ -111,127 +194,179 @@ func (u *User) handleChannelRemoveEvent(event *bridge.ChannelRemoveEvent) {
 			continue
 		}
 
-		ghost := u.createUserFromInfo(removed)
+		ghost := u.createUserFromInfo(sess, removed)
+
+		if sess.settings.Bool(event.ChannelID, "HideJoinLeave") {
+			ch.BatchPart([]*User{ghost})
+			continue
+		}
 
 		ch.Part(ghost, "")
 
 		if event.Remover != nil && removed.Nick != event.Remover.Nick && event.Remover.Nick != "system" {
-			ch.SpoofMessage("system", "removed "+removed.Nick+" from the channel by "+event.Remover.Nick)
+			ch.SpoofMessage("system", "removed "+ghost.Nick+" from the channel by "+u.createUserFromInfo(sess, event.Remover).Nick)
 		}
 	}
 }
 
-func (u *User) getMessageChannel(channelID, channelType string, sender *bridge.UserInfo) Channel {
-	ch := u.Srv.Channel(channelID)
+func (u *User) getMessageChannel(sess *session, channelID, channelType string, sender *bridge.UserInfo) Channel {
+	ch := u.channel(sess, channelID)
 	// in an group
 	if channelType == "G" {
-		myself := u.createUserFromInfo(u.br.GetMe())
+		myself := u.createUserFromInfo(sess, sess.br.GetMe())
 		if !ch.HasUser(myself) {
 			ch.Join(myself)
-			u.syncChannel(channelID, u.br.GetChannelName(channelID))
+			u.syncChannel(sess, channelID, sess.channelName(channelID))
 		}
 	}
-	ghost := u.createUserFromInfo(sender)
+	ghost := u.createUserFromInfo(sess, sender)
 	// join if not in channel
 
 	if !ch.HasUser(ghost) && !ghost.Me {
 		logger.Debugf("User %s is not in channel %s. Joining now", ghost.Nick, ch.String())
 		// ch = u.Srv.Channel("&messages")
-		ch.Join(ghost)
+		if sess.settings.Bool(channelID, "HideJoinLeave") {
+			ch.BatchJoin([]*User{ghost})
+		} else {
+			ch.Join(ghost)
+		}
 	}
 
-	je := u.v.GetStringSlice(u.br.Protocol() + ".joinexclude")
-	ji := u.v.GetStringSlice(u.br.Protocol() + ".joininclude")
+	je := sess.v.GetStringSlice(sess.protocol + ".joinexclude")
+	ji := sess.v.GetStringSlice(sess.protocol + ".joininclude")
+	name := sess.br.GetChannelName(channelID)
 	// excluded channel
-	if stringInSlice(ch.String(), je) {
-		logger.Debugf("channel %s is in JoinExclude, send to &messages", ch.String())
-		ch = u.Srv.Channel("&messages")
+	if stringInSlice(name, je) {
+		logger.Debugf("channel %s is in JoinExclude, send to %s", ch.String(), sess.messagesChannel())
+		ch = u.channel(sess, sess.messagesChannel())
 	}
 	// not in included channel
-	if !stringInSlice(ch.String(), ji) && len(ji) > 0 {
-		logger.Debugf("channel %s is not in JoinInclude, send to &messages", ch.String())
-		ch = u.Srv.Channel("&messages")
+	if !stringInSlice(name, ji) && len(ji) > 0 {
+		logger.Debugf("channel %s is not in JoinInclude, send to %s", ch.String(), sess.messagesChannel())
+		ch = u.channel(sess, sess.messagesChannel())
+	}
+	// muted channel, in the config or on the bridge
+	muted := sess.settings.Bool(channelID, "Mute")
+	if policy := u.mutedPolicy(sess, channelID); policy == mutedMessages || policy == mutedPart {
+		muted = true
+	}
+
+	if channelType != "D" && muted {
+		logger.Debugf("channel %s is muted, send to %s", ch.String(), sess.messagesChannel())
+		ch = u.channel(sess, sess.messagesChannel())
 	}
 
 	return ch
 }
 
-func (u *User) handleChannelMessageEvent(event *bridge.ChannelMessageEvent) {
+func (u *User) handleChannelMessageEvent(sess *session, event *bridge.ChannelMessageEvent) {
 	/*
 			      CHANNEL_OPEN                   = "O"
 		        CHANNEL_PRIVATE                = "P"
 		        CHANNEL_DIRECT                 = "D"
 				CHANNEL_GROUP                  = "G"
 	*/
-	nick := event.Sender.Nick
 	logger.Debug("in handleChannelMessageEvent")
-	ch := u.getMessageChannel(event.ChannelID, event.ChannelType, event.Sender)
-	if event.Sender.Me {
-		nick = u.Nick
-	}
+	ch := u.getMessageChannel(sess, event.ChannelID, event.ChannelType, event.Sender)
+	nick := u.createUserFromInfo(sess, event.Sender).Nick
 
-	if event.ChannelType != "D" && ch.ID() == "&messages" {
-		nick += "/" + u.Srv.Channel(event.ChannelID).String()
+	if event.ChannelType != "D" && ch.ID() == sess.messagesChannel() {
+		nick += "/" + u.channel(sess, event.ChannelID).String()
 	}
 
-	switch event.MessageType {
-	case "notice":
+	switch {
+	case event.MessageType == "notice", sess.settings.Bool(event.ChannelID, "Notice"),
+		u.mutedPolicy(sess, event.ChannelID) == mutedNotice:
 		ch.SpoofNotice(nick, event.Text)
 	default:
 		ch.SpoofMessage(nick, event.Text)
 	}
+
+	if event.Mention && event.ChannelType != "D" {
+		u.copyMention(sess, event)
+	}
 }
 
-func (u *User) handleFileEvent(event *bridge.FileEvent) {
-	ch := u.getMessageChannel(event.ChannelID, event.ChannelType, event.Sender)
+func (u *User) handleFileEvent(sess *session, event *bridge.FileEvent) {
+	ch := u.getMessageChannel(sess, event.ChannelID, event.ChannelType, event.Sender)
+	sender := u.createUserFromInfo(sess, event.Sender)
 
 	switch event.ChannelType {
 	case "D":
+		receiver := u.createUserFromInfo(sess, event.Receiver)
+
 		for _, fname := range event.Files {
-			if event.Sender.Me {
-				if event.Receiver.Me {
-					u.MsgSpoofUser(u, u.Nick, "download file -"+fname.Name)
-				} else {
-					u.MsgSpoofUser(u, event.Receiver.Nick, "download file -"+fname.Name)
-				}
-			} else {
-				u.MsgSpoofUser(u.createUserFromInfo(event.Sender), event.Receiver.Nick, "download file -"+fname.Name)
-			}
+			u.MsgSpoofUser(sender, receiver.Nick, sess.templates.Render(bridge.TemplateFile, event.ChannelID, &bridge.TemplateData{File: fname.Name}))
 		}
 	default:
 		for _, fname := range event.Files {
-			if event.Sender.Me {
-				ch.SpoofMessage(u.Nick, "download file -"+fname.Name)
-			} else {
-				ch.SpoofMessage(event.Sender.Nick, "download file -"+fname.Name)
-			}
+			ch.SpoofMessage(sender.Nick, sess.templates.Render(bridge.TemplateFile, event.ChannelID, &bridge.TemplateData{File: fname.Name}))
 		}
 	}
 }
 
-func (u *User) handleChannelCreateEvent(event *bridge.ChannelCreateEvent) {
-	u.br.UpdateChannels()
+func (u *User) handleChannelCreateEvent(sess *session, event *bridge.ChannelCreateEvent) {
+	sess.br.UpdateChannels()
 
-	logger.Debugf("ACTION_CHANNEL_CREATED adding myself to %s (%s)", u.br.GetChannelName(event.ChannelID), event.ChannelID)
+	logger.Debugf("ACTION_CHANNEL_CREATED adding myself to %s (%s)", sess.channelName(event.ChannelID), event.ChannelID)
 
-	u.syncChannel(event.ChannelID, u.br.GetChannelName(event.ChannelID))
+	u.syncChannel(sess, event.ChannelID, sess.channelName(event.ChannelID))
 }
 
-func (u *User) handleChannelDeleteEvent(event *bridge.ChannelDeleteEvent) {
-	ch := u.Srv.Channel(event.ChannelID)
+func (u *User) handleChannelDeleteEvent(sess *session, event *bridge.ChannelDeleteEvent) {
+	ch := u.channel(sess, event.ChannelID)
 
-	logger.Debugf("ACTION_CHANNEL_DELETED removing myself from %s (%s)", u.br.GetChannelName(event.ChannelID), event.ChannelID)
+	logger.Debugf("ACTION_CHANNEL_DELETED removing myself from %s (%s)", ch.String(), event.ChannelID)
 
 	ch.Part(u, "")
 }
 
-func (u *User) handleUserUpdateEvent(event *bridge.UserUpdateEvent) {
-	u.updateUserFromInfo(event.User)
+func (u *User) handleUserUpdateEvent(sess *session, event *bridge.UserUpdateEvent) {
+	u.updateUserFromInfo(sess, event.User)
 }
 
-func (u *User) handleStatusChangeEvent(event *bridge.StatusChangeEvent) {
-	fmt.Println(event.UserID, u.br.GetMe().User)
-	if event.UserID == u.br.GetMe().User {
+// handleChannelUpdateEvent moves us to the new IRC channel when a channel got renamed.
+func (u *User) handleChannelUpdateEvent(sess *session, event *bridge.ChannelUpdateEvent) {
+	sess.br.UpdateChannels()
+	sess.settings.Forget(event.ChannelID)
+
+	ch := u.channel(sess, event.ChannelID)
+	if !ch.HasUser(u) {
+		return
+	}
+
+	name := sess.channelName(event.ChannelID)
+	if strings.EqualFold(ch.String(), name) {
+		u.syncModes(sess, ch, event.ChannelID)
+		return
+	}
+
+	logger.Debugf("channel %s renamed to %s (%s)", ch.String(), name, event.ChannelID)
+
+	ch.Part(u, "renamed to "+name)
+	ch.Unlink()
+
+	u.syncChannel(sess, event.ChannelID, name)
+}
+
+func (u *User) handleChannelMemberUpdateEvent(sess *session, event *bridge.ChannelMemberUpdateEvent) {
+	ch := u.channel(sess, event.ChannelID)
+	if ch.HasUser(u) {
+		u.syncModes(sess, ch, event.ChannelID)
+	}
+}
+
+func (u *User) handleStatusChangeEvent(sess *session, event *bridge.StatusChangeEvent) {
+	if u.voiceClasses(sess)["online"] {
+		u.updateOnlineVoice(sess, event)
+	}
+
+	// we only show the away status of the bridge we're representing
+	if sess.br != u.br {
+		return
+	}
+
+	if event.UserID == sess.br.GetMe().User {
 		switch event.Status {
 		case "online":
 			logger.Debug("setting myself online")
@@ -243,11 +378,36 @@ func (u *User) handleStatusChangeEvent(event *bridge.StatusChangeEvent) {
 	}
 }
 
+// updateOnlineVoice gives users +v when they come online and removes it when they go away,
+// in the channels of the session where they aren't an admin.
+func (u *User) updateOnlineVoice(sess *session, event *bridge.StatusChangeEvent) {
+	other, ok := u.Srv.HasUserID(strings.ToLower(event.UserID))
+	if event.UserID == sess.br.GetMe().User {
+		other, ok = u, true
+	}
+
+	if !ok {
+		return
+	}
+
+	for _, ch := range other.Channels() {
+		if ch.Service() != sess.name || !ch.HasUser(u) || strings.Contains(ch.UserModes(other), "o") {
+			continue
+		}
+
+		ch.SetUserMode(u.Srv, other, "v", event.Status == "online")
+	}
+}
+
 func (u *User) CreateUserFromInfo(info *bridge.UserInfo) *User {
-	return u.createUserFromInfo(info)
+	return u.createUserFromInfo(nil, info)
 }
 
 func (u *User) CreateUsersFromInfo(info []*bridge.UserInfo) []*User {
+	return u.createUsersFromInfo(nil, info)
+}
+
+func (u *User) createUsersFromInfo(sess *session, info []*bridge.UserInfo) []*User {
 	var users []*User
 
 	for _, userinfo := range info {
@@ -257,14 +417,21 @@ func (u *User) CreateUsersFromInfo(info []*bridge.UserInfo) []*User {
 
 		userinfo := userinfo
 		ghost := NewUser(u.Conn)
-		ghost.UserInfo = userinfo
+		ghost.UserInfo = u.ghostInfo(sess, userinfo)
+
+		if sess != nil {
+			ghost.br = sess.br
+		}
+
 		users = append(users, ghost)
 	}
 
 	return users
 }
 
-func (u *User) updateUserFromInfo(info *bridge.UserInfo) *User {
+func (u *User) updateUserFromInfo(sess *session, info *bridge.UserInfo) *User {
+	info = u.ghostInfo(sess, info)
+
 	if ghost, ok := u.Srv.HasUserID(info.User); ok {
 		if ghost.Nick != info.Nick {
 			changeMsg := &irc.Message{
@@ -282,64 +449,93 @@ func (u *User) updateUserFromInfo(info *bridge.UserInfo) *User {
 
 	ghost := NewUser(u.Conn)
 	ghost.UserInfo = info
+	ghost.br = sess.br
 
 	u.Srv.Add(ghost)
 
 	return ghost
 }
 
-func (u *User) createUserFromInfo(info *bridge.UserInfo) *User {
+func (u *User) createUserFromInfo(sess *session, info *bridge.UserInfo) *User {
+	if sess != nil && info.Me {
+		return u
+	}
+
 	if ghost, ok := u.Srv.HasUserID(info.User); ok {
 		return ghost
 	}
 
 	ghost := NewUser(u.Conn)
-	ghost.UserInfo = info
+	ghost.UserInfo = u.ghostInfo(sess, info)
+
+	if sess != nil {
+		ghost.br = sess.br
+	}
 
 	u.Srv.Add(ghost)
 
 	return ghost
 }
 
-func (u *User) addUsersToChannel(users []*User, channel string, channelID string) {
+func (u *User) addUsersToChannel(sess *session, users []*User, channel string, channelID string) {
 	logger.Debugf("adding %d to %s", len(users), channel)
 
-	ch := u.Srv.Channel(channelID)
+	ch := u.channel(sess, channelID)
 
 	ch.BatchJoin(users)
 }
 
-func (u *User) addUsersToChannels() {
+func (u *User) addUsersToChannels(sess *session) {
 	// wait until the bridge is ready
-	for u.br == nil {
+	for u.session(sess.name) != sess {
 		time.Sleep(time.Millisecond * 500)
 	}
 
 	srv := u.Srv
-	throttle := time.NewTicker(time.Millisecond * 50)
 
 	logger.Debug("in addUsersToChannels()")
+
+	// before the replay marks the channels as viewed
+	unread, err := sess.br.GetUnread()
+	if err != nil {
+		logger.Debugf("getting unread messages of %s failed: %s", sess.name, err)
+	}
+
 	// add all users, also who are not on channels
 	ch := srv.Channel("&users")
 
 	// create and join the users
-	users := u.CreateUsersFromInfo(u.br.GetUsers())
+	users := u.createUsersFromInfo(sess, sess.br.GetUsers())
 	srv.BatchAdd(users)
-	u.addUsersToChannel(users, "&users", "&users")
+	u.addUsersToChannel(nil, users, "&users", "&users")
 
 	// join ourself
 	ch.Join(u)
 
+	// the channel with the messages which mention us
+	u.joinMentions(false)
+
+	u.joinChannels(sess, true)
+
+	if err == nil {
+		u.sendUnreadSummary(sess, unread)
+	}
+}
+
+// joinChannels joins the IRC channels of a session. With replay the messages we haven't seen yet
+// are sent to them, without it the channels are only joined again, eg under their new names.
+func (u *User) joinChannels(sess *session, replay bool) {
+	throttle := time.NewTicker(time.Millisecond * 50)
+
 	// channel that receives messages from channels not joined on irc
-	ch = srv.Channel("&messages")
-	ch.Join(u)
+	u.channel(sess, sess.messagesChannel()).Join(u)
 
 	channels := make(chan *bridge.ChannelInfo, 5)
 	for i := 0; i < 10; i++ {
-		go u.addUserToChannelWorker(channels, throttle)
+		go u.addUserToChannelWorker(sess, channels, throttle, replay)
 	}
 
-	for _, brchannel := range u.br.GetChannels() {
+	for _, brchannel := range sess.br.GetChannels() {
 		logger.Debugf("Adding channel %#v", brchannel)
 		channels <- brchannel
 	}
@@ -347,10 +543,10 @@ func (u *User) addUsersToChannels() {
 	close(channels)
 }
 
-func (u *User) createSpoof(mmchannel *bridge.ChannelInfo) func(string, string) {
+func (u *User) createSpoof(sess *session, mmchannel *bridge.ChannelInfo) func(string, string) {
 	if strings.Contains(mmchannel.Name, "__") {
 		userID := strings.Split(mmchannel.Name, "__")[0]
-		u.createUserFromInfo(u.br.GetUser(userID))
+		u.createUserFromInfo(sess, sess.br.GetUser(userID))
 		// wrap MsgSpoofser here
 		return func(spoofUsername string, msg string) {
 			u.MsgSpoofUser(u, spoofUsername, msg)
@@ -359,34 +555,37 @@ func (u *User) createSpoof(mmchannel *bridge.ChannelInfo) func(string, string) {
 
 	channelName := mmchannel.Name
 
-	if mmchannel.TeamID != u.br.GetMe().TeamID || u.v.GetBool(u.br.Protocol()+".prefixmainteam") {
-		channelName = u.br.GetTeamName(mmchannel.TeamID) + "/" + mmchannel.Name
+	if mmchannel.TeamID != sess.br.GetMe().TeamID || sess.v.GetBool(sess.protocol+".prefixmainteam") {
+		channelName = sess.br.GetTeamName(mmchannel.TeamID) + "/" + mmchannel.Name
 	}
 
-	u.syncChannel(mmchannel.ID, channelName)
-	ch := u.Srv.Channel(mmchannel.ID)
+	u.syncChannel(sess, mmchannel.ID, channelName)
+	ch := u.channel(sess, mmchannel.ID)
 
 	return ch.SpoofMessage
 }
 
-func (u *User) addUserToChannelWorker(channels <-chan *bridge.ChannelInfo, throttle *time.Ticker) {
+func (u *User) addUserToChannelWorker(sess *session, channels <-chan *bridge.ChannelInfo, throttle *time.Ticker, replay bool) {
 	for brchannel := range channels {
 		logger.Debug("addUserToChannelWorker", brchannel)
 
 		<-throttle.C
 		// exclude direct messages
-		spoof := u.createSpoof(brchannel)
+		spoof := u.createSpoof(sess, brchannel)
+		if !replay {
+			continue
+		}
 
-		since := u.br.GetLastViewedAt(brchannel.ID)
+		since := sess.br.GetLastViewedAt(brchannel.ID)
 		// ignore invalid/deleted/old channels
 		if since == 0 {
 			continue
 		}
 		// post everything to the channel you haven't seen yet
-		postlist := u.br.GetPostsSince(brchannel.ID, since)
+		postlist := sess.br.GetPostsSince(brchannel.ID, since)
 		if postlist == nil {
 			// if the channel is not from the primary team id, we can't get posts
-			if brchannel.TeamID == u.br.GetMe().TeamID {
+			if brchannel.TeamID == sess.br.GetMe().TeamID {
 				logger.Errorf("something wrong with getPostsSince for channel %s (%s)", brchannel.ID, brchannel.Name)
 			}
 			continue
@@ -409,21 +608,23 @@ func (u *User) addUserToChannelWorker(channels <-chan *bridge.ChannelInfo, throt
 			ts := time.Unix(0, p.CreateAt*int64(time.Millisecond))
 
 			for _, post := range strings.Split(p.Message, "\n") {
-				user := u.br.GetUser(p.UserId)
+				user := u.createUserFromInfo(sess, sess.br.GetUser(p.UserId))
 				date := ts.Format("2006-01-02")
 				if date != prevDate {
-					spoof("matterircd", fmt.Sprintf("Replaying since %s", date))
+					spoof("matterircd", sess.templates.Render(bridge.TemplateReplaySince, brchannel.ID, &bridge.TemplateData{Timestamp: date}))
 					prevDate = date
 				}
 
 				nick := user.Nick
 
-				spoof(nick, fmt.Sprintf("[%s] %s", ts.Format("15:04"), post))
+				spoof(nick, sess.templates.Render(bridge.TemplateReplay, brchannel.ID, &bridge.TemplateData{Timestamp: ts.Format("15:04"), Message: post}))
 			}
 		}
 
-		if !u.v.GetBool(u.br.Protocol() + ".disableautoview") {
-			u.br.UpdateLastViewed(brchannel.ID)
+		u.sendMarkRead(sess, brchannel.ID, since)
+
+		if !sess.settings.Bool(brchannel.ID, "DisableAutoView") {
+			sess.br.UpdateLastViewed(brchannel.ID)
 		}
 	}
 }
@@ -460,8 +661,8 @@ func (u *User) MsgSpoofUser(sender *User, rcvuser string, msg string) {
 	}
 }
 
-func (u *User) syncChannel(id string, name string) {
-	users, err := u.br.GetChannelUsers(id)
+func (u *User) syncChannel(sess *session, id string, name string) {
+	users, err := sess.br.GetChannelUsers(id)
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -470,35 +671,119 @@ func (u *User) syncChannel(id string, name string) {
 	srv := u.Srv
 
 	// create and join the users
-	batchUsers := u.CreateUsersFromInfo(users)
+	batchUsers := u.createUsersFromInfo(sess, users)
 	srv.BatchAdd(batchUsers)
-	u.addUsersToChannel(batchUsers, "&users", "&users")
-	u.addUsersToChannel(batchUsers, "#"+name, id)
+	u.addUsersToChannel(nil, batchUsers, "&users", "&users")
+	u.addUsersToChannel(sess, batchUsers, "#"+name, id)
 
 	// add myself
-	ch := srv.Channel(id)
-	if !ch.HasUser(u) && u.mayJoin(id) {
+	ch := u.channel(sess, id)
+	if !ch.HasUser(u) && u.mayJoin(sess, id) {
 		logger.Debugf("syncChannel adding myself to %s (id: %s)", name, id)
 		ch.Join(u)
-		svc, _ := srv.HasUser(u.br.Protocol())
-		ch.Topic(svc, u.br.Topic(ch.ID()))
+		svc, _ := srv.HasUser(sess.name)
+		ch.Topic(svc, sess.br.Topic(ch.ID()))
+	}
+
+	if ch.HasUser(u) {
+		u.syncModes(sess, ch, id)
+	}
+}
+
+// syncModes sets the modes of the channel and of its members from the channel on the bridge.
+func (u *User) syncModes(sess *session, ch Channel, channelID string) {
+	if info := sess.br.GetChannel(channelID); info != nil {
+		ch.SetModes(channelModes(info))
+	}
+
+	members, err := sess.br.GetChannelMembers(channelID)
+	if err != nil {
+		logger.Debugf("getting members of %s failed: %s", channelID, err)
+		return
+	}
+
+	voice := u.voiceClasses(sess)
+
+	var statuses map[string]string
+	if voice["online"] {
+		statuses, _ = sess.br.StatusUsers()
+	}
+
+	me := sess.br.GetMe().User
+	modes := make(map[string]string)
+
+	for _, member := range members {
+		id := strings.ToLower(member.UserID)
+		if member.UserID == me {
+			id = u.ID()
+		}
+
+		switch {
+		case member.Admin:
+			modes[id] = "o"
+		case voice["guests"] && member.Guest,
+			voice["bots"] && member.Bot,
+			voice["online"] && statuses[member.UserID] == "online":
+			modes[id] = "v"
+		}
+	}
+
+	ch.SetUserModes(u.Srv, modes)
+}
+
+// voiceClasses returns the classes of users which get +v in the channels of the session.
+func (u *User) voiceClasses(sess *session) map[string]bool {
+	classes := []string{"guests", "bots"}
+	if sess.v.IsSet(sess.protocol + ".Voice") {
+		classes = sess.v.GetStringSlice(sess.protocol + ".Voice")
+	}
+
+	voice := make(map[string]bool)
+	for _, class := range classes {
+		voice[strings.ToLower(class)] = true
+	}
+
+	return voice
+}
+
+// channelModes converts the properties of a bridge channel to IRC channel modes.
+func channelModes(info *bridge.ChannelInfo) string {
+	modes := "n"
+
+	if info.Private {
+		modes += "p"
+	}
+
+	if info.Direct {
+		modes += "s"
 	}
+
+	if info.ReadOnly {
+		modes += "m"
+	}
+
+	return modes
 }
 
-func (u *User) mayJoin(channelID string) bool {
-	ch := u.Srv.Channel(channelID)
+func (u *User) mayJoin(sess *session, channelID string) bool {
+	name := sess.br.GetChannelName(channelID)
 
-	ji := u.v.GetStringSlice(u.br.Protocol() + ".joininclude")
-	je := u.v.GetStringSlice(u.br.Protocol() + ".joinexclude")
+	ji := sess.v.GetStringSlice(sess.protocol + ".joininclude")
+	je := sess.v.GetStringSlice(sess.protocol + ".joinexclude")
 
 	// are we in the joininclude we always are allowed to join
-	if stringInSlice(ch.String(), ji) {
+	if stringInSlice(name, ji) {
 		return true
 	}
 
+	// channels muted on the bridge aren't joined when MutedChannels is "part"
+	if u.mutedPolicy(sess, channelID) == mutedPart {
+		return false
+	}
+
 	// if we are not in excluded and we don't have included specified we are always
 	// allowed to join
-	if !stringInSlice(ch.String(), je) && len(ji) == 0 {
+	if !stringInSlice(name, je) && len(ji) == 0 {
 		return true
 	}
 
@@ -511,14 +796,16 @@ func (u *User) mayJoin(channelID string) bool {
 	return false
 }
 
-func (u *User) isValidServer(server, protocol string) bool {
-	if len(u.v.GetStringSlice(protocol+".restrict")) == 0 {
+func (u *User) isValidServer(server, service string) bool {
+	protocol, v := u.serviceConfig(service)
+
+	if len(v.GetStringSlice(protocol+".restrict")) == 0 {
 		return true
 	}
 
-	logger.Debugf("restrict: %s", u.v.GetStringSlice(protocol+".restrict"))
+	logger.Debugf("restrict: %s", v.GetStringSlice(protocol+".restrict"))
 
-	for _, srv := range u.v.GetStringSlice(protocol + ".restrict") {
+	for _, srv := range v.GetStringSlice(protocol + ".restrict") {
 		if srv == server {
 			return true
 		}
@@ -527,40 +814,105 @@ func (u *User) isValidServer(server, protocol string) bool {
 	return false
 }
 
-func (u *User) loginTo(protocol string) error {
-	var err error
+func (u *User) loginTo(service string) error {
+	var (
+		br  bridge.Bridger
+		err error
+	)
 
+	protocol, v := u.serviceConfig(service)
 	eventChan := make(chan *bridge.Event)
 
+	// every session gets its own copy, with the profiles of the user applied
+	sess := u.newSession(service, protocol, bridge.CopyConfig(v))
+	sess.events = eventChan
+	u.refreshConfig(sess)
+
+	onConnect := func() { u.addUsersToChannels(sess) }
+
 	switch protocol {
 	case "slack":
-		u.br, err = slack.New(u.v, u.Credentials, eventChan, u.addUsersToChannels)
+		br, err = slack.New(sess.v, u.Credentials, eventChan, onConnect)
 	case "mattermost":
-		u.br, _, err = mattermost.New(u.v, u.Credentials, eventChan, u.addUsersToChannels)
+		br, _, err = mattermost.New(sess.v, u.Credentials, eventChan, onConnect)
+	case "rocketchat":
+		br, err = rocketchat.New(sess.v, u.Credentials, eventChan, onConnect)
+	case "matrix":
+		br, err = matrix.New(sess.v, u.Credentials, eventChan, onConnect)
+	default:
+		err = fmt.Errorf("unknown service %s", service)
 	}
 
 	if err != nil {
 		return err
 	}
 
-	status, _ := u.br.StatusUser(u.br.GetMe().User)
-	if status == "away" {
-		u.Srv.EncodeMessage(u, irc.RPL_NOWAWAY, []string{u.Nick}, "You have been marked as being away")
+	sess.br = br
+
+	// now the username of the account is known, its profile can be applied
+	u.refreshConfig(sess)
+
+	// only the first bridge is the one we're representing on IRC
+	if u.br == nil {
+		status, _ := br.StatusUser(br.GetMe().User)
+		if status == "away" {
+			u.Srv.EncodeMessage(u, irc.RPL_NOWAWAY, []string{u.Nick}, "You have been marked as being away")
+		}
+	}
+
+	for _, other := range u.addSession(sess) {
+		u.moveChannels(other)
 	}
 
-	info := u.br.GetMe()
-	u.Me = true
-	u.User = info.User
+	u.Srv.ISupport(u)
 
-	go u.handleEventChan(eventChan)
+	go u.handleEventChan(sess, eventChan)
 
 	return nil
 }
 
-// nolint:unparam,unused
-func (u *User) logoutFrom(protocol string) error {
-	logger.Debug("logging out from", protocol)
+// moveChannels moves the channels of a session which just got namespaced to their new names.
+func (u *User) moveChannels(sess *session) {
+	reason := fmt.Sprintf("channels of %s are now prefixed with %s:", sess.name, sess.prefix)
 
-	u.Srv.Logout(u)
-	return nil
+	for _, ch := range u.Channels() {
+		if ch.Service() != sess.name {
+			continue
+		}
+
+		ch.Part(u, reason)
+		ch.Unlink()
+	}
+
+	// the replay, unread summary and &users were done on login
+	go u.joinChannels(sess, false)
+}
+
+// logoutFrom logs out of the bridge and removes its channels and users.
+func (u *User) logoutFrom(sess *session) error {
+	logger.Debug("logging out from ", sess.name)
+
+	err := sess.br.Logout()
+
+	for _, ch := range u.Channels() {
+		if ch.Service() != sess.name {
+			continue
+		}
+
+		ch.Part(u, "")
+		ch.Unlink()
+	}
+
+	if users, ok := u.Srv.HasChannel("&users"); ok {
+		for _, other := range users.Users() {
+			if other.Ghost && other.br == sess.br {
+				users.Part(other, "")
+				u.Srv.Remove(other)
+			}
+		}
+	}
+
+	u.removeSession(sess)
+
+	return err
 }
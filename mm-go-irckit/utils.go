@@ -1,5 +1,15 @@
 package irckit
 
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// services are the nicks of the service bots, one for each bridge.
+var services = []string{"mattermost", "slack", "rocketchat", "matrix"}
+
 func stringInSlice(a string, list []string) bool {
 	for _, b := range list {
 		if b == a {
@@ -18,3 +28,43 @@ func removeStringInSlice(a string, list []string) []string {
 	}
 	return newlist
 }
+
+// isMattermostToken returns true when pass is a personal (token=) or session (MMAUTHTOKEN=) token.
+func isMattermostToken(pass string) bool {
+	return strings.HasPrefix(pass, "token=") || strings.HasPrefix(pass, "MMAUTHTOKEN=")
+}
+
+// splitMFAToken removes the mfa=<code> argument from the login arguments and returns the code.
+func splitMFAToken(args []string) ([]string, string) {
+	var (
+		rest []string
+		code string
+	)
+
+	for _, arg := range args {
+		if strings.HasPrefix(strings.ToLower(arg), "mfa=") {
+			code = arg[len("mfa="):]
+			continue
+		}
+
+		rest = append(rest, arg)
+	}
+
+	return rest, code
+}
+
+// writeFile replaces a file which only the user may read, creating its directory. It writes to a
+// temporary file first, so a failing write doesn't lose the old file.
+func writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
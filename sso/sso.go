@@ -0,0 +1,194 @@
+// Package sso implements a local web page which helps getting the session token of a
+// mattermost SSO login (GitLab, SAML, OIDC) back to the IRC session waiting for it.
+package sso
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var Logger *logrus.Entry
+
+// requestTimeout is how long a login URL stays valid.
+const requestTimeout = 10 * time.Minute
+
+// Helper is the http.Handler serving the login pages, each login gets a one-time URL.
+type Helper struct {
+	baseURL string
+	client  *http.Client
+
+	sync.Mutex
+	requests map[string]*request
+}
+
+type request struct {
+	server string
+	result chan string
+	timer  *time.Timer
+}
+
+// New creates a helper, baseURL is the address the browser of the user can reach it on.
+func New(baseURL string) *Helper {
+	return &Helper{
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		requests: make(map[string]*request),
+	}
+}
+
+// Start registers a login to server (eg https://chat.example.com) and returns the URL the user
+// has to open. The session token gets sent on the channel, which is closed when the login expires.
+func (h *Helper) Start(server string) (string, <-chan string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+
+	id := hex.EncodeToString(b)
+	req := &request{
+		server: strings.TrimSuffix(server, "/"),
+		result: make(chan string, 1),
+	}
+
+	h.Lock()
+	h.requests[id] = req
+	h.Unlock()
+
+	req.timer = time.AfterFunc(requestTimeout, func() {
+		if h.finish(id) != nil {
+			close(req.result)
+		}
+	})
+
+	return h.baseURL + "/sso/" + id, req.result, nil
+}
+
+// finish removes the request so its URL can't be used again.
+func (h *Helper) finish(id string) *request {
+	h.Lock()
+	defer h.Unlock()
+
+	req, ok := h.requests[id]
+	if !ok {
+		return nil
+	}
+
+	delete(h.requests, id)
+
+	return req
+}
+
+func (h *Helper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/sso/")
+
+	h.Lock()
+	req, ok := h.requests[id]
+	h.Unlock()
+
+	if !ok || !strings.HasPrefix(r.URL.Path, "/sso/") {
+		http.Error(w, "this login link is invalid or expired, use login sso again", http.StatusNotFound)
+		return
+	}
+
+	data := struct {
+		Server string
+		Error  string
+	}{Server: req.server}
+
+	// the token can be posted by the form or given in the URL by a script
+	token := r.FormValue("token")
+	if token == "" {
+		h.render(w, pageTemplate, data)
+		return
+	}
+
+	token = strings.TrimPrefix(strings.TrimSpace(token), "MMAUTHTOKEN=")
+
+	if err := h.verify(req.server, token); err != nil {
+		Logger.Infof("sso login to %s failed: %s", req.server, err)
+		data.Error = err.Error()
+		h.render(w, pageTemplate, data)
+
+		return
+	}
+
+	if h.finish(id) == nil {
+		http.Error(w, "this login link is invalid or expired, use login sso again", http.StatusNotFound)
+		return
+	}
+
+	req.timer.Stop()
+	req.result <- token
+	close(req.result)
+
+	h.render(w, doneTemplate, data)
+}
+
+// verify checks the token is a valid session on the server.
+func (h *Helper) verify(server, token string) error {
+	req, err := http.NewRequest(http.MethodGet, server+"/api/v4/users/me", nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("the token was not accepted by " + server + ", make sure you copied the MMAUTHTOKEN cookie")
+	}
+
+	return nil
+}
+
+func (h *Helper) render(w http.ResponseWriter, t *template.Template, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	if err := t.Execute(w, data); err != nil {
+		Logger.Error(err)
+	}
+}
+
+var pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head><title>matterircd SSO login</title></head>
+<body>
+<h1>matterircd SSO login</h1>
+{{if .Error}}<p style="color: red">{{.Error}}</p>{{end}}
+<ol>
+<li>Open <a href="{{.Server}}" target="_blank">{{.Server}}</a> and login with SSO as usual.</li>
+<li>Open the developer tools of your browser (F12), go to Storage (Firefox) or Application (Chrome) and then Cookies.</li>
+<li>Copy the value of the <code>MMAUTHTOKEN</code> cookie of {{.Server}} and paste it below.</li>
+</ol>
+<form method="post">
+<input type="password" name="token" size="40" placeholder="MMAUTHTOKEN" autofocus>
+<input type="submit" value="Login">
+</form>
+<p>Don't logout of {{.Server}} in your browser afterwards, that ends the session matterircd is using.</p>
+</body>
+</html>
+`))
+
+var doneTemplate = template.Must(template.New("done").Parse(`<!DOCTYPE html>
+<html>
+<head><title>matterircd SSO login</title></head>
+<body>
+<h1>matterircd SSO login</h1>
+<p>The token was handed to matterircd, you can close this page and go back to IRC.</p>
+</body>
+</html>
+`))
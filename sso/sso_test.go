@@ -0,0 +1,67 @@
+package sso
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHelper(t *testing.T) {
+	Logger = logrus.NewEntry(logrus.New())
+
+	// fake mattermost server which only knows the session "good"
+	mm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v4/users/me" || r.Header.Get("Authorization") != "Bearer good" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.Write([]byte(`{"id":"user1","username":"alice"}`))
+	}))
+	defer mm.Close()
+
+	h := New("")
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	h.baseURL = ts.URL
+
+	loginURL, result, err := h.Start(mm.URL)
+	assert.NoError(t, err)
+
+	resp, err := http.Get(loginURL)
+	assert.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), mm.URL)
+
+	resp, err = http.PostForm(loginURL, url.Values{"token": {"bad"}})
+	assert.NoError(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Contains(t, string(body), "was not accepted")
+	assert.Len(t, result, 0)
+
+	resp, err = http.PostForm(loginURL, url.Values{"token": {"MMAUTHTOKEN=good"}})
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "good", <-result)
+
+	// the URL can only be used once
+	resp, err = http.PostForm(loginURL, url.Values{"token": {"good"}})
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, err = http.Get(ts.URL + "/sso/unknown")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}